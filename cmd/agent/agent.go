@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/luksbutz/vigilate/internal/agentapi"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// minInterval is the shortest time between two runs of a check
+	minInterval = 10 * time.Second
+	// flushInterval is how often collected results are sent to the server
+	flushInterval = 5 * time.Second
+	// maxPending caps the results kept while the server can't be reached; the oldest are dropped
+	maxPending = 1000
+)
+
+// agent runs its host's checks on their schedules, and sends the results to the server
+type agent struct {
+	client    *client
+	pluginDir string
+	poll      time.Duration
+
+	mu      sync.Mutex
+	checks  map[int]*scheduledCheck
+	pending []agentapi.Result
+
+	results chan agentapi.Result
+}
+
+// scheduledCheck is a check and when it next runs
+type scheduledCheck struct {
+	check   agentapi.Check
+	next    time.Time
+	running bool
+}
+
+func newAgent(c *client, pluginDir string, poll time.Duration) *agent {
+	return &agent{
+		client:    c,
+		pluginDir: pluginDir,
+		poll:      poll,
+		checks:    make(map[int]*scheduledCheck),
+		results:   make(chan agentapi.Result, 100),
+	}
+}
+
+// run runs checks until ctx is done. The list of checks is fetched again every poll, which also
+// lets the server know the agent is up.
+func (a *agent) run(ctx context.Context) {
+	a.refresh(ctx)
+
+	poll := time.NewTicker(a.poll)
+	defer poll.Stop()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// send what we have before stopping
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			a.flush(flushCtx)
+			cancel()
+			return
+		case <-poll.C:
+			a.refresh(ctx)
+			poll.Reset(a.poll)
+		case <-tick.C:
+			a.runDue(ctx)
+		case <-flush.C:
+			a.flush(ctx)
+		case r := <-a.results:
+			a.mu.Lock()
+			a.pending = append(a.pending, r)
+			if len(a.pending) > maxPending {
+				a.pending = a.pending[len(a.pending)-maxPending:]
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+// refresh fetches the checks to run. Checks that are still assigned keep their schedule.
+func (a *agent) refresh(ctx context.Context) {
+	resp, err := a.client.checks(ctx)
+	if errors.Is(err, errUnauthorized) {
+		log.Println("The agent token was revoked; no checks will run until the agent is given a new one")
+		a.mu.Lock()
+		a.checks = make(map[int]*scheduledCheck)
+		a.mu.Unlock()
+		return
+	} else if err != nil {
+		log.Println("Could not fetch checks:", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	checks := make(map[int]*scheduledCheck, len(resp.Checks))
+	for _, c := range resp.Checks {
+		sc, ok := a.checks[c.HostServiceID]
+		if !ok {
+			sc = &scheduledCheck{next: now}
+			log.Printf("Running %s every %ds", c.Name, c.IntervalSeconds)
+		}
+		sc.check = c
+		checks[c.HostServiceID] = sc
+	}
+
+	a.checks = checks
+
+	if resp.PollSeconds > 0 {
+		a.poll = time.Duration(resp.PollSeconds) * time.Second
+	}
+}
+
+// runDue starts the checks that are due, unless they are still running from last time
+func (a *agent) runDue(ctx context.Context) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for _, sc := range a.checks {
+		if sc.running || now.Before(sc.next) {
+			continue
+		}
+
+		interval := time.Duration(sc.check.IntervalSeconds) * time.Second
+		if interval < minInterval {
+			interval = minInterval
+		}
+		sc.next = now.Add(interval)
+		sc.running = true
+
+		go func(sc *scheduledCheck, c agentapi.Check) {
+			r := runCheck(c, a.pluginDir)
+
+			a.mu.Lock()
+			sc.running = false
+			a.mu.Unlock()
+
+			select {
+			case a.results <- r:
+			case <-ctx.Done():
+			}
+		}(sc, sc.check)
+	}
+}
+
+// flush sends the collected results to the server. If they can't be sent, they are kept for the
+// next try.
+func (a *agent) flush(ctx context.Context) {
+	a.mu.Lock()
+	results := a.pending
+	a.pending = nil
+	a.mu.Unlock()
+
+	if len(results) == 0 {
+		return
+	}
+
+	resp, err := a.client.sendResults(ctx, results)
+	if err != nil {
+		log.Printf("Could not send %d results: %s", len(results), err)
+
+		a.mu.Lock()
+		a.pending = append(results, a.pending...)
+		if len(a.pending) > maxPending {
+			a.pending = a.pending[len(a.pending)-maxPending:]
+		}
+		a.mu.Unlock()
+		return
+	}
+
+	for _, x := range resp.Rejected {
+		log.Printf("Result for host service %d rejected: %s", x.HostServiceID, x.Reason)
+	}
+}
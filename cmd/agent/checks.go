@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/luksbutz/vigilate/internal/agentapi"
+	"github.com/luksbutz/vigilate/internal/plugins"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errUnsupported is returned by checks that can't be run on this platform
+var errUnsupported = errors.New("not supported on " + runtime.GOOS)
+
+// runCheck runs a check and returns its result
+func runCheck(c agentapi.Check, pluginDir string) agentapi.Result {
+	var msg, status string
+	var perf []agentapi.PerfDatum
+
+	switch c.Kind {
+	case agentapi.KindDisk:
+		msg, status, perf = checkDisk(c)
+	case agentapi.KindMemory:
+		msg, status, perf = checkMemory(c)
+	case agentapi.KindLoad:
+		msg, status, perf = checkLoad(c)
+	case agentapi.KindProcess:
+		msg, status, perf = checkProcess(c)
+	case agentapi.KindFileAge:
+		msg, status, perf = checkFileAge(c)
+	case agentapi.KindPlugin:
+		msg, status, perf = checkPlugin(c, pluginDir)
+	default:
+		msg, status = fmt.Sprintf("This agent can't run %s checks", c.Kind), "unknown"
+	}
+
+	return agentapi.Result{
+		HostServiceID: c.HostServiceID,
+		Status:        status,
+		Message:       msg,
+		PerfData:      perf,
+		CheckedAt:     time.Now(),
+	}
+}
+
+// unknown is the result of a check that couldn't find out anything
+func unknown(err error) (string, string, []agentapi.PerfDatum) {
+	return err.Error(), "unknown", nil
+}
+
+// checkDisk checks how full the filesystem holding the path is
+func checkDisk(c agentapi.Check) (string, string, []agentapi.PerfDatum) {
+	path := firstArg(c, "/")
+
+	used, total, err := diskUsage(path)
+	if err != nil {
+		return unknown(err)
+	}
+	if total == 0 {
+		return unknown(fmt.Errorf("%s has no space", path))
+	}
+
+	pct := 100 * float64(used) / float64(total)
+	msg := fmt.Sprintf("%s is %.1f%% full (%s of %s)", path, pct, formatBytes(used), formatBytes(total))
+	perf := []agentapi.PerfDatum{
+		{Label: "used_percent", Unit: "%", Value: round(pct)},
+		{Label: "used", Unit: "B", Value: float64(used)},
+		{Label: "total", Unit: "B", Value: float64(total)},
+	}
+
+	return msg, thresholdStatus(pct, c, 80, 90), perf
+}
+
+// checkMemory checks how much memory is in use
+func checkMemory(c agentapi.Check) (string, string, []agentapi.PerfDatum) {
+	used, total, err := memoryUsage()
+	if err != nil {
+		return unknown(err)
+	}
+	if total == 0 {
+		return unknown(errors.New("no memory found"))
+	}
+
+	pct := 100 * float64(used) / float64(total)
+	msg := fmt.Sprintf("Memory is %.1f%% used (%s of %s)", pct, formatBytes(used), formatBytes(total))
+	perf := []agentapi.PerfDatum{
+		{Label: "used_percent", Unit: "%", Value: round(pct)},
+		{Label: "used", Unit: "B", Value: float64(used)},
+		{Label: "total", Unit: "B", Value: float64(total)},
+	}
+
+	return msg, thresholdStatus(pct, c, 80, 90), perf
+}
+
+// checkLoad checks the one minute load average. Without thresholds, it is a warning above one
+// per cpu, and a problem above two.
+func checkLoad(c agentapi.Check) (string, string, []agentapi.PerfDatum) {
+	load, err := loadAverage()
+	if err != nil {
+		return unknown(err)
+	}
+
+	cpus := float64(runtime.NumCPU())
+	msg := fmt.Sprintf("Load average %.2f, %.2f, %.2f on %d cpus", load[0], load[1], load[2], runtime.NumCPU())
+	perf := []agentapi.PerfDatum{
+		{Label: "load1", Value: load[0]},
+		{Label: "load5", Value: load[1]},
+		{Label: "load15", Value: load[2]},
+	}
+
+	return msg, thresholdStatus(load[0], c, cpus, 2*cpus), perf
+}
+
+// checkProcess checks that at least one process with the given name is running
+func checkProcess(c agentapi.Check) (string, string, []agentapi.PerfDatum) {
+	name := firstArg(c, "")
+	if name == "" {
+		return unknown(errors.New("no process name"))
+	}
+
+	n, err := countProcesses(name)
+	if err != nil {
+		return unknown(err)
+	}
+
+	perf := []agentapi.PerfDatum{{Label: "processes", Value: float64(n)}}
+	if n == 0 {
+		return fmt.Sprintf("%s is not running", name), "problem", perf
+	}
+
+	return fmt.Sprintf("%d %s process(es) running", n, name), "healthy", perf
+}
+
+// checkFileAge checks how long ago a file was changed. Without thresholds, it is a problem if
+// the file is more than a day old.
+func checkFileAge(c agentapi.Check) (string, string, []agentapi.PerfDatum) {
+	path := firstArg(c, "")
+	if path == "" {
+		return unknown(errors.New("no file path"))
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Sprintf("%s does not exist", path), "problem", nil
+	} else if err != nil {
+		return unknown(err)
+	}
+
+	age := time.Since(info.ModTime())
+	if age < 0 {
+		age = 0
+	}
+
+	msg := fmt.Sprintf("%s was changed %s ago", path, age.Round(time.Second))
+	perf := []agentapi.PerfDatum{{Label: "age", Unit: "s", Value: round(age.Seconds())}}
+
+	warning, hasWarning := parseAge(c.Warning)
+	critical, hasCritical := parseAge(c.Critical)
+	if !hasWarning && !hasCritical {
+		critical, hasCritical = 24*time.Hour, true
+	}
+
+	switch {
+	case hasCritical && age > critical:
+		return msg, "problem", perf
+	case hasWarning && age > warning:
+		return msg, "warning", perf
+	}
+	return msg, "healthy", perf
+}
+
+// checkPlugin runs a plugin from the plugin directory
+func checkPlugin(c agentapi.Check, pluginDir string) (string, string, []agentapi.PerfDatum) {
+	if len(c.Args) == 0 {
+		return unknown(errors.New("no plugin"))
+	}
+
+	path, err := plugins.Resolve(pluginDir, c.Args[0])
+	if err != nil {
+		return unknown(err)
+	}
+
+	timeout := time.Duration(c.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	msg, status, data := plugins.Check(path, c.Args[1:], timeout)
+
+	perf := make([]agentapi.PerfDatum, 0, len(data))
+	for _, d := range data {
+		perf = append(perf, agentapi.PerfDatum{Label: d.Label, Unit: d.Unit, Value: d.Value})
+	}
+
+	return msg, status, perf
+}
+
+// thresholdStatus compares value with the check's warning and critical thresholds, or with the
+// given defaults where the check has none
+func thresholdStatus(value float64, c agentapi.Check, defWarning, defCritical float64) string {
+	warning, err := strconv.ParseFloat(strings.TrimSpace(c.Warning), 64)
+	if err != nil {
+		warning = defWarning
+	}
+	critical, err := strconv.ParseFloat(strings.TrimSpace(c.Critical), 64)
+	if err != nil {
+		critical = defCritical
+	}
+
+	switch {
+	case value >= critical:
+		return "problem"
+	case value >= warning:
+		return "warning"
+	}
+	return "healthy"
+}
+
+// parseAge reads a threshold given in seconds, or as a duration like 90m
+func parseAge(s string) (time.Duration, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, false
+	}
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(n * float64(time.Second)), true
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, true
+	}
+	return 0, false
+}
+
+// firstArg returns the first argument of a check, or def if it has none
+func firstArg(c agentapi.Check, def string) string {
+	if len(c.Args) == 0 || strings.TrimSpace(c.Args[0]) == "" {
+		return def
+	}
+	return c.Args[0]
+}
+
+// formatBytes formats a number of bytes for people, e.g. 1.5 GB
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// round rounds to two decimals
+func round(f float64) float64 {
+	return float64(int64(f*100+0.5)) / 100
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/luksbutz/vigilate/internal/agentapi"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+)
+
+// errUnauthorized is returned when the server doesn't accept the agent token
+var errUnauthorized = errors.New("the server did not accept the agent token")
+
+// client talks to the vigilate server
+type client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// apiError is the body of an error response from the server
+type apiError struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// do sends in (if not nil) as JSON to the server, and reads the data of the response into out
+func (c *client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "vigilate-agent/"+agentVersion)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errUnauthorized
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e apiError
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error.Message != "" {
+			return fmt.Errorf("%s %s: %s", method, path, e.Error.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+
+	envelope := struct {
+		Data interface{} `json:"data"`
+	}{Data: out}
+
+	return json.NewDecoder(resp.Body).Decode(&envelope)
+}
+
+// register tells the server the agent has started, retrying until it gets through. It gives up
+// straight away if the token is refused.
+func register(ctx context.Context, c *client) (agentapi.RegisterResponse, error) {
+	hostname, _ := os.Hostname()
+
+	in := agentapi.RegisterRequest{
+		Hostname: hostname,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Version:  agentVersion,
+	}
+
+	wait := 5 * time.Second
+	for {
+		var out agentapi.RegisterResponse
+		err := c.do(ctx, http.MethodPost, agentapi.RegisterPath, in, &out)
+		if err == nil {
+			if out.PollSeconds <= 0 {
+				out.PollSeconds = 60
+			}
+			return out, nil
+		}
+		if errors.Is(err, errUnauthorized) {
+			return out, err
+		}
+
+		log.Printf("Could not register, trying again in %s: %s", wait, err)
+
+		select {
+		case <-ctx.Done():
+			return out, ctx.Err()
+		case <-time.After(wait):
+		}
+
+		if wait < 5*time.Minute {
+			wait *= 2
+		}
+	}
+}
+
+// checks fetches the checks the agent should run
+func (c *client) checks(ctx context.Context) (agentapi.ChecksResponse, error) {
+	var out agentapi.ChecksResponse
+	err := c.do(ctx, http.MethodGet, agentapi.ChecksPath, nil, &out)
+	return out, err
+}
+
+// sendResults sends results to the server
+func (c *client) sendResults(ctx context.Context, results []agentapi.Result) (agentapi.ResultsResponse, error) {
+	var out agentapi.ResultsResponse
+	err := c.do(ctx, http.MethodPost, agentapi.ResultsPath, agentapi.ResultsRequest{Results: results}, &out)
+	return out, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const agentVersion = "1.0.0"
+
+func main() {
+	server := flag.String("server", "", "url of the vigilate server (e.g. https://vigilate.example.com)")
+	token := flag.String("token", "", "agent token of this host (or set VIGILATE_AGENT_TOKEN)")
+	pluginDir := flag.String("pluginDir", "./plugins", "directory of the plugins run by plugin checks")
+	caCert := flag.String("caCert", "", "PEM file of the certificate authority that signed the server's certificate")
+	allowHTTP := flag.Bool("allowHTTP", false, "allow a plain http server url (for testing only)")
+	flag.Parse()
+
+	if *token == "" {
+		*token = os.Getenv("VIGILATE_AGENT_TOKEN")
+	}
+
+	if *server == "" || *token == "" {
+		fmt.Println("Missing required flags.")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	u, err := url.Parse(*server)
+	if err != nil || u.Host == "" {
+		log.Fatal("Invalid server url: ", *server)
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && *allowHTTP) {
+		log.Fatal("The server url must use https, so that the agent token isn't sent in the clear")
+	}
+
+	httpClient, err := newHTTPClient(*caCert)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c := &client{
+		base:  strings.TrimRight(*server, "/"),
+		token: *token,
+		http:  httpClient,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("Starting vigilate agent %s....", agentVersion)
+
+	reg, err := register(ctx, c)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		log.Fatal(err)
+	}
+
+	log.Printf("Registered as host %s (id %d)", reg.HostName, reg.HostID)
+
+	a := newAgent(c, *pluginDir, time.Duration(reg.PollSeconds)*time.Second)
+	a.run(ctx)
+
+	log.Println("Agent stopped")
+}
+
+// newHTTPClient returns the client used to talk to the server, trusting caFile as well as the
+// system's certificate authorities if it is given
+func newHTTPClient(caFile string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
@@ -0,0 +1,131 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// diskUsage returns the bytes used, and the bytes in all, of the filesystem holding path. Space
+// reserved for root is left out, as df does.
+func diskUsage(path string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+
+	bsize := uint64(st.Bsize)
+	used := (st.Blocks - st.Bfree) * bsize
+	total := used + st.Bavail*bsize
+
+	return used, total, nil
+}
+
+// memoryUsage returns the bytes of memory in use, and in all, from /proc/meminfo. Memory that
+// could be freed (MemAvailable) counts as free.
+func memoryUsage() (uint64, uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = n * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	total, ok := values["MemTotal"]
+	if !ok {
+		return 0, 0, fmt.Errorf("no MemTotal in /proc/meminfo")
+	}
+
+	available, ok := values["MemAvailable"]
+	if !ok {
+		// kernels before 3.14
+		available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+	if available > total {
+		available = total
+	}
+
+	return total - available, total, nil
+}
+
+// loadAverage returns the one, five and fifteen minute load averages from /proc/loadavg
+func loadAverage() ([3]float64, error) {
+	var load [3]float64
+
+	b, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return load, err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) < 3 {
+		return load, fmt.Errorf("can't read /proc/loadavg")
+	}
+
+	for i := range load {
+		load[i], err = strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return load, err
+		}
+	}
+
+	return load, nil
+}
+
+// countProcesses returns how many running processes have the given name, either as their
+// command name or as the base name of their executable
+func countProcesses(name string) (int, error) {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, d := range dirs {
+		if _, err := strconv.Atoi(d.Name()); err != nil || !d.IsDir() {
+			continue
+		}
+
+		// the process may exit while we look at it; then it just doesn't count
+		if comm, err := ioutil.ReadFile(filepath.Join("/proc", d.Name(), "comm")); err == nil &&
+			strings.TrimSpace(string(comm)) == name {
+			n++
+			continue
+		}
+
+		cmdline, err := ioutil.ReadFile(filepath.Join("/proc", d.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		argv0 := strings.SplitN(string(cmdline), "\x00", 2)[0]
+		if filepath.Base(argv0) == name {
+			n++
+		}
+	}
+
+	return n, nil
+}
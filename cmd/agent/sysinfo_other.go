@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// The host level checks read /proc, so only file age and plugin checks work on other platforms.
+
+func diskUsage(path string) (uint64, uint64, error) {
+	return 0, 0, errUnsupported
+}
+
+func memoryUsage() (uint64, uint64, error) {
+	return 0, 0, errUnsupported
+}
+
+func loadAverage() ([3]float64, error) {
+	return [3]float64{}, errUnsupported
+}
+
+func countProcesses(name string) (int, error) {
+	return 0, errUnsupported
+}
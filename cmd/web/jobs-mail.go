@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/aymerick/douceur/inliner"
 	"github.com/luksbutz/vigilate/internal/channeldata"
+	"github.com/luksbutz/vigilate/internal/metrics"
 	mail "github.com/xhit/go-simple-mail/v2"
 	"html/template"
 	"jaytaylor.com/html2text"
@@ -193,6 +194,7 @@ func (w Worker) processMailQueueJob(mailMessage channeldata.MailData) {
 	email.AddAlternative(mail.TextPlain, plainText)
 
 	err = email.Send(smtpClient)
+	metrics.NotificationResult("email", err)
 	if err != nil {
 		log.Println(err)
 	} else {
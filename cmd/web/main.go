@@ -6,7 +6,7 @@ import (
 	"github.com/luksbutz/vigilate/internal/config"
 	"github.com/luksbutz/vigilate/internal/handlers"
 	"github.com/luksbutz/vigilate/internal/models"
-	"github.com/pusher/pusher-http-go"
+	"github.com/luksbutz/vigilate/internal/realtime"
 	"log"
 	"net/http"
 	"os"
@@ -18,7 +18,7 @@ var app config.AppConfig
 var repo *handlers.DBRepo
 var session *scs.SessionManager
 var preferenceMap map[string]string
-var wsClient pusher.Client
+var wsClient realtime.Broadcaster
 
 const vigilateVersion = "1.0.0"
 const maxWorkerPoolSize = 5
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"github.com/justinas/nosurf"
+	"github.com/luksbutz/vigilate/internal/handlers"
 	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/models"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -15,7 +19,8 @@ func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
 
-// Auth checks for authentication
+// Auth checks for authentication, and loads the user so that a changed role or a deactivated
+// account takes effect on their next request
 func Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !helpers.IsAuthenticated(r) {
@@ -23,12 +28,176 @@ func Auth(next http.Handler) http.Handler {
 			http.Redirect(w, r, fmt.Sprintf("/?target=%s", url), http.StatusFound)
 			return
 		}
+
+		u, active, err := activeUser(session.GetInt(r.Context(), "userID"))
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		if !active {
+			deleteRememberCookie(w, r)
+			session.Put(r.Context(), "error", "Your account is no longer active")
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		current, err := repo.TrackSession(r, u)
+		if err != nil {
+			helpers.ServerError(w, r, err)
+			return
+		}
+		if !current {
+			logOutRevokedSession(w, r)
+			session.Put(r.Context(), "error", "This session has been logged out")
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		// when the policy requires two-factor authentication, users without it can only set it up.
+		// Users who logged in with single sign-on leave that to the identity provider.
+		setup := fmt.Sprintf("/admin/user/%d/two-factor", u.ID)
+		if needsTwoFactorSetup(r, u) && r.URL.Path != setup {
+			if strings.Contains(r.Header.Get("Accept"), "text/html") {
+				session.Put(r.Context(), "warning", "Please set up two-factor authentication to continue")
+			}
+			http.Redirect(w, r, setup, http.StatusFound)
+			return
+		}
 		w.Header().Add("Cache-Control", "no-store")
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, helpers.WithUser(r, u))
 	})
 }
 
+// RequireAccess lets through only users whose role has at least the given access level. It goes
+// after Auth, which loads the user.
+func RequireAccess(level int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, _ := helpers.CurrentUser(r)
+			if !u.HasAccess(level) {
+				handlers.Forbidden(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// needsTwoFactorSetup reports whether the policy requires the logged in user to use two-factor
+// authentication, and they haven't set it up. It never does for a single sign-on session.
+func needsTwoFactorSetup(r *http.Request, u models.User) bool {
+	if session.GetBool(r.Context(), "sso") {
+		return false
+	}
+	return u.TOTPEnabled == 0 && u.NeedsTwoFactor(preferenceMap["two_factor_policy"])
+}
+
+// activeUser loads a logged in user, reporting false if their account was deleted or deactivated
+func activeUser(id int) (models.User, bool, error) {
+	u, err := repo.DB.GetUserById(id)
+	if err == sql.ErrNoRows {
+		return u, false, nil
+	} else if err != nil {
+		return u, false, err
+	}
+
+	return u, u.UserActive == 1, nil
+}
+
+// APIAuth checks for authentication on API routes, answering with a JSON error instead of a redirect.
+// Requests with an Authorization: Bearer header are authenticated by api token only; read-only
+// tokens may only be used for GET and HEAD requests. Other requests need a logged in session.
+// Either way, the user's role applies too: viewers may only read.
+func APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+		var userID int
+		bySession := false
+		if plain, ok := bearerToken(r); ok {
+			t, err := repo.DB.GetAPITokenByHash(handlers.HashAPIToken(plain))
+			if err == models.ErrInvalidToken {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				handlers.APIError(w, http.StatusUnauthorized, "unauthorized", "invalid or expired api token")
+				return
+			} else if err != nil {
+				log.Println(err)
+				handlers.APIError(w, http.StatusInternalServerError, "internal_error", "something went wrong")
+				return
+			}
+
+			if !t.CanWrite() && !readOnly {
+				handlers.APIError(w, http.StatusForbidden, "forbidden", "this api token is read-only")
+				return
+			}
+
+			err = repo.DB.TouchAPIToken(t.ID)
+			if err != nil {
+				log.Println(err)
+			}
+			userID = t.UserID
+		} else if helpers.IsAuthenticated(r) {
+			userID = session.GetInt(r.Context(), "userID")
+			bySession = true
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			handlers.APIError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+			return
+		}
+
+		u, active, err := activeUser(userID)
+		if err != nil {
+			log.Println(err)
+			handlers.APIError(w, http.StatusInternalServerError, "internal_error", "something went wrong")
+			return
+		}
+		if !active {
+			handlers.APIError(w, http.StatusUnauthorized, "unauthorized", "this account is no longer active")
+			return
+		}
+
+		if bySession {
+			current, err := repo.TrackSession(r, u)
+			if err != nil {
+				log.Println(err)
+				handlers.APIError(w, http.StatusInternalServerError, "internal_error", "something went wrong")
+				return
+			}
+			if !current {
+				logOutRevokedSession(w, r)
+				handlers.APIError(w, http.StatusUnauthorized, "unauthorized", "this session has been logged out")
+				return
+			}
+		}
+
+		if bySession && needsTwoFactorSetup(r, u) {
+			handlers.APIError(w, http.StatusForbidden, "forbidden", "two-factor authentication must be set up first")
+			return
+		}
+
+		if !u.CanOperate() && !readOnly {
+			handlers.APIError(w, http.StatusForbidden, "forbidden", "viewers may only read")
+			return
+		}
+		w.Header().Add("Cache-Control", "no-store")
+
+		next.ServeHTTP(w, helpers.WithUser(r, u))
+	})
+}
+
+// bearerToken returns the token from an Authorization: Bearer header, if there is one
+func bearerToken(r *http.Request) (string, bool) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") {
+		return "", false
+	}
+
+	token := strings.TrimSpace(parts[1])
+	return token, token != ""
+}
+
 // RecoverPanic recovers from a panic
 func RecoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -50,6 +219,26 @@ func NoSurf(next http.Handler) http.Handler {
 	csrfHandler.ExemptPath("/pusher/auth")
 	csrfHandler.ExemptPath("/pusher/hook")
 
+	// heartbeat pings come from scripts, which are identified by the token in the url
+	csrfHandler.ExemptGlob("/ping/*")
+
+	// agents are identified by their token, and don't have a session
+	csrfHandler.ExemptGlob("/agent/v1/*")
+
+	// api requests authenticated by token don't carry the session cookie, so there is nothing to forge
+	csrfHandler.ExemptFunc(func(r *http.Request) bool {
+		_, ok := bearerToken(r)
+		return ok && strings.HasPrefix(r.URL.Path, "/api/")
+	})
+
+	csrfHandler.SetFailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/agent/") {
+			handlers.APIError(w, http.StatusForbidden, "forbidden", "missing or invalid CSRF token")
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	}))
+
 	csrfHandler.SetBaseCookie(http.Cookie{
 		HttpOnly: true,
 		Path:     "/",
@@ -77,10 +266,11 @@ func CheckRemember(next http.Handler) http.Handler {
 					uid, hash := split[0], split[1]
 					id, _ := strconv.Atoi(uid)
 					validHash := repo.DB.CheckForToken(id, hash)
-					if validHash {
+					user, _ := repo.DB.GetUserById(id)
+					// remember me tokens come from password logins, so they don't count while those are turned off
+					if validHash && user.UserActive == 1 && len(repo.Authenticators) > 0 {
 						// valid remember me token, so log the user in
 						_ = session.RenewToken(r.Context())
-						user, _ := repo.DB.GetUserById(id)
 						hashedPassword := user.Password
 						session.Put(r.Context(), "userID", id)
 						session.Put(r.Context(), "userName", user.FirstName)
@@ -88,6 +278,10 @@ func CheckRemember(next http.Handler) http.Handler {
 						session.Put(r.Context(), "userLastName", user.LastName)
 						session.Put(r.Context(), "hashedPassword", string(hashedPassword))
 						session.Put(r.Context(), "user", user)
+						err = repo.DB.TouchRememberMeToken(id, hash, helpers.ClientIP(r), r.UserAgent())
+						if err != nil {
+							log.Println(err)
+						}
 						next.ServeHTTP(w, r)
 					} else {
 						// invalid token, so delete the cookie
@@ -129,12 +323,28 @@ func CheckRemember(next http.Handler) http.Handler {
 	})
 }
 
+// logOutRevokedSession logs out a session that was logged out from the sessions page. If the
+// browser was remembered, it is forgotten, so that it isn't logged straight back in.
+func logOutRevokedSession(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(fmt.Sprintf("_%s_gowatcher_remember", preferenceMap["identifier"]))
+	if err == nil {
+		if split := strings.Split(cookie.Value, "|"); len(split) == 2 {
+			err = repo.DB.DeleteToken(split[1])
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	deleteRememberCookie(w, r)
+}
+
 // deleteRememberCookie deletes the remember me cookie, and logs the user out
 func deleteRememberCookie(w http.ResponseWriter, r *http.Request) {
 	_ = session.RenewToken(r.Context())
 	// delete the cookie
 	newCookie := http.Cookie{
-		Name:     fmt.Sprintf("_%s_ggowatcher_remember", preferenceMap["identifier"]),
+		Name:     fmt.Sprintf("_%s_gowatcher_remember", preferenceMap["identifier"]),
 		Value:    "",
 		Path:     "/",
 		Expires:  time.Now().Add(-100 * time.Hour),
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/go-chi/chi/v5"
 	"github.com/luksbutz/vigilate/internal/handlers"
+	"github.com/luksbutz/vigilate/internal/models"
 	"net/http"
 )
 
@@ -20,8 +21,42 @@ func routes() http.Handler {
 	mux.Get("/", handlers.Repo.LoginScreen)
 	mux.Post("/", handlers.Repo.Login)
 
+	// second login step, for users with two-factor authentication
+	mux.Get("/login/two-factor", handlers.Repo.TwoFactorLogin)
+	mux.Post("/login/two-factor", handlers.Repo.PostTwoFactorLogin)
+
+	// single sign-on, when an OpenID Connect provider is set up
+	mux.Get("/login/oidc", handlers.Repo.OIDCLogin)
+	mux.Get("/login/oidc/callback", handlers.Repo.OIDCCallback)
+
+	// forgotten passwords, reset with a link sent by email
+	mux.Get("/password/forgot", handlers.Repo.ForgotPassword)
+	mux.Post("/password/forgot", handlers.Repo.PostForgotPassword)
+	mux.Get("/password/reset/{token}", handlers.Repo.ResetPassword)
+	mux.Post("/password/reset/{token}", handlers.Repo.PostResetPassword)
+
 	mux.Get("/user/logout", handlers.Repo.Logout)
 
+	// public status pages
+	mux.Get("/status/{slug}", handlers.Repo.PublicStatusPage)
+
+	// badges, unlocked by the token in the url
+	mux.Get("/badge/{token}/status.svg", handlers.Repo.BadgeStatus)
+	mux.Get("/badge/{token}/uptime.svg", handlers.Repo.BadgeUptime)
+
+	// heartbeat pings from outside jobs, identified by the token in the url
+	mux.Post("/ping/{token}", handlers.Repo.Ping)
+
+	// agents running on hosts, identified by their host's agent token
+	mux.Route("/agent/v1", func(mux chi.Router) {
+		mux.NotFound(handlers.APINotFound)
+		mux.MethodNotAllowed(handlers.APIMethodNotAllowed)
+
+		mux.Post("/register", handlers.Repo.AgentRegister)
+		mux.Get("/checks", handlers.Repo.AgentChecks)
+		mux.Post("/results", handlers.Repo.AgentResults)
+	})
+
 	mux.Route("/pusher", func(mux chi.Router) {
 		mux.Use(Auth)
 
@@ -33,44 +68,161 @@ func routes() http.Handler {
 		// all admin routes are protected
 		mux.Use(Auth)
 
-		// sample code for sending to private channel
-		mux.Get("/private-message", handlers.Repo.SendPrivateMessage)
+		// viewers, and everyone above them, may look around
+		mux.Group(func(mux chi.Router) {
+			// live updates from the built-in hub
+			mux.Get("/realtime/ws", handlers.Repo.RealtimeWS)
+			mux.Get("/realtime/events", handlers.Repo.RealtimeEvents)
+
+			// overview
+			mux.Get("/overview", handlers.Repo.AdminDashboard)
+
+			// events
+			mux.Get("/events", handlers.Repo.Events)
+
+			// service status pages (all hosts)
+			mux.Get("/all-healthy", handlers.Repo.AllHealthyServices)
+			mux.Get("/all-warning", handlers.Repo.AllWarningServices)
+			mux.Get("/all-problems", handlers.Repo.AllProblemServices)
+			mux.Get("/all-pending", handlers.Repo.AllPendingServices)
+			mux.Get("/all-unknown", handlers.Repo.AllUnknownServices)
+			mux.Get("/all-unreachable", handlers.Repo.AllUnreachableServices)
+
+			// users may change their own account; the handlers let admins change anyone's
+			mux.Get("/user/{id}", handlers.Repo.OneUser)
+			mux.Post("/user/{id}", handlers.Repo.PostOneUser)
+			mux.Post("/user/{id}/api-tokens", handlers.Repo.PostAPIToken)
+			mux.Get("/user/{id}/api-token/delete/{tokenID}", handlers.Repo.DeleteAPIToken)
+
+			// where users are logged in; the handlers let admins log out anyone
+			mux.Get("/user/{id}/sessions", handlers.Repo.UserSessions)
+			mux.Post("/user/{id}/session/delete/{sessionID}", handlers.Repo.DeleteUserSession)
+			mux.Post("/user/{id}/remembered/delete/{tokenID}", handlers.Repo.DeleteRememberedBrowser)
+			mux.Post("/user/{id}/sessions/logout-all", handlers.Repo.LogOutEverywhere)
+
+			// two-factor authentication, which users only ever set up for themselves
+			mux.Get("/user/{id}/two-factor", handlers.Repo.TwoFactorSetup)
+			mux.Post("/user/{id}/two-factor", handlers.Repo.PostTwoFactorSetup)
+			mux.Post("/user/{id}/two-factor/recovery-codes", handlers.Repo.PostRecoveryCodes)
+			mux.Post("/user/{id}/two-factor/disable", handlers.Repo.PostDisableTwoFactor)
+
+			// status pages
+			mux.Get("/status-pages", handlers.Repo.AllStatusPages)
+			mux.Get("/status-page/{id}", handlers.Repo.StatusPage)
+
+			// schedule
+			mux.Get("/schedule", handlers.Repo.ListEntries)
+
+			// hosts
+			mux.Get("/host/all", handlers.Repo.AllHosts)
+			mux.Get("/host/{id}", handlers.Repo.Host)
+
+			// host groups
+			mux.Get("/groups", handlers.Repo.AllHostGroups)
+			mux.Get("/group/{id}", handlers.Repo.HostGroup)
+		})
+
+		// operators may change hosts and run checks
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireAccess(models.AccessOperator))
+
+			// status page notices
+			mux.Post("/status-page/{id}/notice", handlers.Repo.PostStatusPageNotice)
+			mux.Get("/status-page/{id}/notice/resolve/{noticeID}", handlers.Repo.ResolveStatusPageNotice)
+			mux.Get("/status-page/{id}/notice/delete/{noticeID}", handlers.Repo.DeleteStatusPageNotice)
+
+			// hosts
+			mux.Post("/host/{id}", handlers.Repo.PostHost)
+			mux.Post("/host/ajax/toggle-service", handlers.Repo.ToggleServiceForHost)
+			mux.Get("/host-service/{id}/badge/new", handlers.Repo.NewBadgeToken)
+			mux.Get("/host-service/{id}/badge/delete", handlers.Repo.DeleteBadgeToken)
+			mux.Get("/host-service/{id}/ping/new", handlers.Repo.NewPingToken)
+			mux.Post("/host/ajax/heartbeat", handlers.Repo.UpdateHeartbeat)
+			mux.Post("/host/ajax/thresholds", handlers.Repo.UpdateThresholds)
+			mux.Post("/host/{id}/agent/new", handlers.Repo.NewAgentToken)
+			mux.Post("/host/{id}/agent/delete", handlers.Repo.DeleteAgentToken)
+			mux.Get("/perform-check/{id}/{oldStatus}", handlers.Repo.TestCheck)
+
+			// host groups
+			mux.Post("/group/{id}", handlers.Repo.PostHostGroup)
+			mux.Post("/group/{id}/bulk", handlers.Repo.HostGroupBulkAction)
+			mux.Get("/group/delete/{id}", handlers.Repo.DeleteHostGroup)
+		})
+
+		// admins may change how vigilate itself works, and who may use it
+		mux.Group(func(mux chi.Router) {
+			mux.Use(RequireAccess(models.AccessAdmin))
+
+			// sample code for sending to private channel
+			mux.Get("/private-message", handlers.Repo.SendPrivateMessage)
+
+			// settings
+			mux.Get("/settings", handlers.Repo.Settings)
+			mux.Post("/settings", handlers.Repo.PostSettings)
+
+			// users
+			mux.Get("/users", handlers.Repo.AllUsers)
+			mux.Get("/user/delete/{id}", handlers.Repo.DeleteUser)
+			mux.Post("/user/{id}/two-factor/reset", handlers.Repo.ResetTwoFactor)
+			mux.Post("/user/{id}/unlock", handlers.Repo.UnlockUser)
+			mux.Get("/failed-logins", handlers.Repo.FailedLogins)
+
+			// push notification targets
+			mux.Get("/push-targets", handlers.Repo.AllPushTargets)
+			mux.Get("/push-target/{id}", handlers.Repo.PushTarget)
+			mux.Post("/push-target/{id}", handlers.Repo.PostPushTarget)
+			mux.Get("/push-target/delete/{id}", handlers.Repo.DeletePushTarget)
+			mux.Get("/push-target/test/{id}", handlers.Repo.TestPushTarget)
+
+			// status pages
+			mux.Post("/status-page/{id}", handlers.Repo.PostStatusPage)
+			mux.Get("/status-page/delete/{id}", handlers.Repo.DeleteStatusPage)
+
+			// check commands
+			mux.Get("/check-commands", handlers.Repo.AllCheckCommands)
+			mux.Get("/check-command/{id}", handlers.Repo.OneCheckCommand)
+			mux.Post("/check-command/{id}", handlers.Repo.PostOneCheckCommand)
+			mux.Get("/check-command/delete/{id}", handlers.Repo.DeleteCheckCommand)
+
+			// preferences
+			mux.Post("/preference/ajax/set-system-pref", handlers.Repo.SetSystemPref)
+			mux.Post("/preference/ajax/toggle-monitoring", handlers.Repo.ToggleMonitoring)
+		})
+	})
 
-		// overview
-		mux.Get("/overview", handlers.Repo.AdminDashboard)
+	// prometheus metrics, authenticated like the api so scrapers can use a bearer token
+	mux.With(APIAuth).Get("/metrics", handlers.Repo.Metrics)
 
-		// events
-		mux.Get("/events", handlers.Repo.Events)
+	// json api
+	mux.Route("/api/v1", func(mux chi.Router) {
+		mux.NotFound(handlers.APINotFound)
+		mux.MethodNotAllowed(handlers.APIMethodNotAllowed)
 
-		// settings
-		mux.Get("/settings", handlers.Repo.Settings)
-		mux.Post("/settings", handlers.Repo.PostSettings)
+		mux.Get("/openapi.yaml", handlers.Repo.OpenAPISpec)
 
-		// service status pages (all hosts)
-		mux.Get("/all-healthy", handlers.Repo.AllHealthyServices)
-		mux.Get("/all-warning", handlers.Repo.AllWarningServices)
-		mux.Get("/all-problems", handlers.Repo.AllProblemServices)
-		mux.Get("/all-pending", handlers.Repo.AllPendingServices)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(APIAuth)
 
-		// users
-		mux.Get("/users", handlers.Repo.AllUsers)
-		mux.Get("/user/{id}", handlers.Repo.OneUser)
-		mux.Post("/user/{id}", handlers.Repo.PostOneUser)
-		mux.Get("/user/delete/{id}", handlers.Repo.DeleteUser)
+			// hosts
+			mux.Get("/hosts", handlers.Repo.APIListHosts)
+			mux.Post("/hosts", handlers.Repo.APICreateHost)
+			mux.Get("/hosts/{id}", handlers.Repo.APIGetHost)
+			mux.Put("/hosts/{id}", handlers.Repo.APIUpdateHost)
+			mux.Delete("/hosts/{id}", handlers.Repo.APIDeleteHost)
+			mux.Get("/hosts/{id}/services", handlers.Repo.APIListHostServicesForHost)
 
-		// schedule
-		mux.Get("/schedule", handlers.Repo.ListEntries)
+			// host services
+			mux.Get("/host-services", handlers.Repo.APIListHostServices)
+			mux.Get("/host-services/{id}", handlers.Repo.APIGetHostService)
+			mux.Put("/host-services/{id}", handlers.Repo.APIUpdateHostService)
+			mux.Post("/host-services/{id}/check", handlers.Repo.APICheckHostService)
 
-		// preferences
-		mux.Post("/preference/ajax/set-system-pref", handlers.Repo.SetSystemPref)
-		mux.Post("/preference/ajax/toggle-monitoring", handlers.Repo.ToggleMonitoring)
+			// events
+			mux.Get("/events", handlers.Repo.APIListEvents)
 
-		// hosts
-		mux.Get("/host/all", handlers.Repo.AllHosts)
-		mux.Get("/host/{id}", handlers.Repo.Host)
-		mux.Post("/host/{id}", handlers.Repo.PostHost)
-		mux.Post("/host/ajax/toggle-service", handlers.Repo.ToggleServiceForHost)
-		mux.Get("/perform-check/{id}/{oldStatus}", handlers.Repo.TestCheck)
+			// alerts from prometheus alertmanager
+			mux.Post("/alertmanager", handlers.Repo.AlertmanagerWebhook)
+		})
 	})
 
 	// static files
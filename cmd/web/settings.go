@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/luksbutz/vigilate/internal/config"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/realtime"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// secretSettings are redacted when the settings are printed
+var secretSettings = map[string]bool{
+	"dbpass":           true,
+	"pusherSecret":     true,
+	"oidcClientSecret": true,
+	"ldapBindPassword": true,
+	"passwordResetKey": true,
+}
+
+// requiredSettings must not be empty
+var requiredSettings = []string{"dbuser", "dbhost", "dbport", "db", "identifier"}
+
+// roleLevels are the roles single sign-on and LDAP can give users in none of the mapped groups
+var roleLevels = map[string]int{
+	"none":     0,
+	"viewer":   models.AccessViewer,
+	"operator": models.AccessOperator,
+	"admin":    models.AccessAdmin,
+}
+
+// sslModes are the sslmode values postgres knows
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// settingsOnlyFlags only make sense on the command line
+var settingsOnlyFlags = []string{"config", "print-config"}
+
+// loadSettings fills in the flags not given on the command line from VIGILATE_* environment
+// variables and then the settings file, if there is one
+func loadSettings(fs *flag.FlagSet, path string) (map[string]config.Source, error) {
+	file := map[string]string{}
+
+	if path != "" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read settings file: %w", err)
+		}
+		if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+			log.Printf("Warning: %s can be read by other users; it may hold passwords, so consider chmod 600", path)
+		}
+
+		file, err = config.ReadSettingsFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return config.LoadSettings(fs, file, os.LookupEnv, settingsOnlyFlags...)
+}
+
+// validateSettings returns what is wrong with the settings, if anything
+func validateSettings(fs *flag.FlagSet) []string {
+	var problems []string
+
+	get := func(name string) string {
+		return strings.TrimSpace(fs.Lookup(name).Value.String())
+	}
+
+	for _, name := range requiredSettings {
+		if get(name) == "" {
+			problems = append(problems, fmt.Sprintf("%s is required (flag -%s, environment variable %s, or %s in the settings file)",
+				name, name, config.EnvName(name), config.FileKey(name)))
+		}
+	}
+
+	if _, port, err := net.SplitHostPort(get("port")); err != nil || !validPort(port) {
+		problems = append(problems, fmt.Sprintf("port %q must be [host]:port, e.g. :4000", get("port")))
+	}
+
+	for _, name := range []string{"dbport", "pusherPort"} {
+		if v := get(name); v != "" && !validPort(v) {
+			problems = append(problems, fmt.Sprintf("%s %q must be a port number", name, v))
+		}
+	}
+
+	if !contains(realtime.Modes, get("realtime")) {
+		problems = append(problems, fmt.Sprintf("realtime %q must be one of %s", get("realtime"), strings.Join(realtime.Modes, ", ")))
+	} else if get("realtime") == realtime.ModePusher {
+		for _, name := range []string{"pusherHost", "pusherKey", "pusherSecret"} {
+			if get(name) == "" {
+				problems = append(problems, fmt.Sprintf("%s is required when realtime is pusher (flag -%s, environment variable %s, or %s in the settings file)",
+					name, name, config.EnvName(name), config.FileKey(name)))
+			}
+		}
+	}
+
+	if issuer := get("oidcIssuer"); issuer != "" {
+		if u, err := url.Parse(issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("oidcIssuer %q must be an http or https url", issuer))
+		}
+		for _, name := range []string{"oidcClientId", "oidcRedirectUrl"} {
+			if get(name) == "" {
+				problems = append(problems, fmt.Sprintf("%s is required when oidcIssuer is set (flag -%s, environment variable %s, or %s in the settings file)",
+					name, name, config.EnvName(name), config.FileKey(name)))
+			}
+		}
+		if _, ok := roleLevels[get("oidcDefaultRole")]; !ok {
+			problems = append(problems, fmt.Sprintf("oidcDefaultRole %q must be one of none, viewer, operator, admin", get("oidcDefaultRole")))
+		}
+		if !contains(strings.Fields(get("oidcScopes")), "openid") {
+			problems = append(problems, "oidcScopes must include openid")
+		}
+	}
+
+	if ldapURL := get("ldapUrl"); ldapURL != "" {
+		if u, err := url.Parse(ldapURL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("ldapUrl %q must be an ldap:// or ldaps:// url", ldapURL))
+		}
+		if get("ldapBaseDn") == "" {
+			problems = append(problems, fmt.Sprintf("ldapBaseDn is required when ldapUrl is set (flag -ldapBaseDn, environment variable %s, or %s in the settings file)",
+				config.EnvName("ldapBaseDn"), config.FileKey("ldapBaseDn")))
+		}
+		if !strings.Contains(get("ldapUserFilter"), "%s") {
+			problems = append(problems, fmt.Sprintf("ldapUserFilter %q must contain %%s, where the email address goes", get("ldapUserFilter")))
+		}
+		if f := get("ldapGroupFilter"); f != "" && !strings.Contains(f, "%s") {
+			problems = append(problems, fmt.Sprintf("ldapGroupFilter %q must contain %%s, where the user's DN goes", f))
+		}
+		if _, ok := roleLevels[get("ldapDefaultRole")]; !ok {
+			problems = append(problems, fmt.Sprintf("ldapDefaultRole %q must be one of none, viewer, operator, admin", get("ldapDefaultRole")))
+		}
+	}
+
+	if get("passwordLogin") == "false" && get("oidcIssuer") == "" && get("ldapUrl") == "" {
+		problems = append(problems, "passwordLogin can only be false when single sign-on (oidcIssuer) or LDAP (ldapUrl) is set up")
+	}
+
+	if !contains(sslModes, get("dbssl")) {
+		problems = append(problems, fmt.Sprintf("dbssl %q must be one of %s", get("dbssl"), strings.Join(sslModes, ", ")))
+	}
+
+	return problems
+}
+
+// validPort reports whether s is a tcp port number
+func validPort(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n > 0 && n < 65536
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// printSettings writes the settings in use as a settings file, noting where each came from.
+// Secrets are redacted.
+func printSettings(w io.Writer, fs *flag.FlagSet, sources map[string]config.Source, path string) {
+	fmt.Fprintln(w, "# effective vigilate settings (precedence: flag > environment > file > default)")
+	if path != "" {
+		fmt.Fprintf(w, "# settings file: %s\n", path)
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		source, ok := sources[f.Name]
+		if !ok {
+			return
+		}
+
+		value := f.Value.String()
+		if secretSettings[f.Name] && value != "" {
+			value = "<redacted>"
+		}
+
+		if _, isBool := f.Value.(interface{ IsBoolFlag() bool }); !isBool {
+			value = strconv.Quote(value)
+		}
+
+		from := string(source)
+		switch source {
+		case config.SourceEnv:
+			from = "env " + config.EnvName(f.Name)
+		case config.SourceFlag:
+			from = "flag -" + f.Name
+		}
+
+		fmt.Fprintf(w, "%s = %s # %s\n", config.FileKey(f.Name), value, from)
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/rand"
 	"flag"
 	"fmt"
 	"github.com/alexedwards/scs/postgresstore"
@@ -10,11 +11,16 @@ import (
 	"github.com/luksbutz/vigilate/internal/driver"
 	"github.com/luksbutz/vigilate/internal/handlers"
 	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/ldapauth"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/oidc"
+	"github.com/luksbutz/vigilate/internal/realtime"
 	"github.com/pusher/pusher-http-go"
 	"github.com/robfig/cron/v3"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -36,14 +42,68 @@ func setupApp() (*string, error) {
 	pusherKey := flag.String("pusherKey", "", "pusher key")
 	pusherSecret := flag.String("pusherSecret", "", "pusher secret")
 	pusherSecure := flag.Bool("pusherSecure", false, "pusher server uses SSL (true or false)")
+	realtimeMode := flag.String("realtime", realtime.ModeHub, "how live updates reach browsers: hub (built in) or pusher")
+	pluginDir := flag.String("pluginDir", "./plugins", "directory of the plugins run by command checks")
+	oidcIssuer := flag.String("oidcIssuer", "", "single sign-on: OpenID Connect issuer url; empty turns single sign-on off")
+	oidcClientID := flag.String("oidcClientId", "", "single sign-on: client id")
+	oidcClientSecret := flag.String("oidcClientSecret", "", "single sign-on: client secret; empty for a public client")
+	oidcRedirectURL := flag.String("oidcRedirectUrl", "", "single sign-on: callback url, e.g. https://vigilate.example.com/login/oidc/callback")
+	oidcScopes := flag.String("oidcScopes", strings.Join(oidc.DefaultScopes, " "), "single sign-on: scopes to ask for")
+	oidcRoleClaim := flag.String("oidcRoleClaim", "", "single sign-on: claim holding groups or roles, e.g. groups; empty gives everyone oidcDefaultRole")
+	oidcAdmins := flag.String("oidcAdmins", "", "single sign-on: comma separated role claim values that make a user an admin")
+	oidcOperators := flag.String("oidcOperators", "", "single sign-on: comma separated role claim values that make a user an operator")
+	oidcViewers := flag.String("oidcViewers", "", "single sign-on: comma separated role claim values that make a user a viewer")
+	oidcDefaultRole := flag.String("oidcDefaultRole", "viewer", "single sign-on: role of users matching no value: none, viewer, operator or admin")
+	oidcButton := flag.String("oidcButton", "Log in with single sign-on", "single sign-on: text of the login button")
+	ldapURL := flag.String("ldapUrl", "", "LDAP: directory url, e.g. ldaps://ldap.example.com; empty turns LDAP logins off")
+	ldapStartTLS := flag.Bool("ldapStartTls", false, "LDAP: upgrade an ldap:// connection with StartTLS")
+	ldapInsecureSkipVerify := flag.Bool("ldapInsecureSkipVerify", false, "LDAP: accept any TLS certificate (testing only)")
+	ldapBindDN := flag.String("ldapBindDn", "", "LDAP: DN of the account that looks users up; empty binds anonymously")
+	ldapBindPassword := flag.String("ldapBindPassword", "", "LDAP: password of ldapBindDn")
+	ldapBaseDN := flag.String("ldapBaseDn", "", "LDAP: where users are looked up, e.g. ou=people,dc=example,dc=com")
+	ldapUserFilter := flag.String("ldapUserFilter", "(mail=%s)", "LDAP: filter finding the user; %s is the email address typed in")
+	ldapGroupBaseDN := flag.String("ldapGroupBaseDn", "", "LDAP: where groups are looked up (default ldapBaseDn)")
+	ldapGroupFilter := flag.String("ldapGroupFilter", "", "LDAP: filter finding the user's groups, e.g. (member=%s) where %s is the user's DN; empty reads memberOf")
+	ldapGroupAttribute := flag.String("ldapGroupAttribute", "cn", "LDAP: attribute holding a group's name")
+	ldapAdmins := flag.String("ldapAdmins", "", "LDAP: comma separated groups whose members are admins")
+	ldapOperators := flag.String("ldapOperators", "", "LDAP: comma separated groups whose members are operators")
+	ldapViewers := flag.String("ldapViewers", "", "LDAP: comma separated groups whose members are viewers")
+	ldapLinkExisting := flag.Bool("ldapLinkExisting", false, "LDAP: link a user's first login to an existing account with their email address, if the directory's addresses can be trusted")
+	ldapDefaultRole := flag.String("ldapDefaultRole", "viewer", "LDAP: role of users in none of the groups: none, viewer, operator or admin")
+	passwordLogin := flag.Bool("passwordLogin", true, "users may log in with a password kept by vigilate; false leaves single sign-on and LDAP")
+	passwordResetKey := flag.String("passwordResetKey", "", "key signing password reset links; empty makes a new one each start, spoiling links sent before")
+	trustProxy := flag.Bool("trustProxy", false, "take clients' addresses from X-Forwarded-For, as set by a reverse proxy in front of vigilate")
+	configFile := flag.String("config", os.Getenv("VIGILATE_CONFIG"), "settings file (key = value, as in vigilate.toml.example)")
+	printConfig := flag.Bool("print-config", false, "print the settings in use, with secrets redacted, and exit")
 
 	flag.Parse()
 
-	if *dbUser == "" || *dbHost == "" || *dbPort == "" || *databaseName == "" || *identifier == "" {
-		fmt.Println("Missing required flags.")
+	// settings not given as flags come from the environment, then the settings file
+	sources, err := loadSettings(flag.CommandLine, *configFile)
+	if err != nil {
+		fmt.Println("Invalid settings:")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	problems := validateSettings(flag.CommandLine)
+
+	if *printConfig {
+		printSettings(os.Stdout, flag.CommandLine, sources, *configFile)
+	}
+
+	if len(problems) > 0 {
+		fmt.Println("Invalid settings:")
+		for _, p := range problems {
+			fmt.Println(p)
+		}
 		os.Exit(1)
 	}
 
+	if *printConfig {
+		os.Exit(0)
+	}
+
 	log.Println("Connecting to database....")
 	dsnString := ""
 
@@ -99,11 +159,72 @@ func setupApp() (*string, error) {
 		MailQueue:    mailQueue,
 		Version:      vigilateVersion,
 		Identifier:   *identifier,
+		PluginDir:    *pluginDir,
+
+		PasswordLogin:    *passwordLogin,
+		PasswordResetKey: []byte(*passwordResetKey),
+		TrustProxy:       *trustProxy,
+	}
+
+	if len(a.PasswordResetKey) == 0 {
+		a.PasswordResetKey = make([]byte, 32)
+		if _, err := rand.Read(a.PasswordResetKey); err != nil {
+			log.Fatal("Cannot make a password reset key:", err)
+		}
 	}
 
 	app = a
 
+	if *oidcIssuer != "" {
+		log.Println("Single sign-on with", *oidcIssuer)
+		app.OIDC = oidc.New(oidc.Config{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: *oidcClientSecret,
+			RedirectURL:  *oidcRedirectURL,
+			Scopes:       strings.Fields(*oidcScopes),
+			Roles: oidc.RoleMapping{
+				Claim: *oidcRoleClaim,
+				RoleMapping: models.RoleMapping{
+					Admins:    splitList(*oidcAdmins),
+					Operators: splitList(*oidcOperators),
+					Viewers:   splitList(*oidcViewers),
+					Default:   roleLevels[*oidcDefaultRole],
+				},
+			},
+		})
+	}
+
 	repo = handlers.NewPostgresqlHandlers(db, &app)
+
+	// password logins are checked against the directory first, then vigilate's own users
+	repo.Authenticators = nil
+	if *ldapURL != "" {
+		log.Println("LDAP logins with", *ldapURL)
+		directory := ldapauth.New(ldapauth.Config{
+			URL:                *ldapURL,
+			StartTLS:           *ldapStartTLS,
+			InsecureSkipVerify: *ldapInsecureSkipVerify,
+			BindDN:             *ldapBindDN,
+			BindPassword:       *ldapBindPassword,
+			BaseDN:             *ldapBaseDN,
+			UserFilter:         *ldapUserFilter,
+			GroupBaseDN:        *ldapGroupBaseDN,
+			GroupFilter:        *ldapGroupFilter,
+			GroupAttribute:     *ldapGroupAttribute,
+			Roles: models.RoleMapping{
+				Admins:    splitList(*ldapAdmins),
+				Operators: splitList(*ldapOperators),
+				Viewers:   splitList(*ldapViewers),
+				Default:   roleLevels[*ldapDefaultRole],
+			},
+			LinkExisting: *ldapLinkExisting,
+		})
+		repo.Authenticators = append(repo.Authenticators, handlers.NewLDAPAuthenticator(repo, directory))
+	}
+	if app.PasswordLogin {
+		repo.Authenticators = append(repo.Authenticators, repo.DB)
+	}
 	handlers.NewHandlers(repo, &app)
 
 	log.Println("Getting preferences...")
@@ -122,20 +243,45 @@ func setupApp() (*string, error) {
 	preferenceMap["pusher-key"] = *pusherKey
 	preferenceMap["identifier"] = *identifier
 	preferenceMap["version"] = vigilateVersion
+	preferenceMap["realtime"] = *realtimeMode
+	preferenceMap["sso-button"] = ""
+	if app.OIDC != nil {
+		preferenceMap["sso-button"] = *oidcButton
+	}
+	preferenceMap["password-login"] = "1"
+	if len(repo.Authenticators) == 0 {
+		preferenceMap["password-login"] = "0"
+	}
+	preferenceMap["password-reset"] = "0"
+	if app.PasswordLogin {
+		preferenceMap["password-reset"] = "1"
+	}
 
 	app.PreferenceMap = preferenceMap
 
-	// create pusher client
-	wsClient = pusher.Client{
-		AppID:  *pusherApp,
-		Secret: *pusherSecret,
-		Key:    *pusherKey,
-		Secure: *pusherSecure,
-		Host:   fmt.Sprintf("%s:%s", *pusherHost, *pusherPort),
-	}
+	app.Realtime = *realtimeMode
+	if *realtimeMode == realtime.ModePusher {
+		// create pusher client
+		app.PusherClient = &pusher.Client{
+			AppID:  *pusherApp,
+			Secret: *pusherSecret,
+			Key:    *pusherKey,
+			Secure: *pusherSecure,
+			Host:   fmt.Sprintf("%s:%s", *pusherHost, *pusherPort),
+		}
 
-	log.Println("Host", fmt.Sprintf("%s:%s", *pusherHost, *pusherPort))
-	log.Println("Secure", *pusherSecure)
+		log.Println("Host", fmt.Sprintf("%s:%s", *pusherHost, *pusherPort))
+		log.Println("Secure", *pusherSecure)
+
+		// events are sent in the background, so that a slow pusher server doesn't hold up checks
+		queue := realtime.NewQueue(realtime.PusherSender{Client: app.PusherClient}, realtime.QueueSize)
+		go queue.Run()
+		wsClient = queue
+	} else {
+		log.Println("Sending live updates through the built-in hub")
+		app.Hub = realtime.NewHub()
+		wsClient = app.Hub
+	}
 
 	app.WsClient = wsClient
 
@@ -0,0 +1,108 @@
+// Package agentapi describes what the vigilate server and its agents send each other. Agents
+// authenticate with their host's agent token, as an Authorization: Bearer header, and every
+// response is wrapped in the API's {"data": ...} envelope.
+package agentapi
+
+import "time"
+
+// Paths of the agent endpoints on the server
+const (
+	RegisterPath = "/agent/v1/register"
+	ChecksPath   = "/agent/v1/checks"
+	ResultsPath  = "/agent/v1/results"
+)
+
+// Kinds of check an agent runs. The kind of an agent service is kept in its command.
+const (
+	// KindDisk checks how full the filesystem holding Args[0] (or /) is, in percent
+	KindDisk = "disk"
+	// KindMemory checks how much memory is in use, in percent
+	KindMemory = "memory"
+	// KindLoad checks the one minute load average
+	KindLoad = "load"
+	// KindProcess checks that a process named Args[0] is running
+	KindProcess = "process"
+	// KindFileAge checks how long ago the file Args[0] was changed, in seconds or as a duration like 1h
+	KindFileAge = "file_age"
+	// KindPlugin runs the plugin Args[0] from the agent's plugin directory, with the rest of Args
+	KindPlugin = "plugin"
+)
+
+// Kinds are all the kinds of check, in the order they are offered
+var Kinds = []string{KindDisk, KindMemory, KindLoad, KindProcess, KindFileAge, KindPlugin}
+
+// ValidKind returns true if kind is a kind of check agents can run
+func ValidKind(kind string) bool {
+	for _, k := range Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterRequest is sent by an agent when it starts
+type RegisterRequest struct {
+	Hostname string `json:"hostname"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	Version  string `json:"version"`
+}
+
+// RegisterResponse tells an agent which host it is, and how often to fetch its checks
+type RegisterResponse struct {
+	HostID      int    `json:"host_id"`
+	HostName    string `json:"host_name"`
+	PollSeconds int    `json:"poll_seconds"`
+}
+
+// Check is a check assigned to an agent. Macros in Args have already been replaced.
+type Check struct {
+	HostServiceID   int      `json:"host_service_id"`
+	Name            string   `json:"name"`
+	Kind            string   `json:"kind"`
+	Args            []string `json:"args"`
+	Warning         string   `json:"warning"`
+	Critical        string   `json:"critical"`
+	IntervalSeconds int      `json:"interval_seconds"`
+	TimeoutSeconds  int      `json:"timeout_seconds"`
+}
+
+// ChecksResponse is the list of checks an agent should run
+type ChecksResponse struct {
+	PollSeconds int     `json:"poll_seconds"`
+	Checks      []Check `json:"checks"`
+}
+
+// PerfDatum is one value measured by a check
+type PerfDatum struct {
+	Label string  `json:"label"`
+	Unit  string  `json:"unit"`
+	Value float64 `json:"value"`
+}
+
+// Result is the outcome of running a check. Status is healthy, warning, problem or unknown.
+type Result struct {
+	HostServiceID int         `json:"host_service_id"`
+	Status        string      `json:"status"`
+	Message       string      `json:"message"`
+	PerfData      []PerfDatum `json:"perfdata"`
+	CheckedAt     time.Time   `json:"checked_at"`
+}
+
+// ResultsRequest carries the results an agent has collected since it last sent any
+type ResultsRequest struct {
+	Results []Result `json:"results"`
+}
+
+// ResultsResponse says which results the server took
+type ResultsResponse struct {
+	Accepted int              `json:"accepted"`
+	Rejected []RejectedResult `json:"rejected"`
+}
+
+// RejectedResult is a result the server didn't take, and why. Agents shouldn't send it again.
+type RejectedResult struct {
+	HostServiceID int    `json:"host_service_id"`
+	Reason        string `json:"reason"`
+}
@@ -0,0 +1,79 @@
+// Package badge draws shields-style SVG badges: a grey label on the left and a coloured value on the right.
+package badge
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+)
+
+// Badge colours, matching the ones used by shields.io
+const (
+	Green  = "#4c1"
+	Yellow = "#dfb317"
+	Orange = "#fe7d37"
+	Red    = "#e05d44"
+	Grey   = "#9f9f9f"
+	Blue   = "#007ec6"
+)
+
+const (
+	labelColor = "#555"
+	padding    = 10
+	height     = 20
+)
+
+// Render returns the SVG for a badge
+func Render(label, value, color string) []byte {
+	lw := textWidth(label) + padding
+	vw := textWidth(value) + padding
+	w := lw + vw
+
+	label, value = html.EscapeString(label), html.EscapeString(value)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" role="img" aria-label="%s: %s">`,
+		w, height, label, value)
+	fmt.Fprintf(&b, `<title>%s: %s</title>`, label, value)
+	b.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/>`)
+	b.WriteString(`<stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	fmt.Fprintf(&b, `<clipPath id="r"><rect width="%d" height="%d" rx="3" fill="#fff"/></clipPath>`, w, height)
+	b.WriteString(`<g clip-path="url(#r)">`)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="%s"/>`, lw, height, labelColor)
+	fmt.Fprintf(&b, `<rect x="%d" width="%d" height="%d" fill="%s"/>`, lw, vw, height, html.EscapeString(color))
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="url(#s)"/>`, w, height)
+	b.WriteString(`</g>`)
+	b.WriteString(`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`)
+	writeText(&b, lw/2, label)
+	writeText(&b, lw+vw/2, value)
+	b.WriteString(`</g></svg>`)
+
+	return b.Bytes()
+}
+
+// writeText writes text with a drop shadow, centred on x
+func writeText(b *bytes.Buffer, x int, s string) {
+	fmt.Fprintf(b, `<text x="%d" y="15" fill="#010101" fill-opacity=".3">%s</text>`, x, s)
+	fmt.Fprintf(b, `<text x="%d" y="14">%s</text>`, x, s)
+}
+
+// textWidth estimates the width in pixels of s in 11px Verdana. It doesn't need to be exact,
+// only close enough that the text doesn't overflow its box.
+func textWidth(s string) int {
+	w := 0.0
+	for _, r := range s {
+		switch {
+		case r == ' ' || r == 'i' || r == 'l' || r == 'j' || r == '.' || r == ',' || r == ':' || r == '|' || r == '\'' || r == '!':
+			w += 3.9
+		case r == 'f' || r == 't' || r == 'r' || r == '(' || r == ')' || r == '-' || r == '/':
+			w += 4.9
+		case r == 'm' || r == 'w' || r == 'M' || r == 'W' || r == '%':
+			w += 10.9
+		case r >= 'A' && r <= 'Z':
+			w += 7.5
+		default:
+			w += 7
+		}
+	}
+	return int(w + 0.5)
+}
@@ -4,6 +4,8 @@ import (
 	"github.com/alexedwards/scs/v2"
 	"github.com/luksbutz/vigilate/internal/channeldata"
 	"github.com/luksbutz/vigilate/internal/driver"
+	"github.com/luksbutz/vigilate/internal/oidc"
+	"github.com/luksbutz/vigilate/internal/realtime"
 	"github.com/pusher/pusher-http-go"
 	"github.com/robfig/cron/v3"
 	"html/template"
@@ -18,10 +20,22 @@ type AppConfig struct {
 	MonitorMap    map[int]cron.EntryID
 	PreferenceMap map[string]string
 	Scheduler     *cron.Cron
-	WsClient      pusher.Client
+	WsClient      realtime.Broadcaster
+	Realtime      string
+	Hub           *realtime.Hub
+	PusherClient  *pusher.Client
 	PusherSecret  string
 	TemplateCache map[string]*template.Template
 	MailQueue     chan channeldata.MailJob
 	Version       string
 	Identifier    string
+	PluginDir     string
+	// OIDC is the single sign-on provider, or nil when single sign-on is off
+	OIDC *oidc.Provider
+	// PasswordLogin is false when the passwords kept in the users table can't be used to log in
+	PasswordLogin bool
+	// TrustProxy takes clients' addresses from X-Forwarded-For, as set by a reverse proxy
+	TrustProxy bool
+	// PasswordResetKey signs the tokens in password reset links
+	PasswordResetKey []byte
 }
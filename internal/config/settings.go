@@ -0,0 +1,237 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EnvPrefix starts the names of the environment variables read for settings
+const EnvPrefix = "VIGILATE_"
+
+// Source is where the value of a setting came from
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// FileKey returns the settings file key of a flag, e.g. pusher_host for -pusherHost
+func FileKey(flagName string) string {
+	var b strings.Builder
+	for i, r := range flagName {
+		switch {
+		case r == '-':
+			b.WriteRune('_')
+		case unicode.IsUpper(r):
+			if i > 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// EnvName returns the environment variable of a flag, e.g. VIGILATE_PUSHER_HOST for -pusherHost
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(FileKey(flagName))
+}
+
+// ReadSettingsFile reads a settings file, in the flat subset of TOML: one key = value per line,
+// where values are quoted strings, numbers or true/false, and # starts a comment.
+func ReadSettingsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseSettings(f, path)
+}
+
+// parseSettings reads settings from r; name is used in errors
+func parseSettings(r io.Reader, name string) (map[string]string, error) {
+	settings := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("%s:%d: sections are not supported; put every setting at the top level", name, n)
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", name, n)
+		}
+
+		key := strings.TrimSpace(line[:eq])
+		if !validKey(key) {
+			return nil, fmt.Errorf("%s:%d: invalid key %q", name, n, key)
+		}
+		if _, ok := settings[key]; ok {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", name, n, key)
+		}
+
+		value, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %s", name, n, key, err)
+		}
+
+		settings[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// validKey reports whether s is a bare TOML key
+func validKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r == '_' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseValue reads a value, and the comment that may follow it
+func parseValue(s string) (string, error) {
+	var value, rest string
+
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := 1
+		for ; end < len(s); end++ {
+			if s[end] == '\\' {
+				end++
+			} else if s[end] == '"' {
+				break
+			}
+		}
+		if end >= len(s) {
+			return "", errors.New("string is not closed")
+		}
+		v, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s[:end+1])
+		}
+		value, rest = v, s[end+1:]
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", errors.New("string is not closed")
+		}
+		value, rest = s[1:end+1], s[end+2:]
+	default:
+		if i := strings.Index(s, "#"); i >= 0 {
+			s, rest = strings.TrimSpace(s[:i]), s[i:]
+		}
+		if s == "" {
+			return "", errors.New("missing value")
+		}
+		if _, err := strconv.ParseFloat(strings.ReplaceAll(s, "_", ""), 64); err != nil && s != "true" && s != "false" {
+			return "", fmt.Errorf("%s must be quoted, or be a number or true/false", s)
+		}
+		value = strings.ReplaceAll(s, "_", "")
+	}
+
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %q after the value", rest)
+	}
+
+	return value, nil
+}
+
+// LoadSettings fills in the flags of fs that weren't given on the command line, first from the
+// environment and then from the settings file, so a flag beats an environment variable, which
+// beats the file. Flags named in skip are left alone. It returns where each flag's value came
+// from; the errors of all settings that can't be used are returned together.
+func LoadSettings(fs *flag.FlagSet, file map[string]string, lookupEnv func(string) (string, bool), skip ...string) (map[string]Source, error) {
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	sources := make(map[string]Source)
+	known := make(map[string]bool)
+	var problems []string
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if skipped[f.Name] {
+			return
+		}
+		key := FileKey(f.Name)
+		known[key] = true
+
+		if set[f.Name] {
+			sources[f.Name] = SourceFlag
+			return
+		}
+
+		if v, ok := lookupEnv(EnvName(f.Name)); ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid value %q", EnvName(f.Name), v))
+			}
+			sources[f.Name] = SourceEnv
+			return
+		}
+
+		if v, ok := file[key]; ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s in the settings file: invalid value %q", key, v))
+			}
+			sources[f.Name] = SourceFile
+			return
+		}
+
+		sources[f.Name] = SourceDefault
+	})
+
+	var unknown []string
+	for key := range file {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		problems = append(problems, fmt.Sprintf("%s in the settings file is not a setting", key))
+	}
+
+	if len(problems) > 0 {
+		return sources, errors.New(strings.Join(problems, "\n"))
+	}
+
+	return sources, nil
+}
@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/luksbutz/vigilate/internal/agentapi"
+	"github.com/luksbutz/vigilate/internal/metrics"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/plugins"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// agentStatuses are the statuses an agent may report: those of a ping, and unknown for a check
+// it couldn't run
+var agentStatuses = []string{"healthy", "warning", "problem", "unknown"}
+
+// agentTokenPrefix starts every agent token, so that leaked tokens are easy to spot
+const agentTokenPrefix = "vga_"
+
+// agentPollSeconds is how often agents fetch their checks, and so also let the server know they are up
+const agentPollSeconds = 60
+
+// agentHost returns the host whose agent token the request carries. If there is none, it sends
+// an error and returns false.
+func (repo *DBRepo) agentHost(w http.ResponseWriter, r *http.Request) (models.Host, bool) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") || strings.TrimSpace(parts[1]) == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		APIError(w, http.StatusUnauthorized, "unauthorized", "agent token required")
+		return models.Host{}, false
+	}
+
+	h, err := repo.DB.GetHostByAgentToken(HashAPIToken(strings.TrimSpace(parts[1])))
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, models.ErrInvalidToken) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		APIError(w, http.StatusUnauthorized, "unauthorized", "invalid agent token")
+		return h, false
+	} else if err != nil {
+		apiServerError(w, err)
+		return h, false
+	}
+
+	return h, true
+}
+
+// AgentRegister is called by an agent when it starts. It records the agent's version and os,
+// and tells it which host it is.
+func (repo *DBRepo) AgentRegister(w http.ResponseWriter, r *http.Request) {
+	h, ok := repo.agentHost(w, r)
+	if !ok {
+		return
+	}
+
+	var in agentapi.RegisterRequest
+	if !readJSON(w, r, &in) {
+		return
+	}
+
+	agentOS := strings.TrimSpace(in.OS)
+	if in.Arch != "" {
+		agentOS = fmt.Sprintf("%s/%s", agentOS, strings.TrimSpace(in.Arch))
+	}
+
+	err := repo.DB.UpdateHostAgentSeen(h.ID, truncate(strings.TrimSpace(in.Version), 64), truncate(agentOS, 64))
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	log.Printf("Agent %s (%s) registered for host %s", in.Version, agentOS, h.HostName)
+
+	writeAPIData(w, http.StatusOK, agentapi.RegisterResponse{
+		HostID:      h.ID,
+		HostName:    h.HostName,
+		PollSeconds: agentPollSeconds,
+	})
+}
+
+// AgentChecks sends an agent the active agent checks of its host
+func (repo *DBRepo) AgentChecks(w http.ResponseWriter, r *http.Request) {
+	h, ok := repo.agentHost(w, r)
+	if !ok {
+		return
+	}
+
+	err := repo.DB.UpdateHostAgentSeen(h.ID, "", "")
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	resp := agentapi.ChecksResponse{
+		PollSeconds: agentPollSeconds,
+		Checks:      []agentapi.Check{},
+	}
+
+	if h.Active == 1 {
+		for _, hs := range h.HostServices {
+			if hs.Active != 1 || hs.Service.CheckType != models.CheckTypeAgent {
+				continue
+			}
+
+			args, err := plugins.SplitArgs(hs.Service.Arguments)
+			if err != nil {
+				log.Printf("Arguments of %s can't be read: %s", hs.Service.ServiceName, err)
+				continue
+			}
+
+			resp.Checks = append(resp.Checks, agentapi.Check{
+				HostServiceID:   hs.ID,
+				Name:            hs.Service.ServiceName,
+				Kind:            hs.Service.Command,
+				Args:            plugins.Expand(args, commandMacros(h, hs)),
+				Warning:         hs.WarningThreshold,
+				Critical:        hs.CriticalThreshold,
+				IntervalSeconds: int(scheduleDuration(hs.ScheduleNumber, hs.ScheduleUnit).Seconds()),
+				TimeoutSeconds:  pluginTimeout(hs.Service.TimeoutSeconds),
+			})
+		}
+	}
+
+	writeAPIData(w, http.StatusOK, resp)
+}
+
+// AgentResults takes the results of the checks an agent ran, and applies them to its host's services
+func (repo *DBRepo) AgentResults(w http.ResponseWriter, r *http.Request) {
+	h, ok := repo.agentHost(w, r)
+	if !ok {
+		return
+	}
+
+	var in agentapi.ResultsRequest
+	if !readJSON(w, r, &in) {
+		return
+	}
+
+	err := repo.DB.UpdateHostAgentSeen(h.ID, "", "")
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	byID := make(map[int]models.HostService)
+	for _, hs := range h.HostServices {
+		byID[hs.ID] = hs
+	}
+
+	resp := agentapi.ResultsResponse{Rejected: []agentapi.RejectedResult{}}
+
+	reject := func(id int, reason string) {
+		resp.Rejected = append(resp.Rejected, agentapi.RejectedResult{HostServiceID: id, Reason: reason})
+	}
+
+	for _, res := range in.Results {
+		hs, ok := byID[res.HostServiceID]
+		switch {
+		case !ok || hs.Service.CheckType != models.CheckTypeAgent:
+			reject(res.HostServiceID, "not an agent check of this host")
+			continue
+		case hs.Active != 1 || h.Active != 1:
+			reject(res.HostServiceID, "check is not active")
+			continue
+		case !validAgentStatus(res.Status):
+			reject(res.HostServiceID, "status must be one of "+strings.Join(agentStatuses, ", "))
+			continue
+		}
+
+		msg := truncate(strings.TrimSpace(res.Message), maxCheckMessage)
+		if msg == "" {
+			msg = "Agent reported " + res.Status
+		}
+
+		hs.HostName = h.HostName
+		_, status := repo.applyPassiveResult(h, hs, msg, res.Status)
+
+		err = repo.DB.UpdateHostServiceLastPing(hs.ID, time.Now())
+		if err != nil {
+			log.Println(err)
+		}
+
+		samples := make([]metrics.PerfSample, 0, len(res.PerfData))
+		for _, p := range res.PerfData {
+			samples = append(samples, metrics.PerfSample{Label: p.Label, Unit: p.Unit, Value: p.Value})
+		}
+		metrics.SetPerfData(hs.ID, samples)
+
+		// later results for the same check in this batch build on this one
+		hs.Status = status
+		hs.LastMessage = msg
+		byID[hs.ID] = hs
+
+		resp.Accepted++
+	}
+
+	writeAPIData(w, http.StatusOK, resp)
+}
+
+// testAgentCheck checks that the host's agent is still reporting on an agent check. While it is,
+// the status is the one the agent last reported.
+func (repo *DBRepo) testAgentCheck(h models.Host, hs models.HostService) (string, string) {
+	switch h.AgentStatus() {
+	case models.AgentNone:
+		return "No agent has registered for this host", "pending"
+	case models.AgentOffline:
+		return fmt.Sprintf("Agent offline since %s", h.AgentLastSeen.Format("2006-01-02 15:04:05")), "problem"
+	}
+
+	yearOne := time.Date(0001, 1, 1, 0, 0, 1, 0, time.UTC)
+	if !hs.LastPing.After(yearOne) {
+		return "Waiting for the agent's first result", "pending"
+	}
+
+	due := hs.LastPing.Add(scheduleDuration(hs.ScheduleNumber, hs.ScheduleUnit))
+	if time.Now().After(due.Add(scheduleDuration(hs.GraceNumber, hs.GraceUnit))) {
+		return fmt.Sprintf("No result from the agent since %s", hs.LastPing.Format("2006-01-02 15:04:05")), "problem"
+	}
+
+	return hs.LastMessage, hs.Status
+}
+
+// NewAgentToken gives a host a new agent token; an agent using the old one is locked out. The
+// token is shown once, on the next page load.
+func (repo *DBRepo) NewAgentToken(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	h, err := repo.DB.GetHostByID(id)
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusNotFound)
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		ServerError(w, r, err)
+		return
+	}
+	plain := agentTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	err = repo.DB.UpdateHostAgentToken(h.ID, HashAPIToken(plain), plain[:len(agentTokenPrefix)+6])
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	repo.App.Session.Put(r.Context(), "agent_token", plain)
+	repo.App.Session.Put(r.Context(), "flash", "Agent token created")
+	http.Redirect(w, r, fmt.Sprintf("/admin/host/%d#agent-content", h.ID), http.StatusSeeOther)
+}
+
+// DeleteAgentToken revokes a host's agent token
+func (repo *DBRepo) DeleteAgentToken(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := repo.DB.UpdateHostAgentToken(id, "", "")
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	repo.App.Session.Put(r.Context(), "flash", "Agent token revoked")
+	http.Redirect(w, r, fmt.Sprintf("/admin/host/%d#agent-content", id), http.StatusSeeOther)
+}
+
+// truncate cuts s down to at most n runes
+func truncate(s string, n int) string {
+	if rs := []rune(s); len(rs) > n {
+		return string(rs[:n])
+	}
+	return s
+}
+
+func validAgentStatus(s string) bool {
+	for _, x := range agentStatuses {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/uptime"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxAlertmanagerBodyBytes caps the size of an Alertmanager webhook, which may carry many alerts
+const maxAlertmanagerBodyBytes = 4 << 20
+
+// alertmanagerPayload is the part of Alertmanager's webhook body (version 4) that vigilate uses
+type alertmanagerPayload struct {
+	Version  string              `json:"version"`
+	Receiver string              `json:"receiver"`
+	Status   string              `json:"status"`
+	Alerts   []alertmanagerAlert `json:"alerts"`
+}
+
+type alertmanagerAlert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+// alertmanagerResult is sent back for a webhook
+type alertmanagerResult struct {
+	Updated []alertmanagerUpdate  `json:"updated"`
+	Skipped []alertmanagerSkipped `json:"skipped"`
+}
+
+type alertmanagerUpdate struct {
+	HostServiceID int    `json:"host_service_id"`
+	HostName      string `json:"host_name"`
+	ServiceName   string `json:"service_name"`
+	Status        string `json:"status"`
+}
+
+type alertmanagerSkipped struct {
+	AlertName   string `json:"alertname"`
+	Fingerprint string `json:"fingerprint"`
+	Reason      string `json:"reason"`
+}
+
+// alertTarget is a host service that alerts of one webhook map onto
+type alertTarget struct {
+	host        models.Host
+	hostService models.HostService
+}
+
+// AlertmanagerWebhook receives alerts from Prometheus Alertmanager. Each alert is mapped onto a
+// host service by its labels: the host by vigilate_host, host or instance (without the port), and
+// the service by vigilate_service or alertname. Firing alerts set the host service to problem (or
+// warning, for alerts with severity warning or info), and it is healthy again once all of them
+// are resolved. Alerts are kept until then, since each webhook only carries one group of them.
+// Missing hosts and services are created if the alertmanager_create preference is on.
+func (repo *DBRepo) AlertmanagerWebhook(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAlertmanagerBodyBytes)
+
+	var payload alertmanagerPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		APIError(w, http.StatusBadRequest, "bad_request", strings.TrimPrefix(err.Error(), "json: "))
+		return
+	}
+
+	create := repo.App.PreferenceMap["alertmanager_create"] == "1"
+
+	result := alertmanagerResult{
+		Updated: []alertmanagerUpdate{},
+		Skipped: []alertmanagerSkipped{},
+	}
+
+	targets := make(map[int]*alertTarget)
+	var order []int
+
+	for _, a := range payload.Alerts {
+		h, hs, err := repo.alertHostService(a, create)
+		if err != nil {
+			result.Skipped = append(result.Skipped, alertmanagerSkipped{
+				AlertName:   a.Labels["alertname"],
+				Fingerprint: a.Fingerprint,
+				Reason:      err.Error(),
+			})
+			continue
+		}
+
+		fingerprint := alertFingerprint(a)
+		if status := alertStatus(a); status == "healthy" {
+			err = repo.DB.DeleteFiringAlert(hs.ID, fingerprint)
+		} else {
+			err = repo.DB.UpsertFiringAlert(models.FiringAlert{
+				HostServiceID: hs.ID,
+				Fingerprint:   fingerprint,
+				Status:        status,
+				Message:       alertMessage(a),
+			})
+		}
+		if err != nil {
+			log.Println(err)
+			result.Skipped = append(result.Skipped, alertmanagerSkipped{
+				AlertName:   a.Labels["alertname"],
+				Fingerprint: a.Fingerprint,
+				Reason:      "could not save the alert",
+			})
+			continue
+		}
+
+		if _, ok := targets[hs.ID]; !ok {
+			targets[hs.ID] = &alertTarget{host: h, hostService: hs}
+			order = append(order, hs.ID)
+		}
+	}
+
+	for _, id := range order {
+		t := targets[id]
+
+		// alerts of other groups may still be firing for the same host service
+		alerts, err := repo.DB.GetFiringAlerts(id)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		// a host service is as bad as the worst of its alerts
+		status := "healthy"
+		var messages []string
+		for _, a := range alerts {
+			status = uptime.Worse(status, a.Status)
+			messages = append(messages, a.Message)
+		}
+
+		msg := "Alert resolved"
+		if len(messages) > 0 {
+			sort.Strings(messages)
+			msg = strings.Join(messages, "; ")
+		}
+
+		_, status = repo.applyPassiveResult(t.host, t.hostService, msg, status)
+
+		result.Updated = append(result.Updated, alertmanagerUpdate{
+			HostServiceID: t.hostService.ID,
+			HostName:      t.host.HostName,
+			ServiceName:   t.hostService.Service.ServiceName,
+			Status:        status,
+		})
+	}
+
+	writeAPIData(w, http.StatusOK, result)
+}
+
+// alertHostService finds (or, if create is true, creates) the host service an alert is about
+func (repo *DBRepo) alertHostService(a alertmanagerAlert, create bool) (models.Host, models.HostService, error) {
+	var hs models.HostService
+
+	hostName := alertHostName(a.Labels)
+	if hostName == "" {
+		return models.Host{}, hs, errors.New("no vigilate_host, host or instance label")
+	}
+
+	serviceName := firstLabel(a.Labels, "vigilate_service", "alertname")
+	if serviceName == "" {
+		return models.Host{}, hs, errors.New("no vigilate_service or alertname label")
+	}
+
+	// the host
+	h, err := repo.DB.GetHostByName(hostName)
+	if errors.Is(err, sql.ErrNoRows) && create {
+		var id int
+		id, err = repo.DB.InsertHost(models.Host{HostName: hostName, CanonicalName: hostName, Active: 1})
+		if err == nil {
+			h, err = repo.DB.GetHostByID(id)
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return h, hs, fmt.Errorf("no host named %s", hostName)
+	} else if err != nil {
+		log.Println(err)
+		return h, hs, errors.New("could not look up the host")
+	}
+
+	if h.Active != 1 {
+		return h, hs, fmt.Errorf("host %s is inactive", h.HostName)
+	}
+
+	// the service
+	s, err := repo.DB.GetServiceByName(serviceName)
+	if errors.Is(err, sql.ErrNoRows) && create {
+		s = models.Service{
+			ServiceName: serviceName,
+			Active:      1,
+			Icon:        "fas fa-bell",
+			CheckType:   models.CheckTypeAlertmanager,
+		}
+		s.ID, err = repo.DB.InsertService(s)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return h, hs, fmt.Errorf("no service named %s", serviceName)
+	} else if err != nil {
+		log.Println(err)
+		return h, hs, errors.New("could not look up the service")
+	}
+
+	if s.CheckType != models.CheckTypeAlertmanager {
+		return h, hs, fmt.Errorf("service %s is checked by vigilate, not by alerts", s.ServiceName)
+	}
+
+	// the host service
+	hs, err = repo.DB.GetHostServiceByHostIDServiceID(h.ID, s.ID)
+	if errors.Is(err, sql.ErrNoRows) && create {
+		_, err = repo.DB.InsertHostService(models.HostService{
+			HostID:         h.ID,
+			ServiceID:      s.ID,
+			Active:         1,
+			ScheduleNumber: 3,
+			ScheduleUnit:   "m",
+			Status:         "pending",
+		})
+		if err == nil {
+			hs, err = repo.DB.GetHostServiceByHostIDServiceID(h.ID, s.ID)
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return h, hs, fmt.Errorf("host %s has no service %s", h.HostName, s.ServiceName)
+	} else if err != nil {
+		log.Println(err)
+		return h, hs, errors.New("could not look up the host service")
+	}
+
+	if hs.Active != 1 {
+		if !create {
+			return h, hs, fmt.Errorf("service %s is inactive on host %s", s.ServiceName, h.HostName)
+		}
+
+		err = repo.DB.UpdateHostServiceStatus(h.ID, s.ID, 1)
+		if err != nil {
+			log.Println(err)
+			return h, hs, errors.New("could not activate the host service")
+		}
+		hs.Active = 1
+	}
+
+	hs.HostName = h.HostName
+
+	return h, hs, nil
+}
+
+// alertHostName returns the host an alert is about, from its labels
+func alertHostName(labels map[string]string) string {
+	if name := firstLabel(labels, "vigilate_host", "host"); name != "" {
+		return name
+	}
+
+	instance := labels["instance"]
+	if host, _, err := net.SplitHostPort(instance); err == nil {
+		return host
+	}
+	return instance
+}
+
+// firstLabel returns the value of the first of the given labels that is set
+func firstLabel(labels map[string]string, names ...string) string {
+	for _, n := range names {
+		if v := strings.TrimSpace(labels[n]); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// alertFingerprint returns what tells an alert apart from the others of its host service: the
+// fingerprint Alertmanager gives it, or else a hash of its labels
+func alertFingerprint(a alertmanagerAlert) string {
+	if a.Fingerprint != "" {
+		return truncate(a.Fingerprint, 64)
+	}
+
+	names := make([]string, 0, len(a.Labels))
+	for name := range a.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hasher := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hasher, "%s=%s\n", name, a.Labels[name])
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// alertStatus maps an alert onto a host service status
+func alertStatus(a alertmanagerAlert) string {
+	if a.Status != "firing" {
+		return "healthy"
+	}
+
+	switch strings.ToLower(a.Labels["severity"]) {
+	case "warning", "info":
+		return "warning"
+	}
+	return "problem"
+}
+
+// alertMessage describes a firing alert, using its summary or description annotation if it has one
+func alertMessage(a alertmanagerAlert) string {
+	name := a.Labels["alertname"]
+
+	text := firstLabel(a.Annotations, "summary", "description", "message")
+	if text == "" {
+		return name
+	}
+	if name == "" {
+		return text
+	}
+	return fmt.Sprintf("%s: %s", name, text)
+}
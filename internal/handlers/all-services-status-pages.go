@@ -9,70 +9,50 @@ import (
 
 // AllHealthyServices lists all healthy services
 func (repo *DBRepo) AllHealthyServices(w http.ResponseWriter, r *http.Request) {
-	// get all host services (with host info) for status healthy
-	services, err := repo.DB.GetServicesByStatus("healthy")
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	vars := make(jet.VarMap)
-	vars.Set("services", services)
-
-	err = helpers.RenderPage(w, r, "healthy", vars, nil)
-	if err != nil {
-		printTemplateError(w, err)
-	}
+	repo.servicesByStatusPage(w, r, "healthy", "healthy")
 }
 
 // AllWarningServices lists all warning services
 func (repo *DBRepo) AllWarningServices(w http.ResponseWriter, r *http.Request) {
-	// get all host services (with host info) for status warning
-	services, err := repo.DB.GetServicesByStatus("warning")
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	vars := make(jet.VarMap)
-	vars.Set("services", services)
-
-	err = helpers.RenderPage(w, r, "warning", vars, nil)
-	if err != nil {
-		printTemplateError(w, err)
-	}
+	repo.servicesByStatusPage(w, r, "warning", "warning")
 }
 
 // AllProblemServices lists all problem services
 func (repo *DBRepo) AllProblemServices(w http.ResponseWriter, r *http.Request) {
-	// get all host services (with host info) for status problem
-	services, err := repo.DB.GetServicesByStatus("problem")
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	vars := make(jet.VarMap)
-	vars.Set("services", services)
-
-	err = helpers.RenderPage(w, r, "problems", vars, nil)
-	if err != nil {
-		printTemplateError(w, err)
-	}
+	repo.servicesByStatusPage(w, r, "problem", "problems")
 }
 
 // AllPendingServices lists all pending services
 func (repo *DBRepo) AllPendingServices(w http.ResponseWriter, r *http.Request) {
-	// get all host services (with host info) for status pending
-	services, err := repo.DB.GetServicesByStatus("pending")
+	repo.servicesByStatusPage(w, r, "pending", "pending")
+}
+
+// AllUnknownServices lists all services whose check couldn't tell how they are
+func (repo *DBRepo) AllUnknownServices(w http.ResponseWriter, r *http.Request) {
+	repo.servicesByStatusPage(w, r, "unknown", "unknown")
+}
+
+// AllUnreachableServices lists all services that are unreachable because a parent host is down
+func (repo *DBRepo) AllUnreachableServices(w http.ResponseWriter, r *http.Request) {
+	repo.servicesByStatusPage(w, r, "unreachable", "unreachable")
+}
+
+// servicesByStatusPage renders a page listing all host services (with host info) for a status,
+// optionally filtered by host group and tag
+func (repo *DBRepo) servicesByStatusPage(w http.ResponseWriter, r *http.Request, status, templateName string) {
+	filter := hostFilterFromRequest(r)
+
+	services, err := repo.DB.GetServicesByStatus(status, filter)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+
 	vars := make(jet.VarMap)
 	vars.Set("services", services)
+	repo.setFilterVars(vars, filter)
 
-	err = helpers.RenderPage(w, r, "pending", vars, nil)
+	err = helpers.RenderPage(w, r, templateName, vars, nil)
 	if err != nil {
 		printTemplateError(w, err)
 	}
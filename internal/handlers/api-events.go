@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"github.com/luksbutz/vigilate/internal/models"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultEventsPerPage = 50
+	maxEventsPerPage     = 500
+)
+
+// apiEvent is the API representation of an event
+type apiEvent struct {
+	ID            int       `json:"id"`
+	EventType     string    `json:"event_type"`
+	HostServiceID int       `json:"host_service_id"`
+	HostID        int       `json:"host_id"`
+	HostName      string    `json:"host_name"`
+	ServiceName   string    `json:"service_name"`
+	Message       string    `json:"message"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// APIListEvents lists events, newest first, filtered by host, host service, type and time range,
+// one page at a time
+func (repo *DBRepo) APIListEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	fields := make(map[string]string)
+
+	intParam := func(name string, def, min int) int {
+		if q.Get(name) == "" {
+			return def
+		}
+
+		n, err := strconv.Atoi(q.Get(name))
+		if err != nil || n < min {
+			fields[name] = "must be an integer of at least " + strconv.Itoa(min)
+		}
+		return n
+	}
+
+	timeParam := func(name string) time.Time {
+		if q.Get(name) == "" {
+			return time.Time{}
+		}
+
+		t, err := time.Parse(time.RFC3339, q.Get(name))
+		if err != nil {
+			fields[name] = "must be an RFC 3339 timestamp"
+		}
+		return t
+	}
+
+	page := intParam("page", 1, 1)
+	perPage := intParam("per_page", defaultEventsPerPage, 1)
+	if perPage > maxEventsPerPage {
+		fields["per_page"] = "must be at most " + strconv.Itoa(maxEventsPerPage)
+	}
+
+	f := models.EventFilter{
+		HostID:        intParam("host_id", 0, 1),
+		HostServiceID: intParam("host_service_id", 0, 1),
+		EventType:     q.Get("type"),
+		Since:         timeParam("since"),
+		Until:         timeParam("until"),
+	}
+
+	if len(fields) > 0 {
+		apiValidationError(w, fields)
+		return
+	}
+
+	f.Limit = perPage
+	f.Offset = (page - 1) * perPage
+
+	events, total, err := repo.DB.GetEvents(f)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	out := []apiEvent{}
+	for _, e := range events {
+		out = append(out, apiEvent{
+			ID:            e.ID,
+			EventType:     e.EventType,
+			HostServiceID: e.HostServiceID,
+			HostID:        e.HostID,
+			HostName:      e.HostName,
+			ServiceName:   e.ServiceName,
+			Message:       e.Message,
+			CreatedAt:     e.CreatedAt,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, apiEnvelope{
+		Data: out,
+		Meta: &apiPageMeta{
+			Page:       page,
+			PerPage:    perPage,
+			Total:      total,
+			TotalPages: (total + perPage - 1) / perPage,
+		},
+	})
+}
@@ -0,0 +1,529 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/luksbutz/vigilate/internal/models"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiHost is the API representation of a host
+type apiHost struct {
+	ID            int               `json:"id"`
+	HostName      string            `json:"host_name"`
+	CanonicalName string            `json:"canonical_name"`
+	URL           string            `json:"url"`
+	IP            string            `json:"ip"`
+	IPV6          string            `json:"ipv6"`
+	Location      string            `json:"location"`
+	OS            string            `json:"os"`
+	Active        bool              `json:"active"`
+	ParentIDs     []int             `json:"parent_ids"`
+	GroupIDs      []int             `json:"group_ids"`
+	Tags          map[string]string `json:"tags"`
+	Services      []apiHostService  `json:"services,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	UpdatedAt     time.Time         `json:"updated_at"`
+}
+
+// apiHostInput is the body for creating or updating a host. Omitted fields are left unchanged.
+type apiHostInput struct {
+	HostName      *string            `json:"host_name"`
+	CanonicalName *string            `json:"canonical_name"`
+	URL           *string            `json:"url"`
+	IP            *string            `json:"ip"`
+	IPV6          *string            `json:"ipv6"`
+	Location      *string            `json:"location"`
+	OS            *string            `json:"os"`
+	Active        *bool              `json:"active"`
+	ParentIDs     *[]int             `json:"parent_ids"`
+	GroupIDs      *[]int             `json:"group_ids"`
+	Tags          *map[string]string `json:"tags"`
+}
+
+// apiHostService is the API representation of a host service
+type apiHostService struct {
+	ID             int       `json:"id"`
+	HostID         int       `json:"host_id"`
+	HostName       string    `json:"host_name"`
+	ServiceID      int       `json:"service_id"`
+	ServiceName    string    `json:"service_name"`
+	Active         bool      `json:"active"`
+	ScheduleNumber int       `json:"schedule_number"`
+	ScheduleUnit   string    `json:"schedule_unit"`
+	Status         string    `json:"status"`
+	LastCheck      time.Time `json:"last_check"`
+	LastMessage    string    `json:"last_message"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// apiHostServiceInput is the body for updating a host service. Omitted fields are left unchanged.
+type apiHostServiceInput struct {
+	Active         *bool   `json:"active"`
+	ScheduleNumber *int    `json:"schedule_number"`
+	ScheduleUnit   *string `json:"schedule_unit"`
+}
+
+// serviceStatuses are the statuses a host service can be listed by
+var serviceStatuses = []string{"healthy", "warning", "problem", "pending", "unknown", "unreachable"}
+
+func toAPIHost(h models.Host) apiHost {
+	a := apiHost{
+		ID:            h.ID,
+		HostName:      h.HostName,
+		CanonicalName: h.CanonicalName,
+		URL:           h.URL,
+		IP:            h.IP,
+		IPV6:          h.IPV6,
+		Location:      h.Location,
+		OS:            h.OS,
+		Active:        h.Active == 1,
+		ParentIDs:     h.ParentIDs,
+		GroupIDs:      []int{},
+		Tags:          map[string]string{},
+		CreatedAt:     h.CreatedAt,
+		UpdatedAt:     h.UpdatedAt,
+	}
+
+	if a.ParentIDs == nil {
+		a.ParentIDs = []int{}
+	}
+
+	for _, g := range h.Groups {
+		a.GroupIDs = append(a.GroupIDs, g.ID)
+	}
+
+	for _, t := range h.Tags {
+		a.Tags[t.Key] = t.Value
+	}
+
+	for _, hs := range h.HostServices {
+		hs.HostName = h.HostName
+		a.Services = append(a.Services, toAPIHostService(hs))
+	}
+
+	return a
+}
+
+func toAPIHostService(hs models.HostService) apiHostService {
+	return apiHostService{
+		ID:             hs.ID,
+		HostID:         hs.HostID,
+		HostName:       hs.HostName,
+		ServiceID:      hs.ServiceID,
+		ServiceName:    hs.Service.ServiceName,
+		Active:         hs.Active == 1,
+		ScheduleNumber: hs.ScheduleNumber,
+		ScheduleUnit:   hs.ScheduleUnit,
+		Status:         hs.Status,
+		LastCheck:      hs.LastCheck,
+		LastMessage:    hs.LastMessage,
+		UpdatedAt:      hs.UpdatedAt,
+	}
+}
+
+// APIListHosts lists hosts, optionally filtered by group and tag
+func (repo *DBRepo) APIListHosts(w http.ResponseWriter, r *http.Request) {
+	hosts, err := repo.DB.FilterHosts(hostFilterFromRequest(r))
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	out := []apiHost{}
+	for _, h := range hosts {
+		out = append(out, toAPIHost(h))
+	}
+
+	writeAPIData(w, http.StatusOK, out)
+}
+
+// APIGetHost returns one host with its services
+func (repo *DBRepo) APIGetHost(w http.ResponseWriter, r *http.Request) {
+	h, ok := repo.apiHostFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, toAPIHost(h))
+}
+
+// APICreateHost creates a host
+func (repo *DBRepo) APICreateHost(w http.ResponseWriter, r *http.Request) {
+	var in apiHostInput
+	if !readJSON(w, r, &in) {
+		return
+	}
+
+	var h models.Host
+	h.Active = 1
+	repo.saveAPIHost(w, h, in, http.StatusCreated)
+}
+
+// APIUpdateHost updates a host
+func (repo *DBRepo) APIUpdateHost(w http.ResponseWriter, r *http.Request) {
+	h, ok := repo.apiHostFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var in apiHostInput
+	if !readJSON(w, r, &in) {
+		return
+	}
+
+	repo.saveAPIHost(w, h, in, http.StatusOK)
+}
+
+// APIDeleteHost deletes a host and takes its services off the schedule
+func (repo *DBRepo) APIDeleteHost(w http.ResponseWriter, r *http.Request) {
+	h, ok := repo.apiHostFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	for _, hs := range h.HostServices {
+		if _, scheduled := repo.App.MonitorMap[hs.ID]; scheduled {
+			repo.removeFromMonitorMap(hs)
+		}
+	}
+
+	err := repo.DB.DeleteHost(h.ID)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// APIListHostServicesForHost lists the services of one host
+func (repo *DBRepo) APIListHostServicesForHost(w http.ResponseWriter, r *http.Request) {
+	h, ok := repo.apiHostFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, toAPIHost(h).Services)
+}
+
+// APIListHostServices lists active host services, optionally filtered by status, group and tag
+func (repo *DBRepo) APIListHostServices(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && !validServiceStatus(status) {
+		apiValidationError(w, map[string]string{
+			"status": "must be one of " + strings.Join(serviceStatuses, ", "),
+		})
+		return
+	}
+
+	services, err := repo.DB.GetServicesByStatus(status, hostFilterFromRequest(r))
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	out := []apiHostService{}
+	for _, hs := range services {
+		out = append(out, toAPIHostService(hs))
+	}
+
+	writeAPIData(w, http.StatusOK, out)
+}
+
+// APIGetHostService returns one host service
+func (repo *DBRepo) APIGetHostService(w http.ResponseWriter, r *http.Request) {
+	hs, ok := repo.apiHostServiceFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, toAPIHostService(hs))
+}
+
+// APIUpdateHostService turns a host service on or off and/or changes its schedule
+func (repo *DBRepo) APIUpdateHostService(w http.ResponseWriter, r *http.Request) {
+	hs, ok := repo.apiHostServiceFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var in apiHostServiceInput
+	if !readJSON(w, r, &in) {
+		return
+	}
+
+	fields := make(map[string]string)
+	if in.ScheduleNumber != nil && *in.ScheduleNumber < 1 {
+		fields["schedule_number"] = "must be at least 1"
+	}
+	if in.ScheduleUnit != nil && !validScheduleUnit(*in.ScheduleUnit) {
+		fields["schedule_unit"] = "must be one of s, m, h, d"
+	}
+	if len(fields) > 0 {
+		apiValidationError(w, fields)
+		return
+	}
+
+	h, err := repo.DB.GetHostByID(hs.HostID)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	if in.ScheduleNumber != nil || in.ScheduleUnit != nil {
+		if in.ScheduleNumber != nil {
+			hs.ScheduleNumber = *in.ScheduleNumber
+		}
+		if in.ScheduleUnit != nil {
+			hs.ScheduleUnit = *in.ScheduleUnit
+		}
+
+		err = repo.DB.UpdateHostService(hs)
+		if err != nil {
+			apiServerError(w, err)
+			return
+		}
+
+		// reschedule with the new interval
+		if _, scheduled := repo.App.MonitorMap[hs.ID]; scheduled {
+			repo.removeFromMonitorMap(hs)
+			repo.addToMonitorMap(hs)
+		}
+	}
+
+	if in.Active != nil {
+		active := 0
+		if *in.Active {
+			active = 1
+		}
+
+		if active != hs.Active {
+			repo.setHostServiceActive(h, hs.ServiceID, active)
+		}
+	}
+
+	hs, err = repo.DB.GetHostServiceByID(hs.ID)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, toAPIHostService(hs))
+}
+
+// APICheckHostService runs a check on a host service right away and returns the result
+func (repo *DBRepo) APICheckHostService(w http.ResponseWriter, r *http.Request) {
+	hs, ok := repo.apiHostServiceFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	if !scheduled(hs) {
+		APIError(w, http.StatusConflict, "conflict", fmt.Sprintf("host service %d gets its status from Alertmanager alerts, and can't be checked", hs.ID))
+		return
+	}
+
+	h, err := repo.DB.GetHostByID(hs.HostID)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	hs, err = repo.checkHostService(h, hs)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	writeAPIData(w, http.StatusOK, toAPIHostService(hs))
+}
+
+// saveAPIHost applies the input to the host, validates and saves it, and sends the result
+func (repo *DBRepo) saveAPIHost(w http.ResponseWriter, h models.Host, in apiHostInput, status int) {
+	setString := func(dst *string, src *string) {
+		if src != nil {
+			*dst = strings.TrimSpace(*src)
+		}
+	}
+
+	setString(&h.HostName, in.HostName)
+	setString(&h.CanonicalName, in.CanonicalName)
+	setString(&h.URL, in.URL)
+	setString(&h.IP, in.IP)
+	setString(&h.IPV6, in.IPV6)
+	setString(&h.Location, in.Location)
+	setString(&h.OS, in.OS)
+
+	fields := make(map[string]string)
+	if h.HostName == "" {
+		fields["host_name"] = "is required"
+	}
+	if in.Tags != nil {
+		for k := range *in.Tags {
+			if strings.TrimSpace(k) == "" || strings.ContainsAny(k, "=,\n") {
+				fields["tags"] = fmt.Sprintf("invalid tag key %q", k)
+			}
+		}
+	}
+
+	// groups and parents are checked before anything is saved, so a refused request changes nothing
+	if in.GroupIDs != nil {
+		for _, id := range *in.GroupIDs {
+			_, err := repo.DB.GetHostGroupByID(id)
+			if errors.Is(err, sql.ErrNoRows) {
+				fields["group_ids"] = fmt.Sprintf("there is no host group %d", id)
+			} else if err != nil {
+				apiServerError(w, err)
+				return
+			}
+		}
+	}
+	if in.ParentIDs != nil {
+		for _, id := range *in.ParentIDs {
+			_, err := repo.DB.GetHostByID(id)
+			if errors.Is(err, sql.ErrNoRows) {
+				fields["parent_ids"] = fmt.Sprintf("there is no host %d", id)
+			} else if err != nil {
+				apiServerError(w, err)
+				return
+			}
+		}
+
+		err := repo.DB.CheckHostParents(h.ID, *in.ParentIDs)
+		if errors.Is(err, models.ErrDependencyCycle) {
+			fields["parent_ids"] = "a host cannot depend on itself or on hosts that depend on it"
+		} else if err != nil {
+			apiServerError(w, err)
+			return
+		}
+	}
+
+	if len(fields) > 0 {
+		apiValidationError(w, fields)
+		return
+	}
+
+	active := h.Active
+	if in.Active != nil {
+		active = 0
+		if *in.Active {
+			active = 1
+		}
+	}
+
+	var err error
+	if h.ID > 0 {
+		err = repo.DB.UpdateHost(h)
+		if err == nil && active != h.Active {
+			repo.setHostActive(h, active)
+		}
+	} else {
+		h.Active = active
+		h.ID, err = repo.DB.InsertHost(h)
+	}
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	if in.GroupIDs != nil {
+		err = repo.DB.UpdateHostGroupMembership(h.ID, *in.GroupIDs)
+		if err != nil {
+			apiServerError(w, err)
+			return
+		}
+	}
+
+	if in.Tags != nil {
+		var tags []models.HostTag
+		for k, v := range *in.Tags {
+			tags = append(tags, models.HostTag{Key: strings.TrimSpace(k), Value: strings.TrimSpace(v)})
+		}
+
+		err = repo.DB.UpdateHostTags(h.ID, tags)
+		if err != nil {
+			apiServerError(w, err)
+			return
+		}
+	}
+
+	if in.ParentIDs != nil {
+		err = repo.DB.UpdateHostParents(h.ID, *in.ParentIDs)
+		if errors.Is(err, models.ErrDependencyCycle) {
+			apiValidationError(w, map[string]string{
+				"parent_ids": "a host cannot depend on itself or on hosts that depend on it",
+			})
+			return
+		} else if err != nil {
+			apiServerError(w, err)
+			return
+		}
+	}
+
+	h, err = repo.DB.GetHostByID(h.ID)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	writeAPIData(w, status, toAPIHost(h))
+}
+
+// apiHostFromURL loads the host named by the id url parameter, sending a 404 (and returning false) if there is none
+func (repo *DBRepo) apiHostFromURL(w http.ResponseWriter, r *http.Request) (models.Host, bool) {
+	id, ok := apiIDParam(w, r, "id")
+	if !ok {
+		return models.Host{}, false
+	}
+
+	h, err := repo.DB.GetHostByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		APIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("host %d not found", id))
+		return h, false
+	} else if err != nil {
+		apiServerError(w, err)
+		return h, false
+	}
+
+	return h, true
+}
+
+// apiHostServiceFromURL loads the host service named by the id url parameter, sending a 404 (and returning false) if there is none
+func (repo *DBRepo) apiHostServiceFromURL(w http.ResponseWriter, r *http.Request) (models.HostService, bool) {
+	id, ok := apiIDParam(w, r, "id")
+	if !ok {
+		return models.HostService{}, false
+	}
+
+	hs, err := repo.DB.GetHostServiceByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		APIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("host service %d not found", id))
+		return hs, false
+	} else if err != nil {
+		apiServerError(w, err)
+		return hs, false
+	}
+
+	return hs, true
+}
+
+func validServiceStatus(status string) bool {
+	for _, s := range serviceStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func validScheduleUnit(unit string) bool {
+	switch unit {
+	case "s", "m", "h", "d":
+		return true
+	}
+	return false
+}
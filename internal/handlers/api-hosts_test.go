@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/luksbutz/vigilate/internal/config"
+	"github.com/luksbutz/vigilate/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSaveAPIHostValidatesBeforeSaving(t *testing.T) {
+	name := "router"
+	ids := func(ids ...int) *[]int { return &ids }
+
+	tests := []struct {
+		name      string
+		in        apiHostInput
+		wantField string
+	}{
+		{"unknown group", apiHostInput{HostName: &name, GroupIDs: ids(42)}, "group_ids"},
+		{"unknown parent", apiHostInput{HostName: &name, ParentIDs: ids(42)}, "parent_ids"},
+		{"own parent", apiHostInput{HostName: &name, ParentIDs: ids(1)}, "parent_ids"},
+		{"parent depending on it", apiHostInput{HostName: &name, ParentIDs: ids(2)}, "parent_ids"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			a := &config.AppConfig{}
+			repo := &DBRepo{App: a, DB: db}
+			NewHandlers(repo, a)
+
+			db.hosts[1] = models.Host{ID: 1, HostName: "gateway", Active: 1}
+			db.hosts[2] = models.Host{ID: 2, HostName: "server", Active: 1}
+			db.hostParents[2] = []int{1}
+
+			w := httptest.NewRecorder()
+			repo.saveAPIHost(w, db.hosts[1], tt.in, http.StatusOK)
+
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("got %d, want %d", w.Code, http.StatusUnprocessableEntity)
+			}
+
+			var body apiErrorBody
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Fields[tt.wantField] == "" {
+				t.Errorf("fields %v don't mention %s", body.Error.Fields, tt.wantField)
+			}
+
+			if db.hostsSaved != 0 || db.hosts[1].HostName != "gateway" {
+				t.Errorf("a refused request saved the host: %+v", db.hosts[1])
+			}
+		})
+	}
+}
+
+func TestValidScheduleUnit(t *testing.T) {
+	for unit, want := range map[string]bool{"s": true, "m": true, "h": true, "d": true, "w": false, "": false, "M": false} {
+		if got := validScheduleUnit(unit); got != want {
+			t.Errorf("validScheduleUnit(%q) is %v, want %v", unit, got, want)
+		}
+	}
+}
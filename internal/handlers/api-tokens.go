@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/luksbutz/vigilate/internal/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiTokenPrefix starts every api token, so that leaked tokens are easy to spot
+const apiTokenPrefix = "vgl_"
+
+// PostAPIToken creates an api token for a user. The token is shown once, on the next page load.
+// Whatever its scope, a token can do no more than its user's role allows.
+func (repo *DBRepo) PostAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	if !canManageUser(r, userID) {
+		Forbidden(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	redirect := fmt.Sprintf("/admin/user/%d#api-tokens", userID)
+
+	name := strings.TrimSpace(r.Form.Get("token_name"))
+	if name == "" {
+		repo.App.Session.Put(r.Context(), "error", "Please give the token a name")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	scope := r.Form.Get("scope")
+	if scope != models.APITokenScopeReadWrite {
+		scope = models.APITokenScopeRead
+	}
+
+	plain, hash, err := GenerateAPIToken()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	t := models.APIToken{
+		UserID:      userID,
+		Name:        name,
+		TokenHash:   hash,
+		TokenPrefix: plain[:len(apiTokenPrefix)+6],
+		Scope:       scope,
+	}
+
+	if days, _ := strconv.Atoi(r.Form.Get("expires_days")); days > 0 {
+		t.ExpiresAt = time.Now().AddDate(0, 0, days)
+	}
+
+	_, err = repo.DB.InsertAPIToken(t)
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	repo.App.Session.Put(r.Context(), "api_token", plain)
+	repo.App.Session.Put(r.Context(), "flash", "Token created")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// DeleteAPIToken revokes one of a user's api tokens
+func (repo *DBRepo) DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	tokenID, _ := strconv.Atoi(chi.URLParam(r, "tokenID"))
+	if !canManageUser(r, userID) {
+		Forbidden(w, r)
+		return
+	}
+
+	err := repo.DB.DeleteAPIToken(userID, tokenID)
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	repo.App.Session.Put(r.Context(), "flash", "Token revoked")
+	http.Redirect(w, r, fmt.Sprintf("/admin/user/%d#api-tokens", userID), http.StatusSeeOther)
+}
+
+// GenerateAPIToken returns a new random api token, and the hash to store for it
+func GenerateAPIToken() (string, string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+
+	plain := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	return plain, HashAPIToken(plain), nil
+}
+
+// HashAPIToken returns the hash that is stored for an api token
+func HashAPIToken(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// openAPISpec is the OpenAPI 3 description of the /api/v1 routes
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// maxAPIBodyBytes caps the size of JSON request bodies
+const maxAPIBodyBytes = 1 << 20
+
+// apiEnvelope wraps every successful API response
+type apiEnvelope struct {
+	Data interface{}  `json:"data"`
+	Meta *apiPageMeta `json:"meta,omitempty"`
+}
+
+// apiPageMeta describes one page of a paginated list
+type apiPageMeta struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+// apiErrorBody is the body of every API error response
+type apiErrorBody struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Status  int               `json:"status"`
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// APIError sends a structured JSON error
+func APIError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIError(w, apiErrorDetail{Status: status, Code: code, Message: message})
+}
+
+// APINotFound is the not found handler for the API
+func APINotFound(w http.ResponseWriter, r *http.Request) {
+	APIError(w, http.StatusNotFound, "not_found", "no such endpoint")
+}
+
+// APIMethodNotAllowed is the method not allowed handler for the API
+func APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	APIError(w, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("%s is not allowed here", r.Method))
+}
+
+// OpenAPISpec serves the OpenAPI description of the API
+func (repo *DBRepo) OpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(openAPISpec)
+}
+
+func writeAPIError(w http.ResponseWriter, e apiErrorDetail) {
+	writeJSON(w, e.Status, apiErrorBody{Error: e})
+}
+
+// apiValidationError sends a 422 listing the invalid fields
+func apiValidationError(w http.ResponseWriter, fields map[string]string) {
+	writeAPIError(w, apiErrorDetail{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    "validation_failed",
+		Message: "one or more fields are invalid",
+		Fields:  fields,
+	})
+}
+
+// apiServerError logs err and sends a 500 without leaking the details
+func apiServerError(w http.ResponseWriter, err error) {
+	log.Println(err)
+	APIError(w, http.StatusInternalServerError, "internal_error", "something went wrong")
+}
+
+// writeJSON sends v as indented JSON with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(out)
+}
+
+// writeAPIData sends v wrapped in the data envelope
+func writeAPIData(w http.ResponseWriter, status int, v interface{}) {
+	writeJSON(w, status, apiEnvelope{Data: v})
+}
+
+// readJSON decodes a single JSON object from the request body into dst, and sends
+// a 400 (returning false) if the body is missing, too large or malformed
+func readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err == nil {
+		if dec.Decode(&struct{}{}) != io.EOF {
+			err = errors.New("body must contain a single JSON object")
+		}
+	}
+
+	if err != nil {
+		msg := err.Error()
+		if errors.Is(err, io.EOF) {
+			msg = "request body is empty"
+		}
+		APIError(w, http.StatusBadRequest, "bad_request", strings.TrimPrefix(msg, "json: "))
+		return false
+	}
+
+	return true
+}
+
+// apiIDParam reads a positive integer id from the url, and sends a 404 (returning false) if it isn't one
+func apiIDParam(w http.ResponseWriter, r *http.Request, name string) (int, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, name))
+	if err != nil || id < 1 {
+		APIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("invalid %s", name))
+		return 0, false
+	}
+
+	return id, true
+}
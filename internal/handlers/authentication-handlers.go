@@ -2,8 +2,10 @@ package handlers
 
 import (
 	"crypto/sha256"
+	"database/sql"
 	"encoding/base64"
 	"fmt"
+	"github.com/CloudyKit/jet/v6"
 	"github.com/luksbutz/vigilate/internal/helpers"
 	"github.com/luksbutz/vigilate/internal/models"
 	"log"
@@ -20,7 +22,10 @@ func (repo *DBRepo) LoginScreen(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := helpers.RenderPage(w, r, "login", nil, nil)
+	vars := make(jet.VarMap)
+	vars.Set("target", localTarget(r.URL.Query().Get("target")))
+
+	err := helpers.RenderPage(w, r, "login", vars, nil)
 	if err != nil {
 		printTemplateError(w, err)
 	}
@@ -28,6 +33,10 @@ func (repo *DBRepo) LoginScreen(w http.ResponseWriter, r *http.Request) {
 
 // Login attempts to log the user in
 func (repo *DBRepo) Login(w http.ResponseWriter, r *http.Request) {
+	if !repo.passwordLoginAllowed(w, r) {
+		return
+	}
+
 	_ = repo.App.Session.RenewToken(r.Context())
 	err := r.ParseForm()
 	if err != nil {
@@ -36,20 +45,55 @@ func (repo *DBRepo) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, hash, err := repo.DB.Authenticate(r.Form.Get("email"), r.Form.Get("password"))
+	email := r.Form.Get("email")
+	attempt := models.LoginAttempt{
+		Email:     truncate(email, 255),
+		IPAddress: helpers.ClientIP(r),
+		UserAgent: truncate(r.UserAgent(), 255),
+	}
+
+	known, err := repo.DB.GetUserByEmail(email)
+	if err == nil {
+		attempt.UserID = known.ID
+	} else if err != sql.ErrNoRows {
+		log.Println(err)
+	}
+
+	// wrong passwords count against the account since it was last unlocked
+	since := failureSince(known)
+
+	if known.Locked() {
+		attempt.Reason = models.LoginFailedLocked
+		repo.recordLogin(attempt)
+		repo.loginError(w, r, "This account is locked after too many failed logins; please try again later")
+		return
+	}
+
+	wait, err := repo.loginWait(email, attempt.IPAddress, since)
+	if err != nil {
+		log.Println(err)
+	}
+	if wait > 0 {
+		attempt.Reason = models.LoginFailedThrottled
+		repo.recordLogin(attempt)
+		repo.loginError(w, r, fmt.Sprintf("Too many failed logins; please try again in %d seconds", int(wait.Seconds())+1))
+		return
+	}
+
+	id, hash, err := repo.authenticate(email, r.Form.Get("password"))
 	if err == models.ErrInvalidCredentials {
-		app.Session.Put(r.Context(), "error", "Invalid login")
-		err := helpers.RenderPage(w, r, "login", nil, nil)
-		if err != nil {
-			printTemplateError(w, err)
-		}
+		attempt.Reason = models.LoginFailedPassword
+		repo.recordLogin(attempt)
+		repo.lockIfGuessed(known, attempt, since)
+		repo.loginError(w, r, "Invalid login")
 		return
 	} else if err == models.ErrInactiveAccount {
-		app.Session.Put(r.Context(), "error", "Inactive account!")
-		err := helpers.RenderPage(w, r, "login", nil, nil)
-		if err != nil {
-			printTemplateError(w, err)
-		}
+		attempt.Reason = models.LoginFailedInactive
+		repo.recordLogin(attempt)
+		repo.loginError(w, r, "Inactive account!")
+		return
+	} else if err == errNoRole {
+		repo.loginError(w, r, "Your account has not been given access to vigilate")
 		return
 	} else if err != nil {
 		log.Println(err)
@@ -57,11 +101,54 @@ func (repo *DBRepo) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Form.Get("remember") == "remember" {
+	// we authenticated. Get the user.
+	u, err := repo.DB.GetUserById(id)
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	remember := r.Form.Get("remember") == "remember"
+	target := r.Form.Get("target")
+
+	// with two-factor authentication on, the user isn't logged in, or remembered, until they enter a code
+	if u.TOTPEnabled == 1 {
+		startTwoFactorLogin(r, id, hash, remember, target)
+		http.Redirect(w, r, "/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	repo.completeLogin(w, r, u, hash, remember, target)
+}
+
+// loginError shows the login page again, with an error
+func (repo *DBRepo) loginError(w http.ResponseWriter, r *http.Request, msg string) {
+	app.Session.Put(r.Context(), "error", msg)
+	err := helpers.RenderPage(w, r, "login", nil, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// completeLogin logs in a user who has given everything asked of them
+func (repo *DBRepo) completeLogin(w http.ResponseWriter, r *http.Request, u models.User, hash string, remember bool, target string) {
+	id := u.ID
+
+	// only now, after any second factor, do earlier failures stop counting against the account
+	repo.recordLogin(models.LoginAttempt{
+		Email:     truncate(u.Email, 255),
+		UserID:    id,
+		IPAddress: helpers.ClientIP(r),
+		UserAgent: truncate(r.UserAgent(), 255),
+		Succeeded: true,
+	})
+
+	if remember {
 		randomString := helpers.RandomString(12)
 		hasher := sha256.New()
 
-		_, err = hasher.Write([]byte(randomString))
+		_, err := hasher.Write([]byte(randomString))
 		if err != nil {
 			log.Println(err)
 		}
@@ -73,6 +160,12 @@ func (repo *DBRepo) Login(w http.ResponseWriter, r *http.Request) {
 			log.Println(err)
 		}
 
+		// so that the user can tell their remembered browsers apart
+		err = repo.DB.TouchRememberMeToken(id, sha, helpers.ClientIP(r), r.UserAgent())
+		if err != nil {
+			log.Println(err)
+		}
+
 		// write a cookie
 		expire := time.Now().Add(365 * 24 * 60 * 60 * time.Second)
 		cookie := http.Cookie{
@@ -89,21 +182,15 @@ func (repo *DBRepo) Login(w http.ResponseWriter, r *http.Request) {
 		http.SetCookie(w, &cookie)
 	}
 
-	// we authenticated. Get the user.
-	u, err := repo.DB.GetUserById(id)
-	if err != nil {
-		log.Println(err)
-		ClientError(w, r, http.StatusBadRequest)
-		return
-	}
-
+	// a new session is recorded by the first page the user sees
+	app.Session.Remove(r.Context(), "sessionID")
 	app.Session.Put(r.Context(), "userID", id)
 	app.Session.Put(r.Context(), "hashedPassword", hash)
 	app.Session.Put(r.Context(), "flash", "You've been logged in successfully!")
 	app.Session.Put(r.Context(), "user", u)
 
-	if r.Form.Get("target") != "" {
-		http.Redirect(w, r, r.Form.Get("target"), http.StatusSeeOther)
+	if target != "" {
+		http.Redirect(w, r, target, http.StatusSeeOther)
 		return
 	}
 
@@ -141,6 +228,17 @@ func (repo *DBRepo) Logout(w http.ResponseWriter, r *http.Request) {
 	}
 	http.SetCookie(w, &delCookie)
 
+	userID := app.Session.GetInt(r.Context(), "userID")
+	if sessionID := app.Session.GetInt(r.Context(), "sessionID"); sessionID > 0 {
+		err = repo.DB.DeleteUserSession(userID, sessionID)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	// live update connections were opened with the session; other tabs that are still logged in reconnect
+	disconnectUser(userID)
+
 	_ = app.Session.RenewToken(r.Context())
 	_ = app.Session.Destroy(r.Context())
 	_ = app.Session.RenewToken(r.Context())
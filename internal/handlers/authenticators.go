@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"github.com/luksbutz/vigilate/internal/ldapauth"
+	"github.com/luksbutz/vigilate/internal/models"
+	"log"
+	"strings"
+	"time"
+)
+
+// Authenticator checks the email and password of a login. It returns the user's id and hashed
+// password, models.ErrInvalidCredentials if it doesn't know them, or models.ErrInactiveAccount.
+// The users table is one; an LDAP directory is another.
+type Authenticator interface {
+	Authenticate(email, password string) (int, string, error)
+}
+
+// authenticate checks a login with each of repo.Authenticators in turn, until one knows the user
+func (repo *DBRepo) authenticate(email, password string) (int, string, error) {
+	for _, a := range repo.Authenticators {
+		id, hash, err := a.Authenticate(email, password)
+		switch {
+		case err == nil:
+			return id, hash, nil
+		case err == models.ErrInvalidCredentials:
+			continue
+		case err == models.ErrInactiveAccount || err == errNoRole:
+			return 0, "", err
+		default:
+			// one backend being down shouldn't keep users of the others out
+			log.Println(err)
+		}
+	}
+
+	return 0, "", models.ErrInvalidCredentials
+}
+
+// randomPassword returns a password nobody knows, for accounts whose users log in some other way
+func randomPassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// LDAPAuthenticator logs users in with their password in an LDAP directory. An account is created
+// for a user logging in for the first time; they only get an existing account with their email
+// address if the directory allows linking them.
+type LDAPAuthenticator struct {
+	repo      *DBRepo
+	directory *ldapauth.Directory
+}
+
+// NewLDAPAuthenticator returns an authenticator for the directory
+func NewLDAPAuthenticator(repo *DBRepo, directory *ldapauth.Directory) *LDAPAuthenticator {
+	return &LDAPAuthenticator{repo: repo, directory: directory}
+}
+
+// Authenticate checks the login against the directory, and returns the local user
+func (a *LDAPAuthenticator) Authenticate(email, password string) (int, string, error) {
+	du, err := a.directory.Authenticate(email, password)
+	if err == ldapauth.ErrInvalidCredentials {
+		return 0, "", models.ErrInvalidCredentials
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	u, err := a.localUser(du)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// the password lives in the directory, so there is no hash to keep in the session
+	return u.ID, "", nil
+}
+
+// localUser returns the user for a directory entry, linking or creating it the first time. When
+// roles come from groups, the user's role is brought up to date.
+//
+// An existing account with the entry's email address is only linked when the directory allows it:
+// otherwise whoever can put an address in the directory could take over the account with it, such
+// as the first admin's.
+func (a *LDAPAuthenticator) localUser(du ldapauth.User) (models.User, error) {
+	repo := a.repo
+	roles := a.directory.Roles()
+	level := roles.Level(du.Groups)
+
+	u, err := repo.DB.GetUserByLDAPDN(du.DN)
+	if err == sql.ErrNoRows {
+		if du.Email == "" {
+			log.Printf("LDAP: %s has no email address, so no account can be made for it", du.DN)
+			return u, models.ErrInvalidCredentials
+		}
+
+		u, err = repo.DB.GetUserByEmail(du.Email)
+		if err == sql.ErrNoRows {
+			return a.provision(du, level)
+		} else if err != nil {
+			return u, err
+		}
+
+		if !a.directory.LinkExisting() {
+			log.Printf("LDAP: %s has the email address of user %d, who doesn't log in with LDAP; set ldap_link_existing to link them", du.DN, u.ID)
+			return models.User{}, models.ErrInvalidCredentials
+		}
+
+		err = repo.DB.SetLDAPDN(u.ID, du.DN)
+		if err != nil {
+			return u, err
+		}
+	} else if err != nil {
+		return u, err
+	}
+
+	if u.UserActive != 1 {
+		return u, models.ErrInactiveAccount
+	}
+
+	if roles.FromGroups() {
+		if level == 0 {
+			return u, errNoRole
+		}
+		if level != u.AccessLevel {
+			u.AccessLevel = level
+			u.UpdatedAt = time.Now()
+			err = repo.DB.UpdateUser(u)
+			if err != nil {
+				return u, err
+			}
+		}
+	}
+
+	return u, nil
+}
+
+// provision creates the account of a directory user logging in for the first time. They get a
+// random local password; theirs stays in the directory.
+func (a *LDAPAuthenticator) provision(du ldapauth.User, level int) (models.User, error) {
+	if level == 0 {
+		return models.User{}, errNoRole
+	}
+
+	password, err := randomPassword()
+	if err != nil {
+		return models.User{}, err
+	}
+
+	first := du.FirstName
+	if first == "" && du.LastName == "" {
+		first = strings.Split(du.Email, "@")[0]
+	}
+
+	id, err := a.repo.DB.InsertUser(models.User{
+		FirstName:   first,
+		LastName:    du.LastName,
+		Email:       du.Email,
+		Password:    []byte(password),
+		AccessLevel: level,
+		UserActive:  1,
+	})
+	if err != nil {
+		return models.User{}, err
+	}
+
+	err = a.repo.DB.SetLDAPDN(id, du.DN)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	log.Printf("LDAP: created user %d for %s", id, du.DN)
+
+	return a.repo.DB.GetUserById(id)
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/luksbutz/vigilate/internal/badge"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/uptime"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// badgeCacheTTL is how long browsers and image proxies may cache a badge
+const badgeCacheTTL = time.Minute
+
+// badgeWindows are the periods the uptime badge can cover; the first is the default
+var badgeWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"30d", 30 * 24 * time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"90d", 90 * 24 * time.Hour},
+}
+
+// BadgeStatus serves an SVG badge with the current status of a host service
+func (repo *DBRepo) BadgeStatus(w http.ResponseWriter, r *http.Request) {
+	hs, ok := repo.badgeHostService(w, r)
+	if !ok {
+		return
+	}
+
+	value, color := hs.Status, badge.Grey
+	switch {
+	case hs.Active != 1:
+		value = "paused"
+	case hs.Status == "healthy":
+		value, color = "up", badge.Green
+	case hs.Status == "warning":
+		color = badge.Yellow
+	case hs.Status == "problem":
+		value, color = "down", badge.Red
+	case hs.Status == "unknown":
+		color = badge.Blue
+	case hs.Status == "unreachable":
+		color = badge.Orange
+	}
+
+	writeBadge(w, r, http.StatusOK, badgeLabel(r, hs.Service.ServiceName), value, color)
+}
+
+// BadgeUptime serves an SVG badge with the uptime of a host service over a window given by the
+// window query parameter: 24h, 7d, 30d (the default) or 90d
+func (repo *DBRepo) BadgeUptime(w http.ResponseWriter, r *http.Request) {
+	hs, ok := repo.badgeHostService(w, r)
+	if !ok {
+		return
+	}
+
+	window := badgeWindows[0]
+	for _, bw := range badgeWindows {
+		if r.URL.Query().Get("window") == bw.name {
+			window = bw
+		}
+	}
+
+	now := time.Now()
+	since := now.Add(-window.d)
+
+	events, err := repo.DB.GetEventsForHostServicesSince([]int{hs.ID}, since)
+	if err != nil {
+		log.Println(err)
+		writeBadge(w, r, http.StatusInternalServerError, "uptime", "error", badge.Grey)
+		return
+	}
+
+	value, color := "n/a", badge.Grey
+	if u, ok := uptime.Percent(uptime.FromEvents(events)[hs.ID], since, now); ok {
+		value = formatUptime(u)
+		switch {
+		case u >= 0.999:
+			color = badge.Green
+		case u >= 0.99:
+			color = badge.Yellow
+		case u >= 0.95:
+			color = badge.Orange
+		default:
+			color = badge.Red
+		}
+	}
+
+	writeBadge(w, r, http.StatusOK, badgeLabel(r, "uptime "+window.name), value, color)
+}
+
+// badgeHostService finds the host service for the token in the url, writing a "not found"
+// badge if there is none
+func (repo *DBRepo) badgeHostService(w http.ResponseWriter, r *http.Request) (models.HostService, bool) {
+	hs, err := repo.DB.GetHostServiceByBadgeToken(chi.URLParam(r, "token"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeBadge(w, r, http.StatusNotFound, "badge", "not found", badge.Grey)
+		return hs, false
+	} else if err != nil {
+		log.Println(err)
+		writeBadge(w, r, http.StatusInternalServerError, "badge", "error", badge.Grey)
+		return hs, false
+	}
+
+	return hs, true
+}
+
+// badgeLabel returns the label query parameter, or def if there is none
+func badgeLabel(r *http.Request, def string) string {
+	if l := r.URL.Query().Get("label"); l != "" {
+		if rs := []rune(l); len(rs) > 64 {
+			l = string(rs[:64])
+		}
+		return l
+	}
+	return def
+}
+
+// writeBadge writes a badge with cache headers and an ETag, answering conditional requests
+// for a badge that hasn't changed with 304 Not Modified
+func writeBadge(w http.ResponseWriter, r *http.Request, status int, label, value, color string) {
+	body := badge.Render(label, value, color)
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(badgeCacheTTL.Seconds())))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if status == http.StatusOK && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// NewBadgeToken turns on the badges of a host service, or replaces its badge token so that
+// badge urls handed out before stop working
+func (repo *DBRepo) NewBadgeToken(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	hs, err := repo.DB.GetHostServiceByID(id)
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusNotFound)
+		return
+	}
+
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	err = repo.DB.UpdateHostServiceBadgeToken(hs.ID, base64.RawURLEncoding.EncodeToString(b))
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	repo.App.Session.Put(r.Context(), "flash", "New badge address created")
+	http.Redirect(w, r, fmt.Sprintf("/admin/host/%d#services-content", hs.HostID), http.StatusSeeOther)
+}
+
+// DeleteBadgeToken turns off the badges of a host service
+func (repo *DBRepo) DeleteBadgeToken(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	hs, err := repo.DB.GetHostServiceByID(id)
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusNotFound)
+		return
+	}
+
+	err = repo.DB.UpdateHostServiceBadgeToken(hs.ID, "")
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	repo.App.Session.Put(r.Context(), "flash", "Badges turned off")
+	http.Redirect(w, r, fmt.Sprintf("/admin/host/%d#services-content", hs.HostID), http.StatusSeeOther)
+}
@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/CloudyKit/jet/v6"
+	"github.com/go-chi/chi/v5"
+	"github.com/luksbutz/vigilate/internal/agentapi"
+	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/metrics"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/plugins"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPluginTimeout is used for command checks with no timeout of their own
+	defaultPluginTimeout = 10
+	// maxPluginTimeout caps a command check's timeout, so a hung plugin can't hold up its schedule for long
+	maxPluginTimeout = 300
+	// maxCheckMessage is the longest message that fits in a host service's last message
+	maxCheckMessage = 255
+)
+
+// pluginMacros are the macros that may be used in a command check's arguments
+var pluginMacros = []string{
+	"HOSTNAME", "HOSTADDRESS", "HOSTADDRESS6", "HOSTURL", "SERVICENAME", "WARNING", "CRITICAL",
+}
+
+// testCommandForHost runs the plugin of a command check. A plugin that can't be found or whose
+// arguments can't be read is unknown, like a plugin that exits with code 3.
+func (repo *DBRepo) testCommandForHost(h models.Host, hs models.HostService) (string, string) {
+	path, err := plugins.Resolve(repo.App.PluginDir, hs.Service.Command)
+	if err != nil {
+		return err.Error(), "unknown"
+	}
+
+	args, err := plugins.SplitArgs(hs.Service.Arguments)
+	if err != nil {
+		return fmt.Sprintf("Bad arguments: %s", err), "unknown"
+	}
+	args = plugins.Expand(args, commandMacros(h, hs))
+
+	timeout := time.Duration(pluginTimeout(hs.Service.TimeoutSeconds)) * time.Second
+
+	msg, newStatus, perf := plugins.Check(path, args, timeout)
+
+	samples := make([]metrics.PerfSample, 0, len(perf))
+	for _, p := range perf {
+		samples = append(samples, metrics.PerfSample{Label: p.Label, Unit: p.Unit, Value: p.Value})
+	}
+	metrics.SetPerfData(hs.ID, samples)
+
+	return truncate(msg, maxCheckMessage), newStatus
+}
+
+// commandMacros returns the values of the macros for a host service's plugin
+func commandMacros(h models.Host, hs models.HostService) map[string]string {
+	address := h.IP
+	for _, a := range []string{h.IPV6, h.CanonicalName, h.HostName} {
+		if address == "" {
+			address = a
+		}
+	}
+
+	return map[string]string{
+		"HOSTNAME":     h.HostName,
+		"HOSTADDRESS":  address,
+		"HOSTADDRESS6": h.IPV6,
+		"HOSTURL":      h.URL,
+		"SERVICENAME":  hs.Service.ServiceName,
+		"WARNING":      hs.WarningThreshold,
+		"CRITICAL":     hs.CriticalThreshold,
+	}
+}
+
+// pluginTimeout returns the timeout, in seconds, to run a plugin with
+func pluginTimeout(seconds int) int {
+	if seconds <= 0 {
+		return defaultPluginTimeout
+	}
+	if seconds > maxPluginTimeout {
+		return maxPluginTimeout
+	}
+	return seconds
+}
+
+// isCheckCommand returns true for services that are set up on the check commands pages: those run
+// as a plugin by the server, and those run by agents
+func isCheckCommand(s models.Service) bool {
+	return s.CheckType == models.CheckTypeCommand || s.CheckType == models.CheckTypeAgent
+}
+
+// AllCheckCommands lists the services checked by plugins or agents
+func (repo *DBRepo) AllCheckCommands(w http.ResponseWriter, r *http.Request) {
+	services, err := repo.DB.AllServices()
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	var commands []models.Service
+	for _, s := range services {
+		if isCheckCommand(s) {
+			commands = append(commands, s)
+		}
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("services", commands)
+	vars.Set("pluginDir", repo.App.PluginDir)
+
+	err = helpers.RenderPage(w, r, "check-commands", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// OneCheckCommand shows the form for a check command
+func (repo *DBRepo) OneCheckCommand(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Println(err)
+	}
+
+	s := models.Service{
+		Active:         1,
+		Icon:           "fas fa-terminal",
+		CheckType:      models.CheckTypeCommand,
+		TimeoutSeconds: defaultPluginTimeout,
+	}
+
+	if id > 0 {
+		s, err = repo.DB.GetServiceByID(id)
+		if err != nil || !isCheckCommand(s) {
+			log.Println(err)
+			ClientError(w, r, http.StatusNotFound)
+			return
+		}
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("service", s)
+	vars.Set("pluginDir", repo.App.PluginDir)
+	vars.Set("macros", pluginMacros)
+	vars.Set("agentKinds", agentapi.Kinds)
+
+	err = helpers.RenderPage(w, r, "check-command", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// PostOneCheckCommand saves a check command. A new one is added, inactive, to every host.
+func (repo *DBRepo) PostOneCheckCommand(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	var s models.Service
+	if id > 0 {
+		s, err = repo.DB.GetServiceByID(id)
+		if err != nil || !isCheckCommand(s) {
+			log.Println(err)
+			ClientError(w, r, http.StatusNotFound)
+			return
+		}
+	}
+
+	s.CheckType = models.CheckTypeCommand
+	if r.Form.Get("check_type") == models.CheckTypeAgent {
+		s.CheckType = models.CheckTypeAgent
+	}
+
+	s.ServiceName = strings.TrimSpace(r.Form.Get("service_name"))
+	s.Icon = strings.TrimSpace(r.Form.Get("icon"))
+	s.Command = strings.TrimSpace(r.Form.Get("command"))
+	if s.CheckType == models.CheckTypeAgent {
+		s.Command = r.Form.Get("agent_kind")
+	}
+	s.Arguments = strings.TrimSpace(r.Form.Get("arguments"))
+	s.TimeoutSeconds, _ = strconv.Atoi(r.Form.Get("timeout_seconds"))
+	s.Active = 0
+	if r.Form.Get("active") == "1" {
+		s.Active = 1
+	}
+	if s.Icon == "" {
+		s.Icon = "fas fa-terminal"
+	}
+
+	redirect := fmt.Sprintf("/admin/check-command/%d", id)
+
+	if s.ServiceName == "" || s.Command == "" {
+		repo.App.Session.Put(r.Context(), "error", "Please enter a name and a command")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	other, err := repo.DB.GetServiceByName(s.ServiceName)
+	if err == nil && other.ID != s.ID {
+		repo.App.Session.Put(r.Context(), "error", "A service with this name already exists")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		ServerError(w, r, err)
+		return
+	}
+
+	args, err := plugins.SplitArgs(s.Arguments)
+	if err != nil {
+		repo.App.Session.Put(r.Context(), "error", fmt.Sprintf("Arguments: %s", err))
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	// plugins run by the server must be there now; those run by agents are only on the hosts
+	if s.CheckType == models.CheckTypeCommand {
+		_, err = plugins.Resolve(repo.App.PluginDir, s.Command)
+	} else {
+		err = validateAgentCheck(s.Command, args)
+	}
+	if err != nil {
+		repo.App.Session.Put(r.Context(), "error", fmt.Sprintf("Command: %s", err))
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if s.TimeoutSeconds < 1 || s.TimeoutSeconds > maxPluginTimeout {
+		repo.App.Session.Put(r.Context(), "error",
+			fmt.Sprintf("Please enter a timeout from 1 to %d seconds", maxPluginTimeout))
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if s.ID == 0 {
+		s.ID, err = repo.DB.InsertService(s)
+		if err != nil {
+			ServerError(w, r, err)
+			return
+		}
+
+		err = repo.DB.AddServiceToAllHosts(s.ID)
+		if err != nil {
+			ServerError(w, r, err)
+			return
+		}
+	} else {
+		err = repo.DB.UpdateService(s)
+		if err != nil {
+			ServerError(w, r, err)
+			return
+		}
+	}
+
+	repo.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/check-command/%d", s.ID), http.StatusSeeOther)
+}
+
+// validateAgentCheck checks that an agent check is of a known kind, and has the arguments it needs
+func validateAgentCheck(kind string, args []string) error {
+	if !agentapi.ValidKind(kind) {
+		return fmt.Errorf("agents can't run %s checks", kind)
+	}
+
+	switch kind {
+	case agentapi.KindProcess:
+		if len(args) == 0 {
+			return errors.New("enter the name of the process as the argument")
+		}
+	case agentapi.KindFileAge:
+		if len(args) == 0 {
+			return errors.New("enter the path of the file as the argument")
+		}
+	case agentapi.KindPlugin:
+		if len(args) == 0 {
+			return errors.New("enter the plugin, and its arguments, as the arguments")
+		}
+	}
+
+	return nil
+}
+
+// DeleteCheckCommand deletes a check command, and takes it off every host
+func (repo *DBRepo) DeleteCheckCommand(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	s, err := repo.DB.GetServiceByID(id)
+	if err != nil || !isCheckCommand(s) {
+		log.Println(err)
+		ClientError(w, r, http.StatusNotFound)
+		return
+	}
+
+	// stop checking it before its host services go away
+	hosts, err := repo.DB.AllHosts()
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	for _, h := range hosts {
+		hs, err := repo.DB.GetHostServiceByHostIDServiceID(h.ID, s.ID)
+		if err == nil && hs.Active == 1 {
+			repo.removeFromMonitorMap(hs)
+			metrics.SetPerfData(hs.ID, nil)
+		}
+	}
+
+	err = repo.DB.DeleteService(s.ID)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	repo.App.Session.Put(r.Context(), "flash", "Check command deleted")
+	http.Redirect(w, r, "/admin/check-commands", http.StatusSeeOther)
+}
+
+// UpdateThresholds saves the warning and critical thresholds of a command or agent check
+func (repo *DBRepo) UpdateThresholds(w http.ResponseWriter, r *http.Request) {
+	var resp jsonResp
+	resp.OK = true
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		resp.OK = false
+	}
+
+	id, _ := strconv.Atoi(r.Form.Get("host_service_id"))
+
+	hs, err := repo.DB.GetHostServiceByID(id)
+	if err != nil || !isCheckCommand(hs.Service) {
+		log.Println(err)
+		resp.OK = false
+		resp.Message = "Command check not found"
+	}
+
+	warning := strings.TrimSpace(r.Form.Get("warning_threshold"))
+	critical := strings.TrimSpace(r.Form.Get("critical_threshold"))
+
+	if resp.OK && (len(warning) > 255 || len(critical) > 255) {
+		resp.OK = false
+		resp.Message = "Thresholds can be at most 255 characters"
+	}
+
+	if resp.OK {
+		err = repo.DB.UpdateHostServiceThresholds(hs.ID, warning, critical)
+		if err != nil {
+			log.Println(err)
+			resp.OK = false
+			resp.Message = "Something went wrong"
+		}
+	}
+
+	out, _ := json.MarshalIndent(resp, "", "\t")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
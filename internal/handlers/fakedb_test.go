@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"database/sql"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/repository"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeDB keeps users in memory, for testing logins without postgres. Only the methods the tests
+// need are here; the others panic, through the nil DatabaseRepo it embeds.
+type fakeDB struct {
+	repository.DatabaseRepo
+
+	mu           sync.Mutex
+	users        map[int]models.User
+	oidcSubjects map[int]string
+	ldapDNs      map[int]string
+	attempts     []models.LoginAttempt
+	// resetsCounted are the users whose password reset links were counted, before sending another
+	resetsCounted []int
+	// hosts, hostGroups and hostParents are the hosts and groups there are, and the parents of
+	// each host; hostsSaved counts the hosts inserted or updated
+	hosts       map[int]models.Host
+	hostGroups  map[int]models.HostGroup
+	hostParents map[int][]int
+	hostsSaved  int
+	// totpSecrets, totpSteps and recoveryCodes are each user's two-factor secret, the last time
+	// step used, and the hashes of their unused recovery codes
+	totpSecrets   map[int]string
+	totpSteps     map[int]int64
+	recoveryCodes map[int][]string
+	nextID        int
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		users:         make(map[int]models.User),
+		oidcSubjects:  make(map[int]string),
+		ldapDNs:       make(map[int]string),
+		hosts:         make(map[int]models.Host),
+		hostGroups:    make(map[int]models.HostGroup),
+		hostParents:   make(map[int][]int),
+		totpSecrets:   make(map[int]string),
+		totpSteps:     make(map[int]int64),
+		recoveryCodes: make(map[int][]string),
+		nextID:        1,
+	}
+}
+
+// addUser adds a user with a local password, and returns it with its id
+func (db *fakeDB) addUser(u models.User) models.User {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u.ID = db.nextID
+	db.nextID++
+	db.users[u.ID] = u
+
+	return u
+}
+
+func (db *fakeDB) GetUserById(id int) (models.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u, ok := db.users[id]
+	if !ok {
+		return u, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+func (db *fakeDB) GetUserByEmail(email string) (models.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, u := range db.users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+func (db *fakeDB) InsertUser(u models.User) (int, error) {
+	return db.addUser(u).ID, nil
+}
+
+func (db *fakeDB) UpdateUser(u models.User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	existing, ok := db.users[u.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	// like the real one, this leaves the password alone
+	u.Password = existing.Password
+	db.users[u.ID] = u
+
+	return nil
+}
+
+func (db *fakeDB) GetUserByOIDCSubject(subject string) (models.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for id, s := range db.oidcSubjects {
+		if s == subject {
+			return db.users[id], nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+func (db *fakeDB) SetOIDCSubject(userID int, subject string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.oidcSubjects[userID] = subject
+	return nil
+}
+
+func (db *fakeDB) InsertLoginAttempt(a models.LoginAttempt) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = time.Now()
+	}
+	db.attempts = append(db.attempts, a)
+	return nil
+}
+
+// CountLoginFailures counts wrong passwords and codes for an address after since and its last
+// successful login, like the real one
+func (db *fakeDB) CountLoginFailures(email string, since time.Time) (int, time.Time, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, a := range db.attempts {
+		if a.Succeeded && strings.EqualFold(a.Email, email) && a.CreatedAt.After(since) {
+			since = a.CreatedAt
+		}
+	}
+
+	return db.countFailures(since, func(a models.LoginAttempt) bool { return strings.EqualFold(a.Email, email) })
+}
+
+func (db *fakeDB) CountLoginFailuresFromIP(ip string, since time.Time) (int, time.Time, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.countFailures(since, func(a models.LoginAttempt) bool { return a.IPAddress == ip })
+}
+
+// countFailures counts the wrong passwords and codes after since that match, and returns when the
+// latest was, or since if there were none
+func (db *fakeDB) countFailures(since time.Time, match func(a models.LoginAttempt) bool) (int, time.Time, error) {
+	n, last := 0, since
+	for _, a := range db.attempts {
+		if !match(a) || !a.CreatedAt.After(since) ||
+			(a.Reason != models.LoginFailedPassword && a.Reason != models.LoginFailedTwoFactor) {
+			continue
+		}
+		n++
+		if a.CreatedAt.After(last) {
+			last = a.CreatedAt
+		}
+	}
+	return n, last, nil
+}
+
+func (db *fakeDB) GetUserByLDAPDN(dn string) (models.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for id, d := range db.ldapDNs {
+		if d == dn {
+			return db.users[id], nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+func (db *fakeDB) SetLDAPDN(userID int, dn string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.ldapDNs[userID] = dn
+	return nil
+}
+
+func (db *fakeDB) IsLDAPUser(userID int) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.ldapDNs[userID] != "", nil
+}
+
+func (db *fakeDB) IsOIDCUser(userID int) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.oidcSubjects[userID] != "", nil
+}
+
+// CountPasswordResetsSince says the user has had all the links they may have, so none is sent
+func (db *fakeDB) CountPasswordResetsSince(userID int, since time.Time) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.resetsCounted = append(db.resetsCounted, userID)
+	return passwordResetLimit, nil
+}
+
+func (db *fakeDB) GetHostByID(id int) (models.Host, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	h, ok := db.hosts[id]
+	if !ok {
+		return h, sql.ErrNoRows
+	}
+	return h, nil
+}
+
+func (db *fakeDB) GetHostGroupByID(id int) (models.HostGroup, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	g, ok := db.hostGroups[id]
+	if !ok {
+		return g, sql.ErrNoRows
+	}
+	return g, nil
+}
+
+// CheckHostParents refuses a host as its own parent, or as a parent of one of its parents
+func (db *fakeDB) CheckHostParents(hostID int, parentIDs []int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, id := range parentIDs {
+		if id == hostID {
+			return models.ErrDependencyCycle
+		}
+		for _, grandparent := range db.hostParents[id] {
+			if grandparent == hostID {
+				return models.ErrDependencyCycle
+			}
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) UpdateHost(h models.Host) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.hosts[h.ID] = h
+	db.hostsSaved++
+	return nil
+}
+
+func (db *fakeDB) InsertHost(h models.Host) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	h.ID = db.nextID
+	db.nextID++
+	db.hosts[h.ID] = h
+	db.hostsSaved++
+	return h.ID, nil
+}
+
+func (db *fakeDB) GetTOTPSecret(userID int) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.totpSecrets[userID], nil
+}
+
+// UseTOTPStep accepts a step after the last one used, like the real one
+func (db *fakeDB) UseTOTPStep(userID int, step int64) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if step <= db.totpSteps[userID] {
+		return false, nil
+	}
+	db.totpSteps[userID] = step
+	return true, nil
+}
+
+func (db *fakeDB) UseRecoveryCode(userID int, hash string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i, h := range db.recoveryCodes[userID] {
+		if h == hash {
+			db.recoveryCodes[userID] = append(db.recoveryCodes[userID][:i], db.recoveryCodes[userID][i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -13,8 +13,10 @@ import (
 	"github.com/luksbutz/vigilate/internal/repository/dbrepo"
 	"log"
 	"net/http"
+	"net/url"
 	"runtime/debug"
 	"strconv"
+	"strings"
 )
 
 //Repo is the repository
@@ -25,6 +27,8 @@ var app *config.AppConfig
 type DBRepo struct {
 	App *config.AppConfig
 	DB  repository.DatabaseRepo
+	// Authenticators check password logins, in order
+	Authenticators []Authenticator
 }
 
 // NewHandlers creates the handlers
@@ -35,10 +39,12 @@ func NewHandlers(repo *DBRepo, a *config.AppConfig) {
 
 // NewPostgresqlHandlers creates db repo for postgres
 func NewPostgresqlHandlers(db *driver.DB, a *config.AppConfig) *DBRepo {
-	return &DBRepo{
+	repo := &DBRepo{
 		App: a,
 		DB:  dbrepo.NewPostgresRepo(db.SQL, a),
 	}
+	repo.Authenticators = []Authenticator{repo.DB}
+	return repo
 }
 
 // AdminDashboard displays the dashboard
@@ -49,7 +55,7 @@ func (repo *DBRepo) AdminDashboard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	healthy, warning, problem, pending, err := repo.DB.GetAllServiceStatusCounts()
+	healthy, warning, problem, pending, unknown, unreachable, err := repo.DB.GetAllServiceStatusCounts()
 	if err != nil {
 		log.Println(err)
 		return
@@ -60,8 +66,16 @@ func (repo *DBRepo) AdminDashboard(w http.ResponseWriter, r *http.Request) {
 	vars.Set("no_warning", warning)
 	vars.Set("no_problem", problem)
 	vars.Set("no_pending", pending)
+	vars.Set("no_unknown", unknown)
+	vars.Set("no_unreachable", unreachable)
 	vars.Set("hosts", hosts)
 
+	groups, err := repo.DB.AllHostGroups()
+	if err != nil {
+		log.Println(err)
+	}
+	vars.Set("groups", groups)
+
 	err = helpers.RenderPage(w, r, "dashboard", vars, nil)
 	if err != nil {
 		printTemplateError(w, err)
@@ -98,6 +112,7 @@ func (repo *DBRepo) PostSettings(w http.ResponseWriter, r *http.Request) {
 	prefMap := make(map[string]string)
 
 	prefMap["site_url"] = r.Form.Get("site_url")
+	prefMap["alertmanager_create"] = r.Form.Get("alertmanager_create")
 	prefMap["notify_name"] = r.Form.Get("notify_name")
 	prefMap["notify_email"] = r.Form.Get("notify_email")
 	prefMap["smtp_server"] = r.Form.Get("smtp_server")
@@ -109,16 +124,42 @@ func (repo *DBRepo) PostSettings(w http.ResponseWriter, r *http.Request) {
 	prefMap["twilio_phone_number"] = r.Form.Get("twilio_phone_number")
 	prefMap["twilio_sid"] = r.Form.Get("twilio_sid")
 	prefMap["twilio_auth_token"] = r.Form.Get("twilio_auth_token")
+	prefMap["vonage_api_key"] = r.Form.Get("vonage_api_key")
+	prefMap["vonage_api_secret"] = r.Form.Get("vonage_api_secret")
+	prefMap["vonage_from"] = r.Form.Get("vonage_from")
+	prefMap["messagebird_access_key"] = r.Form.Get("messagebird_access_key")
+	prefMap["messagebird_originator"] = r.Form.Get("messagebird_originator")
+	prefMap["sms_http_url"] = r.Form.Get("sms_http_url")
+	prefMap["sms_http_method"] = r.Form.Get("sms_http_method")
+	prefMap["sms_http_content_type"] = r.Form.Get("sms_http_content_type")
+	prefMap["sms_http_body"] = r.Form.Get("sms_http_body")
+	prefMap["sms_http_auth_header"] = r.Form.Get("sms_http_auth_header")
 	prefMap["smtp_from_email"] = r.Form.Get("smtp_from_email")
 	prefMap["smtp_from_name"] = r.Form.Get("smtp_from_name")
 	prefMap["notify_via_sms"] = r.Form.Get("notify_via_sms")
 	prefMap["notify_via_email"] = r.Form.Get("notify_via_email")
+	prefMap["notify_via_push"] = r.Form.Get("notify_via_push")
+	prefMap["notify_group_seconds"] = r.Form.Get("notify_group_seconds")
 	prefMap["sms_notify_number"] = r.Form.Get("sms_notify_number")
+	prefMap["two_factor_policy"] = r.Form.Get("two_factor_policy")
+	prefMap["lockout_attempts"] = r.Form.Get("lockout_attempts")
+	prefMap["lockout_minutes"] = r.Form.Get("lockout_minutes")
 
 	if r.Form.Get("sms_enabled") == "0" {
 		prefMap["notify_via_sms"] = "0"
 	}
 
+	if prefMap["two_factor_policy"] != models.TwoFactorAdmins && prefMap["two_factor_policy"] != models.TwoFactorEveryone {
+		prefMap["two_factor_policy"] = models.TwoFactorOptional
+	}
+
+	if n, err := strconv.Atoi(prefMap["lockout_attempts"]); err != nil || n < 0 {
+		prefMap["lockout_attempts"] = strconv.Itoa(defaultLockoutAttempts)
+	}
+	if n, err := strconv.Atoi(prefMap["lockout_minutes"]); err != nil || n <= 0 {
+		prefMap["lockout_minutes"] = strconv.Itoa(defaultLockoutMinutes)
+	}
+
 	err := repo.DB.InsertOrUpdateSitePreferences(prefMap)
 	if err != nil {
 		log.Println(err)
@@ -142,8 +183,9 @@ func (repo *DBRepo) PostSettings(w http.ResponseWriter, r *http.Request) {
 
 // AllHosts displays list of all hosts
 func (repo *DBRepo) AllHosts(w http.ResponseWriter, r *http.Request) {
-	// get all hosts from database
-	hosts, err := repo.DB.AllHosts()
+	// get all hosts (matching the group/tag filter) from database
+	filter := hostFilterFromRequest(r)
+	hosts, err := repo.DB.FilterHosts(filter)
 	if err != nil {
 		log.Println(err)
 		return
@@ -151,6 +193,7 @@ func (repo *DBRepo) AllHosts(w http.ResponseWriter, r *http.Request) {
 
 	vars := make(jet.VarMap)
 	vars.Set("hosts", hosts)
+	repo.setFilterVars(vars, filter)
 
 	// send data to template
 	err = helpers.RenderPage(w, r, "hosts", vars, nil)
@@ -176,10 +219,61 @@ func (repo *DBRepo) Host(w http.ResponseWriter, r *http.Request) {
 		h = host
 	}
 
+	// dependency tree
+	ancestors, err := repo.DB.GetHostAncestors(h.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	children, err := repo.DB.GetHostChildren(h.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// all other hosts, to choose parents from
+	allHosts, err := repo.DB.AllHosts()
+	if err != nil {
+		log.Println(err)
+	}
+
+	var candidates []models.Host
+	for _, x := range allHosts {
+		if x.ID != h.ID {
+			candidates = append(candidates, x)
+		}
+	}
+
+	isParent := make(map[int]bool)
+	for _, id := range h.ParentIDs {
+		isParent[id] = true
+	}
+
+	groups, err := repo.DB.AllHostGroups()
+	if err != nil {
+		log.Println(err)
+	}
+
+	memberOf := make(map[int]bool)
+	var tags []string
+	for _, g := range h.Groups {
+		memberOf[g.ID] = true
+	}
+	for _, t := range h.Tags {
+		tags = append(tags, t.String())
+	}
+
 	vars := make(jet.VarMap)
 	vars.Set("host", h)
-
-	err := helpers.RenderPage(w, r, "host", vars, nil)
+	vars.Set("ancestors", ancestors)
+	vars.Set("children", children)
+	vars.Set("candidates", candidates)
+	vars.Set("isParent", isParent)
+	vars.Set("groups", groups)
+	vars.Set("memberOf", memberOf)
+	vars.Set("tags", strings.Join(tags, "\n"))
+	vars.Set("newAgentToken", repo.App.Session.PopString(r.Context(), "agent_token"))
+
+	err = helpers.RenderPage(w, r, "host", vars, nil)
 	if err != nil {
 		printTemplateError(w, err)
 	}
@@ -232,6 +326,43 @@ func (repo *DBRepo) PostHost(w http.ResponseWriter, r *http.Request) {
 		h.ID = newID
 	}
 
+	// groups and tags
+	var groupIDs []int
+	for _, x := range r.Form["group_ids"] {
+		groupID, _ := strconv.Atoi(x)
+		if groupID > 0 {
+			groupIDs = append(groupIDs, groupID)
+		}
+	}
+
+	err = repo.DB.UpdateHostGroupMembership(h.ID, groupIDs)
+	if err != nil {
+		log.Println(err)
+	}
+
+	err = repo.DB.UpdateHostTags(h.ID, parseTags(r.Form.Get("tags")))
+	if err != nil {
+		log.Println(err)
+	}
+
+	// parent hosts
+	var parentIDs []int
+	for _, x := range r.Form["parent_ids"] {
+		parentID, _ := strconv.Atoi(x)
+		if parentID > 0 {
+			parentIDs = append(parentIDs, parentID)
+		}
+	}
+
+	err = repo.DB.UpdateHostParents(h.ID, parentIDs)
+	if err == models.ErrDependencyCycle {
+		repo.App.Session.Put(r.Context(), "error", "A host cannot depend on itself or on hosts that depend on it")
+		http.Redirect(w, r, fmt.Sprintf("/admin/host/%d", h.ID), http.StatusSeeOther)
+		return
+	} else if err != nil {
+		log.Println(err)
+	}
+
 	repo.App.Session.Put(r.Context(), "flash", "Changes saved")
 	http.Redirect(w, r, fmt.Sprintf("/admin/host/%d", h.ID), http.StatusSeeOther)
 }
@@ -261,6 +392,11 @@ func (repo *DBRepo) OneUser(w http.ResponseWriter, r *http.Request) {
 		log.Println(err)
 	}
 
+	if !canManageUser(r, id) {
+		Forbidden(w, r)
+		return
+	}
+
 	vars := make(jet.VarMap)
 
 	if id > 0 {
@@ -272,24 +408,60 @@ func (repo *DBRepo) OneUser(w http.ResponseWriter, r *http.Request) {
 		}
 
 		vars.Set("user", u)
+
+		tokens, err := repo.DB.AllAPITokensForUser(id)
+		if err != nil {
+			log.Println(err)
+		}
+		vars.Set("tokens", tokens)
+
+		codesLeft, err := repo.DB.CountRecoveryCodes(id)
+		if err != nil {
+			log.Println(err)
+		}
+		vars.Set("recoveryCodesLeft", codesLeft)
+		vars.Set("twoFactorRequired", u.NeedsTwoFactor(repo.App.PreferenceMap["two_factor_policy"]))
 	} else {
 		var u models.User
 		vars.Set("user", u)
+		vars.Set("tokens", []models.APIToken{})
+		vars.Set("recoveryCodesLeft", 0)
+		vars.Set("twoFactorRequired", false)
 	}
 
+	vars.Set("newToken", repo.App.Session.PopString(r.Context(), "api_token"))
+	vars.Set("recoveryCodes", strings.Fields(repo.App.Session.PopString(r.Context(), "recovery_codes")))
+	vars.Set("roles", models.Roles)
+
 	err = helpers.RenderPage(w, r, "user", vars, nil)
 	if err != nil {
 		printTemplateError(w, err)
 	}
 }
 
-// PostOneUser adds/edits a user
+// PostOneUser adds/edits a user. Only admins set roles and status, and never their own, so
+// that there is always an admin left.
 func (repo *DBRepo) PostOneUser(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		log.Println(err)
 	}
 
+	if !canManageUser(r, id) {
+		Forbidden(w, r)
+		return
+	}
+
+	current, _ := helpers.CurrentUser(r)
+	setsAccess := current.IsAdmin() && id != current.ID
+
+	accessLevel, _ := strconv.Atoi(r.Form.Get("access_level"))
+	if setsAccess && !models.ValidAccessLevel(accessLevel) {
+		repo.App.Session.Put(r.Context(), "error", "Please choose a role")
+		http.Redirect(w, r, fmt.Sprintf("/admin/user/%d", id), http.StatusSeeOther)
+		return
+	}
+
 	var u models.User
 
 	if id > 0 {
@@ -297,7 +469,10 @@ func (repo *DBRepo) PostOneUser(w http.ResponseWriter, r *http.Request) {
 		u.FirstName = r.Form.Get("first_name")
 		u.LastName = r.Form.Get("last_name")
 		u.Email = r.Form.Get("email")
-		u.UserActive, _ = strconv.Atoi(r.Form.Get("user_active"))
+		if setsAccess {
+			u.UserActive, _ = strconv.Atoi(r.Form.Get("user_active"))
+			u.AccessLevel = accessLevel
+		}
 		err := repo.DB.UpdateUser(u)
 		if err != nil {
 			log.Println(err)
@@ -314,13 +489,18 @@ func (repo *DBRepo) PostOneUser(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		}
+
+		// a deactivated user loses their live updates at once, not just their next page
+		if u.UserActive == 0 && app.Hub != nil {
+			app.Hub.DisconnectUser(id)
+		}
 	} else {
 		u.FirstName = r.Form.Get("first_name")
 		u.LastName = r.Form.Get("last_name")
 		u.Email = r.Form.Get("email")
 		u.UserActive, _ = strconv.Atoi(r.Form.Get("user_active"))
 		u.Password = []byte(r.Form.Get("password"))
-		u.AccessLevel = 3
+		u.AccessLevel = accessLevel
 
 		_, err := repo.DB.InsertUser(u)
 		if err != nil {
@@ -331,17 +511,39 @@ func (repo *DBRepo) PostOneUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	repo.App.Session.Put(r.Context(), "flash", "Changes saved")
+	if !current.IsAdmin() {
+		http.Redirect(w, r, fmt.Sprintf("/admin/user/%d", id), http.StatusSeeOther)
+		return
+	}
 	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
 }
 
 // DeleteUser soft deletes a user
 func (repo *DBRepo) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	current, _ := helpers.CurrentUser(r)
+	if id == current.ID {
+		repo.App.Session.Put(r.Context(), "error", "You can't delete your own account")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
 	_ = repo.DB.DeleteUser(id)
+	if app.Hub != nil {
+		app.Hub.DisconnectUser(id)
+	}
 	repo.App.Session.Put(r.Context(), "flash", "User deleted")
 	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
 }
 
+// canManageUser reports whether the logged in user may see and change the account with the given
+// id: admins may change anyone, everyone else only themselves
+func canManageUser(r *http.Request, id int) bool {
+	u, _ := helpers.CurrentUser(r)
+	return u.IsAdmin() || (id > 0 && id == u.ID)
+}
+
 type serviceJSON struct {
 	OK bool `json:"ok"`
 }
@@ -399,6 +601,29 @@ func ClientError(w http.ResponseWriter, r *http.Request, status int) {
 	}
 }
 
+// Forbidden tells a user that their role doesn't allow what they asked for: in json when the page
+// asked from a script, otherwise with an error on the page they came from
+func Forbidden(w http.ResponseWriter, r *http.Request) {
+	msg := "You don't have permission to do that"
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		out, _ := json.MarshalIndent(jsonResp{OK: false, Message: msg}, "", "\t")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write(out)
+		return
+	}
+
+	// go back, unless that is where they were refused, e.g. a link typed in by hand
+	back := "/admin/overview"
+	if ref, err := url.Parse(r.Referer()); err == nil && strings.HasPrefix(ref.Path, "/admin/") && ref.Path != r.URL.Path {
+		back = ref.RequestURI()
+	}
+
+	app.Session.Put(r.Context(), "error", msg)
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
 // ServerError will display error page for internal server error
 func ServerError(w http.ResponseWriter, r *http.Request, err error) {
 	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
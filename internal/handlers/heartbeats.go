@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/luksbutz/vigilate/internal/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPingMessage caps the length of the message sent with a ping
+const maxPingMessage = 1000
+
+// pingStatuses are the statuses a ping may report
+var pingStatuses = []string{"healthy", "warning", "problem"}
+
+// pingInput is the JSON body of a ping
+type pingInput struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// pingResult is sent back for a ping
+type pingResult struct {
+	HostServiceID int       `json:"host_service_id"`
+	Status        string    `json:"status"`
+	Message       string    `json:"message"`
+	ReceivedAt    time.Time `json:"received_at"`
+}
+
+// testHeartbeat checks that a heartbeat was pinged in time. While it was, the status is the one
+// the last ping reported.
+func (repo *DBRepo) testHeartbeat(hs models.HostService) (string, string) {
+	yearOne := time.Date(0001, 1, 1, 0, 0, 1, 0, time.UTC)
+	if !hs.LastPing.After(yearOne) {
+		return "Waiting for the first ping", "pending"
+	}
+
+	due := hs.LastPing.Add(scheduleDuration(hs.ScheduleNumber, hs.ScheduleUnit))
+	if time.Now().After(due.Add(scheduleDuration(hs.GraceNumber, hs.GraceUnit))) {
+		return fmt.Sprintf("No ping since %s", hs.LastPing.Format("2006-01-02 15:04:05")), "problem"
+	}
+
+	return hs.LastMessage, hs.Status
+}
+
+// Ping records a ping for a heartbeat from an outside job. It takes an optional status (healthy,
+// warning or problem; healthy if left out) and message, as form values or as a JSON object.
+func (repo *DBRepo) Ping(w http.ResponseWriter, r *http.Request) {
+	hs, err := repo.DB.GetHostServiceByPingToken(chi.URLParam(r, "token"))
+	if errors.Is(err, sql.ErrNoRows) {
+		APIError(w, http.StatusNotFound, "not_found", "no heartbeat has this ping url")
+		return
+	} else if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	var in pingInput
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") && r.ContentLength != 0 {
+		if !readJSON(w, r, &in) {
+			return
+		}
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodyBytes)
+		if err := r.ParseForm(); err != nil {
+			APIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		in.Status = r.Form.Get("status")
+		in.Message = r.Form.Get("message")
+	}
+
+	status := strings.ToLower(strings.TrimSpace(in.Status))
+	if status == "" {
+		status = "healthy"
+	}
+	if !validPingStatus(status) {
+		apiValidationError(w, map[string]string{"status": "must be one of " + strings.Join(pingStatuses, ", ")})
+		return
+	}
+
+	msg := strings.TrimSpace(in.Message)
+	if msg == "" {
+		msg = "Ping received"
+	}
+	if rs := []rune(msg); len(rs) > maxPingMessage {
+		msg = string(rs[:maxPingMessage])
+	}
+
+	now := time.Now()
+	err = repo.DB.UpdateHostServiceLastPing(hs.ID, now)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	h, err := repo.DB.GetHostByID(hs.HostID)
+	if err != nil {
+		apiServerError(w, err)
+		return
+	}
+
+	// a paused heartbeat keeps track of pings, but its status doesn't change
+	if hs.Active == 1 && h.Active == 1 {
+		msg, status = repo.applyPassiveResult(h, hs, msg, status)
+	} else {
+		msg, status = hs.LastMessage, hs.Status
+	}
+
+	writeAPIData(w, http.StatusOK, pingResult{
+		HostServiceID: hs.ID,
+		Status:        status,
+		Message:       msg,
+		ReceivedAt:    now,
+	})
+}
+
+func validPingStatus(s string) bool {
+	for _, x := range pingStatuses {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
+
+// NewPingToken gives a heartbeat a new ping url; the old one stops working
+func (repo *DBRepo) NewPingToken(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	hs, err := repo.DB.GetHostServiceByID(id)
+	if err != nil || hs.ServiceID != Heartbeat {
+		log.Println(err)
+		ClientError(w, r, http.StatusNotFound)
+		return
+	}
+
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	err = repo.DB.UpdateHostServicePingToken(hs.ID, base64.RawURLEncoding.EncodeToString(b))
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	repo.App.Session.Put(r.Context(), "flash", "New ping url created")
+	http.Redirect(w, r, fmt.Sprintf("/admin/host/%d#services-content", hs.HostID), http.StatusSeeOther)
+}
+
+// UpdateHeartbeat saves how often a heartbeat expects to be pinged, and how late a ping may be
+func (repo *DBRepo) UpdateHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var resp jsonResp
+	resp.OK = true
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		resp.OK = false
+	}
+
+	id, _ := strconv.Atoi(r.Form.Get("host_service_id"))
+
+	hs, err := repo.DB.GetHostServiceByID(id)
+	if err != nil || hs.ServiceID != Heartbeat {
+		log.Println(err)
+		resp.OK = false
+		resp.Message = "Heartbeat not found"
+	}
+
+	hs.ScheduleNumber, _ = strconv.Atoi(r.Form.Get("schedule_number"))
+	hs.ScheduleUnit = r.Form.Get("schedule_unit")
+	hs.GraceNumber, _ = strconv.Atoi(r.Form.Get("grace_number"))
+	hs.GraceUnit = r.Form.Get("grace_unit")
+
+	if resp.OK && (hs.ScheduleNumber < 1 || hs.GraceNumber < 0 ||
+		!validScheduleUnit(hs.ScheduleUnit) || !validScheduleUnit(hs.GraceUnit)) {
+		resp.OK = false
+		resp.Message = "Please enter a whole number of seconds, minutes or hours"
+	}
+
+	if resp.OK {
+		err = repo.DB.UpdateHostServiceHeartbeat(hs)
+		if err != nil {
+			log.Println(err)
+			resp.OK = false
+			resp.Message = "Something went wrong"
+		}
+	}
+
+	// reschedule, since the check runs more often for short intervals
+	if resp.OK && hs.Active == 1 {
+		repo.removeFromMonitorMap(hs)
+		repo.addToMonitorMap(hs)
+	}
+
+	out, _ := json.MarshalIndent(resp, "", "\t")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
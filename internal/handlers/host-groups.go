@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/CloudyKit/jet/v6"
+	"github.com/go-chi/chi/v5"
+	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/models"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// AllHostGroups lists all host groups with their status counts
+func (repo *DBRepo) AllHostGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := repo.DB.AllHostGroups()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("groups", groups)
+
+	err = helpers.RenderPage(w, r, "host-groups", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// HostGroup shows the host group add/edit page, with its hosts and bulk actions
+func (repo *DBRepo) HostGroup(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	var g models.HostGroup
+	var hosts []models.Host
+
+	if id > 0 {
+		group, err := repo.DB.GetHostGroupByID(id)
+		if err != nil {
+			log.Println(err)
+			ClientError(w, r, http.StatusBadRequest)
+			return
+		}
+		g = group
+
+		hosts, err = repo.DB.FilterHosts(models.HostFilter{GroupID: g.ID})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	services, err := repo.DB.AllServices()
+	if err != nil {
+		log.Println(err)
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("group", g)
+	vars.Set("hosts", hosts)
+	vars.Set("services", services)
+
+	err = helpers.RenderPage(w, r, "host-group", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// PostHostGroup adds/edits a host group
+func (repo *DBRepo) PostHostGroup(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	g := models.HostGroup{
+		ID:          id,
+		GroupName:   strings.TrimSpace(r.Form.Get("group_name")),
+		Description: r.Form.Get("description"),
+	}
+
+	if g.GroupName == "" {
+		repo.App.Session.Put(r.Context(), "error", "Group name is required")
+		http.Redirect(w, r, fmt.Sprintf("/admin/group/%d", g.ID), http.StatusSeeOther)
+		return
+	}
+
+	if g.ID > 0 {
+		err = repo.DB.UpdateHostGroup(g)
+	} else {
+		g.ID, err = repo.DB.InsertHostGroup(g)
+	}
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	repo.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/group/%d", g.ID), http.StatusSeeOther)
+}
+
+// DeleteHostGroup deletes a host group; its hosts are kept
+func (repo *DBRepo) DeleteHostGroup(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := repo.DB.DeleteHostGroup(id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	repo.App.Session.Put(r.Context(), "flash", "Group deleted")
+	http.Redirect(w, r, "/admin/groups", http.StatusSeeOther)
+}
+
+// HostGroupBulkAction applies an action to every host in a group
+func (repo *DBRepo) HostGroupBulkAction(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	hosts, err := repo.DB.FilterHosts(models.HostFilter{GroupID: id})
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	serviceID, _ := strconv.Atoi(r.Form.Get("service_id"))
+
+	switch r.Form.Get("action") {
+	case "activate-hosts":
+		for _, h := range hosts {
+			repo.setHostActive(h, 1)
+		}
+	case "deactivate-hosts":
+		for _, h := range hosts {
+			repo.setHostActive(h, 0)
+		}
+	case "enable-service":
+		for _, h := range hosts {
+			repo.setHostServiceActive(h, serviceID, 1)
+		}
+	case "disable-service":
+		for _, h := range hosts {
+			repo.setHostServiceActive(h, serviceID, 0)
+		}
+	default:
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	repo.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Changes applied to %d host(s)", len(hosts)))
+	http.Redirect(w, r, fmt.Sprintf("/admin/group/%d", id), http.StatusSeeOther)
+}
+
+// setHostActive activates or deactivates a host, and adds or removes its services from the schedule
+func (repo *DBRepo) setHostActive(h models.Host, active int) {
+	if h.Active == active {
+		return
+	}
+
+	h.Active = active
+	err := repo.DB.UpdateHost(h)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, hs := range h.HostServices {
+		if hs.Active != 1 {
+			continue
+		}
+
+		hs.HostName = h.HostName
+		if active == 1 {
+			repo.addToMonitorMap(hs)
+		} else {
+			repo.removeFromMonitorMap(hs)
+		}
+	}
+}
+
+// setHostServiceActive turns a service on or off for a host, and updates the schedule
+func (repo *DBRepo) setHostServiceActive(h models.Host, serviceID, active int) {
+	err := repo.DB.UpdateHostServiceStatus(h.ID, serviceID, active)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	hs, err := repo.DB.GetHostServiceByHostIDServiceID(h.ID, serviceID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if active == 1 && h.Active == 1 {
+		repo.pushScheduleChangeEvent(hs, "pending")
+		repo.pushStatusChangedEvent(h, hs, "pending")
+		repo.addToMonitorMap(hs)
+	} else if active == 0 {
+		repo.removeFromMonitorMap(hs)
+	}
+}
+
+// hostFilterFromRequest reads the group and tag filter from the query string. The tag
+// may be given as key or as key=value.
+func hostFilterFromRequest(r *http.Request) models.HostFilter {
+	var f models.HostFilter
+
+	f.GroupID, _ = strconv.Atoi(r.URL.Query().Get("group"))
+
+	tag := strings.TrimSpace(r.URL.Query().Get("tag"))
+	if tag != "" {
+		t := parseTag(tag)
+		f.TagKey, f.TagValue = t.Key, t.Value
+	}
+
+	return f
+}
+
+// setFilterVars adds everything the host filter form needs to the template variables
+func (repo *DBRepo) setFilterVars(vars jet.VarMap, f models.HostFilter) {
+	groups, err := repo.DB.AllHostGroups()
+	if err != nil {
+		log.Println(err)
+	}
+
+	tagKeys, err := repo.DB.AllTagKeys()
+	if err != nil {
+		log.Println(err)
+	}
+
+	tag := models.HostTag{Key: f.TagKey, Value: f.TagValue}
+
+	vars.Set("filterGroups", groups)
+	vars.Set("filterTagKeys", tagKeys)
+	vars.Set("filterGroupID", f.GroupID)
+	vars.Set("filterTag", tag.String())
+	vars.Set("filterQuery", filterQuery(f))
+}
+
+// filterQuery returns the filter as a query string (including the leading ?), or an empty string
+func filterQuery(f models.HostFilter) string {
+	q := url.Values{}
+	if f.GroupID > 0 {
+		q.Set("group", strconv.Itoa(f.GroupID))
+	}
+
+	if f.TagKey != "" {
+		q.Set("tag", models.HostTag{Key: f.TagKey, Value: f.TagValue}.String())
+	}
+
+	if len(q) == 0 {
+		return ""
+	}
+
+	return "?" + q.Encode()
+}
+
+// parseTag parses a tag in key or key=value form
+func parseTag(s string) models.HostTag {
+	key, value := s, ""
+	if i := strings.Index(s, "="); i >= 0 {
+		key, value = s[:i], s[i+1:]
+	}
+
+	return models.HostTag{Key: strings.TrimSpace(key), Value: strings.TrimSpace(value)}
+}
+
+// parseTags parses one tag per line (or comma separated), skipping empty entries
+func parseTags(s string) []models.HostTag {
+	var tags []models.HostTag
+
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == '\n' || r == '\r' || r == ','
+	})
+
+	for _, f := range fields {
+		t := parseTag(f)
+		if t.Key != "" {
+			tags = append(tags, t)
+		}
+	}
+
+	return tags
+}
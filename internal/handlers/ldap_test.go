@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"github.com/luksbutz/vigilate/internal/config"
+	"github.com/luksbutz/vigilate/internal/ldapauth"
+	"github.com/luksbutz/vigilate/internal/models"
+	"testing"
+)
+
+// ldapRoles makes admins of the admins group, and viewers of everyone else
+var ldapRoles = models.RoleMapping{
+	Admins:  []string{"admins"},
+	Default: models.AccessViewer,
+}
+
+func TestLDAPLocalUser(t *testing.T) {
+	const dn = "uid=bob,ou=people,dc=example,dc=com"
+
+	tests := []struct {
+		name string
+		// existing is a user already there, linked to dn if linked is set
+		existing     *models.User
+		linked       bool
+		linkExisting bool
+		groups       []string
+		wantErr      error
+		// wantLevel is the access level of the user afterwards
+		wantLevel int
+		// wantLinked is whether the user is linked to dn afterwards
+		wantLinked bool
+	}{
+		{
+			name:       "new user is created with their role",
+			groups:     []string{"admins"},
+			wantLevel:  models.AccessAdmin,
+			wantLinked: true,
+		},
+		{
+			name:      "existing account is not taken over",
+			existing:  &models.User{Email: "Bob@Example.com", AccessLevel: models.AccessAdmin, UserActive: 1},
+			wantErr:   models.ErrInvalidCredentials,
+			wantLevel: models.AccessAdmin,
+		},
+		{
+			name:         "existing account is linked when the directory allows it",
+			existing:     &models.User{Email: "Bob@Example.com", AccessLevel: models.AccessAdmin, UserActive: 1},
+			linkExisting: true,
+			wantLevel:    models.AccessViewer,
+			wantLinked:   true,
+		},
+		{
+			name:       "linked user gets the role of their groups",
+			existing:   &models.User{Email: "bob@example.com", AccessLevel: models.AccessViewer, UserActive: 1},
+			linked:     true,
+			groups:     []string{"admins"},
+			wantLevel:  models.AccessAdmin,
+			wantLinked: true,
+		},
+		{
+			name:       "inactive user is turned away",
+			existing:   &models.User{Email: "bob@example.com", AccessLevel: models.AccessViewer, UserActive: 0},
+			linked:     true,
+			wantErr:    models.ErrInactiveAccount,
+			wantLevel:  models.AccessViewer,
+			wantLinked: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			a := &config.AppConfig{}
+			repo := &DBRepo{App: a, DB: db}
+			NewHandlers(repo, a)
+
+			if tt.existing != nil {
+				u := db.addUser(*tt.existing)
+				if tt.linked {
+					db.ldapDNs[u.ID] = dn
+				}
+			}
+
+			directory := ldapauth.NewWithDialer(ldapauth.Config{Roles: ldapRoles, LinkExisting: tt.linkExisting}, nil)
+			auth := NewLDAPAuthenticator(repo, directory)
+
+			_, err := auth.localUser(ldapauth.User{DN: dn, Email: "bob@example.com", Groups: tt.groups})
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			u, err := db.GetUserByEmail("bob@example.com")
+			if err != nil {
+				t.Fatal("no user")
+			}
+
+			if u.AccessLevel != tt.wantLevel {
+				t.Errorf("access level is %d, want %d", u.AccessLevel, tt.wantLevel)
+			}
+			if linked := db.ldapDNs[u.ID] == dn; linked != tt.wantLinked {
+				t.Errorf("linked is %v, want %v", linked, tt.wantLinked)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/CloudyKit/jet/v6"
+	"github.com/go-chi/chi/v5"
+	"github.com/luksbutz/vigilate/internal/channeldata"
+	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/models"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// loginFailureWindow is how long a wrong password counts against an account or an address
+	loginFailureWindow = time.Hour
+	// accountFreeFailures is how many wrong passwords may be given for one account before each
+	// further try has to wait, twice as long each time, up to maxAccountDelay
+	accountFreeFailures = 2
+	maxAccountDelay     = time.Minute
+	// ipFreeFailures is how many wrong passwords may be given from one address, for any accounts,
+	// before each further try has to wait, twice as long each time, up to maxIPDelay
+	ipFreeFailures = 10
+	maxIPDelay     = 5 * time.Minute
+	// defaultLockoutAttempts is how many wrong passwords lock an account, unless the settings say
+	// otherwise; 0 never locks one
+	defaultLockoutAttempts = 5
+	// defaultLockoutMinutes is how long an account stays locked, unless the settings say otherwise
+	defaultLockoutMinutes = 15
+	// failedLoginsShown is how many failed logins admins see
+	failedLoginsShown = 200
+)
+
+// loginDelay returns how long to wait after the latest of a number of failures, before another
+// try: nothing for the first few, then one second, doubling with each failure, up to max
+func loginDelay(failures, free int, max time.Duration) time.Duration {
+	n := failures - free
+	if n <= 0 {
+		return 0
+	}
+	if n > 16 {
+		return max
+	}
+
+	d := time.Second << uint(n-1)
+	if d > max {
+		return max
+	}
+	return d
+}
+
+// failureSince returns when the failed logins that count against an account start: an hour ago,
+// or when it was last unlocked if that is later
+func failureSince(u models.User) time.Time {
+	since := time.Now().Add(-loginFailureWindow)
+	if u.LockedUntil.After(since) {
+		return u.LockedUntil
+	}
+	return since
+}
+
+// loginWait returns how long a login for email from ip has to wait because of earlier wrong
+// passwords and codes, counting those for the account made after since
+func (repo *DBRepo) loginWait(email, ip string, since time.Time) (time.Duration, error) {
+	now := time.Now()
+
+	n, last, err := repo.DB.CountLoginFailures(email, since)
+	if err != nil {
+		return 0, err
+	}
+	wait := last.Add(loginDelay(n, accountFreeFailures, maxAccountDelay)).Sub(now)
+
+	n, last, err = repo.DB.CountLoginFailuresFromIP(ip, now.Add(-loginFailureWindow))
+	if err != nil {
+		return 0, err
+	}
+	if w := last.Add(loginDelay(n, ipFreeFailures, maxIPDelay)).Sub(now); w > wait {
+		wait = w
+	}
+
+	return wait, nil
+}
+
+// lockoutSettings returns how many wrong passwords lock an account, and for how long
+func lockoutSettings() (int, time.Duration) {
+	attempts, err := strconv.Atoi(app.PreferenceMap["lockout_attempts"])
+	if err != nil || attempts < 0 {
+		attempts = defaultLockoutAttempts
+	}
+
+	minutes, err := strconv.Atoi(app.PreferenceMap["lockout_minutes"])
+	if err != nil || minutes <= 0 {
+		minutes = defaultLockoutMinutes
+	}
+
+	return attempts, time.Duration(minutes) * time.Minute
+}
+
+// recordLogin keeps a login attempt; failing to is logged, but doesn't stop the login
+func (repo *DBRepo) recordLogin(a models.LoginAttempt) {
+	err := repo.DB.InsertLoginAttempt(a)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// lockIfGuessed locks the account of a user, after a wrong password or code, if it has had too
+// many of them, and lets them know by email
+func (repo *DBRepo) lockIfGuessed(u models.User, a models.LoginAttempt, since time.Time) {
+	attempts, duration := lockoutSettings()
+	if u.ID == 0 || attempts == 0 {
+		return
+	}
+
+	n, _, err := repo.DB.CountLoginFailures(a.Email, since)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if n < attempts {
+		return
+	}
+
+	until := time.Now().Add(duration)
+	err = repo.DB.LockUser(u.ID, until)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	log.Printf("Locked user %d until %s after %d failed logins, the last from %s", u.ID, until.Format("2006-01-02 15:04"), n, a.IPAddress)
+
+	content := fmt.Sprintf(`<p>Your vigilate account has been locked after %d failed logins, the last from %s.
+						You can log in again after %s.</p>
+						<p>If they weren't you, someone may be trying to guess your password; consider choosing
+						a new one after logging in.</p>`,
+		n,
+		template.HTMLEscapeString(a.IPAddress),
+		until.Format("2006-01-02 15:04 MST"))
+
+	helpers.SendEmail(channeldata.MailData{
+		ToName:    strings.TrimSpace(u.FirstName + " " + u.LastName),
+		ToAddress: u.Email,
+		Subject:   "Your vigilate account has been locked",
+		Content:   template.HTML(content),
+	})
+}
+
+// FailedLogins shows admins the latest failed logins
+func (repo *DBRepo) FailedLogins(w http.ResponseWriter, r *http.Request) {
+	attempts, err := repo.DB.RecentFailedLogins(failedLoginsShown)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("attempts", attempts)
+
+	err = helpers.RenderPage(w, r, "failed-logins", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// UnlockUser lets a user locked after too many failed logins log in again
+func (repo *DBRepo) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := repo.DB.UnlockUser(id)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "User unlocked")
+	http.Redirect(w, r, fmt.Sprintf("/admin/user/%d", id), http.StatusSeeOther)
+}
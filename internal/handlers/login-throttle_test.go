@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/luksbutz/vigilate/internal/config"
+	"github.com/luksbutz/vigilate/internal/models"
+	"testing"
+	"time"
+)
+
+func TestLoginDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		free     int
+		max      time.Duration
+		want     time.Duration
+	}{
+		{0, accountFreeFailures, maxAccountDelay, 0},
+		{2, accountFreeFailures, maxAccountDelay, 0},
+		{3, accountFreeFailures, maxAccountDelay, time.Second},
+		{4, accountFreeFailures, maxAccountDelay, 2 * time.Second},
+		{8, accountFreeFailures, maxAccountDelay, 32 * time.Second},
+		// 64 seconds is more than the most an account waits
+		{9, accountFreeFailures, maxAccountDelay, maxAccountDelay},
+		{18, accountFreeFailures, maxAccountDelay, maxAccountDelay},
+		// past the point where doubling a second would overflow
+		{1000, accountFreeFailures, maxAccountDelay, maxAccountDelay},
+		{10, ipFreeFailures, maxIPDelay, 0},
+		{11, ipFreeFailures, maxIPDelay, time.Second},
+		{19, ipFreeFailures, maxIPDelay, 256 * time.Second},
+		{20, ipFreeFailures, maxIPDelay, maxIPDelay},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d failures, %d free", tt.failures, tt.free), func(t *testing.T) {
+			if got := loginDelay(tt.failures, tt.free, tt.max); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailureSince(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		lockedUntil time.Time
+		want        time.Time
+	}{
+		{"never locked", time.Time{}, now.Add(-loginFailureWindow)},
+		{"unlocked long ago", now.Add(-2 * loginFailureWindow), now.Add(-loginFailureWindow)},
+		{"unlocked lately", now.Add(-10 * time.Minute), now.Add(-10 * time.Minute)},
+		{"still locked", now.Add(10 * time.Minute), now.Add(10 * time.Minute)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := failureSince(models.User{LockedUntil: tt.lockedUntil})
+			if d := got.Sub(tt.want); d < -time.Second || d > time.Second {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginWait(t *testing.T) {
+	const email, ip = "bob@example.com", "192.0.2.1"
+	now := time.Now()
+
+	// failed returns a wrong password for bob from ip, ago before now
+	failed := func(ago time.Duration) models.LoginAttempt {
+		return models.LoginAttempt{Email: email, IPAddress: ip, Reason: models.LoginFailedPassword, CreatedAt: now.Add(-ago)}
+	}
+
+	tests := []struct {
+		name     string
+		attempts []models.LoginAttempt
+		// lockedUntil is when bob's account was last unlocked
+		lockedUntil time.Time
+		wantWait    bool
+	}{
+		{"no failures", nil, time.Time{}, false},
+		{"free failures", []models.LoginAttempt{failed(0), failed(0)}, time.Time{}, false},
+		{"one too many", []models.LoginAttempt{failed(0), failed(0), failed(0)}, time.Time{}, true},
+		{"wrong codes count too", []models.LoginAttempt{failed(0), failed(0),
+			{Email: email, IPAddress: ip, Reason: models.LoginFailedTwoFactor, CreatedAt: now}}, time.Time{}, true},
+		{"waited long enough", []models.LoginAttempt{failed(time.Minute), failed(time.Minute), failed(time.Minute)}, time.Time{}, false},
+		{"failures before a success", []models.LoginAttempt{failed(time.Second), failed(time.Second), failed(time.Second),
+			{Email: email, IPAddress: ip, Succeeded: true, CreatedAt: now}}, time.Time{}, false},
+		{"failures before an unlock", []models.LoginAttempt{failed(2 * time.Second), failed(2 * time.Second), failed(0)},
+			now.Add(-time.Second), false},
+		{"failures older than the window", []models.LoginAttempt{failed(2 * loginFailureWindow), failed(2 * loginFailureWindow),
+			failed(0)}, time.Time{}, false},
+		{"locked attempts don't count", []models.LoginAttempt{failed(0), failed(0),
+			{Email: email, IPAddress: ip, Reason: models.LoginFailedLocked, CreatedAt: now}}, time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			a := &config.AppConfig{}
+			repo := &DBRepo{App: a, DB: db}
+			NewHandlers(repo, a)
+
+			db.attempts = tt.attempts
+
+			wait, err := repo.loginWait(email, ip, failureSince(models.User{LockedUntil: tt.lockedUntil}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (wait > 0) != tt.wantWait {
+				t.Errorf("wait is %s, want a wait: %v", wait, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestLoginWaitFromIP(t *testing.T) {
+	const ip = "192.0.2.1"
+
+	db := newFakeDB()
+	a := &config.AppConfig{}
+	repo := &DBRepo{App: a, DB: db}
+	NewHandlers(repo, a)
+
+	// one wrong password each for many accounts, from one address
+	for i := 0; i <= ipFreeFailures; i++ {
+		db.attempts = append(db.attempts, models.LoginAttempt{
+			Email:     fmt.Sprintf("user%d@example.com", i),
+			IPAddress: ip,
+			Reason:    models.LoginFailedPassword,
+			CreatedAt: time.Now(),
+		})
+	}
+
+	wait, err := repo.loginWait("another@example.com", ip, failureSince(models.User{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("wait is %s, want up to a second", wait)
+	}
+
+	wait, err = repo.loginWait("another@example.com", "192.0.2.2", failureSince(models.User{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait > 0 {
+		t.Errorf("another address waits %s", wait)
+	}
+}
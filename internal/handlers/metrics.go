@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"bytes"
+	"github.com/luksbutz/vigilate/internal/metrics"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/realtime"
+	"net/http"
+	"strconv"
+)
+
+// Metrics exposes the status of every active host service, and vigilate's own counters,
+// in the Prometheus text format
+func (repo *DBRepo) Metrics(w http.ResponseWriter, r *http.Request) {
+	services, err := repo.DB.GetServicesByStatus("", models.HostFilter{})
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	var b bytes.Buffer
+
+	metrics.WriteHeader(&b, "vigilate_host_service_status",
+		"Current status of a host service; 1 for the status it is in, 0 for the others.", "gauge")
+	for _, hs := range services {
+		for _, status := range serviceStatuses {
+			value := 0.0
+			if hs.Status == status {
+				value = 1
+			}
+			metrics.WriteSample(&b, "vigilate_host_service_status", value, append(hostServiceLabels(hs), "status", status)...)
+		}
+	}
+
+	metrics.WriteHeader(&b, "vigilate_host_service_last_check_timestamp_seconds",
+		"Unix time of the last check of a host service.", "gauge")
+	for _, hs := range services {
+		if hs.LastCheck.Year() > 1 {
+			metrics.WriteSample(&b, "vigilate_host_service_last_check_timestamp_seconds",
+				float64(hs.LastCheck.Unix()), hostServiceLabels(hs)...)
+		}
+	}
+
+	metrics.WriteHeader(&b, "vigilate_host_service_last_check_duration_seconds",
+		"How long the last check of a host service took. Only known for checks run since vigilate started.", "gauge")
+	for _, hs := range services {
+		if d, ok := metrics.LastCheckDuration(hs.ID); ok {
+			metrics.WriteSample(&b, "vigilate_host_service_last_check_duration_seconds",
+				d.Seconds(), hostServiceLabels(hs)...)
+		}
+	}
+
+	metrics.WriteHeader(&b, "vigilate_plugin_perfdata",
+		"Performance data reported by the last run of a command check's plugin.", "gauge")
+	for _, hs := range services {
+		for _, p := range metrics.PerfData(hs.ID) {
+			metrics.WriteSample(&b, "vigilate_plugin_perfdata", p.Value,
+				append(hostServiceLabels(hs), "label", p.Label, "unit", p.Unit)...)
+		}
+	}
+
+	metrics.ChecksRun.Write(&b)
+	metrics.StateChanges.Write(&b)
+	metrics.NotificationsSent.Write(&b)
+	metrics.NotificationsFailed.Write(&b)
+	metrics.Broadcasts.Write(&b)
+
+	monitoring := 0.0
+	if repo.App.PreferenceMap["monitoring_live"] == "1" {
+		monitoring = 1
+	}
+
+	metrics.WriteGauge(&b, "vigilate_monitoring_live", "1 if monitoring is switched on.", monitoring)
+	metrics.WriteGauge(&b, "vigilate_scheduler_entries", "Checks on the schedule.",
+		float64(len(repo.App.Scheduler.Entries())))
+	metrics.WriteGauge(&b, "vigilate_mail_queue_depth", "Emails waiting to be sent.",
+		float64(len(repo.App.MailQueue)))
+	if q, ok := repo.App.WsClient.(*realtime.Queue); ok {
+		metrics.WriteGauge(&b, "vigilate_broadcast_queue_depth", "Live update events waiting to be sent to Pusher.",
+			float64(q.Len()))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(b.Bytes())
+}
+
+func hostServiceLabels(hs models.HostService) []string {
+	return []string{
+		"host", hs.HostName,
+		"service", hs.Service.ServiceName,
+		"host_service_id", strconv.Itoa(hs.ID),
+	}
+}
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/luksbutz/vigilate/internal/channeldata"
+	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/metrics"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/sms"
+	"html/template"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusChange describes a host service status transition that we notify about
+type statusChange struct {
+	HostService models.HostService
+	OldStatus   string
+	NewStatus   string
+	Message     string
+}
+
+// notificationGroup collects status changes until the grouping window closes
+type notificationGroup struct {
+	mu      sync.Mutex
+	pending []statusChange
+	timer   *time.Timer
+}
+
+var pendingNotifications notificationGroup
+
+// notifyStatusChange sends notifications for a status change. If the notify_group_seconds
+// preference is set, the change is held back and sent together with all other changes
+// that happen within that many seconds.
+func (repo *DBRepo) notifyStatusChange(c statusChange) {
+	window, _ := strconv.Atoi(repo.App.PreferenceMap["notify_group_seconds"])
+	if window <= 0 {
+		repo.sendNotifications([]statusChange{c})
+		return
+	}
+
+	pendingNotifications.mu.Lock()
+	defer pendingNotifications.mu.Unlock()
+
+	pendingNotifications.pending = append(pendingNotifications.pending, c)
+	if pendingNotifications.timer == nil {
+		pendingNotifications.timer = time.AfterFunc(time.Duration(window)*time.Second, repo.flushNotifications)
+	}
+}
+
+// flushNotifications sends all changes collected in the current grouping window
+func (repo *DBRepo) flushNotifications() {
+	pendingNotifications.mu.Lock()
+	changes := pendingNotifications.pending
+	pendingNotifications.pending = nil
+	pendingNotifications.timer = nil
+	pendingNotifications.mu.Unlock()
+
+	repo.sendNotifications(dedupeStatusChanges(changes))
+}
+
+// dedupeStatusChanges collapses multiple changes of the same host service into one,
+// from the first old status to the last new status, and drops services that ended up
+// back where they started
+func dedupeStatusChanges(changes []statusChange) []statusChange {
+	var order []int
+	merged := make(map[int]statusChange)
+
+	for _, c := range changes {
+		if existing, ok := merged[c.HostService.ID]; ok {
+			c.OldStatus = existing.OldStatus
+		} else {
+			order = append(order, c.HostService.ID)
+		}
+		merged[c.HostService.ID] = c
+	}
+
+	var result []statusChange
+	for _, id := range order {
+		if c := merged[id]; c.OldStatus != c.NewStatus {
+			result = append(result, c)
+		}
+	}
+
+	return result
+}
+
+// sendNotifications sends email, sms and push notifications for one or more status changes
+func (repo *DBRepo) sendNotifications(changes []statusChange) {
+	var notifiable []statusChange
+	for _, c := range changes {
+		// a service becoming unreachable isn't notified, so neither is its recovery, unless it
+		// was down before then; still being down once it is reachable again is
+		if c.OldStatus == "unreachable" && c.NewStatus == "healthy" && !repo.downBeforeUnreachable(c.HostService.ID) {
+			continue
+		}
+
+		switch c.NewStatus {
+		case "healthy", "warning", "unknown", "problem":
+			notifiable = append(notifiable, c)
+		}
+	}
+
+	if len(notifiable) == 0 {
+		return
+	}
+
+	// send email (we don't email about services leaving the pending state)
+	if repo.App.PreferenceMap["notify_via_email"] == "1" {
+		var emailChanges []statusChange
+		for _, c := range notifiable {
+			if c.OldStatus != "pending" {
+				emailChanges = append(emailChanges, c)
+			}
+		}
+
+		if len(emailChanges) > 0 {
+			repo.sendEmailNotification(emailChanges)
+		}
+	}
+
+	// send sms
+	if repo.App.PreferenceMap["notify_via_sms"] == "1" {
+		to := repo.App.PreferenceMap["sms_notify_number"]
+
+		err := sms.SendText(to, smsNotificationText(notifiable), repo.App)
+		metrics.NotificationResult("sms", err)
+		if err != nil {
+			log.Println("Error sending sms in notifications.go", err)
+		}
+	}
+
+	// send push notifications
+	if repo.App.PreferenceMap["notify_via_push"] == "1" {
+		title, msg := pushNotificationText(notifiable)
+		repo.sendPushNotifications(title, msg, worstStatus(notifiable))
+	}
+}
+
+// downBeforeUnreachable reports whether a host service that is recovering from unreachable was
+// in warning, unknown or problem before it became unreachable, and so has been notified as down
+func (repo *DBRepo) downBeforeUnreachable(hostServiceID int) bool {
+	status, err := repo.DB.StatusBeforeUnreachable(hostServiceID)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	return status == "warning" || status == "unknown" || status == "problem"
+}
+
+// sendEmailNotification queues a single email describing one or more status changes
+func (repo *DBRepo) sendEmailNotification(changes []statusChange) {
+	mm := channeldata.MailData{
+		ToName:    repo.App.PreferenceMap["notify_name"],
+		ToAddress: repo.App.PreferenceMap["notify_email"],
+	}
+
+	if len(changes) == 1 {
+		c := changes[0]
+		mm.Subject = fmt.Sprintf("%s: service %s on %s", strings.ToUpper(c.NewStatus), c.HostService.Service.ServiceName, c.HostService.HostName)
+		mm.Content = template.HTML(fmt.Sprintf(`<p>Service %s on %s reported %s status</p>
+						<p><strong>Messaged received:</strong> %s</p>`,
+			template.HTMLEscapeString(c.HostService.Service.ServiceName),
+			template.HTMLEscapeString(c.HostService.HostName),
+			c.NewStatus,
+			template.HTMLEscapeString(c.Message)))
+	} else {
+		mm.Subject = fmt.Sprintf("%s: %d services changed status (%s)", strings.ToUpper(worstStatus(changes)), len(changes), statusSummary(changes))
+
+		var rows strings.Builder
+		for _, c := range changes {
+			rows.WriteString(fmt.Sprintf("<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>",
+				template.HTMLEscapeString(c.HostService.HostName),
+				template.HTMLEscapeString(c.HostService.Service.ServiceName),
+				c.NewStatus,
+				template.HTMLEscapeString(c.Message)))
+		}
+
+		mm.Content = template.HTML(fmt.Sprintf(`<p>The following services changed status:</p>
+						<table><thead><tr><th>Host</th><th>Service</th><th>Status</th><th>Message</th></tr></thead>
+						<tbody>%s</tbody></table>`, rows.String()))
+	}
+
+	helpers.SendEmail(mm)
+}
+
+// smsMaxServices is how many services a grouped text message names; the rest are counted, so
+// that an outage of hundreds of services is still one text message, not dozens
+const smsMaxServices = 5
+
+// smsNotificationText returns the text message for one or more status changes
+func smsNotificationText(changes []statusChange) string {
+	if len(changes) == 1 {
+		c := changes[0]
+		switch c.NewStatus {
+		case "healthy":
+			return fmt.Sprintf("Service %s on %s is healthy", c.HostService.Service.ServiceName, c.HostService.HostName)
+		case "problem":
+			return fmt.Sprintf("Service %s on %s reports a problem: %s", c.HostService.Service.ServiceName, c.HostService.HostName, c.Message)
+		case "unknown":
+			return fmt.Sprintf("Service %s on %s can't be checked: %s", c.HostService.Service.ServiceName, c.HostService.HostName, c.Message)
+		default:
+			return fmt.Sprintf("Service %s on %s reports a warning: %s", c.HostService.Service.ServiceName, c.HostService.HostName, c.Message)
+		}
+	}
+
+	var affected []string
+	for _, c := range changes {
+		if len(affected) == smsMaxServices {
+			affected = append(affected, fmt.Sprintf("and %d more", len(changes)-smsMaxServices))
+			break
+		}
+		affected = append(affected, fmt.Sprintf("%s on %s (%s)", c.HostService.Service.ServiceName, c.HostService.HostName, c.NewStatus))
+	}
+
+	return fmt.Sprintf("%d services changed status (%s): %s", len(changes), statusSummary(changes), strings.Join(affected, ", "))
+}
+
+// pushNotificationText returns the title and message of a push notification for one or more status changes
+func pushNotificationText(changes []statusChange) (string, string) {
+	if len(changes) == 1 {
+		c := changes[0]
+		return fmt.Sprintf("%s: %s on %s", c.NewStatus, c.HostService.Service.ServiceName, c.HostService.HostName), c.Message
+	}
+
+	var lines []string
+	for _, c := range changes {
+		lines = append(lines, fmt.Sprintf("%s on %s: %s", c.HostService.Service.ServiceName, c.HostService.HostName, c.NewStatus))
+	}
+
+	return fmt.Sprintf("%d services changed status (%s)", len(changes), statusSummary(changes)), strings.Join(lines, "\n")
+}
+
+// worstStatus returns the most severe new status among the changes
+func worstStatus(changes []statusChange) string {
+	severity := map[string]int{"healthy": 0, "warning": 1, "unknown": 2, "problem": 3}
+
+	worst := "healthy"
+	for _, c := range changes {
+		if severity[c.NewStatus] > severity[worst] {
+			worst = c.NewStatus
+		}
+	}
+
+	return worst
+}
+
+// statusSummary returns a summary such as "2 problem, 1 healthy"
+func statusSummary(changes []statusChange) string {
+	counts := make(map[string]int)
+	for _, c := range changes {
+		counts[c.NewStatus]++
+	}
+
+	var parts []string
+	for _, status := range []string{"problem", "unknown", "warning", "healthy"} {
+		if counts[status] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[status], status))
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
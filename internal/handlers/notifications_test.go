@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/luksbutz/vigilate/internal/models"
+	"strings"
+	"testing"
+)
+
+// changesTo returns n changes of different services to status
+func changesTo(n int, status string) []statusChange {
+	var changes []statusChange
+	for i := 1; i <= n; i++ {
+		changes = append(changes, statusChange{
+			HostService: models.HostService{HostName: fmt.Sprintf("host%d", i), Service: models.Service{ServiceName: "HTTP"}},
+			OldStatus:   "healthy",
+			NewStatus:   status,
+			Message:     "connection refused",
+		})
+	}
+	return changes
+}
+
+func TestSMSNotificationText(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes []statusChange
+		want    string
+	}{
+		{"one", changesTo(1, "problem"), "Service HTTP on host1 reports a problem: connection refused"},
+		{"one unknown", changesTo(1, "unknown"), "Service HTTP on host1 can't be checked: connection refused"},
+		{"a few", changesTo(2, "problem"), "2 services changed status (2 problem): HTTP on host1 (problem), HTTP on host2 (problem)"},
+		{"as many as are named", changesTo(smsMaxServices, "healthy"),
+			"5 services changed status (5 healthy): HTTP on host1 (healthy), HTTP on host2 (healthy), HTTP on host3 (healthy), HTTP on host4 (healthy), HTTP on host5 (healthy)"},
+		{"mixed", append(changesTo(1, "unknown"), changesTo(2, "problem")...),
+			"3 services changed status (2 problem, 1 unknown): HTTP on host1 (unknown), HTTP on host1 (problem), HTTP on host2 (problem)"},
+		{"more than are named", changesTo(300, "problem"),
+			"300 services changed status (300 problem): HTTP on host1 (problem), HTTP on host2 (problem), HTTP on host3 (problem), HTTP on host4 (problem), HTTP on host5 (problem), and 295 more"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := smsNotificationText(tt.changes)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if strings.Count(got, " on ") > smsMaxServices {
+				t.Errorf("names more than %d services", smsMaxServices)
+			}
+		})
+	}
+}
+
+func TestWorstStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes []statusChange
+		want    string
+	}{
+		{"healthy", changesTo(2, "healthy"), "healthy"},
+		{"warning", append(changesTo(1, "healthy"), changesTo(1, "warning")...), "warning"},
+		{"unknown is worse than warning", append(changesTo(1, "warning"), changesTo(1, "unknown")...), "unknown"},
+		{"problem is worst", append(changesTo(1, "problem"), changesTo(1, "unknown")...), "problem"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := worstStatus(tt.changes); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/oidc"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// oidcLoginTimeout is how long a user has to log in at the identity provider
+const oidcLoginTimeout = 10 * time.Minute
+
+var (
+	// errNoRole is returned when the role mapping gives a user from outside vigilate no access level
+	errNoRole = errors.New("no role for this user")
+	// errSSONoEmail is returned when a new user's ID token has no email address
+	errSSONoEmail = errors.New("single sign-on: no email address")
+	// errSSOUnverified is returned when an account has the user's email address, but the identity
+	// provider hasn't verified that the address is theirs
+	errSSOUnverified = errors.New("single sign-on: email address not verified")
+)
+
+// OIDCLogin sends the browser to the identity provider to log in
+func (repo *DBRepo) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if app.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var state, nonce, verifier string
+	var err error
+	for _, s := range []*string{&state, &nonce, &verifier} {
+		*s, err = oidc.NewRandom()
+		if err != nil {
+			ServerError(w, r, err)
+			return
+		}
+	}
+
+	authURL, err := app.OIDC.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Println(err)
+		app.Session.Put(r.Context(), "error", "Single sign-on is not available right now")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "oidcState", state)
+	app.Session.Put(r.Context(), "oidcNonce", nonce)
+	app.Session.Put(r.Context(), "oidcVerifier", verifier)
+	app.Session.Put(r.Context(), "oidcTarget", localTarget(r.URL.Query().Get("target")))
+	app.Session.Put(r.Context(), "oidcExpires", int(time.Now().Add(oidcLoginTimeout).Unix()))
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback is where the identity provider sends the browser back to. It checks the ID token,
+// finds or creates the user, and logs them in.
+func (repo *DBRepo) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if app.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// the state, nonce and verifier are good for one try only
+	state := app.Session.PopString(r.Context(), "oidcState")
+	nonce := app.Session.PopString(r.Context(), "oidcNonce")
+	verifier := app.Session.PopString(r.Context(), "oidcVerifier")
+	target := app.Session.PopString(r.Context(), "oidcTarget")
+	expires := app.Session.PopInt(r.Context(), "oidcExpires")
+
+	fail := func(msg string) {
+		app.Session.Put(r.Context(), "error", msg)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+
+	q := r.URL.Query()
+	if state == "" || time.Now().Unix() > int64(expires) ||
+		subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		fail("Single sign-on took too long or was started elsewhere; please try again")
+		return
+	}
+
+	if e := q.Get("error"); e != "" {
+		log.Println("single sign-on:", e, q.Get("error_description"))
+		fail("The identity provider did not log you in")
+		return
+	}
+
+	rawIDToken, err := app.OIDC.Exchange(r.Context(), q.Get("code"), verifier)
+	if err != nil {
+		log.Println(err)
+		fail("Single sign-on failed; please try again")
+		return
+	}
+
+	claims, err := app.OIDC.Verify(r.Context(), rawIDToken, nonce)
+	if err != nil {
+		log.Println(err)
+		fail("Single sign-on failed; please try again")
+		return
+	}
+
+	u, err := repo.oidcUser(claims)
+	switch {
+	case err == models.ErrInactiveAccount:
+		fail("Inactive account!")
+		return
+	case err == errNoRole:
+		fail("Your account has not been given access to vigilate")
+		return
+	case err == errSSONoEmail:
+		fail("The identity provider did not send your email address")
+		return
+	case err == errSSOUnverified:
+		fail("An account with your email address exists, but the identity provider has not verified the address")
+		return
+	case err != nil:
+		ServerError(w, r, err)
+		return
+	}
+
+	_ = app.Session.RenewToken(r.Context())
+
+	// the identity provider looks after second factors, so vigilate's own isn't asked for
+	app.Session.Put(r.Context(), "sso", true)
+	repo.completeLogin(w, r, u, "", false, target)
+}
+
+// oidcUser returns the user an ID token is for. A user seen for the first time is matched by
+// verified email address to an existing account, or else created. When roles come from the
+// claims, the user's role is brought up to date.
+func (repo *DBRepo) oidcUser(c oidc.Claims) (models.User, error) {
+	roles := app.OIDC.Roles()
+	level := roles.Level(c)
+
+	u, err := repo.DB.GetUserByOIDCSubject(c.Subject)
+	if err == sql.ErrNoRows {
+		if c.Email == "" {
+			return u, errSSONoEmail
+		}
+
+		u, err = repo.DB.GetUserByEmail(c.Email)
+		if err == sql.ErrNoRows {
+			return repo.provisionOIDCUser(c, level)
+		} else if err != nil {
+			return u, err
+		}
+
+		if !c.EmailVerified {
+			return u, errSSOUnverified
+		}
+
+		err = repo.DB.SetOIDCSubject(u.ID, c.Subject)
+		if err != nil {
+			return u, err
+		}
+	} else if err != nil {
+		return u, err
+	}
+
+	if u.UserActive != 1 {
+		return u, models.ErrInactiveAccount
+	}
+
+	if roles.FromClaims() {
+		if level == 0 {
+			return u, errNoRole
+		}
+		if level != u.AccessLevel {
+			u.AccessLevel = level
+			u.UpdatedAt = time.Now()
+			err = repo.DB.UpdateUser(u)
+			if err != nil {
+				return u, err
+			}
+		}
+	}
+
+	return u, nil
+}
+
+// provisionOIDCUser creates the account of a user logging in with single sign-on for the first
+// time. They get a random password, so they can't log in with one until it is reset.
+func (repo *DBRepo) provisionOIDCUser(c oidc.Claims, level int) (models.User, error) {
+	if level == 0 {
+		return models.User{}, errNoRole
+	}
+
+	password, err := randomPassword()
+	if err != nil {
+		return models.User{}, err
+	}
+
+	first, last := c.GivenName, c.FamilyName
+	if first == "" && last == "" {
+		first = c.Name
+		if i := strings.LastIndex(c.Name, " "); i > 0 {
+			first, last = c.Name[:i], c.Name[i+1:]
+		}
+	}
+	if first == "" {
+		first = strings.Split(c.Email, "@")[0]
+	}
+
+	id, err := repo.DB.InsertUser(models.User{
+		FirstName:   first,
+		LastName:    last,
+		Email:       c.Email,
+		Password:    []byte(password),
+		AccessLevel: level,
+		UserActive:  1,
+	})
+	if err != nil {
+		return models.User{}, err
+	}
+
+	err = repo.DB.SetOIDCSubject(id, c.Subject)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	log.Printf("Single sign-on: created user %d for %s", id, c.Email)
+
+	return repo.DB.GetUserById(id)
+}
+
+// localTarget returns target if it is a path on this site, so that it is safe to redirect to
+// after logging in, or "" otherwise
+func localTarget(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.Contains(target, `\`) {
+		return ""
+	}
+	return target
+}
+
+// passwordLoginAllowed reports whether users may log in with a password, and if not, tells them
+// to use single sign-on
+func (repo *DBRepo) passwordLoginAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if len(repo.Authenticators) > 0 {
+		return true
+	}
+
+	app.Session.Put(r.Context(), "error", "Password login is turned off; please log in with single sign-on")
+	err := helpers.RenderPage(w, r, "login", nil, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+	return false
+}
@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"encoding/gob"
+	"github.com/alexedwards/scs/v2"
+	"github.com/luksbutz/vigilate/internal/config"
+	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/oidc"
+	"github.com/luksbutz/vigilate/internal/oidc/oidctest"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ssoRoles gives admins and viewers their role from the groups claim, and nobody else a role
+var ssoRoles = oidc.RoleMapping{
+	Claim: "groups",
+	RoleMapping: models.RoleMapping{
+		Admins:  []string{"vigilate-admins"},
+		Viewers: []string{"staff"},
+	},
+}
+
+// ssoTest is vigilate, with single sign-on through a mock provider, running in a test server
+type ssoTest struct {
+	provider *oidctest.Server
+	db       *fakeDB
+	server   *httptest.Server
+	client   *http.Client
+}
+
+// newSSOTest starts a mock provider, and vigilate's single sign-on routes in a test server, with
+// a browser that keeps cookies and stops following redirects once back on vigilate's own pages
+func newSSOTest(t *testing.T) *ssoTest {
+	t.Helper()
+
+	gob.Register(models.User{})
+
+	st := &ssoTest{
+		provider: oidctest.NewServer("vigilate", "s3cret"),
+		db:       newFakeDB(),
+	}
+	t.Cleanup(st.provider.Close)
+
+	a := &config.AppConfig{
+		Session:       scs.New(),
+		PreferenceMap: map[string]string{},
+		PasswordLogin: true,
+	}
+
+	repo := &DBRepo{App: a, DB: st.db}
+	NewHandlers(repo, a)
+	helpers.NewHelpers(a)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oidc", repo.OIDCLogin)
+	mux.HandleFunc("/login/oidc/callback", repo.OIDCCallback)
+	mux.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(a.Session.GetInt(r.Context(), "userID")) + " " + a.Session.GetString(r.Context(), "error")))
+	})
+	st.server = httptest.NewServer(a.Session.LoadAndSave(mux))
+	t.Cleanup(st.server.Close)
+
+	a.OIDC = oidc.New(oidc.Config{
+		Issuer:       st.provider.Issuer(),
+		ClientID:     "vigilate",
+		ClientSecret: "s3cret",
+		RedirectURL:  st.server.URL + "/login/oidc/callback",
+		Roles:        ssoRoles,
+	})
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.client = &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host == strings.TrimPrefix(st.server.URL, "http://") && req.URL.Path != "/login/oidc/callback" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+
+	return st
+}
+
+// get fetches a path of vigilate, and returns the response, which is closed
+func (st *ssoTest) get(t *testing.T, path string) *http.Response {
+	t.Helper()
+
+	resp, err := st.client.Get(st.server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp
+}
+
+// whoami returns the id of the user logged in, and the error shown, in the browser's session
+func (st *ssoTest) whoami(t *testing.T) (int, string) {
+	t.Helper()
+
+	resp, err := st.client.Get(st.server.URL + "/whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.SplitN(string(body), " ", 2)
+	id, _ := strconv.Atoi(parts[0])
+
+	return id, parts[1]
+}
+
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	st := newSSOTest(t)
+	st.provider.Claims = map[string]interface{}{
+		"sub":         "alice-1",
+		"email":       "alice@example.com",
+		"given_name":  "Alice",
+		"family_name": "Example",
+		"groups":      []string{"staff", "vigilate-admins"},
+	}
+
+	resp := st.get(t, "/login/oidc?target=/admin/host/all")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/admin/host/all" {
+		t.Fatalf("login ended with %s to %q, want a redirect to the target", resp.Status, resp.Header.Get("Location"))
+	}
+
+	id, msg := st.whoami(t)
+	if id == 0 {
+		t.Fatalf("nobody is logged in; error %q", msg)
+	}
+
+	u, _ := st.db.GetUserById(id)
+	if u.Email != "alice@example.com" || u.FirstName != "Alice" || u.LastName != "Example" ||
+		u.AccessLevel != models.AccessAdmin || u.UserActive != 1 {
+		t.Errorf("wrong user created: %+v", u)
+	}
+	if st.db.oidcSubjects[id] != "alice-1" {
+		t.Errorf("user is linked to subject %q", st.db.oidcSubjects[id])
+	}
+
+	// the login is recorded, so that wrong passwords before it stop counting
+	if n := len(st.db.attempts); n != 1 || !st.db.attempts[0].Succeeded {
+		t.Errorf("logins recorded: %+v", st.db.attempts)
+	}
+}
+
+func TestOIDCLoginStateMismatch(t *testing.T) {
+	st := newSSOTest(t)
+
+	// start a login, but come back with a state from another one
+	client := *st.client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(st.server.URL + "/login/oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Location"), st.provider.URL+"/authorize?") {
+		t.Fatalf("login went to %q, not the provider", resp.Header.Get("Location"))
+	}
+
+	resp = st.get(t, "/login/oidc/callback?code=stolen&state=another")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/" {
+		t.Fatalf("callback ended with %s to %q, want a redirect to the login page", resp.Status, resp.Header.Get("Location"))
+	}
+
+	id, msg := st.whoami(t)
+	if id != 0 || !strings.Contains(msg, "started elsewhere") {
+		t.Errorf("user %d logged in, error %q", id, msg)
+	}
+
+	// the state is good for one try, so the callback can't be replayed either
+	st.get(t, "/login/oidc/callback?code=stolen&state=another")
+	if id, _ := st.whoami(t); id != 0 {
+		t.Errorf("user %d logged in on a replay", id)
+	}
+}
+
+func TestOIDCLoginWithoutSession(t *testing.T) {
+	st := newSSOTest(t)
+
+	resp := st.get(t, "/login/oidc/callback?code=stolen&state=")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/" {
+		t.Errorf("callback without a login started ended with %s to %q", resp.Status, resp.Header.Get("Location"))
+	}
+	if id, _ := st.whoami(t); id != 0 {
+		t.Errorf("user %d logged in", id)
+	}
+}
+
+func TestOIDCUser(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing is a user already there, linked to subject if it is set
+		existing *models.User
+		subject  string
+		claims   oidc.Claims
+		wantErr  error
+		// wantLevel is the access level of the user afterwards
+		wantLevel int
+		// wantLinked is whether the user is linked to the claims' subject afterwards
+		wantLinked bool
+	}{
+		{
+			name:       "new user is created with their role",
+			claims:     ssoClaims("bob-1", "bob@example.com", true, "staff"),
+			wantLevel:  models.AccessViewer,
+			wantLinked: true,
+		},
+		{
+			name:    "new user without a role is turned away",
+			claims:  ssoClaims("bob-1", "bob@example.com", true, "sales"),
+			wantErr: errNoRole,
+		},
+		{
+			name:    "new user without an email address is turned away",
+			claims:  ssoClaims("bob-1", "", true, "staff"),
+			wantErr: errSSONoEmail,
+		},
+		{
+			name:       "existing account is linked by verified email",
+			existing:   &models.User{Email: "Bob@Example.com", AccessLevel: models.AccessViewer, UserActive: 1},
+			claims:     ssoClaims("bob-1", "bob@example.com", true, "vigilate-admins"),
+			wantLevel:  models.AccessAdmin,
+			wantLinked: true,
+		},
+		{
+			name:      "existing account is not linked by unverified email",
+			existing:  &models.User{Email: "bob@example.com", AccessLevel: models.AccessViewer, UserActive: 1},
+			claims:    ssoClaims("bob-1", "bob@example.com", false, "vigilate-admins"),
+			wantErr:   errSSOUnverified,
+			wantLevel: models.AccessViewer,
+		},
+		{
+			name:       "linked user gets the role of their groups",
+			existing:   &models.User{Email: "bob@example.com", AccessLevel: models.AccessAdmin, UserActive: 1},
+			subject:    "bob-1",
+			claims:     ssoClaims("bob-1", "bob@example.com", false, "staff"),
+			wantLevel:  models.AccessViewer,
+			wantLinked: true,
+		},
+		{
+			name:       "linked user who lost their groups is turned away",
+			existing:   &models.User{Email: "bob@example.com", AccessLevel: models.AccessAdmin, UserActive: 1},
+			subject:    "bob-1",
+			claims:     ssoClaims("bob-1", "bob@example.com", true),
+			wantErr:    errNoRole,
+			wantLevel:  models.AccessAdmin,
+			wantLinked: true,
+		},
+		{
+			name:       "inactive user is turned away",
+			existing:   &models.User{Email: "bob@example.com", AccessLevel: models.AccessViewer, UserActive: 0},
+			subject:    "bob-1",
+			claims:     ssoClaims("bob-1", "bob@example.com", true, "staff"),
+			wantErr:    models.ErrInactiveAccount,
+			wantLevel:  models.AccessViewer,
+			wantLinked: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			a := &config.AppConfig{OIDC: oidc.New(oidc.Config{Roles: ssoRoles})}
+			repo := &DBRepo{App: a, DB: db}
+			NewHandlers(repo, a)
+
+			if tt.existing != nil {
+				u := db.addUser(*tt.existing)
+				if tt.subject != "" {
+					db.oidcSubjects[u.ID] = tt.subject
+				}
+			}
+
+			_, err := repo.oidcUser(tt.claims)
+			if err != tt.wantErr {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			u, err := db.GetUserByEmail(tt.claims.Email)
+			if err != nil {
+				if tt.wantLevel != 0 {
+					t.Fatal("no user")
+				}
+				return
+			}
+
+			if u.AccessLevel != tt.wantLevel {
+				t.Errorf("access level is %d, want %d", u.AccessLevel, tt.wantLevel)
+			}
+			if linked := db.oidcSubjects[u.ID] == tt.claims.Subject; linked != tt.wantLinked {
+				t.Errorf("linked is %v, want %v", linked, tt.wantLinked)
+			}
+		})
+	}
+}
+
+// ssoClaims returns the claims of a verified ID token
+func ssoClaims(subject, email string, verified bool, groups ...string) oidc.Claims {
+	raw := map[string]interface{}{"sub": subject, "email": email}
+	var values []interface{}
+	for _, g := range groups {
+		values = append(values, g)
+	}
+	raw["groups"] = values
+
+	return oidc.Claims{
+		Subject:       subject,
+		Email:         email,
+		EmailVerified: verified,
+		Raw:           raw,
+	}
+}
@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/CloudyKit/jet/v6"
+	"github.com/go-chi/chi/v5"
+	"github.com/luksbutz/vigilate/internal/channeldata"
+	"github.com/luksbutz/vigilate/internal/helpers"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// passwordResetTimeout is how long a password reset link works for
+	passwordResetTimeout = time.Hour
+	// passwordResetLimit is how many links may be sent to one address in passwordResetWindow, so
+	// that nobody can fill a user's inbox
+	passwordResetLimit  = 3
+	passwordResetWindow = time.Hour
+)
+
+// errInvalidResetToken is returned for a password reset token that is forged, mangled or expired
+var errInvalidResetToken = errors.New("invalid password reset token")
+
+// ForgotPassword shows the form asking for the email address to send a password reset link to
+func (repo *DBRepo) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if !app.PasswordLogin {
+		http.NotFound(w, r)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("forgotPassword", true)
+
+	err := helpers.RenderPage(w, r, "login", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// PostForgotPassword emails a password reset link. The answer is the same whether or not the
+// address belongs to anyone, so that it can't be used to find out who has an account.
+func (repo *DBRepo) PostForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if !app.PasswordLogin {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	err = repo.sendPasswordReset(strings.TrimSpace(r.Form.Get("email")))
+	if err != nil {
+		log.Println(err)
+	}
+
+	app.Session.Put(r.Context(), "flash", "If that address has an account, a link to reset its password is on its way")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// sendPasswordReset emails a password reset link to the user with the given address, if there is
+// one who may have it
+func (repo *DBRepo) sendPasswordReset(email string) error {
+	if email == "" {
+		return nil
+	}
+
+	u, err := repo.DB.GetUserByEmail(email)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if u.UserActive != 1 {
+		return nil
+	}
+
+	// the password of a directory user lives in the directory, and is changed there
+	ldapUser, err := repo.DB.IsLDAPUser(u.ID)
+	if err != nil {
+		return err
+	}
+	if ldapUser {
+		log.Printf("Password reset: user %d logs in with LDAP, so no link was sent", u.ID)
+		return nil
+	}
+
+	// a single sign-on user logs in at the identity provider, so a link would only give them a
+	// second way in, which the provider can't turn off
+	ssoUser, err := repo.DB.IsOIDCUser(u.ID)
+	if err != nil {
+		return err
+	}
+	if ssoUser {
+		log.Printf("Password reset: user %d logs in with single sign-on, so no link was sent", u.ID)
+		return nil
+	}
+
+	sent, err := repo.DB.CountPasswordResetsSince(u.ID, time.Now().Add(-passwordResetWindow))
+	if err != nil {
+		return err
+	}
+	if sent >= passwordResetLimit {
+		log.Printf("Password reset: user %d was sent %d links in the last %s, so no more were sent", u.ID, sent, passwordResetWindow)
+		return nil
+	}
+
+	siteURL := strings.TrimRight(app.PreferenceMap["site_url"], "/")
+	if siteURL == "" {
+		return errors.New("password reset: set the URL of this application in settings to send links")
+	}
+
+	expires := time.Now().Add(passwordResetTimeout)
+	token, err := newPasswordResetToken(u.ID, expires)
+	if err != nil {
+		return err
+	}
+
+	err = repo.DB.InsertPasswordReset(u.ID, HashAPIToken(token), expires)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/password/reset/%s", siteURL, token)
+	helpers.SendEmail(channeldata.MailData{
+		ToName:    strings.TrimSpace(u.FirstName + " " + u.LastName),
+		ToAddress: u.Email,
+		Subject:   "Reset your vigilate password",
+		Content: template.HTML(fmt.Sprintf(`<p>Someone, hopefully you, asked to reset the password of your vigilate account.
+						Follow this link within an hour to choose a new one:</p>
+						<p><a href="%s">%s</a></p>
+						<p>If it wasn't you, you can ignore this email: your password hasn't changed.</p>`,
+			template.HTMLEscapeString(link),
+			template.HTMLEscapeString(link))),
+	})
+
+	return nil
+}
+
+// ResetPassword shows the form for choosing a new password, when the link's token is good
+func (repo *DBRepo) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if !app.PasswordLogin {
+		http.NotFound(w, r)
+		return
+	}
+
+	// the token is in the url, so it mustn't leak to the sites the page loads scripts from
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	token := chi.URLParam(r, "token")
+	if !repo.passwordResetValid(w, r, token) {
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("resetToken", token)
+
+	err := helpers.RenderPage(w, r, "login", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// PostResetPassword sets a new password with a password reset link. Browsers remembered before
+// then are logged out, the account is unlocked, and the link can't be used again.
+func (repo *DBRepo) PostResetPassword(w http.ResponseWriter, r *http.Request) {
+	if !app.PasswordLogin {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	token := chi.URLParam(r, "token")
+	if !repo.passwordResetValid(w, r, token) {
+		return
+	}
+
+	password := r.Form.Get("password")
+	if password == "" || password != r.Form.Get("confirm_password") {
+		app.Session.Put(r.Context(), "error", "The passwords do not match")
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+
+	userID, _ := parsePasswordResetToken(token)
+	ok, err := repo.DB.UsePasswordReset(userID, HashAPIToken(token))
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+	if !ok {
+		app.Session.Put(r.Context(), "error", "This password reset link has been used already, or has expired")
+		http.Redirect(w, r, "/password/forgot", http.StatusSeeOther)
+		return
+	}
+
+	// this logs out remembered browsers, and spoils any other links the user was sent
+	err = repo.DB.UpdatePassword(userID, password)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	// whoever locked the account by guessing at it didn't know this password
+	err = repo.DB.UnlockUser(userID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	log.Printf("Password reset: user %d chose a new password", userID)
+
+	app.Session.Put(r.Context(), "flash", "Your password has been changed; please log in")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// passwordResetValid reports whether a password reset token is signed, unexpired and unused, and
+// if not, sends the browser to ask for a new link
+func (repo *DBRepo) passwordResetValid(w http.ResponseWriter, r *http.Request, token string) bool {
+	userID, err := parsePasswordResetToken(token)
+	if err == nil {
+		var ok bool
+		ok, err = repo.DB.PasswordResetValid(userID, HashAPIToken(token))
+		if err != nil {
+			ServerError(w, r, err)
+			return false
+		}
+		if ok {
+			return true
+		}
+	}
+
+	app.Session.Put(r.Context(), "error", "This password reset link has been used already, or has expired")
+	http.Redirect(w, r, "/password/forgot", http.StatusSeeOther)
+	return false
+}
+
+// newPasswordResetToken returns a token for a password reset link: the user's id, when it
+// expires, and a random part, signed with app.PasswordResetKey
+func newPasswordResetToken(userID int, expires time.Time) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	payload := fmt.Sprintf("%d.%d.%s", userID, expires.Unix(), base64.RawURLEncoding.EncodeToString(b))
+
+	return payload + "." + signPasswordReset(payload), nil
+}
+
+// parsePasswordResetToken checks the signature and expiry of a password reset token, and returns
+// the id of the user it is for. Whether it has been used is up to the database.
+func parsePasswordResetToken(token string) (int, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return 0, errInvalidResetToken
+	}
+
+	payload, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(signPasswordReset(payload))) {
+		return 0, errInvalidResetToken
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return 0, errInvalidResetToken
+	}
+
+	userID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, errInvalidResetToken
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, errInvalidResetToken
+	}
+
+	return userID, nil
+}
+
+// signPasswordReset returns the signature of a password reset token's payload
+func signPasswordReset(payload string) string {
+	mac := hmac.New(sha256.New, app.PasswordResetKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"github.com/luksbutz/vigilate/internal/config"
+	"github.com/luksbutz/vigilate/internal/models"
+	"testing"
+)
+
+func TestSendPasswordResetSkipsOtherLogins(t *testing.T) {
+	tests := []struct {
+		name        string
+		user        models.User
+		ldapDN      string
+		oidcSubject string
+		// wantSent is whether a link gets as far as being counted against the user's limit
+		wantSent bool
+	}{
+		{"local user", models.User{Email: "bob@example.com", UserActive: 1}, "", "", true},
+		{"inactive user", models.User{Email: "bob@example.com", UserActive: 0}, "", "", false},
+		{"LDAP user", models.User{Email: "bob@example.com", UserActive: 1}, "uid=bob,ou=people,dc=example,dc=com", "", false},
+		{"single sign-on user", models.User{Email: "bob@example.com", UserActive: 1}, "", "bob-1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			a := &config.AppConfig{}
+			repo := &DBRepo{App: a, DB: db}
+			NewHandlers(repo, a)
+
+			u := db.addUser(tt.user)
+			if tt.ldapDN != "" {
+				db.ldapDNs[u.ID] = tt.ldapDN
+			}
+			if tt.oidcSubject != "" {
+				db.oidcSubjects[u.ID] = tt.oidcSubject
+			}
+
+			if err := repo.sendPasswordReset("Bob@Example.com"); err != nil {
+				t.Fatal(err)
+			}
+
+			if sent := len(db.resetsCounted) > 0; sent != tt.wantSent {
+				t.Errorf("link sent is %v, want %v", sent, tt.wantSent)
+			}
+		})
+	}
+}
@@ -5,11 +5,8 @@ import (
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/luksbutz/vigilate/internal/certificateutils"
-	"github.com/luksbutz/vigilate/internal/channeldata"
-	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/metrics"
 	"github.com/luksbutz/vigilate/internal/models"
-	"github.com/luksbutz/vigilate/internal/sms"
-	"html/template"
 	"log"
 	"net/http"
 	"strconv"
@@ -24,6 +21,8 @@ const (
 	HTTPS = 2
 	// SSLCertificate is ssl certificate check
 	SSLCertificate = 3
+	// Heartbeat is the passive check, fed by pings from outside
+	Heartbeat = 4
 )
 
 // jsonResp describes the JSON response sent back to client
@@ -74,7 +73,7 @@ func (repo *DBRepo) updateHostServiceStatusCount(h models.Host, hs models.HostSe
 		return
 	}
 
-	healthy, warning, problem, pending, err := repo.DB.GetAllServiceStatusCounts()
+	healthy, warning, problem, pending, unknown, unreachable, err := repo.DB.GetAllServiceStatusCounts()
 	if err != nil {
 		log.Println(err)
 		return
@@ -85,6 +84,8 @@ func (repo *DBRepo) updateHostServiceStatusCount(h models.Host, hs models.HostSe
 	data["warning_count"] = strconv.Itoa(warning)
 	data["problem_count"] = strconv.Itoa(problem)
 	data["pending_count"] = strconv.Itoa(pending)
+	data["unknown_count"] = strconv.Itoa(unknown)
+	data["unreachable_count"] = strconv.Itoa(unreachable)
 
 	repo.broadcastMessage("public-channel", "host-service-count-changed", data)
 
@@ -111,6 +112,49 @@ func (repo *DBRepo) TestCheck(w http.ResponseWriter, r *http.Request) {
 		okay = false
 	}
 
+	message := "Something went wrong"
+	if okay && !scheduled(hs) {
+		message = "This service gets its status from Alertmanager alerts, and can't be checked"
+		okay = false
+	}
+
+	if okay {
+		hs, err = repo.checkHostService(h, hs)
+		if err != nil {
+			log.Println(err)
+			okay = false
+		}
+	}
+
+	var resp jsonResp
+
+	// create JSON
+	if okay {
+		resp = jsonResp{
+			OK:            true,
+			Message:       hs.LastMessage,
+			ServiceID:     hs.ServiceID,
+			HostServiceID: hs.ID,
+			HostID:        hs.HostID,
+			OldStatus:     oldStatus,
+			NewStatus:     hs.Status,
+			LastCheck:     hs.LastCheck,
+		}
+	} else {
+		resp.OK = false
+		resp.Message = message
+	}
+
+	// send JSON to client
+	out, _ := json.MarshalIndent(resp, "", "\t")
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
+
+// checkHostService tests a host service right away, records the result as an event, broadcasts
+// a status change and saves the new status and last check time. It returns the updated host service.
+func (repo *DBRepo) checkHostService(h models.Host, hs models.HostService) (models.HostService, error) {
 	// test the service
 	msg, newStatus := repo.testServiceForHost(h, hs)
 
@@ -124,7 +168,7 @@ func (repo *DBRepo) TestCheck(w http.ResponseWriter, r *http.Request) {
 		Message:       msg,
 	}
 
-	err = repo.DB.InsertEvent(event)
+	err := repo.DB.InsertEvent(event)
 	if err != nil {
 		log.Println(err)
 	}
@@ -141,41 +185,16 @@ func (repo *DBRepo) TestCheck(w http.ResponseWriter, r *http.Request) {
 	hs.LastCheck = time.Now()
 
 	err = repo.DB.UpdateHostService(hs)
-	if err != nil {
-		log.Println(err)
-		okay = false
-	}
-
-	var resp jsonResp
-
-	// create JSON
-	if okay {
-		resp = jsonResp{
-			OK:            true,
-			Message:       msg,
-			ServiceID:     hs.ServiceID,
-			HostServiceID: hs.ID,
-			HostID:        hs.HostID,
-			OldStatus:     oldStatus,
-			NewStatus:     newStatus,
-			LastCheck:     hs.LastCheck,
-		}
-	} else {
-		resp.OK = false
-		resp.Message = "Something went wrong"
-	}
 
-	// send JSON to client
-	out, _ := json.MarshalIndent(resp, "", "\t")
-
-	w.Header().Set("Content-Type", "application/json")
-	_, _ = w.Write(out)
+	return hs, err
 }
 
 // testServiceForHost checks the service according to service id
 func (repo *DBRepo) testServiceForHost(h models.Host, hs models.HostService) (string, string) {
 	var msg, newStatus string
 
+	start := time.Now()
+
 	switch hs.ServiceID {
 	case HTTP:
 		msg, newStatus = repo.testHTTPForHost(h.URL)
@@ -186,9 +205,43 @@ func (repo *DBRepo) testServiceForHost(h models.Host, hs models.HostService) (st
 	case SSLCertificate:
 		msg, newStatus = repo.testSSLForHost(h.URL)
 		break
+	case Heartbeat:
+		msg, newStatus = repo.testHeartbeat(hs)
+		break
+	default:
+		switch hs.Service.CheckType {
+		case models.CheckTypeCommand:
+			msg, newStatus = repo.testCommandForHost(h, hs)
+		case models.CheckTypeAgent:
+			msg, newStatus = repo.testAgentCheck(h, hs)
+		case models.CheckTypeAlertmanager:
+			// there is nothing to check: the status is whatever the alerts last said
+			return hs.LastMessage, hs.Status
+		}
+	}
+
+	return repo.recordCheckResult(h, hs, msg, newStatus, time.Since(start))
+}
+
+// recordCheckResult handles the outcome of a check: it counts it, and when the status changes it
+// saves an event, tells connected clients and sends notifications. It returns the message and
+// status to save, which differ from the ones given if a parent host is down.
+func (repo *DBRepo) recordCheckResult(h models.Host, hs models.HostService, msg, newStatus string, elapsed time.Duration) (string, string) {
+	// a failure behind a parent host that is down is reported as unreachable, and not notified
+	if newStatus == "problem" {
+		down, err := repo.DB.ParentHostDown(h.ID)
+		if err != nil {
+			log.Println(err)
+		} else if down {
+			newStatus = "unreachable"
+			msg = fmt.Sprintf("%s (parent host is down)", msg)
+		}
 	}
 
+	metrics.ObserveCheck(hs.ID, hs.Service.ServiceName, newStatus, elapsed)
+
 	if hs.Status != newStatus {
+		metrics.StateChanges.Inc(hs.Status, newStatus)
 		repo.pushStatusChangedEvent(h, hs, newStatus)
 
 		// save event
@@ -205,58 +258,13 @@ func (repo *DBRepo) testServiceForHost(h models.Host, hs models.HostService) (st
 			log.Println(err)
 		}
 
-		// send email
-		if repo.App.PreferenceMap["notify_via_email"] == "1" {
-			if hs.Status != "pending" {
-				mm := channeldata.MailData{
-					ToName:    repo.App.PreferenceMap["notify_name"],
-					ToAddress: repo.App.PreferenceMap["notify_email"],
-				}
-
-				switch newStatus {
-				case "healthy":
-					mm.Subject = fmt.Sprintf("HEALTHY: service %s on %s", hs.Service.ServiceName, hs.HostName)
-					mm.Content = template.HTML(fmt.Sprintf(`<p>Service %s on %s reported healthy status</p>
-						<p><strong>Messaged received:</strong> %s</p>`, hs.Service.ServiceName, hs.HostName, msg))
-				case "problem":
-					mm.Subject = fmt.Sprintf("PROBLEM: service %s on %s", hs.Service.ServiceName, hs.HostName)
-					mm.Content = template.HTML(fmt.Sprintf(`<p>Service %s on %s reported problem status</p>
-						<p><strong>Messaged received:</strong> %s</p>`, hs.Service.ServiceName, hs.HostName, msg))
-				case "warning":
-					mm.Subject = fmt.Sprintf("WARNING: service %s on %s", hs.Service.ServiceName, hs.HostName)
-					mm.Content = template.HTML(fmt.Sprintf(`<p>Service %s on %s reported warning status</p>
-						<p><strong>Messaged received:</strong> %s</p>`, hs.Service.ServiceName, hs.HostName, msg))
-				default:
-				}
-
-				if len(mm.Content) > 0 {
-					helpers.SendEmail(mm)
-				}
-			}
-		}
-
-		// send sms
-		if repo.App.PreferenceMap["notify_via_sms"] == "1" {
-			to := repo.App.PreferenceMap["sms_notify_number"]
-			smsMessage := ""
-
-			switch newStatus {
-			case "healthy":
-				smsMessage = fmt.Sprintf("Service %s on %s is healthy", hs.Service.ServiceName, hs.HostName)
-			case "problem":
-				smsMessage = fmt.Sprintf("Service %s on %s reports a problem: %s", hs.Service.ServiceName, hs.HostName, msg)
-			case "warning":
-				smsMessage = fmt.Sprintf("Service %s on %s repots a warning: %s", hs.Service.ServiceName, hs.HostName, msg)
-			default:
-			}
-
-			if len(smsMessage) > 0 {
-				err := sms.SendTextTwilio(to, smsMessage, repo.App)
-				if err != nil {
-					log.Println("Error sending sms in perform-checks.go", err)
-				}
-			}
-		}
+		// send notifications (possibly grouped with other changes)
+		repo.notifyStatusChange(statusChange{
+			HostService: hs,
+			OldStatus:   hs.Status,
+			NewStatus:   newStatus,
+			Message:     msg,
+		})
 	}
 
 	repo.pushScheduleChangeEvent(hs, newStatus)
@@ -264,6 +272,17 @@ func (repo *DBRepo) testServiceForHost(h models.Host, hs models.HostService) (st
 	return msg, newStatus
 }
 
+// applyPassiveResult handles a status reported from outside, by a ping or an alert, as if a check
+// had found it, and saves it if it is a change
+func (repo *DBRepo) applyPassiveResult(h models.Host, hs models.HostService, msg, newStatus string) (string, string) {
+	msg, newStatus = repo.recordCheckResult(h, hs, msg, newStatus, 0)
+	if newStatus != hs.Status {
+		repo.updateHostServiceStatusCount(h, hs, newStatus, msg)
+	}
+
+	return msg, newStatus
+}
+
 func (repo *DBRepo) pushStatusChangedEvent(h models.Host, hs models.HostService, newStatus string) {
 	data := map[string]string{
 		"host_id":         strconv.Itoa(hs.HostID),
@@ -402,11 +421,10 @@ func (repo *DBRepo) broadcastMessage(channel, messageType string, data map[strin
 }
 
 func (repo *DBRepo) addToMonitorMap(hs models.HostService) {
-	if repo.App.PreferenceMap["monitoring_live"] == "1" {
+	if repo.App.PreferenceMap["monitoring_live"] == "1" && scheduled(hs) {
 		var j job
 		j.HostServiceID = hs.ID
-		scheduleID, err := repo.App.Scheduler.AddJob(
-			fmt.Sprintf("@every %d%s", hs.ScheduleNumber, hs.ScheduleUnit), j)
+		scheduleID, err := repo.App.Scheduler.AddJob(cronSpec(hs), j)
 		if err != nil {
 			log.Println(err)
 			return
@@ -421,7 +439,7 @@ func (repo *DBRepo) addToMonitorMap(hs models.HostService) {
 		data["service"] = hs.Service.ServiceName
 		data["host"] = hs.HostName
 		data["last_run"] = hs.LastCheck.Format("2006-01-02 15:04:05")
-		data["schedule"] = fmt.Sprintf("@every %d%s", hs.ScheduleNumber, hs.ScheduleUnit)
+		data["schedule"] = cronSpec(hs)
 
 		repo.broadcastMessage("public-channel", "schedule-changed", data)
 
@@ -431,6 +449,7 @@ func (repo *DBRepo) addToMonitorMap(hs models.HostService) {
 func (repo *DBRepo) removeFromMonitorMap(hs models.HostService) {
 	if repo.App.PreferenceMap["monitoring_live"] == "1" {
 		repo.App.Scheduler.Remove(repo.App.MonitorMap[hs.ID])
+		delete(repo.App.MonitorMap, hs.ID)
 
 		data := make(map[string]string)
 		data["host_service_id"] = strconv.Itoa(hs.ID)
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/CloudyKit/jet/v6"
+	"github.com/go-chi/chi/v5"
+	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/metrics"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/push"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// AllPushTargets lists all push notification targets
+func (repo *DBRepo) AllPushTargets(w http.ResponseWriter, r *http.Request) {
+	targets, err := repo.DB.AllPushTargets()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("targets", targets)
+
+	err = helpers.RenderPage(w, r, "push-targets", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// PushTarget displays the add/edit push target page
+func (repo *DBRepo) PushTarget(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	var t models.PushTarget
+	t.Active = 1
+
+	if id > 0 {
+		target, err := repo.DB.GetPushTargetByID(id)
+		if err != nil {
+			log.Println(err)
+			ClientError(w, r, http.StatusBadRequest)
+			return
+		}
+		t = target
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("target", t)
+
+	err := helpers.RenderPage(w, r, "push-target", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// PostPushTarget adds/edits a push target
+func (repo *DBRepo) PostPushTarget(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	var t models.PushTarget
+	if id > 0 {
+		t, err = repo.DB.GetPushTargetByID(id)
+		if err != nil {
+			log.Println(err)
+			ClientError(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+
+	t.Name = r.Form.Get("name")
+	t.Kind = r.Form.Get("kind")
+	t.URL = r.Form.Get("url")
+	t.Token = r.Form.Get("token")
+	t.Recipient = r.Form.Get("recipient")
+	t.Active, _ = strconv.Atoi(r.Form.Get("active"))
+
+	if _, err := push.NewNotifier(t); err != nil {
+		repo.App.Session.Put(r.Context(), "error", "Please choose a valid target type")
+		http.Redirect(w, r, fmt.Sprintf("/admin/push-target/%d", t.ID), http.StatusSeeOther)
+		return
+	}
+
+	if t.ID > 0 {
+		err = repo.DB.UpdatePushTarget(t)
+	} else {
+		t.ID, err = repo.DB.InsertPushTarget(t)
+	}
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	repo.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, "/admin/push-targets", http.StatusSeeOther)
+}
+
+// DeletePushTarget deletes a push target
+func (repo *DBRepo) DeletePushTarget(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := repo.DB.DeletePushTarget(id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	repo.App.Session.Put(r.Context(), "flash", "Push target deleted")
+	http.Redirect(w, r, "/admin/push-targets", http.StatusSeeOther)
+}
+
+// TestPushTarget sends a test notification to a push target, and returns JSON response
+func (repo *DBRepo) TestPushTarget(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	resp := jsonResp{OK: true, Message: "Test notification sent"}
+
+	t, err := repo.DB.GetPushTargetByID(id)
+	if err == nil {
+		err = push.Send(t, "Vigilate test", "This is a test notification from vigilate", "warning")
+	}
+
+	if err != nil {
+		log.Println(err)
+		resp.OK = false
+		resp.Message = err.Error()
+	}
+
+	out, _ := json.MarshalIndent(resp, "", "\t")
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
+
+// sendPushNotifications sends a notification to all active push targets
+func (repo *DBRepo) sendPushNotifications(title, msg, status string) {
+	targets, err := repo.DB.AllPushTargets()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, t := range targets {
+		if t.Active != 1 {
+			continue
+		}
+
+		err := push.Send(t, title, msg, status)
+		metrics.NotificationResult("push", err)
+		if err != nil {
+			log.Println("Error sending push notification to", t.Name, err)
+		}
+	}
+}
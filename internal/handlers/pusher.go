@@ -9,7 +9,15 @@ import (
 	"strconv"
 )
 
+// PusherAuth authenticates a browser's subscription to a Pusher channel; it is only there when
+// live updates go through Pusher
 func (repo *DBRepo) PusherAuth(w http.ResponseWriter, r *http.Request) {
+	client := app.PusherClient
+	if client == nil {
+		http.NotFound(w, r)
+		return
+	}
+
 	userID := repo.App.Session.GetInt(r.Context(), "userID")
 
 	u, _ := repo.DB.GetUserById(userID)
@@ -24,7 +32,7 @@ func (repo *DBRepo) PusherAuth(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	response, err := app.WsClient.AuthenticatePresenceChannel(params, presenceData)
+	response, err := client.AuthenticatePresenceChannel(params, presenceData)
 	if err != nil {
 		log.Println(err)
 		return
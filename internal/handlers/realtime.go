@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// RealtimeWS opens the websocket that carries live updates from the built-in hub
+func (repo *DBRepo) RealtimeWS(w http.ResponseWriter, r *http.Request) {
+	if repo.App.Hub == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	repo.App.Hub.ServeWS(w, r, repo.App.Session.GetInt(r.Context(), "userID"))
+}
+
+// RealtimeEvents streams live updates from the built-in hub as server-sent events, for browsers
+// that can't open the websocket
+func (repo *DBRepo) RealtimeEvents(w http.ResponseWriter, r *http.Request) {
+	if repo.App.Hub == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	repo.App.Hub.ServeSSE(w, r, repo.App.Session.GetInt(r.Context(), "userID"))
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/CloudyKit/jet/v6"
+	"github.com/go-chi/chi/v5"
+	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/models"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// sessionTouchInterval is how often a session's last seen time and address are brought up to date
+const sessionTouchInterval = time.Minute
+
+// TrackSession records the logged in session of u the first time it is seen, so that it shows on
+// their sessions page. It reports false if the session has been logged out from there since.
+func (repo *DBRepo) TrackSession(r *http.Request, u models.User) (bool, error) {
+	now := time.Now()
+	ip := helpers.ClientIP(r)
+
+	id := app.Session.GetInt(r.Context(), "sessionID")
+	if id == 0 {
+		// sessions expire by themselves, so their records can go too
+		err := repo.DB.DeleteUserSessionsBefore(now.Add(-app.Session.Lifetime))
+		if err != nil {
+			log.Println(err)
+		}
+
+		id, err = repo.DB.InsertUserSession(models.UserSession{
+			UserID:    u.ID,
+			IPAddress: ip,
+			UserAgent: truncate(r.UserAgent(), 255),
+		})
+		if err != nil {
+			return false, err
+		}
+
+		app.Session.Put(r.Context(), "sessionID", id)
+		app.Session.Put(r.Context(), "sessionSeen", int(now.Unix()))
+		return true, nil
+	}
+
+	ok, err := repo.DB.UserSessionExists(u.ID, id)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if now.Unix()-int64(app.Session.GetInt(r.Context(), "sessionSeen")) >= int64(sessionTouchInterval.Seconds()) {
+		err = repo.DB.TouchUserSession(id, ip)
+		if err != nil {
+			log.Println(err)
+		}
+		app.Session.Put(r.Context(), "sessionSeen", int(now.Unix()))
+	}
+
+	return true, nil
+}
+
+// UserSessions shows where a user is logged in: their sessions, and the browsers that remember
+// them. Users see their own; admins see anyone's.
+func (repo *DBRepo) UserSessions(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	if !canManageUser(r, id) || id == 0 {
+		Forbidden(w, r)
+		return
+	}
+
+	u, err := repo.DB.GetUserById(id)
+	if err != nil {
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	sessions, err := repo.DB.AllUserSessions(id, time.Now().Add(-app.Session.Lifetime))
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	remembered, err := repo.DB.AllRememberTokensForUser(id)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	current, _ := helpers.CurrentUser(r)
+	currentSession := 0
+	if current.ID == id {
+		currentSession = app.Session.GetInt(r.Context(), "sessionID")
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("user", u)
+	vars.Set("sessions", sessions)
+	vars.Set("remembered", remembered)
+	vars.Set("currentSession", currentSession)
+
+	err = helpers.RenderPage(w, r, "sessions", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// DeleteUserSession logs out one of a user's sessions
+func (repo *DBRepo) DeleteUserSession(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	if !canManageUser(r, id) {
+		Forbidden(w, r)
+		return
+	}
+
+	sessionID, _ := strconv.Atoi(chi.URLParam(r, "sessionID"))
+	err := repo.DB.DeleteUserSession(id, sessionID)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	// the session's live update connections reconnect, and are turned away if it was theirs
+	disconnectUser(id)
+
+	app.Session.Put(r.Context(), "flash", "Session logged out")
+	http.Redirect(w, r, fmt.Sprintf("/admin/user/%d/sessions", id), http.StatusSeeOther)
+}
+
+// DeleteRememberedBrowser stops a browser that remembers a user from logging them in again
+func (repo *DBRepo) DeleteRememberedBrowser(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	if !canManageUser(r, id) {
+		Forbidden(w, r)
+		return
+	}
+
+	tokenID, _ := strconv.Atoi(chi.URLParam(r, "tokenID"))
+	err := repo.DB.DeleteRememberTokenByID(id, tokenID)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Browser forgotten")
+	http.Redirect(w, r, fmt.Sprintf("/admin/user/%d/sessions", id), http.StatusSeeOther)
+}
+
+// LogOutEverywhere logs out all of a user's sessions and forgets every browser that remembers
+// them. A user doing it for themselves is logged out here too.
+func (repo *DBRepo) LogOutEverywhere(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	if !canManageUser(r, id) || id == 0 {
+		Forbidden(w, r)
+		return
+	}
+
+	err := repo.DB.DeleteUserSessionsForUser(id)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	err = repo.DB.DeleteRememberMeTokensForUser(id)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	disconnectUser(id)
+
+	current, _ := helpers.CurrentUser(r)
+	if current.ID == id {
+		repo.Logout(w, r)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "User logged out everywhere")
+	http.Redirect(w, r, fmt.Sprintf("/admin/user/%d/sessions", id), http.StatusSeeOther)
+}
+
+// disconnectUser closes a user's live update connections, if the built-in hub is in use
+func disconnectUser(id int) {
+	if app.Hub != nil {
+		app.Hub.DisconnectUser(id)
+	}
+}
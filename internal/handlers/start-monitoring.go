@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"fmt"
+	"github.com/luksbutz/vigilate/internal/models"
 	"log"
 	"strconv"
 	"time"
@@ -37,14 +38,13 @@ func (repo *DBRepo) StartMonitoring() {
 
 		// range through the services
 		for _, x := range servicesToMonitor {
-			//	get the schedule unit and number
-			var sch string
-			if x.ScheduleUnit == "d" {
-				sch = fmt.Sprintf("@every %d%s", x.ScheduleNumber*24, "h")
-			} else {
-				sch = fmt.Sprintf("@every %d%s", x.ScheduleNumber, x.ScheduleUnit)
+			if !scheduled(x) {
+				continue
 			}
 
+			//	get the schedule unit and number
+			sch := cronSpec(x)
+
 			// create a job
 			var j job
 			j.HostServiceID = x.ID
@@ -92,3 +92,35 @@ func (repo *DBRepo) StartMonitoring() {
 		}
 	}
 }
+
+// scheduled returns false for host services that are never checked by vigilate, since their status
+// comes from outside
+func scheduled(hs models.HostService) bool {
+	return hs.Service.CheckType != models.CheckTypeAlertmanager
+}
+
+// cronSpec returns the schedule of the job that checks a host service. A heartbeat's job only looks
+// for a missed ping, so it runs at least every minute to notice one soon after it was due.
+func cronSpec(hs models.HostService) string {
+	if hs.ServiceID == Heartbeat && scheduleDuration(hs.ScheduleNumber, hs.ScheduleUnit) > time.Minute {
+		return "@every 1m"
+	}
+
+	if hs.ScheduleUnit == "d" {
+		return fmt.Sprintf("@every %d%s", hs.ScheduleNumber*24, "h")
+	}
+	return fmt.Sprintf("@every %d%s", hs.ScheduleNumber, hs.ScheduleUnit)
+}
+
+// scheduleDuration converts a schedule number and unit (s, m, h or d) to a duration
+func scheduleDuration(number int, unit string) time.Duration {
+	switch unit {
+	case "s":
+		return time.Duration(number) * time.Second
+	case "h":
+		return time.Duration(number) * time.Hour
+	case "d":
+		return time.Duration(number) * 24 * time.Hour
+	}
+	return time.Duration(number) * time.Minute
+}
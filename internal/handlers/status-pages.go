@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/CloudyKit/jet/v6"
+	"github.com/go-chi/chi/v5"
+	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/luksbutz/vigilate/internal/uptime"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// statusPageDays is the number of days of uptime history shown on a status page
+	statusPageDays = 90
+	// statusPageCacheTTL is how long a rendered status page is served from memory
+	statusPageCacheTTL = time.Minute
+)
+
+var validSlug = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// noticeSeverities are the kinds of notice that can be posted on a status page
+var noticeSeverities = []string{"info", "maintenance", "incident"}
+
+// statusPageCache holds rendered public status pages by slug
+type statusPageCache struct {
+	mu    sync.Mutex
+	pages map[string]cachedStatusPage
+}
+
+type cachedStatusPage struct {
+	body    []byte
+	expires time.Time
+}
+
+var publicStatusPages = statusPageCache{pages: make(map[string]cachedStatusPage)}
+
+func (c *statusPageCache) get(slug string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pages[slug]
+	if !ok || time.Now().After(p.expires) {
+		return nil, false
+	}
+	return p.body, true
+}
+
+func (c *statusPageCache) set(slug string, body []byte) {
+	c.mu.Lock()
+	c.pages[slug] = cachedStatusPage{body: body, expires: time.Now().Add(statusPageCacheTTL)}
+	c.mu.Unlock()
+}
+
+// clear empties the cache, so that changes made by an admin show up right away
+func (c *statusPageCache) clear() {
+	c.mu.Lock()
+	c.pages = make(map[string]cachedStatusPage)
+	c.mu.Unlock()
+}
+
+// publicComponent is a component as shown on the public status page
+type publicComponent struct {
+	Name       string
+	Status     string
+	StatusText string
+	Uptime     string
+	Days       []publicDay
+	Services   []models.HostService
+}
+
+// publicDay is one bar of a component's uptime history
+type publicDay struct {
+	Level string
+	Title string
+}
+
+// AllStatusPages lists all status pages
+func (repo *DBRepo) AllStatusPages(w http.ResponseWriter, r *http.Request) {
+	pages, err := repo.DB.AllStatusPages()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("pages", pages)
+
+	err = helpers.RenderPage(w, r, "status-pages", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// StatusPage displays the add/edit page for a status page, its components and notices
+func (repo *DBRepo) StatusPage(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	var p models.StatusPage
+	p.Active = 1
+
+	if id > 0 {
+		page, err := repo.DB.GetStatusPageByID(id)
+		if err != nil {
+			log.Println(err)
+			ClientError(w, r, http.StatusNotFound)
+			return
+		}
+		p = page
+	}
+
+	services, err := repo.DB.GetServicesByStatus("", models.HostFilter{})
+	if err != nil {
+		log.Println(err)
+	}
+
+	// which services are selected, by component index
+	selected := make(map[int]map[int]bool)
+	for i, c := range p.Components {
+		selected[i] = make(map[int]bool)
+		for _, hsID := range c.HostServiceIDs {
+			selected[i][hsID] = true
+		}
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("page", p)
+	vars.Set("services", services)
+	vars.Set("selected", selected)
+	vars.Set("newComponent", len(p.Components))
+	vars.Set("severities", noticeSeverities)
+
+	err = helpers.RenderPage(w, r, "status-page", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// PostStatusPage saves a status page and its components
+func (repo *DBRepo) PostStatusPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	p := models.StatusPage{
+		ID:          id,
+		Name:        strings.TrimSpace(r.Form.Get("name")),
+		Slug:        strings.ToLower(strings.TrimSpace(r.Form.Get("slug"))),
+		Description: strings.TrimSpace(r.Form.Get("description")),
+	}
+	p.Active, _ = strconv.Atoi(r.Form.Get("active"))
+
+	redirect := fmt.Sprintf("/admin/status-page/%d", id)
+
+	if p.Name == "" || !validSlug.MatchString(p.Slug) {
+		repo.App.Session.Put(r.Context(), "error", "Please enter a name, and an address made of lower case letters, digits and dashes")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	if id > 0 {
+		err = repo.DB.UpdateStatusPage(p)
+	} else {
+		p.ID, err = repo.DB.InsertStatusPage(p)
+	}
+	if err != nil {
+		log.Println(err)
+		repo.App.Session.Put(r.Context(), "error", "Could not save the status page. Is the address already in use?")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	// components are numbered 0..component_count-1; those left without a name are removed
+	var components []models.StatusPageComponent
+	count, _ := strconv.Atoi(r.Form.Get("component_count"))
+	for i := 0; i < count; i++ {
+		c := models.StatusPageComponent{
+			Name: strings.TrimSpace(r.Form.Get(fmt.Sprintf("component_name_%d", i))),
+		}
+		if c.Name == "" {
+			continue
+		}
+
+		c.SortOrder, _ = strconv.Atoi(r.Form.Get(fmt.Sprintf("component_order_%d", i)))
+		for _, x := range r.Form[fmt.Sprintf("component_services_%d", i)] {
+			if hsID, _ := strconv.Atoi(x); hsID > 0 {
+				c.HostServiceIDs = append(c.HostServiceIDs, hsID)
+			}
+		}
+
+		components = append(components, c)
+	}
+
+	err = repo.DB.UpdateStatusPageComponents(p.ID, components)
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	publicStatusPages.clear()
+
+	repo.App.Session.Put(r.Context(), "flash", "Changes saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/status-page/%d", p.ID), http.StatusSeeOther)
+}
+
+// DeleteStatusPage deletes a status page
+func (repo *DBRepo) DeleteStatusPage(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	err := repo.DB.DeleteStatusPage(id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	publicStatusPages.clear()
+
+	repo.App.Session.Put(r.Context(), "flash", "Status page deleted")
+	http.Redirect(w, r, "/admin/status-pages", http.StatusSeeOther)
+}
+
+// PostStatusPageNotice posts a notice on a status page
+func (repo *DBRepo) PostStatusPageNotice(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	redirect := fmt.Sprintf("/admin/status-page/%d#notices", id)
+
+	n := models.StatusPageNotice{
+		StatusPageID: id,
+		Title:        strings.TrimSpace(r.Form.Get("title")),
+		Body:         strings.TrimSpace(r.Form.Get("body")),
+		Severity:     noticeSeverities[0],
+	}
+
+	for _, s := range noticeSeverities {
+		if r.Form.Get("severity") == s {
+			n.Severity = s
+		}
+	}
+
+	if n.Title == "" {
+		repo.App.Session.Put(r.Context(), "error", "Please give the notice a title")
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	_, err = repo.DB.InsertStatusPageNotice(n)
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	publicStatusPages.clear()
+
+	repo.App.Session.Put(r.Context(), "flash", "Notice posted")
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// ResolveStatusPageNotice marks a notice as resolved
+func (repo *DBRepo) ResolveStatusPageNotice(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	noticeID, _ := strconv.Atoi(chi.URLParam(r, "noticeID"))
+
+	err := repo.DB.ResolveStatusPageNotice(id, noticeID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	publicStatusPages.clear()
+
+	repo.App.Session.Put(r.Context(), "flash", "Notice resolved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/status-page/%d#notices", id), http.StatusSeeOther)
+}
+
+// DeleteStatusPageNotice deletes a notice
+func (repo *DBRepo) DeleteStatusPageNotice(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+	noticeID, _ := strconv.Atoi(chi.URLParam(r, "noticeID"))
+
+	err := repo.DB.DeleteStatusPageNotice(id, noticeID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	publicStatusPages.clear()
+
+	repo.App.Session.Put(r.Context(), "flash", "Notice deleted")
+	http.Redirect(w, r, fmt.Sprintf("/admin/status-page/%d#notices", id), http.StatusSeeOther)
+}
+
+// PublicStatusPage shows a status page to anyone, without logging in. Rendered pages are kept
+// in memory for a minute, and browsers and proxies may cache them for as long.
+func (repo *DBRepo) PublicStatusPage(w http.ResponseWriter, r *http.Request) {
+	slug := chi.URLParam(r, "slug")
+
+	body, ok := publicStatusPages.get(slug)
+	if !ok {
+		p, err := repo.DB.GetStatusPageBySlug(slug)
+		if errors.Is(err, sql.ErrNoRows) {
+			ClientError(w, r, http.StatusNotFound)
+			return
+		} else if err != nil {
+			ServerError(w, r, err)
+			return
+		}
+
+		vars, err := repo.publicStatusPageVars(p)
+		if err != nil {
+			ServerError(w, r, err)
+			return
+		}
+
+		var b bytes.Buffer
+		err = helpers.RenderPublicPage(&b, "status-page-public", vars)
+		if err != nil {
+			ServerError(w, r, err)
+			return
+		}
+
+		body = b.Bytes()
+		publicStatusPages.set(slug, body)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(statusPageCacheTTL.Seconds())))
+	_, _ = w.Write(body)
+}
+
+// publicStatusPageVars works out the current status and uptime history of each component
+func (repo *DBRepo) publicStatusPageVars(p models.StatusPage) (jet.VarMap, error) {
+	now := time.Now()
+
+	var ids []int
+	for _, c := range p.Components {
+		ids = append(ids, c.HostServiceIDs...)
+	}
+
+	events, err := repo.DB.GetEventsForHostServicesSince(ids, now.AddDate(0, 0, -statusPageDays))
+	if err != nil {
+		return nil, err
+	}
+	history := uptime.FromEvents(events)
+
+	overall := ""
+	var components []publicComponent
+
+	for _, c := range p.Components {
+		pc := publicComponent{Name: c.Name, Services: c.HostServices}
+
+		// the component is as good as its worst service
+		var series [][]uptime.Day
+		worstUptime, known := 1.0, false
+		for _, hs := range c.HostServices {
+			pc.Status = uptime.Worse(pc.Status, hs.Status)
+			series = append(series, uptime.Days(history[hs.ID], now, statusPageDays))
+
+			if u, ok := uptime.Percent(history[hs.ID], now.AddDate(0, 0, -statusPageDays), now); ok {
+				known = true
+				if u < worstUptime {
+					worstUptime = u
+				}
+			}
+		}
+
+		if known {
+			pc.Uptime = formatUptime(worstUptime)
+		}
+
+		pc.StatusText = statusText(pc.Status)
+		overall = uptime.Worse(overall, pc.Status)
+
+		days := uptime.Combine(series...)
+		if days == nil {
+			days = uptime.Days(nil, now, statusPageDays)
+		}
+
+		for _, d := range days {
+			pc.Days = append(pc.Days, toPublicDay(d))
+		}
+
+		components = append(components, pc)
+	}
+
+	var open, past []models.StatusPageNotice
+	for _, n := range p.Notices {
+		if n.Resolved() {
+			past = append(past, n)
+		} else {
+			open = append(open, n)
+		}
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("page", p)
+	vars.Set("components", components)
+	vars.Set("overall", overall)
+	vars.Set("overallText", overallStatusText(overall))
+	vars.Set("openNotices", open)
+	vars.Set("pastNotices", past)
+	vars.Set("days", statusPageDays)
+	vars.Set("generatedAt", now)
+
+	return vars, nil
+}
+
+func toPublicDay(d uptime.Day) publicDay {
+	date := d.Date.Format("Jan 2, 2006")
+
+	if !d.Known {
+		return publicDay{Level: "none", Title: date + ": no data"}
+	}
+
+	level := "up"
+	switch {
+	case d.Uptime < 0.95:
+		level = "down"
+	case d.Uptime < 0.9995:
+		level = "partial"
+	case d.Worst == "warning":
+		level = "degraded"
+	}
+
+	return publicDay{Level: level, Title: fmt.Sprintf("%s: %s uptime", date, formatUptime(d.Uptime))}
+}
+
+// formatUptime formats a fraction as a percentage, without rounding anything below 100% up to it
+func formatUptime(f float64) string {
+	if f >= 1 {
+		return "100%"
+	}
+	s := strconv.FormatFloat(float64(int(f*10000))/100, 'f', 2, 64)
+	return s + "%"
+}
+
+func statusText(status string) string {
+	switch status {
+	case "healthy":
+		return "Operational"
+	case "warning":
+		return "Degraded Performance"
+	case "problem", "unreachable":
+		return "Outage"
+	}
+	return "Unknown"
+}
+
+func overallStatusText(status string) string {
+	switch status {
+	case "healthy":
+		return "All Systems Operational"
+	case "warning":
+		return "Degraded Performance"
+	case "problem", "unreachable":
+		return "Partial Outage"
+	}
+	return "Status Unknown"
+}
@@ -0,0 +1,487 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/CloudyKit/jet/v6"
+	"github.com/go-chi/chi/v5"
+	"github.com/luksbutz/vigilate/internal/helpers"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// totpPeriod is how long each code lasts
+	totpPeriod = 30
+	// totpSkew is how many periods either side of now a code is accepted for, to allow for
+	// clocks that are a little off
+	totpSkew = 1
+	// recoveryCodeCount is how many recovery codes a user gets at a time
+	recoveryCodeCount = 10
+	// twoFactorLoginTimeout is how long a user has to enter their code after their password
+	twoFactorLoginTimeout = 5 * time.Minute
+	// twoFactorLoginAttempts is how many codes may be tried for one password login; wrong codes
+	// also count towards the throttling and lockout of wrong passwords
+	twoFactorLoginAttempts = 5
+)
+
+var totpOpts = totp.ValidateOpts{
+	Period:    totpPeriod,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// TwoFactorLogin shows the second step of logging in, where a user with two-factor authentication
+// enters a code from their app or a recovery code
+func (repo *DBRepo) TwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	if _, ok := pendingTwoFactorUser(r); !ok {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("twoFactor", true)
+
+	err := helpers.RenderPage(w, r, "login", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// PostTwoFactorLogin checks the code of the second login step, and logs the user in. Wrong codes
+// count against the account like wrong passwords, so that giving the password again doesn't buy
+// more guesses.
+func (repo *DBRepo) PostTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	id, ok := pendingTwoFactorUser(r)
+	if !ok {
+		app.Session.Put(r.Context(), "error", "Please log in again")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	u, err := repo.DB.GetUserById(id)
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	attempt := models.LoginAttempt{
+		Email:     truncate(u.Email, 255),
+		UserID:    u.ID,
+		IPAddress: helpers.ClientIP(r),
+		UserAgent: truncate(r.UserAgent(), 255),
+	}
+
+	if u.Locked() {
+		clearPendingTwoFactor(r)
+		attempt.Reason = models.LoginFailedLocked
+		repo.recordLogin(attempt)
+		app.Session.Put(r.Context(), "error", "This account is locked after too many failed logins; please try again later")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	since := failureSince(u)
+	wait, err := repo.loginWait(u.Email, attempt.IPAddress, since)
+	if err != nil {
+		log.Println(err)
+	}
+	if wait > 0 {
+		attempt.Reason = models.LoginFailedThrottled
+		repo.recordLogin(attempt)
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("Too many failed logins; please try again in %d seconds", int(wait.Seconds())+1))
+		http.Redirect(w, r, "/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	valid, err := repo.checkSecondFactor(id, r.Form.Get("code"))
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		attempt.Reason = models.LoginFailedTwoFactor
+		repo.recordLogin(attempt)
+		repo.lockIfGuessed(u, attempt, since)
+
+		attempts := app.Session.GetInt(r.Context(), "twoFactorAttempts") + 1
+		if attempts >= twoFactorLoginAttempts {
+			clearPendingTwoFactor(r)
+			app.Session.Put(r.Context(), "error", "Too many wrong codes. Please log in again")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		app.Session.Put(r.Context(), "twoFactorAttempts", attempts)
+		app.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	hash := app.Session.GetString(r.Context(), "twoFactorHash")
+	remember := app.Session.GetBool(r.Context(), "twoFactorRemember")
+	target := app.Session.GetString(r.Context(), "twoFactorTarget")
+	clearPendingTwoFactor(r)
+
+	_ = app.Session.RenewToken(r.Context())
+	repo.completeLogin(w, r, u, hash, remember, target)
+}
+
+// startTwoFactorLogin keeps a login whose password was right in the session, until the user
+// enters their code
+func startTwoFactorLogin(r *http.Request, id int, hash string, remember bool, target string) {
+	app.Session.Put(r.Context(), "twoFactorUserID", id)
+	app.Session.Put(r.Context(), "twoFactorHash", hash)
+	app.Session.Put(r.Context(), "twoFactorRemember", remember)
+	app.Session.Put(r.Context(), "twoFactorTarget", target)
+	app.Session.Put(r.Context(), "twoFactorExpires", int(time.Now().Add(twoFactorLoginTimeout).Unix()))
+	app.Session.Put(r.Context(), "twoFactorAttempts", 0)
+}
+
+// pendingTwoFactorUser returns the id of the user whose login waits for a code, if there is one
+// and it hasn't timed out
+func pendingTwoFactorUser(r *http.Request) (int, bool) {
+	id := app.Session.GetInt(r.Context(), "twoFactorUserID")
+	if id == 0 {
+		return 0, false
+	}
+
+	if int(time.Now().Unix()) > app.Session.GetInt(r.Context(), "twoFactorExpires") {
+		clearPendingTwoFactor(r)
+		return 0, false
+	}
+
+	return id, true
+}
+
+// clearPendingTwoFactor forgets a login waiting for a code
+func clearPendingTwoFactor(r *http.Request) {
+	for _, key := range []string{"twoFactorUserID", "twoFactorHash", "twoFactorRemember", "twoFactorTarget",
+		"twoFactorExpires", "twoFactorAttempts"} {
+		app.Session.Remove(r.Context(), key)
+	}
+}
+
+// TwoFactorSetup shows a new secret, as a QR code, for a user to add to their authenticator app
+func (repo *DBRepo) TwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	u, ok := repo.twoFactorOwner(w, r)
+	if !ok {
+		return
+	}
+
+	if u.TOTPEnabled == 1 {
+		http.Redirect(w, r, fmt.Sprintf("/admin/user/%d#two-factor", u.ID), http.StatusSeeOther)
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      "Vigilate",
+		AccountName: u.Email,
+		Period:      totpPeriod,
+		Digits:      totpOpts.Digits,
+		Algorithm:   totpOpts.Algorithm,
+	})
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	// every visit starts afresh, so a secret that was shown but never confirmed is dropped
+	err = repo.DB.SetTOTPSecret(u.ID, key.Secret())
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	img, err := key.Image(200, 200)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	vars := make(jet.VarMap)
+	vars.Set("user", u)
+	vars.Set("secret", key.Secret())
+	vars.Set("qrCode", "data:image/png;base64,"+base64.StdEncoding.EncodeToString(buf.Bytes()))
+	vars.Set("required", u.NeedsTwoFactor(app.PreferenceMap["two_factor_policy"]))
+
+	err = helpers.RenderPage(w, r, "two-factor", vars, nil)
+	if err != nil {
+		printTemplateError(w, err)
+	}
+}
+
+// PostTwoFactorSetup turns on two-factor authentication once the user has entered a code for
+// their new secret, and gives them their recovery codes
+func (repo *DBRepo) PostTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	u, ok := repo.twoFactorOwner(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	secret, err := repo.DB.GetTOTPSecret(u.ID)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	step, ok := matchTOTP(secret, r.Form.Get("code"), time.Now())
+	if u.TOTPEnabled == 1 || !ok {
+		app.Session.Put(r.Context(), "error", "Invalid code. Please scan the new QR code and try again")
+		http.Redirect(w, r, fmt.Sprintf("/admin/user/%d/two-factor", u.ID), http.StatusSeeOther)
+		return
+	}
+
+	err = repo.DB.EnableTOTP(u.ID, step)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	err = repo.newRecoveryCodes(r, u.ID)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	// browsers remembered before now only ever gave a password
+	err = repo.DB.DeleteRememberMeTokensForUser(u.ID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication is on")
+	http.Redirect(w, r, fmt.Sprintf("/admin/user/%d#two-factor", u.ID), http.StatusSeeOther)
+}
+
+// PostRecoveryCodes replaces a user's recovery codes, after they enter a current code
+func (repo *DBRepo) PostRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	u, ok := repo.twoFactorOwner(w, r)
+	if !ok {
+		return
+	}
+
+	if !repo.confirmSecondFactor(w, r, u) {
+		return
+	}
+
+	err := repo.newRecoveryCodes(r, u.ID)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "New recovery codes created")
+	http.Redirect(w, r, fmt.Sprintf("/admin/user/%d#two-factor", u.ID), http.StatusSeeOther)
+}
+
+// PostDisableTwoFactor turns off two-factor authentication for a user, after they enter a
+// current code, unless the two-factor policy requires it of them
+func (repo *DBRepo) PostDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	u, ok := repo.twoFactorOwner(w, r)
+	if !ok {
+		return
+	}
+
+	if u.NeedsTwoFactor(app.PreferenceMap["two_factor_policy"]) {
+		app.Session.Put(r.Context(), "error", "Two-factor authentication is required for your account")
+		http.Redirect(w, r, fmt.Sprintf("/admin/user/%d#two-factor", u.ID), http.StatusSeeOther)
+		return
+	}
+
+	if !repo.confirmSecondFactor(w, r, u) {
+		return
+	}
+
+	err := repo.DB.DisableTOTP(u.ID)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication is off")
+	http.Redirect(w, r, fmt.Sprintf("/admin/user/%d#two-factor", u.ID), http.StatusSeeOther)
+}
+
+// ResetTwoFactor turns off two-factor authentication for another user, e.g. one who has lost
+// both their phone and their recovery codes. They have to set it up again if the policy
+// requires it.
+func (repo *DBRepo) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	current, _ := helpers.CurrentUser(r)
+	if id == current.ID {
+		Forbidden(w, r)
+		return
+	}
+
+	err := repo.DB.DisableTOTP(id)
+	if err != nil {
+		ServerError(w, r, err)
+		return
+	}
+
+	// remembered browsers got past the second step, which no longer protects the account
+	err = repo.DB.DeleteRememberMeTokensForUser(id)
+	if err != nil {
+		log.Println(err)
+	}
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication reset")
+	http.Redirect(w, r, fmt.Sprintf("/admin/user/%d#two-factor", id), http.StatusSeeOther)
+}
+
+// twoFactorOwner returns the logged in user, if the url is for their own account: nobody sets up
+// two-factor authentication for someone else
+func (repo *DBRepo) twoFactorOwner(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+
+	u, _ := helpers.CurrentUser(r)
+	if u.ID == 0 || id != u.ID {
+		Forbidden(w, r)
+		return u, false
+	}
+
+	return u, true
+}
+
+// confirmSecondFactor checks the code a user entered to confirm a change to their two-factor
+// authentication, sending them back to their page if it is wrong
+func (repo *DBRepo) confirmSecondFactor(w http.ResponseWriter, r *http.Request, u models.User) bool {
+	err := r.ParseForm()
+	if err != nil {
+		log.Println(err)
+		ClientError(w, r, http.StatusBadRequest)
+		return false
+	}
+
+	valid, err := repo.checkSecondFactor(u.ID, r.Form.Get("code"))
+	if err != nil {
+		ServerError(w, r, err)
+		return false
+	}
+
+	if u.TOTPEnabled != 1 || !valid {
+		app.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, fmt.Sprintf("/admin/user/%d#two-factor", u.ID), http.StatusSeeOther)
+		return false
+	}
+
+	return true
+}
+
+// checkSecondFactor reports whether code is a current code from the user's app, or one of their
+// unused recovery codes. Either is used up by a successful check.
+func (repo *DBRepo) checkSecondFactor(userID int, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+
+	secret, err := repo.DB.GetTOTPSecret(userID)
+	if err != nil {
+		return false, err
+	}
+
+	if step, ok := matchTOTP(secret, code, time.Now()); ok {
+		return repo.DB.UseTOTPStep(userID, step)
+	}
+
+	return repo.DB.UseRecoveryCode(userID, hashRecoveryCode(code))
+}
+
+// newRecoveryCodes replaces a user's recovery codes, and keeps the new ones in the session to be
+// shown once, on the next page load
+func (repo *DBRepo) newRecoveryCodes(r *http.Request, userID int) error {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		_, err := rand.Read(b)
+		if err != nil {
+			return err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		code = code[:5] + "-" + code[5:10]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	err := repo.DB.ReplaceRecoveryCodes(userID, hashes)
+	if err != nil {
+		return err
+	}
+
+	app.Session.Put(r.Context(), "recovery_codes", strings.Join(codes, " "))
+	return nil
+}
+
+// matchTOTP reports whether code is the code of secret at a time step close to now, and returns
+// that step
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if secret == "" || len(code) != totpOpts.Digits.Length() {
+		return 0, false
+	}
+
+	for i := -totpSkew; i <= totpSkew; i++ {
+		t := now.Add(time.Duration(i*totpPeriod) * time.Second)
+		want, err := totp.GenerateCodeCustom(secret, t, totpOpts)
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return t.Unix() / totpPeriod, true
+		}
+	}
+
+	return 0, false
+}
+
+// hashRecoveryCode returns the hash that is stored for a recovery code. Case, spaces and dashes
+// don't matter, so codes may be typed in however they were written down.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"github.com/luksbutz/vigilate/internal/config"
+	"github.com/luksbutz/vigilate/internal/models"
+	"github.com/pquerna/otp/totp"
+	"testing"
+	"time"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// codeAt returns the code of the test secret at t
+func codeAt(t *testing.T, at time.Time) string {
+	t.Helper()
+
+	code, err := totp.GenerateCodeCustom(testTOTPSecret, at, totpOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestMatchTOTP(t *testing.T) {
+	// the start of a time step, so that a second either way is another step
+	now := time.Unix(1700000010, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantOK   bool
+		wantStep int64
+	}{
+		{"current code", testTOTPSecret, codeAt(t, now), true, step},
+		{"end of the current step", testTOTPSecret, codeAt(t, now.Add(29*time.Second)), true, step},
+		{"previous step", testTOTPSecret, codeAt(t, now.Add(-time.Second)), true, step - 1},
+		{"next step", testTOTPSecret, codeAt(t, now.Add(totpPeriod*time.Second)), true, step + 1},
+		{"two steps ago", testTOTPSecret, codeAt(t, now.Add(-totpPeriod*time.Second-time.Second)), false, 0},
+		{"two steps ahead", testTOTPSecret, codeAt(t, now.Add(2*totpPeriod*time.Second)), false, 0},
+		{"spaces around", testTOTPSecret, " " + codeAt(t, now) + "\n", true, step},
+		{"too short", testTOTPSecret, codeAt(t, now)[1:], false, 0},
+		{"too long", testTOTPSecret, codeAt(t, now) + "0", false, 0},
+		{"empty", testTOTPSecret, "", false, 0},
+		{"no secret", "", codeAt(t, now), false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := matchTOTP(tt.secret, tt.code, now)
+			if ok != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("got step %d, %v; want step %d, %v", gotStep, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := hashRecoveryCode("abcde-fghij")
+	if len(want) != 64 {
+		t.Fatalf("hash %q is not a hex sha256", want)
+	}
+
+	for _, typed := range []string{"abcdefghij", "ABCDE-FGHIJ", "abcde fghij", " abc-de-fgh ij "} {
+		if got := hashRecoveryCode(typed); got != want {
+			t.Errorf("%q hashes differently from abcde-fghij", typed)
+		}
+	}
+
+	for _, other := range []string{"abcde-fghik", "abcde-fghi", ""} {
+		if hashRecoveryCode(other) == want {
+			t.Errorf("%q hashes the same as abcde-fghij", other)
+		}
+	}
+}
+
+func TestCheckSecondFactor(t *testing.T) {
+	db := newFakeDB()
+	a := &config.AppConfig{}
+	repo := &DBRepo{App: a, DB: db}
+	NewHandlers(repo, a)
+
+	u := db.addUser(models.User{Email: "bob@example.com", UserActive: 1})
+	db.totpSecrets[u.ID] = testTOTPSecret
+	db.recoveryCodes[u.ID] = []string{hashRecoveryCode("abcde-fghij")}
+
+	check := func(code string, want bool) {
+		t.Helper()
+		ok, err := repo.checkSecondFactor(u.ID, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("code %q accepted is %v, want %v", code, ok, want)
+		}
+	}
+
+	code := codeAt(t, time.Now())
+	check(code, true)
+	// a code can't be replayed, e.g. by someone looking over the user's shoulder
+	check(code, false)
+	// nor can one from before it, still inside the window
+	check(codeAt(t, time.Now().Add(-totpPeriod*time.Second)), false)
+
+	check("ABCDE FGHIJ", true)
+	// a recovery code works once
+	check("abcde-fghij", false)
+
+	check("", false)
+}
@@ -1,16 +1,20 @@
 package helpers
 
 import (
+	"context"
 	"fmt"
 	"github.com/CloudyKit/jet/v6"
 	"github.com/justinas/nosurf"
 	"github.com/luksbutz/vigilate/internal/config"
 	"github.com/luksbutz/vigilate/internal/models"
 	"github.com/luksbutz/vigilate/internal/templates"
+	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"runtime/debug"
+	"strings"
 	"time"
 )
 
@@ -35,6 +39,39 @@ func IsAuthenticated(r *http.Request) bool {
 	return exists
 }
 
+// contextKey keys the values middleware puts in a request's context
+type contextKey string
+
+const userKey contextKey = "user"
+
+// WithUser returns the request carrying the logged in user, as loaded for this request
+func WithUser(r *http.Request, u models.User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey, u))
+}
+
+// CurrentUser returns the user put in the request by WithUser
+func CurrentUser(r *http.Request) (models.User, bool) {
+	u, ok := r.Context().Value(userKey).(models.User)
+	return u, ok
+}
+
+// ClientIP returns the address a request came from. Behind a reverse proxy, with app.TrustProxy
+// set, that is the address the proxy added to X-Forwarded-For.
+func ClientIP(r *http.Request) string {
+	if app.TrustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // RandomString returns a random string of letters of length n
 func RandomString(n int) string {
 	b := make([]byte, n)
@@ -77,12 +114,19 @@ func DefaultData(td templates.TemplateData, r *http.Request, w http.ResponseWrit
 	td.CSRFToken = nosurf.Token(r)
 	td.IsAuthenticated = IsAuthenticated(r)
 	td.PreferenceMap = app.PreferenceMap
-	// if logged in, store user id in template data
-	if td.IsAuthenticated {
+	// if logged in, store the user in template data; the copy loaded for this request has their current role
+	if u, ok := CurrentUser(r); ok {
+		td.User = u
+	} else if td.IsAuthenticated {
 		u := app.Session.Get(r.Context(), "user").(models.User)
 		td.User = u
 	}
 
+	// live updates pick up from the moment the page was rendered
+	if app.Hub != nil {
+		td.RealtimeCursor = app.Hub.Cursor()
+	}
+
 	td.Flash = app.Session.PopString(r.Context(), "flash")
 	td.Warning = app.Session.PopString(r.Context(), "warning")
 	td.Error = app.Session.PopString(r.Context(), "error")
@@ -125,3 +169,21 @@ func RenderPage(w http.ResponseWriter, r *http.Request, templateName string, var
 	}
 	return nil
 }
+
+// RenderPublicPage renders a page for visitors who are not logged in. It touches neither the
+// session nor the CSRF token, so the output is the same for everyone and can be cached.
+func RenderPublicPage(w io.Writer, templateName string, vars jet.VarMap) error {
+	addTemplateFunctions()
+
+	t, err := views.GetTemplate(fmt.Sprintf("%s.jet", templateName))
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if err = t.Execute(w, vars, templates.TemplateData{}); err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
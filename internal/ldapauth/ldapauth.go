@@ -0,0 +1,258 @@
+// Package ldapauth checks passwords against an LDAP directory, such as Active Directory or
+// OpenLDAP, by looking the user up and binding as them, and finds the groups they are in.
+package ldapauth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/luksbutz/vigilate/internal/models"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCredentials is returned when the directory has no such user, or the password is wrong
+var ErrInvalidCredentials = errors.New("ldapauth: invalid credentials")
+
+// timeout is how long each request to the directory may take
+const timeout = 10 * time.Second
+
+// Config is how to reach the directory and find users and groups in it
+type Config struct {
+	// URL is the directory's url, e.g. ldaps://ldap.example.com or ldap://dc1.example.com:389
+	URL string
+	// StartTLS upgrades an ldap:// connection to TLS before anything is sent
+	StartTLS bool
+	// InsecureSkipVerify accepts any TLS certificate; only for testing
+	InsecureSkipVerify bool
+	// BindDN and BindPassword are the account used to look users up; empty binds anonymously
+	BindDN       string
+	BindPassword string
+	// BaseDN is where users are looked up
+	BaseDN string
+	// UserFilter finds the user logging in; each %s is replaced by what they typed, e.g. (mail=%s)
+	UserFilter string
+	// EmailAttribute, FirstNameAttribute and LastNameAttribute are read from the user's entry
+	EmailAttribute     string
+	FirstNameAttribute string
+	LastNameAttribute  string
+	// GroupBaseDN is where groups are looked up; it defaults to BaseDN
+	GroupBaseDN string
+	// GroupFilter finds the user's groups; each %s is replaced by the user's DN, e.g.
+	// (member=%s). When it is empty, the user's memberOf attribute is used instead.
+	GroupFilter string
+	// GroupAttribute is the attribute holding a group's name, e.g. cn
+	GroupAttribute string
+	// Roles gives users their access level from their groups
+	Roles models.RoleMapping
+	// LinkExisting lets a user's first login take over an existing account with their email
+	// address, which isn't linked to the directory yet. Only turn it on if nobody can put
+	// someone else's address in the directory.
+	LinkExisting bool
+}
+
+// Conn is the part of an LDAP connection the directory uses. *ldap.Conn is one; a stand-in for
+// an LDAP server can be another.
+type Conn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+// User is a user the directory knows
+type User struct {
+	DN        string
+	Email     string
+	FirstName string
+	LastName  string
+	// Groups holds the names of the user's groups, and for memberOf, their DNs too
+	Groups []string
+}
+
+// Directory is an LDAP directory that users log in with
+type Directory struct {
+	config Config
+	dial   func() (Conn, error)
+}
+
+// New returns a directory that connects to c.URL for each login
+func New(c Config) *Directory {
+	d := NewWithDialer(c, nil)
+	d.dial = d.dialURL
+	return d
+}
+
+// NewWithDialer returns a directory that gets its connections from dial, such as a stand-in for
+// an LDAP server
+func NewWithDialer(c Config, dial func() (Conn, error)) *Directory {
+	if c.UserFilter == "" {
+		c.UserFilter = "(mail=%s)"
+	}
+	if c.EmailAttribute == "" {
+		c.EmailAttribute = "mail"
+	}
+	if c.FirstNameAttribute == "" {
+		c.FirstNameAttribute = "givenName"
+	}
+	if c.LastNameAttribute == "" {
+		c.LastNameAttribute = "sn"
+	}
+	if c.GroupBaseDN == "" {
+		c.GroupBaseDN = c.BaseDN
+	}
+	if c.GroupAttribute == "" {
+		c.GroupAttribute = "cn"
+	}
+
+	return &Directory{config: c, dial: dial}
+}
+
+// Roles returns how users get their access level
+func (d *Directory) Roles() models.RoleMapping {
+	return d.config.Roles
+}
+
+// LinkExisting reports whether a user's first login may take over an existing account with their
+// email address
+func (d *Directory) LinkExisting() bool {
+	return d.config.LinkExisting
+}
+
+// dialURL connects to the directory's url
+func (d *Directory) dialURL() (Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: d.config.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(d.config.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+
+	if d.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// Authenticate checks a login and password: it looks the user up, binds as them with the
+// password, and reads their groups
+func (d *Directory) Authenticate(login, password string) (User, error) {
+	var u User
+
+	// an empty password would be an unauthenticated bind, which many servers accept
+	login = strings.TrimSpace(login)
+	if login == "" || password == "" {
+		return u, ErrInvalidCredentials
+	}
+
+	conn, err := d.dial()
+	if err != nil {
+		return u, fmt.Errorf("ldapauth: connect: %w", err)
+	}
+	defer conn.Close()
+
+	if err := d.bindService(conn); err != nil {
+		return u, err
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		d.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(timeout.Seconds()), false,
+		strings.ReplaceAll(d.config.UserFilter, "%s", ldap.EscapeFilter(login)),
+		[]string{d.config.EmailAttribute, d.config.FirstNameAttribute, d.config.LastNameAttribute, "memberOf"},
+		nil,
+	))
+	if err != nil {
+		return u, fmt.Errorf("ldapauth: find user: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		// no such user, or the filter isn't specific enough to say who it is
+		return u, ErrInvalidCredentials
+	}
+
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return u, ErrInvalidCredentials
+		}
+		return u, fmt.Errorf("ldapauth: bind as user: %w", err)
+	}
+
+	u = User{
+		DN:        entry.DN,
+		Email:     entry.GetAttributeValue(d.config.EmailAttribute),
+		FirstName: entry.GetAttributeValue(d.config.FirstNameAttribute),
+		LastName:  entry.GetAttributeValue(d.config.LastNameAttribute),
+	}
+
+	u.Groups, err = d.groups(conn, entry)
+	if err != nil {
+		return u, err
+	}
+
+	return u, nil
+}
+
+// bindService binds as the service account, or anonymously if there isn't one
+func (d *Directory) bindService(conn Conn) error {
+	if d.config.BindDN == "" {
+		return nil
+	}
+
+	if err := conn.Bind(d.config.BindDN, d.config.BindPassword); err != nil {
+		return fmt.Errorf("ldapauth: bind as %s: %w", d.config.BindDN, err)
+	}
+
+	return nil
+}
+
+// groups returns the names of the user's groups, searching for them with the group filter, or
+// else reading the user's memberOf attribute
+func (d *Directory) groups(conn Conn, entry *ldap.Entry) ([]string, error) {
+	if d.config.GroupFilter == "" {
+		var groups []string
+		for _, dn := range entry.GetAttributeValues("memberOf") {
+			groups = append(groups, dn)
+			if name := firstRDNValue(dn); name != "" {
+				groups = append(groups, name)
+			}
+		}
+		return groups, nil
+	}
+
+	// the user may not be allowed to search for groups, so go back to the service account
+	if err := d.bindService(conn); err != nil {
+		return nil, err
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		d.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(timeout.Seconds()), false,
+		strings.ReplaceAll(d.config.GroupFilter, "%s", ldap.EscapeFilter(entry.DN)),
+		[]string{d.config.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldapauth: find groups: %w", err)
+	}
+
+	var groups []string
+	for _, g := range res.Entries {
+		groups = append(groups, g.GetAttributeValues(d.config.GroupAttribute)...)
+	}
+
+	return groups, nil
+}
+
+// firstRDNValue returns the value of the first part of a DN, e.g. admins for
+// cn=admins,ou=groups,dc=example,dc=com
+func firstRDNValue(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return ""
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
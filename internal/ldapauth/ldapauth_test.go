@@ -0,0 +1,295 @@
+package ldapauth
+
+import (
+	"errors"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/luksbutz/vigilate/internal/models"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeConn is a stand-in for an LDAP server. It knows some passwords, answers searches under
+// the user and group base DNs with canned entries, and records what it was asked.
+type fakeConn struct {
+	// passwords are the passwords of the DNs that can bind
+	passwords map[string]string
+	// users and groups answer searches under ou=people and ou=groups
+	users  []*ldap.Entry
+	groups []*ldap.Entry
+
+	binds   []string
+	filters []string
+	closed  bool
+}
+
+func (c *fakeConn) Bind(username, password string) error {
+	c.binds = append(c.binds, username)
+
+	if p, ok := c.passwords[username]; !ok || p != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+func (c *fakeConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.filters = append(c.filters, req.Filter)
+
+	if _, err := ldap.CompileFilter(req.Filter); err != nil {
+		return nil, err
+	}
+
+	res := &ldap.SearchResult{}
+	switch {
+	case strings.HasSuffix(req.BaseDN, "ou=people,dc=example,dc=com"):
+		res.Entries = c.users
+	case strings.HasSuffix(req.BaseDN, "ou=groups,dc=example,dc=com"):
+		res.Entries = c.groups
+	}
+	return res, nil
+}
+
+func (c *fakeConn) Close() {
+	c.closed = true
+}
+
+const (
+	serviceDN = "cn=vigilate,ou=services,dc=example,dc=com"
+	aliceDN   = "uid=alice,ou=people,dc=example,dc=com"
+)
+
+// alice is a user in the admins and staff groups
+var alice = ldap.NewEntry(aliceDN, map[string][]string{
+	"mail":      {"alice@example.com"},
+	"givenName": {"Alice"},
+	"sn":        {"Example"},
+	"memberOf":  {"cn=admins,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"},
+})
+
+// newTestDirectory returns a directory using conn, and a count of the connections made
+func newTestDirectory(c Config, conn *fakeConn) (*Directory, *int) {
+	dials := 0
+	d := NewWithDialer(c, func() (Conn, error) {
+		dials++
+		return conn, nil
+	})
+	return d, &dials
+}
+
+func testConfig() Config {
+	return Config{
+		BindDN:       serviceDN,
+		BindPassword: "service-secret",
+		BaseDN:       "ou=people,dc=example,dc=com",
+	}
+}
+
+func testConn() *fakeConn {
+	return &fakeConn{
+		passwords: map[string]string{serviceDN: "service-secret", aliceDN: "alice-secret"},
+		users:     []*ldap.Entry{alice},
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	conn := testConn()
+	d, _ := newTestDirectory(testConfig(), conn)
+
+	u, err := d.Authenticate(" alice@example.com ", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := User{
+		DN:        aliceDN,
+		Email:     "alice@example.com",
+		FirstName: "Alice",
+		LastName:  "Example",
+		Groups: []string{
+			"cn=admins,ou=groups,dc=example,dc=com", "admins",
+			"cn=staff,ou=groups,dc=example,dc=com", "staff",
+		},
+	}
+	if !reflect.DeepEqual(u, want) {
+		t.Errorf("got %+v, want %+v", u, want)
+	}
+
+	if !reflect.DeepEqual(conn.binds, []string{serviceDN, aliceDN}) {
+		t.Errorf("bound as %v, want the service account and then alice", conn.binds)
+	}
+	if !reflect.DeepEqual(conn.filters, []string{"(mail=alice@example.com)"}) {
+		t.Errorf("searched for %v", conn.filters)
+	}
+	if !conn.closed {
+		t.Error("connection left open")
+	}
+}
+
+func TestAuthenticateEscapesFilter(t *testing.T) {
+	conn := testConn()
+	conn.users = nil
+	d, _ := newTestDirectory(testConfig(), conn)
+
+	// a login that would match everybody, if it went into the filter as typed
+	if _, err := d.Authenticate("*)(mail=*", "alice-secret"); err != ErrInvalidCredentials {
+		t.Errorf("got %v, want %v", err, ErrInvalidCredentials)
+	}
+
+	want := `(mail=\2a\29\28mail=\2a)`
+	if len(conn.filters) != 1 || conn.filters[0] != want {
+		t.Errorf("searched for %v, want %s", conn.filters, want)
+	}
+}
+
+func TestAuthenticateRefuses(t *testing.T) {
+	bob := ldap.NewEntry("uid=bob,ou=people,dc=example,dc=com", map[string][]string{"mail": {"bob@example.com"}})
+
+	tests := []struct {
+		name     string
+		login    string
+		password string
+		users    []*ldap.Entry
+		// wantDial is whether the directory is asked at all
+		wantDial bool
+		// wantBinds are the DNs bound as
+		wantBinds []string
+	}{
+		{"empty password", "alice@example.com", "", []*ldap.Entry{alice}, false, nil},
+		{"empty login", "  ", "alice-secret", []*ldap.Entry{alice}, false, nil},
+		{"no such user", "carol@example.com", "alice-secret", nil, true, []string{serviceDN}},
+		{"more than one user", "alice@example.com", "alice-secret", []*ldap.Entry{alice, bob}, true, []string{serviceDN}},
+		{"wrong password", "alice@example.com", "wrong", []*ldap.Entry{alice}, true, []string{serviceDN, aliceDN}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := testConn()
+			conn.users = tt.users
+			d, dials := newTestDirectory(testConfig(), conn)
+
+			if _, err := d.Authenticate(tt.login, tt.password); err != ErrInvalidCredentials {
+				t.Errorf("got %v, want %v", err, ErrInvalidCredentials)
+			}
+			if (*dials > 0) != tt.wantDial {
+				t.Errorf("connected %d times", *dials)
+			}
+			if !reflect.DeepEqual(conn.binds, tt.wantBinds) {
+				t.Errorf("bound as %v, want %v", conn.binds, tt.wantBinds)
+			}
+		})
+	}
+}
+
+func TestAuthenticateServiceAccountFails(t *testing.T) {
+	conn := testConn()
+	conn.passwords[serviceDN] = "rotated"
+	d, _ := newTestDirectory(testConfig(), conn)
+
+	// a broken service account is an outage, not a wrong password
+	_, err := d.Authenticate("alice@example.com", "alice-secret")
+	if err == nil || err == ErrInvalidCredentials {
+		t.Errorf("got %v, want an error about the service account", err)
+	}
+}
+
+func TestAuthenticateGroupFilter(t *testing.T) {
+	conn := testConn()
+	conn.groups = []*ldap.Entry{
+		ldap.NewEntry("cn=operators,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"operators"}}),
+		ldap.NewEntry("cn=staff,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"staff"}}),
+	}
+
+	c := testConfig()
+	c.GroupBaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupFilter = "(&(objectClass=groupOfNames)(member=%s))"
+	d, _ := newTestDirectory(c, conn)
+
+	// a DN may hold characters that mean something in a filter
+	const dn = "uid=al(i)ce,ou=people,dc=example,dc=com"
+	conn.passwords[dn] = "alice-secret"
+	conn.users = []*ldap.Entry{ldap.NewEntry(dn, map[string][]string{"mail": {"alice@example.com"}})}
+
+	u, err := d.Authenticate("alice@example.com", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the groups come from the search, not from memberOf
+	if want := []string{"operators", "staff"}; !reflect.DeepEqual(u.Groups, want) {
+		t.Errorf("groups are %v, want %v", u.Groups, want)
+	}
+
+	// the groups are looked up as the service account again
+	wantBinds := []string{serviceDN, dn, serviceDN}
+	if !reflect.DeepEqual(conn.binds, wantBinds) {
+		t.Errorf("bound as %v, want %v", conn.binds, wantBinds)
+	}
+
+	wantFilter := `(&(objectClass=groupOfNames)(member=uid=al\28i\29ce,ou=people,dc=example,dc=com))`
+	if len(conn.filters) != 2 || conn.filters[1] != wantFilter {
+		t.Errorf("searched for %v, want %s", conn.filters, wantFilter)
+	}
+}
+
+func TestAuthenticateAnonymous(t *testing.T) {
+	conn := testConn()
+	c := testConfig()
+	c.BindDN = ""
+	d, _ := newTestDirectory(c, conn)
+
+	if _, err := d.Authenticate("alice@example.com", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conn.binds, []string{aliceDN}) {
+		t.Errorf("bound as %v, want only alice", conn.binds)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	c := testConfig()
+	c.Roles = models.RoleMapping{
+		Admins:    []string{"admins"},
+		Operators: []string{"cn=operators,ou=groups,dc=example,dc=com"},
+		Viewers:   []string{"staff"},
+	}
+	d, _ := newTestDirectory(c, testConn())
+
+	tests := []struct {
+		name   string
+		groups []string
+		want   int
+	}{
+		{"admin by name", []string{"cn=staff,ou=groups,dc=example,dc=com", "staff", "cn=admins,ou=groups,dc=example,dc=com", "admins"}, models.AccessAdmin},
+		{"operator by DN", []string{"cn=operators,ou=groups,dc=example,dc=com", "operators"}, models.AccessOperator},
+		{"viewer", []string{"staff"}, models.AccessViewer},
+		{"no matching group", []string{"sales"}, 0},
+		{"no groups", nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.Roles().Level(tt.groups); got != tt.want {
+				t.Errorf("level is %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if !d.Roles().FromGroups() {
+		t.Error("roles don't come from groups")
+	}
+}
+
+func TestFirstRDNValue(t *testing.T) {
+	tests := map[string]string{
+		"cn=admins,ou=groups,dc=example,dc=com":    "admins",
+		`cn=ops\2c eu,ou=groups,dc=example,dc=com`: "ops, eu",
+		"not a dn": "",
+		"":         "",
+	}
+
+	for dn, want := range tests {
+		if got := firstRDNValue(dn); got != want {
+			t.Errorf("firstRDNValue(%q) is %q, want %q", dn, got, want)
+		}
+	}
+}
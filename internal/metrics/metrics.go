@@ -0,0 +1,212 @@
+// Package metrics keeps vigilate's counters and writes them, with any gauges the caller
+// adds, in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ChecksRun counts checks run, by service and resulting status
+	ChecksRun = NewCounterVec("vigilate_checks_total",
+		"Checks run, by service and resulting status.", "service", "status")
+	// StateChanges counts host service status changes
+	StateChanges = NewCounterVec("vigilate_state_changes_total",
+		"Host service status changes, by old and new status.", "from", "to")
+	// NotificationsSent counts notifications delivered, by channel
+	NotificationsSent = NewCounterVec("vigilate_notifications_sent_total",
+		"Notifications sent, by channel.", "channel")
+	// NotificationsFailed counts notifications that could not be delivered, by channel
+	NotificationsFailed = NewCounterVec("vigilate_notifications_failed_total",
+		"Notifications that could not be sent, by channel.", "channel")
+	// Broadcasts counts live update events sent through Pusher, by outcome
+	Broadcasts = NewCounterVec("vigilate_broadcasts_total",
+		"Live update events for Pusher, by outcome (sent, failed, or dropped from a full queue).", "outcome")
+)
+
+var (
+	durationsMu   sync.Mutex
+	lastDurations = make(map[int]time.Duration)
+)
+
+// ObserveCheck records a check of a host service: it counts the check and remembers how long it took
+func ObserveCheck(hostServiceID int, service, status string, d time.Duration) {
+	ChecksRun.Inc(service, status)
+
+	durationsMu.Lock()
+	lastDurations[hostServiceID] = d
+	durationsMu.Unlock()
+}
+
+// LastCheckDuration returns how long the last check of a host service took, if it has been
+// checked since vigilate started
+func LastCheckDuration(hostServiceID int) (time.Duration, bool) {
+	durationsMu.Lock()
+	defer durationsMu.Unlock()
+
+	d, ok := lastDurations[hostServiceID]
+	return d, ok
+}
+
+// PerfSample is one value of the performance data reported by a plugin
+type PerfSample struct {
+	Label string
+	Unit  string
+	Value float64
+}
+
+var (
+	perfMu   sync.Mutex
+	perfData = make(map[int][]PerfSample)
+)
+
+// SetPerfData replaces the performance data last reported for a host service
+func SetPerfData(hostServiceID int, samples []PerfSample) {
+	perfMu.Lock()
+	defer perfMu.Unlock()
+
+	if len(samples) == 0 {
+		delete(perfData, hostServiceID)
+		return
+	}
+	perfData[hostServiceID] = samples
+}
+
+// PerfData returns the performance data last reported for a host service
+func PerfData(hostServiceID int) []PerfSample {
+	perfMu.Lock()
+	defer perfMu.Unlock()
+
+	return perfData[hostServiceID]
+}
+
+// NotificationResult counts a notification on a channel as sent, or as failed if err is not nil
+func NotificationResult(channel string, err error) {
+	if err != nil {
+		NotificationsFailed.Inc(channel)
+		return
+	}
+	NotificationsSent.Inc(channel)
+}
+
+// CounterVec is a counter partitioned by a fixed set of labels
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec returns a counter with the given label names
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+// Inc adds one to the counter for the given label values, which must match the label names in order
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.mu.Lock()
+	c.values[c.labelString(labelValues)]++
+	c.mu.Unlock()
+}
+
+// Add adds n to the counter for the given label values
+func (c *CounterVec) Add(n float64, labelValues ...string) {
+	c.mu.Lock()
+	c.values[c.labelString(labelValues)] += n
+	c.mu.Unlock()
+}
+
+// Write writes the counter in the text exposition format
+func (c *CounterVec) Write(w io.Writer) {
+	WriteHeader(w, c.name, c.help, "counter")
+
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, k, formatValue(c.values[k]))
+	}
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) labelString(values []string) string {
+	pairs := make([]string, 0, 2*len(c.labels))
+	for i, l := range c.labels {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs = append(pairs, l, v)
+	}
+	return labelString(pairs)
+}
+
+// WriteHeader writes the HELP and TYPE lines for a metric
+func WriteHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// WriteSample writes one sample. Labels are given as name, value pairs.
+func WriteSample(w io.Writer, name string, value float64, labels ...string) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labelString(labels), formatValue(value))
+}
+
+// WriteGauge writes a gauge with a single, unlabelled sample
+func WriteGauge(w io.Writer, name, help string, value float64) {
+	WriteHeader(w, name, help, "gauge")
+	WriteSample(w, name, value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelString(pairs []string) string {
+	if len(pairs) < 2 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(pairs[i+1]))
+		b.WriteString(`"`)
+	}
+	b.WriteString("}")
+
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
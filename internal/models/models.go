@@ -15,6 +15,10 @@ var (
 	ErrDuplicateEmail = errors.New("models: duplicate email")
 	// ErrInactiveAccount inactive account error
 	ErrInactiveAccount = errors.New("models: Inactive Account")
+	// ErrDependencyCycle host dependency cycle error
+	ErrDependencyCycle = errors.New("models: host dependency cycle")
+	// ErrInvalidToken unknown, expired or revoked api token error
+	ErrInvalidToken = errors.New("models: invalid api token")
 )
 
 // User model
@@ -26,12 +30,225 @@ type User struct {
 	AccessLevel int
 	Email       string
 	Password    []byte
+	TOTPEnabled int
+	LockedUntil time.Time
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
 	DeletedAt   time.Time
 	Preferences map[string]string
 }
 
+// Access levels, stored in users.access_level. Each role may do everything the ones below it may.
+const (
+	// AccessViewer may look at hosts, services, events and the schedule, but change nothing
+	AccessViewer = 1
+	// AccessOperator may also edit hosts and groups, run checks and post status page notices
+	AccessOperator = 2
+	// AccessAdmin may also change settings, users, push targets, status pages and check commands
+	AccessAdmin = 3
+)
+
+// Role is an access level with its name, for forms
+type Role struct {
+	Level int
+	Name  string
+}
+
+// Roles are the access levels a user can be given, lowest first
+var Roles = []Role{
+	{AccessViewer, "Viewer"},
+	{AccessOperator, "Operator"},
+	{AccessAdmin, "Admin"},
+}
+
+// ValidAccessLevel reports whether level is one of Roles
+func ValidAccessLevel(level int) bool {
+	for _, role := range Roles {
+		if role.Level == level {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAccess reports whether the user's role includes the given access level
+func (u User) HasAccess(level int) bool {
+	return u.AccessLevel >= level
+}
+
+// CanOperate reports whether the user may change hosts and run checks
+func (u User) CanOperate() bool {
+	return u.HasAccess(AccessOperator)
+}
+
+// IsAdmin reports whether the user may change settings and users
+func (u User) IsAdmin() bool {
+	return u.HasAccess(AccessAdmin)
+}
+
+// Role returns the name of the user's role
+func (u User) Role() string {
+	name := "None"
+	for _, role := range Roles {
+		if u.AccessLevel >= role.Level {
+			name = role.Name
+		}
+	}
+	return name
+}
+
+// RoleMapping gives users from an identity provider or directory an access level from the
+// groups or roles they have there
+type RoleMapping struct {
+	// Admins, Operators and Viewers are the group names that give each role
+	Admins    []string
+	Operators []string
+	Viewers   []string
+	// Default is the access level of a user in none of the groups; 0 turns them away
+	Default int
+}
+
+// Level returns the highest access level any of the groups give, or Default
+func (m RoleMapping) Level(groups []string) int {
+	for _, role := range []struct {
+		level int
+		names []string
+	}{
+		{AccessAdmin, m.Admins},
+		{AccessOperator, m.Operators},
+		{AccessViewer, m.Viewers},
+	} {
+		for _, name := range role.names {
+			for _, g := range groups {
+				if g == name {
+					return role.level
+				}
+			}
+		}
+	}
+
+	return m.Default
+}
+
+// FromGroups reports whether any group gives a role, in which case a user's role is brought up
+// to date with their groups at every login
+func (m RoleMapping) FromGroups() bool {
+	return len(m.Admins)+len(m.Operators)+len(m.Viewers) > 0
+}
+
+// Two-factor policies, kept in the two_factor_policy preference
+const (
+	// TwoFactorOptional lets every user choose whether to use two-factor authentication
+	TwoFactorOptional = "optional"
+	// TwoFactorAdmins makes admins use two-factor authentication
+	TwoFactorAdmins = "admins"
+	// TwoFactorEveryone makes every user use two-factor authentication
+	TwoFactorEveryone = "everyone"
+)
+
+// TwoFactorPolicies are the two-factor policies, for forms
+var TwoFactorPolicies = []string{TwoFactorOptional, TwoFactorAdmins, TwoFactorEveryone}
+
+// NeedsTwoFactor reports whether the policy makes the user use two-factor authentication
+func (u User) NeedsTwoFactor(policy string) bool {
+	switch policy {
+	case TwoFactorEveryone:
+		return true
+	case TwoFactorAdmins:
+		return u.IsAdmin()
+	default:
+		return false
+	}
+}
+
+// Locked reports whether the user's account is locked after too many failed logins
+func (u User) Locked() bool {
+	return time.Now().Before(u.LockedUntil)
+}
+
+// Reasons a login attempt failed, stored in login_attempts.reason
+const (
+	// LoginFailedPassword is a wrong email address or password
+	LoginFailedPassword = "password"
+	// LoginFailedThrottled is an attempt made too soon after earlier failures
+	LoginFailedThrottled = "throttled"
+	// LoginFailedLocked is an attempt on a locked account
+	LoginFailedLocked = "locked"
+	// LoginFailedInactive is the right password for an inactive account
+	LoginFailedInactive = "inactive"
+	// LoginFailedTwoFactor is a wrong two-factor or recovery code, after the right password
+	LoginFailedTwoFactor = "two_factor"
+)
+
+// LoginAttempt is the model for a login with a password, or a completed login of any kind, kept so
+// that password guessing can be slowed down and seen. UserID is 0 when the email address belongs
+// to nobody.
+type LoginAttempt struct {
+	ID        int
+	Email     string
+	UserID    int
+	IPAddress string
+	UserAgent string
+	Succeeded bool
+	Reason    string
+	CreatedAt time.Time
+}
+
+// UserSession is the model for a logged in browser session, kept so that users can see where
+// they are logged in, and log sessions out
+type UserSession struct {
+	ID         int
+	UserID     int
+	IPAddress  string
+	UserAgent  string
+	LastSeenAt time.Time
+	CreatedAt  time.Time
+}
+
+// RememberToken is the model for a browser that "remember me" logs in. Only a hash of the token in
+// its cookie is stored, and isn't loaded here.
+type RememberToken struct {
+	ID         int
+	UserID     int
+	IPAddress  string
+	UserAgent  string
+	LastUsedAt time.Time
+	CreatedAt  time.Time
+}
+
+// API token scopes
+const (
+	// APITokenScopeRead allows only reading through the API
+	APITokenScopeRead = "read"
+	// APITokenScopeReadWrite allows reading and changing through the API
+	APITokenScopeReadWrite = "read-write"
+)
+
+// APIToken is the model for a user's API token. Only a hash of the token is stored;
+// TokenPrefix is kept so that tokens can be told apart in the UI.
+type APIToken struct {
+	ID          int
+	UserID      int
+	Name        string
+	TokenHash   string
+	TokenPrefix string
+	Scope       string
+	ExpiresAt   time.Time
+	LastUsedAt  time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Expired returns true if the token has an expiry date and it has passed
+func (t APIToken) Expired() bool {
+	return t.ExpiresAt.Year() > 1 && time.Now().After(t.ExpiresAt)
+}
+
+// CanWrite returns true if the token may be used for requests that change state
+func (t APIToken) CanWrite() bool {
+	return t.Scope == APITokenScopeReadWrite
+}
+
 // Preference model
 type Preference struct {
 	ID         int
@@ -55,16 +272,123 @@ type Host struct {
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 	HostServices  []HostService
+	ParentIDs     []int
+	Groups        []HostGroup
+	Tags          []HostTag
+	// AgentTokenPrefix is the start of the host's agent token, kept to tell tokens apart. It is
+	// empty while the host has no agent token.
+	AgentTokenPrefix string
+	AgentLastSeen    time.Time
+	AgentVersion     string
+	AgentOS          string
+}
+
+// AgentOfflineAfter is how long an agent may go without contacting the server before it is
+// shown as offline. Agents poll every minute.
+const AgentOfflineAfter = 3 * time.Minute
+
+// Agent statuses
+const (
+	AgentNone    = "none"
+	AgentOnline  = "online"
+	AgentOffline = "offline"
+)
+
+// AgentStatus returns whether the host's agent has been in touch lately: AgentNone if no agent
+// has ever registered for it, AgentOnline or AgentOffline otherwise
+func (h Host) AgentStatus() string {
+	if h.AgentLastSeen.Year() <= 1 {
+		return AgentNone
+	}
+	if time.Since(h.AgentLastSeen) > AgentOfflineAfter {
+		return AgentOffline
+	}
+	return AgentOnline
+}
+
+// HostGroup is the model for a group of hosts
+type HostGroup struct {
+	ID          int
+	GroupName   string
+	Description string
+	HostCount   int
+	Healthy     int
+	Warning     int
+	Problem     int
+	Pending     int
+	Unknown     int
+	Unreachable int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// HostTag is the model for a key/value tag on a host
+type HostTag struct {
+	Key   string
+	Value string
 }
 
+// String returns the tag in key=value form
+func (t HostTag) String() string {
+	if t.Value == "" {
+		return t.Key
+	}
+	return t.Key + "=" + t.Value
+}
+
+// HostFilter restricts hosts and host services to a group and/or tag. Zero values match everything.
+type HostFilter struct {
+	GroupID  int
+	TagKey   string
+	TagValue string
+}
+
+// HostDependency is the model for an entry in a host's dependency tree
+type HostDependency struct {
+	HostID   int
+	HostName string
+	Depth    int
+	Status   string
+}
+
+// Service check types
+const (
+	// CheckTypeBuiltin services are checked by vigilate itself, according to their id
+	CheckTypeBuiltin = "builtin"
+	// CheckTypeAlertmanager services are never checked; their status comes from Alertmanager alerts
+	CheckTypeAlertmanager = "alertmanager"
+	// CheckTypeCommand services are checked by running a Nagios-compatible plugin
+	CheckTypeCommand = "command"
+	// CheckTypeAgent services are checked by the agent running on the host. Their command is
+	// the kind of check.
+	CheckTypeAgent = "agent"
+)
+
 // Service is the model for services
 type Service struct {
 	ID          int
 	ServiceName string
 	Active      int
 	Icon        string
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	CheckType   string
+	// Command, Arguments and TimeoutSeconds configure the plugin of a command check. Arguments
+	// is a template that may contain macros such as $HOSTADDRESS$.
+	Command        string
+	Arguments      string
+	TimeoutSeconds int
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// FiringAlert is an Alertmanager alert that is firing for a host service, kept until it is resolved
+type FiringAlert struct {
+	ID            int
+	HostServiceID int
+	Fingerprint   string
+	Status        string
+	Message       string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
 // HostService is the model for host services
@@ -82,6 +406,17 @@ type HostService struct {
 	Service        Service
 	HostName       string
 	LastMessage    string
+	// BadgeToken lets anyone holding it see the service's badges. Badges are off while it is empty.
+	BadgeToken string
+	// PingToken is the secret part of a heartbeat's ping url
+	PingToken string
+	// GraceNumber and GraceUnit are how late a heartbeat's ping may be before it is a problem
+	GraceNumber int
+	GraceUnit   string
+	LastPing    time.Time
+	// WarningThreshold and CriticalThreshold are passed to a command check's plugin
+	WarningThreshold  string
+	CriticalThreshold string
 }
 
 // Schedule is the model for a schedule
@@ -108,3 +443,67 @@ type Event struct {
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 }
+
+// StatusPage is the model for a public status page
+type StatusPage struct {
+	ID          int
+	Name        string
+	Slug        string
+	Description string
+	Active      int
+	Components  []StatusPageComponent
+	Notices     []StatusPageNotice
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// StatusPageComponent is a named group of host services shown as one line on a status page
+type StatusPageComponent struct {
+	ID             int
+	StatusPageID   int
+	Name           string
+	SortOrder      int
+	HostServiceIDs []int
+	HostServices   []HostService
+}
+
+// StatusPageNotice is a message posted by hand on a status page, such as an incident or planned maintenance
+type StatusPageNotice struct {
+	ID           int
+	StatusPageID int
+	Title        string
+	Body         string
+	Severity     string
+	ResolvedAt   time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// Resolved returns true if the notice has been marked as resolved
+func (n StatusPageNotice) Resolved() bool {
+	return n.ResolvedAt.Year() > 1
+}
+
+// EventFilter restricts and paginates an event query. Zero values match everything.
+type EventFilter struct {
+	HostID        int
+	HostServiceID int
+	EventType     string
+	Since         time.Time
+	Until         time.Time
+	Limit         int
+	Offset        int
+}
+
+// PushTarget is the model for a push notification target (telegram chat, ntfy topic or gotify server)
+type PushTarget struct {
+	ID        int
+	Name      string
+	Kind      string
+	URL       string
+	Token     string
+	Recipient string
+	Active    int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
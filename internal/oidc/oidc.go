@@ -0,0 +1,253 @@
+// Package oidc logs users in through an OpenID Connect provider, using the authorization code
+// flow with PKCE. The provider's settings are found through discovery, and ID tokens are checked
+// against the provider's published keys.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultScopes are asked for when no scopes are configured
+var DefaultScopes = []string{"openid", "profile", "email"}
+
+// Config is how vigilate is registered with the provider
+type Config struct {
+	// Issuer is the provider's issuer url, e.g. https://login.example.com/realms/main. Discovery
+	// looks for Issuer + /.well-known/openid-configuration.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is vigilate's callback url, as registered with the provider
+	RedirectURL string
+	Scopes      []string
+	// Roles gives users their access level
+	Roles RoleMapping
+}
+
+// Provider is an OpenID Connect provider. Its discovery document and keys are fetched when first
+// needed, so vigilate starts even while the provider is down.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      []jsonWebKey
+	keysAt    time.Time
+}
+
+// discovery is the part of the discovery document vigilate uses
+type discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+// keysRefreshInterval is how often keys may be fetched again when a token is signed with a key
+// that isn't known yet, which happens after the provider rotates its keys
+const keysRefreshInterval = time.Minute
+
+// New returns a provider for the config
+func New(c Config) *Provider {
+	c.Issuer = strings.TrimSpace(c.Issuer)
+	if len(c.Scopes) == 0 {
+		c.Scopes = DefaultScopes
+	}
+
+	return &Provider{
+		config: c,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Issuer returns the provider's issuer url
+func (p *Provider) Issuer() string {
+	return p.config.Issuer
+}
+
+// Roles returns how users get their access level
+func (p *Provider) Roles() RoleMapping {
+	return p.config.Roles
+}
+
+// NewRandom returns a random url-safe string, for use as a state, nonce or PKCE code verifier
+func NewRandom() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallenge returns the S256 PKCE challenge of a code verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the provider's url that the browser is sent to for logging in. state and
+// nonce are checked again on the way back; verifier is kept for Exchange.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	d, err := p.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.config.ClientID)
+	v.Set("redirect_uri", p.config.RedirectURL)
+	v.Set("scope", strings.Join(p.config.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", codeChallenge(verifier))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// tokenResponse is the part of the token endpoint's answer vigilate uses
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange trades the code the provider sent back for an ID token, which still has to be checked
+// with Verify
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	d, err := p.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	if p.config.ClientSecret == "" {
+		// a public client identifies itself in the body
+		form.Set("client_id", p.config.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+
+	var t tokenResponse
+	if err := json.Unmarshal(body, &t); err != nil {
+		return "", fmt.Errorf("oidc: token endpoint answered %s with an unreadable body", resp.Status)
+	}
+
+	if t.Error != "" {
+		return "", fmt.Errorf("oidc: token endpoint: %s %s", t.Error, t.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc: token endpoint answered %s", resp.Status)
+	}
+	if t.IDToken == "" {
+		return "", errors.New("oidc: token endpoint sent no id_token; is the openid scope allowed?")
+	}
+
+	return t.IDToken, nil
+}
+
+// endpoints returns the discovery document, fetching it the first time
+func (p *Provider) endpoints(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	d := p.discovery
+	p.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+
+	d = &discovery{}
+	err := p.getJSON(ctx, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", d)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %w", err)
+	}
+
+	if d.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("oidc: discovery: provider says its issuer is %q, not %q", d.Issuer, p.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery: authorization_endpoint, token_endpoint or jwks_uri is missing")
+	}
+	if len(d.CodeChallengeMethods) > 0 && !contains(d.CodeChallengeMethods, "S256") {
+		return nil, errors.New("oidc: discovery: provider does not support S256 PKCE")
+	}
+
+	p.mu.Lock()
+	p.discovery = d
+	p.mu.Unlock()
+
+	return d, nil
+}
+
+// getJSON fetches a url and decodes its json body into v
+func (p *Provider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", u, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,320 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"github.com/luksbutz/vigilate/internal/oidc/oidctest"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID    = "vigilate"
+	testSecret      = "s3cret"
+	testRedirectURL = "http://vigilate.test/login/oidc/callback"
+)
+
+// newTestProvider starts a mock provider and returns it with a Provider configured for it
+func newTestProvider(t *testing.T, secret string) (*oidctest.Server, *Provider) {
+	t.Helper()
+
+	s := oidctest.NewServer(testClientID, secret)
+	t.Cleanup(s.Close)
+
+	p := New(Config{
+		Issuer:       s.Issuer(),
+		ClientID:     testClientID,
+		ClientSecret: secret,
+		RedirectURL:  testRedirectURL,
+	})
+
+	return s, p
+}
+
+// authorize follows an authorization url to the mock provider, which logs the user in, and
+// returns the query of the redirect back to vigilate
+func authorize(t *testing.T, authURL string) url.Values {
+	t.Helper()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorization endpoint answered %s", resp.Status)
+	}
+
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(back.String(), testRedirectURL+"?") {
+		t.Fatalf("sent back to %s, not the redirect url", back)
+	}
+
+	return back.Query()
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	s, p := newTestProvider(t, testSecret)
+
+	authURL, err := p.AuthCodeURL(context.Background(), "the-state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Scheme + "://" + u.Host + u.Path; got != s.URL+"/authorize" {
+		t.Errorf("authorization endpoint is %s, want %s", got, s.URL+"/authorize")
+	}
+
+	q := u.Query()
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid profile email",
+		"state":                 "the-state",
+		"nonce":                 "the-nonce",
+		"code_challenge":        codeChallenge("the-verifier"),
+		"code_challenge_method": "S256",
+	}
+	for k, v := range want {
+		if q.Get(k) != v {
+			t.Errorf("%s is %q, want %q", k, q.Get(k), v)
+		}
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// the example of RFC 7636, appendix B
+	got := codeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("code challenge is %s, want %s", got, want)
+	}
+}
+
+func TestLoginFlow(t *testing.T) {
+	for _, secret := range []string{testSecret, ""} {
+		name := "confidential client"
+		if secret == "" {
+			name = "public client"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s, p := newTestProvider(t, secret)
+			s.Claims = map[string]interface{}{
+				"sub":            "alice-1",
+				"email":          "alice@example.com",
+				"email_verified": true,
+				"name":           "Alice Example",
+				"given_name":     "Alice",
+				"family_name":    "Example",
+			}
+
+			ctx := context.Background()
+			authURL, err := p.AuthCodeURL(ctx, "the-state", "the-nonce", "the-verifier")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			back := authorize(t, authURL)
+			if back.Get("state") != "the-state" {
+				t.Errorf("state came back as %q", back.Get("state"))
+			}
+
+			rawIDToken, err := p.Exchange(ctx, back.Get("code"), "the-verifier")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := p.Verify(ctx, rawIDToken, "the-nonce")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.Subject != "alice-1" || c.Email != "alice@example.com" || !c.EmailVerified ||
+				c.Name != "Alice Example" || c.GivenName != "Alice" || c.FamilyName != "Example" {
+				t.Errorf("wrong claims: %+v", c)
+			}
+		})
+	}
+}
+
+func TestExchangeChecksPKCE(t *testing.T) {
+	_, p := newTestProvider(t, testSecret)
+	ctx := context.Background()
+
+	authURL, err := p.AuthCodeURL(ctx, "the-state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	back := authorize(t, authURL)
+
+	_, err = p.Exchange(ctx, back.Get("code"), "another-verifier")
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("exchange with the wrong code verifier gave %v, want invalid_grant", err)
+	}
+}
+
+func TestExchangeCodeWorksOnce(t *testing.T) {
+	_, p := newTestProvider(t, testSecret)
+	ctx := context.Background()
+
+	authURL, err := p.AuthCodeURL(ctx, "the-state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	back := authorize(t, authURL)
+
+	if _, err := p.Exchange(ctx, back.Get("code"), "the-verifier"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(ctx, back.Get("code"), "the-verifier"); err == nil {
+		t.Error("a code was exchanged twice")
+	}
+}
+
+func TestExchangeWrongSecret(t *testing.T) {
+	s, _ := newTestProvider(t, testSecret)
+
+	p := New(Config{
+		Issuer:       s.Issuer(),
+		ClientID:     testClientID,
+		ClientSecret: "wrong",
+		RedirectURL:  testRedirectURL,
+	})
+
+	ctx := context.Background()
+	authURL, err := p.AuthCodeURL(ctx, "the-state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	back := authorize(t, authURL)
+
+	_, err = p.Exchange(ctx, back.Get("code"), "the-verifier")
+	if err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("exchange with the wrong secret gave %v, want invalid_client", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s, p := newTestProvider(t, testSecret)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// claims returns good claims for the nonce, with changes
+	claims := func(change func(c map[string]interface{})) map[string]interface{} {
+		c := s.StandardClaims("the-nonce")
+		c["sub"] = "alice-1"
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		nonce   string
+		wantErr string
+	}{
+		{"good", s.IDToken(claims(nil)), "the-nonce", ""},
+		{"audience list", s.IDToken(claims(func(c map[string]interface{}) {
+			c["aud"] = []string{"another", testClientID}
+			c["azp"] = testClientID
+		})), "the-nonce", ""},
+		{"nonce mismatch", s.IDToken(claims(nil)), "another-nonce", "nonce does not match"},
+		{"no nonce expected", s.IDToken(claims(nil)), "", "nonce does not match"},
+		{"bad signature", oidctest.SignRS256(otherKey, s.KeyID, claims(nil)), "the-nonce", "bad signature"},
+		{"tampered payload", tamper(s.IDToken(claims(nil)), s.IDToken(claims(func(c map[string]interface{}) {
+			c["sub"] = "mallory"
+		}))), "the-nonce", "bad signature"},
+		{"unknown key", oidctest.SignRS256(s.Key, "another-key", claims(nil)), "the-nonce", "unknown signing key"},
+		{"wrong audience", s.IDToken(claims(func(c map[string]interface{}) {
+			c["aud"] = "another-client"
+		})), "the-nonce", "not issued for this client"},
+		{"wrong authorized party", s.IDToken(claims(func(c map[string]interface{}) {
+			c["azp"] = "another-client"
+		})), "the-nonce", "issued to another party"},
+		{"wrong issuer", s.IDToken(claims(func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example.com"
+		})), "the-nonce", "issued by"},
+		{"expired", s.IDToken(claims(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-2 * clockSkew).Unix()
+		})), "the-nonce", "expired"},
+		{"no expiry", s.IDToken(claims(func(c map[string]interface{}) {
+			delete(c, "exp")
+		})), "the-nonce", "no expiry"},
+		{"issued in the future", s.IDToken(claims(func(c map[string]interface{}) {
+			c["iat"] = time.Now().Add(2 * clockSkew).Unix()
+		})), "the-nonce", "issued in the future"},
+		{"no subject", s.IDToken(claims(func(c map[string]interface{}) {
+			delete(c, "sub")
+		})), "the-nonce", "no subject"},
+		{"unsigned", unsigned(s.IDToken(claims(nil))), "the-nonce", "not supported"},
+		{"not a jwt", "not-a-jwt", "the-nonce", "not a signed jwt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.Verify(context.Background(), tt.token, tt.nonce)
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("got %v, want no error", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidToken) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want an invalid token error about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// tamper returns token with the payload of another
+func tamper(token, other string) string {
+	parts := strings.Split(token, ".")
+	parts[1] = strings.Split(other, ".")[1]
+	return strings.Join(parts, ".")
+}
+
+// unsigned returns token with its header saying it isn't signed
+func unsigned(token string) string {
+	parts := strings.Split(token, ".")
+	parts[0] = "eyJhbGciOiJub25lIn0" // {"alg":"none"}
+	return strings.Join(parts, ".")
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	s, _ := newTestProvider(t, testSecret)
+
+	// the provider says its issuer is s.URL, without the slash
+	p := New(Config{Issuer: s.URL + "/", ClientID: testClientID, RedirectURL: testRedirectURL})
+
+	_, err := p.AuthCodeURL(context.Background(), "the-state", "the-nonce", "the-verifier")
+	if err == nil || !strings.Contains(err.Error(), "issuer") {
+		t.Errorf("got %v, want an issuer mismatch", err)
+	}
+}
@@ -0,0 +1,250 @@
+// Package oidctest runs an OpenID Connect provider in-process, for testing single sign-on
+// without a real identity provider. It does discovery, the authorization code flow with PKCE,
+// and signs ID tokens with an RSA key it publishes on its jwks_uri.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Server is a running provider. The user who logs in at its authorization endpoint has the
+// claims in Claims.
+type Server struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+	// Claims are the claims of the user logging in, e.g. sub, email and groups. iss, aud, exp,
+	// iat and nonce are added to ID tokens.
+	Claims map[string]interface{}
+	// Key signs ID tokens; its public half is published with the key id KeyID
+	Key   *rsa.PrivateKey
+	KeyID string
+
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+// grant is an authorization code waiting to be exchanged
+type grant struct {
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	claims        map[string]interface{}
+}
+
+// NewServer starts a provider for one client; an empty secret makes it a public client. Close
+// it when done.
+func NewServer(clientID, clientSecret string) *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic("oidctest: " + err.Error())
+	}
+
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Claims:       map[string]interface{}{"sub": "user-1"},
+		Key:          key,
+		KeyID:        "test-key",
+		grants:       make(map[string]grant),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/jwks", s.jwks)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Issuer returns the provider's issuer url
+func (s *Server) Issuer() string {
+	return s.URL
+}
+
+// discovery serves the discovery document
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                           s.URL,
+		"authorization_endpoint":           s.URL + "/authorize",
+		"token_endpoint":                   s.URL + "/token",
+		"jwks_uri":                         s.URL + "/jwks",
+		"code_challenge_methods_supported": []string{"S256"},
+	})
+}
+
+// authorize logs the user in straight away, and sends the browser back with a code
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != s.ClientID || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+
+	s.mu.Lock()
+	s.grants[code] = grant{
+		redirectURI:   q.Get("redirect_uri"),
+		codeChallenge: q.Get("code_challenge"),
+		nonce:         q.Get("nonce"),
+		claims:        copyClaims(s.Claims),
+	}
+	s.mu.Unlock()
+
+	back := url.Values{}
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+back.Encode(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token, checking the client and the PKCE code verifier
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	if !s.clientAuthenticated(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	// a code works once
+	s.mu.Lock()
+	g, ok := s.grants[r.Form.Get("code")]
+	delete(s.grants, r.Form.Get("code"))
+	s.mu.Unlock()
+
+	if !ok || g.redirectURI != r.Form.Get("redirect_uri") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(g.codeChallenge)) != 1 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "code verifier does not match"})
+		return
+	}
+
+	claims := s.StandardClaims(g.nonce)
+	for k, v := range g.claims {
+		claims[k] = v
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     s.IDToken(claims),
+	})
+}
+
+// clientAuthenticated checks the client id, and the secret of a confidential client
+func (s *Server) clientAuthenticated(r *http.Request) bool {
+	if s.ClientSecret == "" {
+		return r.Form.Get("client_id") == s.ClientID
+	}
+
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+
+	return id == s.ClientID && secret == s.ClientSecret
+}
+
+// jwks serves the public key
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	e := big.NewInt(int64(s.Key.PublicKey.E))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": s.KeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(s.Key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(e.Bytes()),
+		}},
+	})
+}
+
+// StandardClaims returns the registered claims of an ID token for the client, issued now and
+// good for five minutes
+func (s *Server) StandardClaims(nonce string) map[string]interface{} {
+	now := time.Now()
+
+	return map[string]interface{}{
+		"iss":   s.URL,
+		"aud":   s.ClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": nonce,
+	}
+}
+
+// IDToken returns claims as an ID token signed with the server's key
+func (s *Server) IDToken(claims map[string]interface{}) string {
+	return SignRS256(s.Key, s.KeyID, claims)
+}
+
+// SignRS256 returns claims as a jwt signed with key, with kid in its header
+func SignRS256(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		panic("oidctest: " + err.Error())
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic("oidctest: " + err.Error())
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// randomString returns a random url-safe string
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("oidctest: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// copyClaims returns a shallow copy of claims
+func copyClaims(claims map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(claims))
+	for k, v := range claims {
+		c[k] = v
+	}
+	return c
+}
+
+// writeJSON sends v as json
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,40 @@
+package oidc
+
+import (
+	"github.com/luksbutz/vigilate/internal/models"
+)
+
+// RoleMapping decides a user's access level from the claims of their ID token
+type RoleMapping struct {
+	// Claim is the claim holding the user's groups or roles, e.g. groups. When it is empty,
+	// everyone gets Default.
+	Claim string
+	models.RoleMapping
+}
+
+// Level returns the access level the claims give: the highest role any of the claim's values
+// match, or Default
+func (m RoleMapping) Level(c Claims) int {
+	if m.Claim == "" {
+		return m.Default
+	}
+
+	var values []string
+	switch v := c.Raw[m.Claim].(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	return m.RoleMapping.Level(values)
+}
+
+// FromClaims reports whether roles come from the claims, and so are updated at every login
+func (m RoleMapping) FromClaims() bool {
+	return m.Claim != ""
+}
@@ -0,0 +1,58 @@
+package oidc
+
+import (
+	"encoding/json"
+	"github.com/luksbutz/vigilate/internal/models"
+	"testing"
+)
+
+func TestRoleMappingLevel(t *testing.T) {
+	m := RoleMapping{
+		Claim: "groups",
+		RoleMapping: models.RoleMapping{
+			Admins:    []string{"vigilate-admins"},
+			Operators: []string{"vigilate-operators"},
+			Viewers:   []string{"staff"},
+			Default:   0,
+		},
+	}
+
+	tests := []struct {
+		name   string
+		claims string
+		want   int
+	}{
+		{"admin", `{"groups": ["staff", "vigilate-admins"]}`, models.AccessAdmin},
+		{"operator", `{"groups": ["vigilate-operators", "staff"]}`, models.AccessOperator},
+		{"viewer", `{"groups": ["staff"]}`, models.AccessViewer},
+		{"single value", `{"groups": "vigilate-operators"}`, models.AccessOperator},
+		{"no matching group", `{"groups": ["sales"]}`, 0},
+		{"no claim", `{}`, 0},
+		{"wrong type", `{"groups": 7}`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Claims
+			if err := json.Unmarshal([]byte(tt.claims), &c.Raw); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := m.Level(c); got != tt.want {
+				t.Errorf("level is %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoleMappingWithoutClaim(t *testing.T) {
+	m := RoleMapping{RoleMapping: models.RoleMapping{Admins: []string{"vigilate-admins"}, Default: models.AccessViewer}}
+
+	c := Claims{Raw: map[string]interface{}{"groups": []interface{}{"vigilate-admins"}}}
+	if got := m.Level(c); got != models.AccessViewer {
+		t.Errorf("level is %d, want the default %d", got, models.AccessViewer)
+	}
+	if m.FromClaims() {
+		t.Error("roles come from the claims without a claim")
+	}
+}
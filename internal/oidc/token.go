@@ -0,0 +1,341 @@
+package oidc
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned for an ID token that can't be trusted
+var ErrInvalidToken = errors.New("oidc: invalid id token")
+
+// clockSkew is how far the provider's clock may be from ours
+const clockSkew = time.Minute
+
+// Claims are the claims of a verified ID token
+type Claims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	GivenName     string
+	FamilyName    string
+	// Raw holds every claim, for role mapping
+	Raw map[string]interface{}
+}
+
+// jsonWebKey is a key from the provider's jwks_uri
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// algorithms maps the signing algorithms vigilate accepts to their key type and hash
+var algorithms = map[string]struct {
+	kty  string
+	hash crypto.Hash
+}{
+	"RS256": {"RSA", crypto.SHA256},
+	"RS384": {"RSA", crypto.SHA384},
+	"RS512": {"RSA", crypto.SHA512},
+	"ES256": {"EC", crypto.SHA256},
+	"ES384": {"EC", crypto.SHA384},
+	"ES512": {"EC", crypto.SHA512},
+}
+
+// Verify checks an ID token's signature, issuer, audience, expiry and nonce, and returns its claims
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (Claims, error) {
+	var c Claims
+
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return c, fmt.Errorf("%w: not a signed jwt", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return c, fmt.Errorf("%w: header: %s", ErrInvalidToken, err)
+	}
+
+	alg, ok := algorithms[header.Alg]
+	if !ok {
+		return c, fmt.Errorf("%w: signing algorithm %q is not supported", ErrInvalidToken, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return c, fmt.Errorf("%w: signature: %s", ErrInvalidToken, err)
+	}
+
+	key, err := p.signingKey(ctx, header.Kid, alg.kty)
+	if err != nil {
+		return c, err
+	}
+
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(key, alg.hash, h.Sum(nil), signature) {
+		return c, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return c, fmt.Errorf("%w: payload: %s", ErrInvalidToken, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&c.Raw); err != nil {
+		return c, fmt.Errorf("%w: payload: %s", ErrInvalidToken, err)
+	}
+
+	if err := p.checkClaims(c.Raw, nonce, time.Now()); err != nil {
+		return c, err
+	}
+
+	c.Subject = stringClaim(c.Raw, "sub")
+	c.Email = stringClaim(c.Raw, "email")
+	c.Name = stringClaim(c.Raw, "name")
+	c.GivenName = stringClaim(c.Raw, "given_name")
+	c.FamilyName = stringClaim(c.Raw, "family_name")
+	switch v := c.Raw["email_verified"].(type) {
+	case bool:
+		c.EmailVerified = v
+	case string:
+		// some providers send it as a string
+		c.EmailVerified = v == "true"
+	}
+
+	return c, nil
+}
+
+// checkClaims checks the registered claims of an ID token
+func (p *Provider) checkClaims(raw map[string]interface{}, nonce string, now time.Time) error {
+	if iss := stringClaim(raw, "iss"); iss != p.config.Issuer {
+		return fmt.Errorf("%w: issued by %q, not %q", ErrInvalidToken, iss, p.config.Issuer)
+	}
+
+	var audience []string
+	switch v := raw["aud"].(type) {
+	case string:
+		audience = []string{v}
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+	}
+	if !contains(audience, p.config.ClientID) {
+		return fmt.Errorf("%w: not issued for this client", ErrInvalidToken)
+	}
+	if azp, ok := raw["azp"].(string); ok && azp != p.config.ClientID {
+		return fmt.Errorf("%w: issued to another party", ErrInvalidToken)
+	}
+
+	exp, ok := timeClaim(raw, "exp")
+	if !ok {
+		return fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	if now.After(exp.Add(clockSkew)) {
+		return fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if iat, ok := timeClaim(raw, "iat"); ok && iat.After(now.Add(clockSkew)) {
+		return fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	}
+
+	got := stringClaim(raw, "nonce")
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return fmt.Errorf("%w: nonce does not match", ErrInvalidToken)
+	}
+
+	if stringClaim(raw, "sub") == "" {
+		return fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+
+	return nil
+}
+
+// signingKey returns the provider's key with the given id and type. The keys are fetched again,
+// at most once every keysRefreshInterval, when no key matches.
+func (p *Provider) signingKey(ctx context.Context, kid, kty string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	keys, fetchedAt := p.keys, p.keysAt
+	p.mu.Unlock()
+
+	if key := findKey(keys, kid, kty); key != nil {
+		return key, nil
+	}
+
+	if time.Since(fetchedAt) < keysRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown signing key %q", ErrInvalidToken, kid)
+	}
+
+	d, err := p.endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc: keys: %w", err)
+	}
+
+	p.mu.Lock()
+	p.keys, p.keysAt = set.Keys, time.Now()
+	p.mu.Unlock()
+
+	if key := findKey(set.Keys, kid, kty); key != nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown signing key %q", ErrInvalidToken, kid)
+}
+
+// findKey returns the signing key with the given id and type. A token without a key id may use
+// the provider's only key of that type.
+func findKey(keys []jsonWebKey, kid, kty string) crypto.PublicKey {
+	var found []jsonWebKey
+	for _, k := range keys {
+		if k.Kty != kty || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		if kid == "" || k.Kid == kid {
+			found = append(found, k)
+		}
+	}
+	if len(found) != 1 {
+		return nil
+	}
+
+	key, err := found[0].publicKey()
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// publicKey decodes the key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("rsa exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("curve %q is not supported", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("ec point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("key type %q is not supported", k.Kty)
+}
+
+// verifySignature checks a jws signature of a digest
+func verifySignature(key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// jws ecdsa signatures are r and s side by side, each the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url json segment of a jwt into v
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// decodeBigInt decodes a base64url big-endian number
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty number")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// stringClaim returns a claim that is a string, or "" if it is missing or isn't one
+func stringClaim(raw map[string]interface{}, name string) string {
+	s, _ := raw[name].(string)
+	return s
+}
+
+// timeClaim returns a claim that is a time in seconds since the epoch
+func timeClaim(raw map[string]interface{}, name string) (time.Time, bool) {
+	n, ok := raw[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
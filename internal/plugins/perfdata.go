@@ -0,0 +1,131 @@
+package plugins
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PerfDatum is one value of a plugin's performance data, e.g. 'load1'=0.42;5;10;0
+type PerfDatum struct {
+	Label string
+	Value float64
+	Unit  string
+	Warn  string
+	Crit  string
+	Min   string
+	Max   string
+}
+
+var numberPrefix = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?`)
+
+// ParseOutput splits a plugin's output into its first line of text and its performance data.
+// Performance data follows a | on the first line, and on the long output lines after the first
+// of them to contain a |.
+func ParseOutput(out string) (string, []PerfDatum) {
+	lines := strings.Split(strings.ReplaceAll(out, "\r\n", "\n"), "\n")
+
+	text, perf := lines[0], ""
+	if i := strings.Index(text, "|"); i >= 0 {
+		text, perf = text[:i], text[i+1:]
+	}
+
+	for i, l := range lines[1:] {
+		if j := strings.Index(l, "|"); j >= 0 {
+			perf += " " + l[j+1:] + " " + strings.Join(lines[i+2:], " ")
+			break
+		}
+	}
+
+	return strings.TrimSpace(text), ParsePerfData(perf)
+}
+
+// ParsePerfData parses space separated performance data. Values that can't be read, that are
+// U (unknown) or that have no label are left out.
+func ParsePerfData(s string) []PerfDatum {
+	var data []PerfDatum
+
+	for {
+		s = strings.TrimLeft(s, " \t\n")
+		if s == "" {
+			return data
+		}
+
+		// the label, which may be quoted with ' (and '' inside for a ')
+		var label string
+		if s[0] == '\'' {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s); i++ {
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						b.WriteByte('\'')
+						i++
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[i])
+			}
+			label = b.String()
+			if i < len(s) {
+				// past the closing quote
+				i++
+			}
+			s = s[i:]
+			if !strings.HasPrefix(s, "=") {
+				s = skipToken(s)
+				continue
+			}
+			s = s[1:]
+		} else {
+			eq := strings.IndexByte(s, '=')
+			sp := strings.IndexAny(s, " \t\n")
+			if eq < 0 || (sp >= 0 && sp < eq) {
+				s = skipToken(s)
+				continue
+			}
+			label, s = s[:eq], s[eq+1:]
+		}
+
+		// value[unit];warn;crit;min;max
+		end := strings.IndexAny(s, " \t\n")
+		if end < 0 {
+			end = len(s)
+		}
+		fields := strings.Split(s[:end], ";")
+		s = s[end:]
+
+		num := numberPrefix.FindString(fields[0])
+		if label == "" || num == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			continue
+		}
+
+		d := PerfDatum{Label: label, Value: v, Unit: fields[0][len(num):]}
+		for i, f := range fields[1:] {
+			switch i {
+			case 0:
+				d.Warn = f
+			case 1:
+				d.Crit = f
+			case 2:
+				d.Min = f
+			case 3:
+				d.Max = f
+			}
+		}
+
+		data = append(data, d)
+	}
+}
+
+func skipToken(s string) string {
+	if i := strings.IndexAny(s, " \t\n"); i >= 0 {
+		return s[i:]
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package plugins
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		out      string
+		wantText string
+		wantPerf []PerfDatum
+	}{
+		{"empty", "", "", nil},
+		{"text only", "OK - all fine\n", "OK - all fine", nil},
+		{"perfdata on the first line", "OK - load 0.42 | load1=0.42;5;10;0\n", "OK - load 0.42",
+			[]PerfDatum{{Label: "load1", Value: 0.42, Warn: "5", Crit: "10", Min: "0"}}},
+		{"long output isn't the message", "DISK OK\n/ 40% used\n/var 70% used\n", "DISK OK", nil},
+		{"perfdata in the long output", "DISK OK | root=40%\n/ 40% used\n/var 70% used | var=70%;80;90\nhome=10%\n", "DISK OK",
+			[]PerfDatum{
+				{Label: "root", Value: 40, Unit: "%"},
+				{Label: "var", Value: 70, Unit: "%", Warn: "80", Crit: "90"},
+				{Label: "home", Value: 10, Unit: "%"},
+			}},
+		{"windows line endings", "OK - fine | t=1s\r\n", "OK - fine", []PerfDatum{{Label: "t", Value: 1, Unit: "s"}}},
+		{"only perfdata", "| a=1", "", []PerfDatum{{Label: "a", Value: 1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, perf := ParseOutput(tt.out)
+			if text != tt.wantText {
+				t.Errorf("text is %q, want %q", text, tt.wantText)
+			}
+			if !reflect.DeepEqual(perf, tt.wantPerf) {
+				t.Errorf("perfdata is %+v, want %+v", perf, tt.wantPerf)
+			}
+		})
+	}
+}
+
+func TestParsePerfData(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []PerfDatum
+	}{
+		{"empty", "  ", nil},
+		{"value", "time=0.25", []PerfDatum{{Label: "time", Value: 0.25}}},
+		{"all fields", "rta=12.5ms;100;500;0;1000", []PerfDatum{
+			{Label: "rta", Value: 12.5, Unit: "ms", Warn: "100", Crit: "500", Min: "0", Max: "1000"}}},
+		{"empty fields", "used=5GB;;;0;", []PerfDatum{{Label: "used", Value: 5, Unit: "GB", Min: "0"}}},
+		{"ranges are kept as they are", "temp=40C;@10:20;~:30", []PerfDatum{
+			{Label: "temp", Value: 40, Unit: "C", Warn: "@10:20", Crit: "~:30"}}},
+		{"several", "a=1 b=-2.5\tc=3e2", []PerfDatum{
+			{Label: "a", Value: 1}, {Label: "b", Value: -2.5}, {Label: "c", Value: 300}}},
+		{"counter", "packets=123c", []PerfDatum{{Label: "packets", Value: 123, Unit: "c"}}},
+		{"leading dot", "ratio=.5", []PerfDatum{{Label: "ratio", Value: 0.5}}},
+		{"quoted label", "'C:\\ used space'=42%", []PerfDatum{{Label: "C:\\ used space", Value: 42, Unit: "%"}}},
+		{"quote in a quoted label", "'it''s'=1", []PerfDatum{{Label: "it's", Value: 1}}},
+		{"label with =", "'a=b'=1", []PerfDatum{{Label: "a=b", Value: 1}}},
+		{"unknown value", "a=U b=2", []PerfDatum{{Label: "b", Value: 2}}},
+		{"no value", "a= b=2", []PerfDatum{{Label: "b", Value: 2}}},
+		{"no label", "=1 b=2", []PerfDatum{{Label: "b", Value: 2}}},
+		{"not perfdata", "garbage b=2", []PerfDatum{{Label: "b", Value: 2}}},
+		{"quoted label without a value", "'a' b=2", []PerfDatum{{Label: "b", Value: 2}}},
+		{"unterminated quote", "'abc", nil},
+		{"unterminated quote after a value", "a=1 'b", []PerfDatum{{Label: "a", Value: 1}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParsePerfData(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
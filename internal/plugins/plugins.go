@@ -0,0 +1,233 @@
+// Package plugins runs Nagios-compatible check plugins and reads what they report.
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugin exit codes
+const (
+	OK       = 0
+	Warning  = 1
+	Critical = 2
+	Unknown  = 3
+)
+
+// maxOutput caps how much of a plugin's output is kept
+const maxOutput = 64 << 10
+
+// ErrTimeout is returned when a plugin runs for longer than its timeout
+var ErrTimeout = errors.New("plugins: timed out")
+
+// Result is what a plugin run reported
+type Result struct {
+	ExitCode int
+	Output   string
+	Duration time.Duration
+}
+
+// Resolve returns the path of command inside dir. Commands may be in a subdirectory of dir, but
+// can't escape it.
+func Resolve(dir, command string) (string, error) {
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return "", errors.New("no command")
+	}
+	if dir == "" {
+		return "", errors.New("no plugin directory is configured")
+	}
+
+	path := filepath.Join(dir, filepath.Clean(string(filepath.Separator)+command))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("%s not found in the plugin directory", command)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", command)
+	}
+
+	return path, nil
+}
+
+// Run runs the plugin at path with args, without a shell. A plugin that doesn't exit within
+// timeout is killed, and ErrTimeout is returned.
+func Run(path string, args []string, timeout time.Duration) (Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var out, errOut limitedBuffer
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Dir = filepath.Dir(path)
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return Result{ExitCode: Unknown}, err
+	}
+
+	// don't wait for children of the plugin that might be holding its output open
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		return Result{ExitCode: Critical, Duration: time.Since(start)}, ErrTimeout
+	}
+
+	r := Result{Duration: time.Since(start), Output: out.String()}
+	if strings.TrimSpace(r.Output) == "" {
+		r.Output = errOut.String()
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		r.ExitCode = OK
+	case errors.As(err, &exitErr):
+		r.ExitCode = exitErr.ExitCode()
+		if r.ExitCode < 0 || r.ExitCode > Unknown {
+			r.ExitCode = Unknown
+		}
+	default:
+		return Result{ExitCode: Unknown, Duration: r.Duration}, err
+	}
+
+	return r, nil
+}
+
+// SplitArgs splits an argument template into arguments at spaces, like a shell would, but
+// without any of a shell's expansions. Single and double quotes group words, and a backslash
+// escapes the next character outside single quotes.
+func SplitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+
+	return args, nil
+}
+
+// Expand replaces Nagios-style macros, such as $HOSTADDRESS$, in each argument. Macros are
+// replaced after the template is split, so a value with spaces stays one argument.
+func Expand(args []string, macros map[string]string) []string {
+	pairs := make([]string, 0, 2*len(macros))
+	for k, v := range macros {
+		pairs = append(pairs, "$"+k+"$", v)
+	}
+	r := strings.NewReplacer(pairs...)
+
+	result := make([]string, len(args))
+	for i, a := range args {
+		result[i] = r.Replace(a)
+	}
+	return result
+}
+
+// limitedBuffer keeps the first maxOutput bytes written to it, and throws the rest away
+type limitedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if room := maxOutput - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Check runs the plugin at path and maps its result onto a vigilate status: exit code 0 is
+// healthy, 1 is warning, 2 is problem and 3 is unknown. A plugin that can't be run is unknown too,
+// and one that times out is a problem. The message is the first line of the plugin's output.
+func Check(path string, args []string, timeout time.Duration) (string, string, []PerfDatum) {
+	result, err := Run(path, args, timeout)
+	if errors.Is(err, ErrTimeout) {
+		return fmt.Sprintf("Plugin timed out after %s", timeout), "problem", nil
+	} else if err != nil {
+		return fmt.Sprintf("Could not run %s: %s", filepath.Base(path), err), "unknown", nil
+	}
+
+	text, perf := ParseOutput(result.Output)
+	if text == "" {
+		text = fmt.Sprintf("Plugin exited with code %d", result.ExitCode)
+	}
+
+	switch result.ExitCode {
+	case OK:
+		return text, "healthy", perf
+	case Warning:
+		return text, "warning", perf
+	case Critical:
+		return text, "problem", perf
+	}
+	return text, "unknown", perf
+}
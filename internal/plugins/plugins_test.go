@@ -0,0 +1,156 @@
+package plugins
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"-H $HOSTADDRESS$ -w 5", []string{"-H", "$HOSTADDRESS$", "-w", "5"}},
+		{"  -a\t-b\n-c  ", []string{"-a", "-b", "-c"}},
+		{`-s "GET / HTTP/1.0"`, []string{"-s", "GET / HTTP/1.0"}},
+		{`-s 'it''s'`, []string{"-s", "its"}},
+		{`-s "it's"`, []string{"-s", "it's"}},
+		{`-s 'a "b" c'`, []string{"-s", `a "b" c`}},
+		{`-e ""`, []string{"-e", ""}},
+		{`a\ b`, []string{"a b"}},
+		{`"a\"b"`, []string{`a"b`}},
+		// a backslash means nothing inside single quotes
+		{`'a\b'`, []string{`a\b`}},
+		{`pre"fix"post`, []string{"prefixpost"}},
+		// nothing a shell would do happens
+		{"$(reboot) `reboot` ; | > *", []string{"$(reboot)", "`reboot`", ";", "|", ">", "*"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := SplitArgs(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitArgsErrors(t *testing.T) {
+	for _, in := range []string{`-s "open`, `-s 'open`, `trailing\`} {
+		if got, err := SplitArgs(in); err == nil {
+			t.Errorf("SplitArgs(%q) is %q, want an error", in, got)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	macros := map[string]string{
+		"HOSTADDRESS": "192.0.2.1",
+		"HOSTNAME":    "web 1",
+		"WARNING":     "$CRITICAL$",
+		"CRITICAL":    "10",
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"no macros", []string{"-v"}, []string{"-v"}},
+		{"whole argument", []string{"-H", "$HOSTADDRESS$"}, []string{"-H", "192.0.2.1"}},
+		{"part of an argument", []string{"--url=http://$HOSTADDRESS$:8080/"}, []string{"--url=http://192.0.2.1:8080/"}},
+		{"spaces stay in one argument", []string{"-n", "$HOSTNAME$"}, []string{"-n", "web 1"}},
+		{"values aren't expanded again", []string{"$WARNING$"}, []string{"$CRITICAL$"}},
+		{"unknown macros are left alone", []string{"$NOSUCH$", "$$"}, []string{"$NOSUCH$", "$$"}},
+		{"lowercase is another macro", []string{"$hostaddress$"}, []string{"$hostaddress$"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Expand(tt.args, macros); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// writePlugin writes a shell script plugin into a temporary directory, and returns its path
+func writePlugin(t *testing.T, script string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "check_test")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheck(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh to run plugins with")
+	}
+
+	tests := []struct {
+		name       string
+		script     string
+		wantMsg    string
+		wantStatus string
+		wantPerf   int
+	}{
+		{"ok", `echo "OK - fine | load=0.5;1;2"; exit 0`, "OK - fine", "healthy", 1},
+		{"warning", `echo "WARNING - busy"; exit 1`, "WARNING - busy", "warning", 0},
+		{"critical", `echo "CRITICAL - down"; exit 2`, "CRITICAL - down", "problem", 0},
+		{"unknown", `echo "UNKNOWN - no such disk"; exit 3`, "UNKNOWN - no such disk", "unknown", 0},
+		{"exit code out of range", `echo "odd"; exit 42`, "odd", "unknown", 0},
+		{"no output", `exit 2`, "Plugin exited with code 2", "problem", 0},
+		{"output on stderr", `echo "broken" >&2; exit 3`, "broken", "unknown", 0},
+		{"arguments", `echo "$1|$2"; exit 0`, "a b", "healthy", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, status, perf := Check(writePlugin(t, tt.script), []string{"a b", "c"}, 5*time.Second)
+			if msg != tt.wantMsg || status != tt.wantStatus {
+				t.Errorf("got %q, %s, want %q, %s", msg, status, tt.wantMsg, tt.wantStatus)
+			}
+			if len(perf) != tt.wantPerf {
+				t.Errorf("got %d performance values, want %d", len(perf), tt.wantPerf)
+			}
+		})
+	}
+}
+
+func TestCheckCantRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "check_test")
+	if err := os.WriteFile(path, []byte("not a program"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, status, _ := Check(path, nil, 5*time.Second); status != "unknown" {
+		t.Errorf("status is %s, want unknown", status)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh to run plugins with")
+	}
+
+	start := time.Now()
+	_, status, _ := Check(writePlugin(t, "exec sleep 10"), nil, 100*time.Millisecond)
+	if status != "problem" {
+		t.Errorf("status is %s, want problem", status)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("took %s to time out", d)
+	}
+}
@@ -0,0 +1,52 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gotify sends notifications to a Gotify server
+type gotify struct {
+	serverURL string
+	appToken  string
+}
+
+// gotifyPriorities maps our priorities onto Gotify's 0 to 10 scale
+var gotifyPriorities = map[Priority]int{
+	PriorityLow:     2,
+	PriorityDefault: 5,
+	PriorityHigh:    8,
+}
+
+// Notify sends a message to the Gotify server
+func (g *gotify) Notify(title, msg string, priority Priority) error {
+	if g.serverURL == "" {
+		return errors.New("push: no gotify server url configured")
+	}
+
+	payload := map[string]interface{}{
+		"title":    title,
+		"message":  msg,
+		"priority": gotifyPriorities[priority],
+	}
+
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/message?token=%s", strings.TrimSuffix(g.serverURL, "/"), url.QueryEscape(g.appToken))
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(out))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	return do(req)
+}
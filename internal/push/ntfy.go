@@ -0,0 +1,46 @@
+package push
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const defaultNtfyServer = "https://ntfy.sh"
+
+// ntfy publishes notifications to an ntfy topic
+type ntfy struct {
+	serverURL   string
+	accessToken string
+	topic       string
+}
+
+// ntfyPriorities maps our priorities onto ntfy's 1 (min) to 5 (max) scale
+var ntfyPriorities = map[Priority]string{
+	PriorityLow:     "2",
+	PriorityDefault: "3",
+	PriorityHigh:    "5",
+}
+
+// Notify publishes a message to the ntfy topic
+func (n *ntfy) Notify(title, msg string, priority Priority) error {
+	serverURL := strings.TrimSuffix(n.serverURL, "/")
+	if serverURL == "" {
+		serverURL = defaultNtfyServer
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", serverURL, n.topic), strings.NewReader(msg))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Title", title)
+	req.Header.Add("Priority", ntfyPriorities[priority])
+	req.Header.Add("Tags", "vigilate")
+
+	if n.accessToken != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", n.accessToken))
+	}
+
+	return do(req)
+}
@@ -0,0 +1,87 @@
+package push
+
+import (
+	"errors"
+	"fmt"
+	"github.com/luksbutz/vigilate/internal/models"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ErrUnknownKind unsupported push target kind error
+var ErrUnknownKind = errors.New("push: unknown target kind")
+
+// Priority is the urgency of a push notification, mapped onto each backend's own scale
+type Priority int
+
+const (
+	// PriorityLow is used for recoveries
+	PriorityLow Priority = iota
+	// PriorityDefault is used for warnings
+	PriorityDefault
+	// PriorityHigh is used for problems
+	PriorityHigh
+)
+
+// Notifier is the interface every push backend implements
+type Notifier interface {
+	// Notify delivers a notification with the given title, message and priority
+	Notify(title, msg string, priority Priority) error
+}
+
+// client is shared by all notifiers, so a hanging push server cannot block a check forever
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// PriorityForStatus maps a vigilate status onto a push priority
+func PriorityForStatus(status string) Priority {
+	switch status {
+	case "problem":
+		return PriorityHigh
+	case "warning", "unknown":
+		return PriorityDefault
+	default:
+		return PriorityLow
+	}
+}
+
+// NewNotifier returns the notifier for a push target
+func NewNotifier(t models.PushTarget) (Notifier, error) {
+	switch t.Kind {
+	case "telegram":
+		return &telegram{apiURL: t.URL, botToken: t.Token, chatID: t.Recipient}, nil
+	case "ntfy":
+		return &ntfy{serverURL: t.URL, accessToken: t.Token, topic: t.Recipient}, nil
+	case "gotify":
+		return &gotify{serverURL: t.URL, appToken: t.Token}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKind, t.Kind)
+	}
+}
+
+// Send delivers a notification for a status change to a single push target
+func Send(t models.PushTarget, title, msg, status string) error {
+	n, err := NewNotifier(t)
+	if err != nil {
+		return err
+	}
+
+	return n.Notify(title, msg, PriorityForStatus(status))
+}
+
+// do performs the request, and returns an error if the request failed or the
+// server did not answer with a 2xx status
+func do(req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("push: server returned %s: %s", resp.Status, body)
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const defaultTelegramAPI = "https://api.telegram.org"
+
+// telegram sends notifications to a chat through a Telegram bot
+type telegram struct {
+	apiURL   string
+	botToken string
+	chatID   string
+}
+
+// Notify sends a message to the Telegram chat. Telegram has no priorities, so
+// low priority messages are delivered silently.
+func (t *telegram) Notify(title, msg string, priority Priority) error {
+	apiURL := strings.TrimSuffix(t.apiURL, "/")
+	if apiURL == "" {
+		apiURL = defaultTelegramAPI
+	}
+
+	payload := map[string]interface{}{
+		"chat_id":              t.chatID,
+		"text":                 fmt.Sprintf("%s\n%s", title, msg),
+		"disable_notification": priority == PriorityLow,
+	}
+
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/bot%s/sendMessage", apiURL, t.botToken), bytes.NewReader(out))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	return do(req)
+}
@@ -0,0 +1,440 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// writeWait is how long a write to a client may take
+	writeWait = 10 * time.Second
+	// pingPeriod is how often clients are pinged, which also keeps proxies from closing idle connections
+	pingPeriod = 25 * time.Second
+	// pongWait is how long a websocket client may stay silent before it is dropped
+	pongWait = 2 * pingPeriod
+	// sendBuffer is how many messages may wait for a client; a client that falls further behind
+	// is dropped. It holds a full replay, and then some.
+	sendBuffer = replayBuffer + 16
+	// maxClientMessage is the largest message a client may send
+	maxClientMessage = 4096
+)
+
+// sseHeader starts an event stream response. The body ends when the connection closes.
+const sseHeader = "HTTP/1.1 200 OK\r\n" +
+	"Content-Type: text/event-stream\r\n" +
+	"Cache-Control: no-store\r\n" +
+	"Connection: close\r\n" +
+	"X-Accel-Buffering: no\r\n" +
+	"\r\n" +
+	"retry: 3000\n\n"
+
+// message is what goes over the wire, to and from clients. Events carry their id; subscribed
+// and resync messages carry the hub's epoch and latest id, which the client resumes from.
+type message struct {
+	Type    string      `json:"type"`
+	ID      uint64      `json:"id,omitempty"`
+	Epoch   string      `json:"epoch,omitempty"`
+	Channel string      `json:"channel,omitempty"`
+	Event   string      `json:"event,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+
+	// LastID and the epoch are sent by a client subscribing again after losing its connection
+	LastID uint64 `json:"last_id,omitempty"`
+}
+
+// outgoing is a message on its way to a client; id is the cursor it moves the client to
+type outgoing struct {
+	id   uint64
+	data []byte
+}
+
+// Hub sends events to the browsers connected to it, over a websocket or, where that isn't
+// possible, server-sent events. Every event gets the next id, and the latest are kept so that
+// clients that lost their connection can catch up on what they missed.
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[*client]struct{}
+	epoch   string
+	seq     uint64
+	recent  ring
+}
+
+// client is a browser connected to the hub
+type client struct {
+	userID int
+	// channels is guarded by the hub's mutex
+	channels map[string]bool
+	send     chan outgoing
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewHub returns a hub with no clients
+func NewHub() *Hub {
+	return &Hub{
+		clients: make(map[*client]struct{}),
+		// a new epoch tells clients that events from before a restart are gone
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+		recent: newRing(replayBuffer),
+	}
+}
+
+func newClient(userID int) *client {
+	return &client{
+		userID:   userID,
+		channels: make(map[string]bool),
+		send:     make(chan outgoing, sendBuffer),
+		done:     make(chan struct{}),
+	}
+}
+
+// close tells the client's connection to finish; it is safe to call more than once
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// Trigger sends an event to every client listening on the channel. It never waits for a client;
+// one that can't keep up is disconnected, and catches up when it reconnects.
+func (h *Hub) Trigger(channel, event string, data interface{}) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id := h.seq + 1
+	msg, err := json.Marshal(message{Type: "event", ID: id, Channel: channel, Event: event, Data: data})
+	if err != nil {
+		return err
+	}
+
+	h.seq = id
+	h.recent.add(entry{id: id, channel: channel, data: msg})
+
+	for c := range h.clients {
+		if !c.channels[channel] {
+			continue
+		}
+		select {
+		case c.send <- outgoing{id: id, data: msg}:
+		default:
+			log.Printf("Realtime client of user %d is too slow; disconnecting it", c.userID)
+			c.close()
+		}
+	}
+
+	return nil
+}
+
+// Cursor returns the hub's epoch and latest event id, as epoch:id. A page rendered now is up
+// to date as of this cursor, and its client resumes from it.
+func (h *Hub) Cursor() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return formatCursor(h.epoch, h.seq)
+}
+
+// Clients returns the number of connected clients
+func (h *Hub) Clients() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// DisconnectUser closes every connection of a user, e.g. when they log out
+func (h *Hub) DisconnectUser(userID int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range h.clients {
+		if c.userID == userID {
+			c.close()
+		}
+	}
+}
+
+func (h *Hub) add(c *client) {
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+}
+
+func (h *Hub) remove(c *client) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+	c.close()
+}
+
+// subscribe adds channels to a client, if the client's user may listen on them. If the client
+// says where it left off (epoch and lastID), it is first sent the events on these channels it
+// missed, or told to resync if they are no longer kept. A subscribed or resync message follows,
+// with the cursor to resume from next time.
+func (h *Hub) subscribe(c *client, channels []string, epoch string, lastID uint64) error {
+	for _, channel := range channels {
+		if !CanSubscribe(channel, c.userID) {
+			return fmt.Errorf("not allowed to subscribe to %s", channel)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	wanted := make(map[string]bool)
+	for _, channel := range channels {
+		c.channels[channel] = true
+		wanted[channel] = true
+	}
+
+	reply := message{Type: "subscribed", Channel: strings.Join(channels, ","), Epoch: h.epoch, ID: h.seq}
+
+	var missed []entry
+	if epoch != "" {
+		var ok bool
+		missed, ok = h.missed(wanted, epoch, lastID)
+		if !ok || len(missed)+1 > cap(c.send)-len(c.send) {
+			reply.Type = "resync"
+			missed = nil
+		}
+	}
+
+	for _, e := range missed {
+		c.send <- outgoing{id: e.id, data: e.data}
+	}
+
+	b, _ := json.Marshal(reply)
+	select {
+	case c.send <- outgoing{id: h.seq, data: b}:
+	default:
+		c.close()
+	}
+
+	return nil
+}
+
+// missed returns the events on the channels after lastID, oldest first. It reports false if
+// the client can't be caught up: the hub restarted, or the events were dropped from the buffer.
+func (h *Hub) missed(channels map[string]bool, epoch string, lastID uint64) ([]entry, bool) {
+	if epoch != h.epoch || lastID > h.seq {
+		return nil, false
+	}
+	if lastID == h.seq {
+		return nil, true
+	}
+	if oldest, ok := h.recent.oldest(); !ok || oldest > lastID+1 {
+		return nil, false
+	}
+
+	var missed []entry
+	h.recent.each(func(e entry) {
+		if e.id > lastID && channels[e.channel] {
+			missed = append(missed, e)
+		}
+	})
+	return missed, true
+}
+
+func (h *Hub) unsubscribe(c *client, channel string) {
+	h.mu.Lock()
+	delete(c.channels, channel)
+	h.mu.Unlock()
+}
+
+// queue sends a message to a client, unless it has gone
+func (c *client) queue(m message) {
+	b, _ := json.Marshal(m)
+	select {
+	case c.send <- outgoing{data: b}:
+	case <-c.done:
+	}
+}
+
+// ServeWS upgrades the request to a websocket for the given (logged in) user. The client sends
+// {"type":"subscribe","channel":"..."} for each channel it wants, adding "epoch" and "last_id"
+// when it comes back after losing its connection, and receives
+// {"type":"event","id":1,"channel":"...","event":"...","data":{...}} for each event on them.
+func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request, userID int) {
+	s := websocket.Server{
+		Handshake: sameOrigin,
+		Handler: func(ws *websocket.Conn) {
+			h.serveWS(ws, userID)
+		},
+	}
+	s.ServeHTTP(w, r)
+}
+
+// sameOrigin only lets pages of this site open a websocket. The session cookie goes with any
+// websocket request, so without this check any site could listen in.
+func sameOrigin(cfg *websocket.Config, r *http.Request) error {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || origin.Host == "" {
+		return errors.New("websocket request without an origin")
+	}
+	if !strings.EqualFold(origin.Host, r.Host) {
+		return fmt.Errorf("websocket request from %s", origin.Host)
+	}
+	cfg.Origin = origin
+	return nil
+}
+
+func (h *Hub) serveWS(ws *websocket.Conn, userID int) {
+	defer ws.Close()
+
+	// the http server's timeouts are meant for requests, not long lived connections
+	_ = ws.SetDeadline(time.Time{})
+	ws.MaxPayloadBytes = maxClientMessage
+
+	c := newClient(userID)
+	h.add(c)
+	defer h.remove(c)
+
+	go h.readWS(ws, c)
+
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case out := <-c.send:
+			_ = ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := websocket.Message.Send(ws, string(out.data)); err != nil {
+				return
+			}
+		case <-ping.C:
+			_ = ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := websocket.JSON.Send(ws, message{Type: "ping"}); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// readWS handles what a websocket client sends, until it goes away or stays silent too long
+func (h *Hub) readWS(ws *websocket.Conn, c *client) {
+	defer c.close()
+
+	for {
+		_ = ws.SetReadDeadline(time.Now().Add(pongWait))
+
+		var in message
+		if err := websocket.JSON.Receive(ws, &in); err != nil {
+			return
+		}
+
+		switch in.Type {
+		case "subscribe":
+			if err := h.subscribe(c, []string{in.Channel}, in.Epoch, in.LastID); err != nil {
+				c.queue(message{Type: "error", Channel: in.Channel, Error: err.Error()})
+			}
+		case "unsubscribe":
+			h.unsubscribe(c, in.Channel)
+		case "pong":
+		default:
+			c.queue(message{Type: "error", Error: fmt.Sprintf("unknown message type %q", in.Type)})
+		}
+	}
+}
+
+// ServeSSE streams events to the given (logged in) user as server-sent events, for browsers
+// that can't open a websocket. The channels to listen on are given as ?channels=a,b, and where
+// to resume from as ?cursor=epoch:id; when the browser reconnects by itself, it sends the id
+// of the last event it got in the Last-Event-ID header instead.
+func (h *Hub) ServeSSE(w http.ResponseWriter, r *http.Request, userID int) {
+	var channels []string
+	for _, channel := range strings.Split(r.URL.Query().Get("channels"), ",") {
+		channel = strings.TrimSpace(channel)
+		if channel == "" {
+			continue
+		}
+		if !CanSubscribe(channel, userID) {
+			http.Error(w, fmt.Sprintf("not allowed to subscribe to %s", channel), http.StatusForbidden)
+			return
+		}
+		channels = append(channels, channel)
+	}
+
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = r.URL.Query().Get("cursor")
+	}
+	epoch, lastID := parseCursor(cursor)
+
+	// the response is written straight to the connection: responses are buffered by the session
+	// middleware, and the http server's write timeout would cut the stream short
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Time{})
+
+	c := newClient(userID)
+	h.add(c)
+	defer h.remove(c)
+
+	if err := h.subscribe(c, channels, epoch, lastID); err != nil {
+		log.Println(err)
+		return
+	}
+
+	// the client sends nothing more; reading tells us when it goes away
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, buf)
+		c.close()
+	}()
+
+	write := func(s string) bool {
+		_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+		_, err := buf.WriteString(s)
+		if err == nil {
+			err = buf.Flush()
+		}
+		return err == nil
+	}
+
+	if !write(sseHeader) {
+		return
+	}
+
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case out := <-c.send:
+			frame := "data: " + string(out.data) + "\n\n"
+			if out.id > 0 {
+				frame = "id: " + formatCursor(h.epoch, out.id) + "\n" + frame
+			}
+			if !write(frame) {
+				return
+			}
+		case <-ping.C:
+			if !write(": ping\n\n") {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
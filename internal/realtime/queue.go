@@ -0,0 +1,173 @@
+package realtime
+
+import (
+	"errors"
+	"github.com/luksbutz/vigilate/internal/metrics"
+	"github.com/pusher/pusher-http-go"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// QueueSize is how many events may wait to be sent
+	QueueSize = 1000
+	// maxBatch is the most events Pusher takes in one batch
+	maxBatch = 10
+	// maxAttempts is how often a batch is tried when the server has a transient problem
+	maxAttempts = 4
+	// retryWait is the wait before the first retry; it doubles with each one
+	retryWait = 500 * time.Millisecond
+)
+
+// Event is an event waiting to be sent
+type Event struct {
+	Channel string
+	Name    string
+	Data    interface{}
+}
+
+// BatchSender sends several events in one go
+type BatchSender interface {
+	SendBatch(events []Event) error
+}
+
+// PusherSender sends events with Pusher's batch trigger
+type PusherSender struct {
+	Client *pusher.Client
+}
+
+// SendBatch sends events with Pusher's batch trigger
+func (p PusherSender) SendBatch(events []Event) error {
+	batch := make([]pusher.Event, 0, len(events))
+	for _, e := range events {
+		batch = append(batch, pusher.Event{Channel: e.Channel, Name: e.Name, Data: e.Data})
+	}
+	return p.Client.TriggerBatch(batch)
+}
+
+// Queue sends events in the background, in batches, so that checks never wait on a slow or
+// dead server. When the queue is full, the oldest events are dropped: live updates are only
+// of use while they are fresh.
+type Queue struct {
+	sender BatchSender
+	size   int
+	wake   chan struct{}
+
+	mu       sync.Mutex
+	events   []Event
+	dropping bool
+}
+
+// NewQueue returns a queue that holds up to size events for sender. Run sends them.
+func NewQueue(sender BatchSender, size int) *Queue {
+	return &Queue{
+		sender: sender,
+		size:   size,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Trigger queues an event, and never waits
+func (q *Queue) Trigger(channel, event string, data interface{}) error {
+	q.mu.Lock()
+	if len(q.events) >= q.size {
+		q.events = q.events[1:]
+		metrics.Broadcasts.Inc("dropped")
+		if !q.dropping {
+			log.Println("Live update queue is full; dropping the oldest updates")
+			q.dropping = true
+		}
+	}
+	q.events = append(q.events, Event{Channel: channel, Name: event, Data: data})
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Len returns the number of events waiting to be sent
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events)
+}
+
+// Run sends queued events, forever
+func (q *Queue) Run() {
+	for range q.wake {
+		for {
+			batch := q.take(maxBatch)
+			if len(batch) == 0 {
+				break
+			}
+			q.send(batch)
+		}
+	}
+}
+
+// take removes up to n events from the front of the queue
+func (q *Queue) take(n int) []Event {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.events) == 0 {
+		if q.dropping {
+			log.Println("Live update queue has caught up")
+			q.dropping = false
+		}
+		return nil
+	}
+
+	if n > len(q.events) {
+		n = len(q.events)
+	}
+	batch := make([]Event, n)
+	copy(batch, q.events)
+	q.events = q.events[n:]
+
+	return batch
+}
+
+// send sends a batch, trying again while the problem looks transient
+func (q *Queue) send(batch []Event) {
+	wait := retryWait
+	for attempt := 1; ; attempt++ {
+		err := q.sender.SendBatch(batch)
+		if err == nil {
+			metrics.Broadcasts.Add(float64(len(batch)), "sent")
+			return
+		}
+
+		if !transient(err) || attempt == maxAttempts {
+			log.Printf("Could not send %d live updates: %s", len(batch), err)
+			metrics.Broadcasts.Add(float64(len(batch)), "failed")
+			return
+		}
+
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// pusherStatus finds the status code in the errors pusher returns for http errors
+var pusherStatus = regexp.MustCompile(`^Status Code: (\d{3})`)
+
+// transient reports whether sending again might work: the server couldn't be reached, was
+// overloaded, or failed
+func transient(err error) bool {
+	if m := pusherStatus.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code >= 500 || code == 429
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
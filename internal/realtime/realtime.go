@@ -0,0 +1,44 @@
+// Package realtime sends live events to the browsers watching vigilate, either through a
+// Pusher compatible server or through the hub built into vigilate itself.
+package realtime
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// ModeHub sends events through the built-in hub
+	ModeHub = "hub"
+	// ModePusher sends events through a Pusher compatible server, such as Pusher or ipê
+	ModePusher = "pusher"
+)
+
+// Modes are the ways events can be sent
+var Modes = []string{ModeHub, ModePusher}
+
+// PublicChannel is the channel every logged in user gets
+const PublicChannel = "public-channel"
+
+// privateChannelPrefix starts the channel of a single user, e.g. private-channel-3
+const privateChannelPrefix = "private-channel-"
+
+// Broadcaster triggers an event on a channel. A *Hub is one, as is a *Queue, and a *pusher.Client.
+type Broadcaster interface {
+	Trigger(channel, event string, data interface{}) error
+}
+
+// CanSubscribe reports whether the user may listen on the channel: everyone may listen on the
+// public channel, but only the user themselves on their private channel
+func CanSubscribe(channel string, userID int) bool {
+	if channel == PublicChannel {
+		return true
+	}
+
+	if strings.HasPrefix(channel, privateChannelPrefix) {
+		id, err := strconv.Atoi(strings.TrimPrefix(channel, privateChannelPrefix))
+		return err == nil && id > 0 && id == userID
+	}
+
+	return false
+}
@@ -0,0 +1,79 @@
+package realtime
+
+import (
+	"strconv"
+	"strings"
+)
+
+// replayBuffer is how many of the latest events the hub keeps for clients catching up
+const replayBuffer = 256
+
+// entry is an event kept for replay
+type entry struct {
+	id      uint64
+	channel string
+	data    []byte
+}
+
+// ring keeps the latest events, dropping the oldest when full
+type ring struct {
+	entries []entry
+	next    int
+	full    bool
+}
+
+func newRing(size int) ring {
+	return ring{entries: make([]entry, size)}
+}
+
+func (r *ring) add(e entry) {
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// oldest returns the id of the oldest event kept, if there is one
+func (r *ring) oldest() (uint64, bool) {
+	if r.full {
+		return r.entries[r.next].id, true
+	}
+	if r.next == 0 {
+		return 0, false
+	}
+	return r.entries[0].id, true
+}
+
+// each calls f for the events kept, oldest first
+func (r *ring) each(f func(entry)) {
+	if r.full {
+		for _, e := range r.entries[r.next:] {
+			f(e)
+		}
+	}
+	for _, e := range r.entries[:r.next] {
+		f(e)
+	}
+}
+
+// formatCursor writes where a client is up to, e.g. kq2x9c:42
+func formatCursor(epoch string, id uint64) string {
+	return epoch + ":" + strconv.FormatUint(id, 10)
+}
+
+// parseCursor reads a cursor written by formatCursor. A cursor that can't be read gives an
+// empty epoch, which means the client isn't resuming.
+func parseCursor(s string) (string, uint64) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return "", 0
+	}
+
+	id, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return "", 0
+	}
+
+	return s[:i], id
+}
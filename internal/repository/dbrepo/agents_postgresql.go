@@ -0,0 +1,56 @@
+package dbrepo
+
+import (
+	"context"
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// GetHostByAgentToken returns the host whose agent token has the given hash
+func (m *postgresDBRepo) GetHostByAgentToken(hash string) (models.Host, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if hash == "" {
+		return models.Host{}, models.ErrInvalidToken
+	}
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, `select id from hosts where agent_token_hash = $1`, hash).Scan(&id)
+	if err != nil {
+		return models.Host{}, err
+	}
+
+	return m.GetHostByID(id)
+}
+
+// UpdateHostAgentToken sets the hash and prefix of a host's agent token. Empty values revoke it.
+func (m *postgresDBRepo) UpdateHostAgentToken(hostID int, hash, prefix string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update hosts set agent_token_hash = $1, agent_token_prefix = $2, updated_at = $3 where id = $4`
+
+	_, err := m.DB.ExecContext(ctx, stmt, hash, prefix, time.Now(), hostID)
+
+	return err
+}
+
+// UpdateHostAgentSeen records that a host's agent was in touch. The version and os are kept
+// as they are when left empty.
+func (m *postgresDBRepo) UpdateHostAgentSeen(hostID int, version, os string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		update hosts set
+			agent_last_seen = $1,
+			agent_version = coalesce(nullif($2, ''), agent_version),
+			agent_os = coalesce(nullif($3, ''), agent_os)
+		where id = $4
+`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), version, os, hostID)
+
+	return err
+}
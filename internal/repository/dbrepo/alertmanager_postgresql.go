@@ -0,0 +1,92 @@
+package dbrepo
+
+import (
+	"context"
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// UpsertFiringAlert saves an alert that is firing for a host service, or brings its status and
+// message up to date if it was firing already
+func (m *postgresDBRepo) UpsertFiringAlert(a models.FiringAlert) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into alertmanager_alerts (host_service_id, fingerprint, status, message, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6)
+		on conflict (host_service_id, fingerprint) do update
+			set status = excluded.status, message = excluded.message
+`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		a.HostServiceID,
+		a.Fingerprint,
+		a.Status,
+		a.Message,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteFiringAlert forgets an alert of a host service that has been resolved
+func (m *postgresDBRepo) DeleteFiringAlert(hostServiceID int, fingerprint string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from alertmanager_alerts where host_service_id = $1 and fingerprint = $2`,
+		hostServiceID, fingerprint)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetFiringAlerts returns the alerts still firing for a host service
+func (m *postgresDBRepo) GetFiringAlerts(hostServiceID int) ([]models.FiringAlert, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select id, host_service_id, fingerprint, status, message, created_at, updated_at
+		from alertmanager_alerts
+		where host_service_id = $1
+		order by created_at
+`
+
+	rows, err := m.DB.QueryContext(ctx, query, hostServiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alerts []models.FiringAlert
+	for rows.Next() {
+		var a models.FiringAlert
+		err = rows.Scan(
+			&a.ID,
+			&a.HostServiceID,
+			&a.Fingerprint,
+			&a.Status,
+			&a.Message,
+			&a.CreatedAt,
+			&a.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return alerts, nil
+}
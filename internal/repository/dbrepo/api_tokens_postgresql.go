@@ -0,0 +1,163 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// AllAPITokensForUser returns a user's api tokens, newest first
+func (m *postgresDBRepo) AllAPITokensForUser(userID int) ([]models.APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			id, user_id, name, token_hash, token_prefix, scope, expires_at, last_used_at, created_at, updated_at
+		from api_tokens
+		where user_id = $1
+		order by created_at desc
+`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []models.APIToken
+
+	for rows.Next() {
+		var t models.APIToken
+		err := rows.Scan(
+			&t.ID,
+			&t.UserID,
+			&t.Name,
+			&t.TokenHash,
+			&t.TokenPrefix,
+			&t.Scope,
+			&t.ExpiresAt,
+			&t.LastUsedAt,
+			&t.CreatedAt,
+			&t.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// InsertAPIToken inserts an api token
+func (m *postgresDBRepo) InsertAPIToken(t models.APIToken) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if t.ExpiresAt.IsZero() {
+		t.ExpiresAt = time.Date(1, 1, 1, 0, 0, 1, 0, time.UTC)
+	}
+
+	stmt := `
+		insert into api_tokens
+			(user_id, name, token_hash, token_prefix, scope, expires_at, created_at, updated_at)
+		values
+			($1, $2, $3, $4, $5, $6, $7, $8)
+		returning id
+`
+
+	var newID int
+	err := m.DB.QueryRowContext(ctx, stmt,
+		t.UserID,
+		t.Name,
+		t.TokenHash,
+		t.TokenPrefix,
+		t.Scope,
+		t.ExpiresAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteAPIToken revokes one of a user's api tokens
+func (m *postgresDBRepo) DeleteAPIToken(userID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from api_tokens where id = $1 and user_id = $2`, id, userID)
+
+	return err
+}
+
+// GetAPITokenByHash returns the api token with the given hash. Tokens that are expired, or that
+// belong to an inactive or deleted user, give models.ErrInvalidToken.
+func (m *postgresDBRepo) GetAPITokenByHash(hash string) (models.APIToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			t.id, t.user_id, t.name, t.token_hash, t.token_prefix, t.scope, t.expires_at, t.last_used_at,
+			t.created_at, t.updated_at
+		from api_tokens t
+			left join users u on (t.user_id = u.id)
+		where
+			t.token_hash = $1
+			and u.user_active = 1
+			and u.deleted_at is null
+`
+
+	var t models.APIToken
+	err := m.DB.QueryRowContext(ctx, query, hash).Scan(
+		&t.ID,
+		&t.UserID,
+		&t.Name,
+		&t.TokenHash,
+		&t.TokenPrefix,
+		&t.Scope,
+		&t.ExpiresAt,
+		&t.LastUsedAt,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, models.ErrInvalidToken
+	} else if err != nil {
+		return t, err
+	}
+
+	if t.Expired() {
+		return t, models.ErrInvalidToken
+	}
+
+	return t, nil
+}
+
+// TouchAPIToken records that an api token was just used. To save writes, last_used_at
+// is only updated once a minute.
+func (m *postgresDBRepo) TouchAPIToken(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		update api_tokens set last_used_at = $1
+		where id = $2 and last_used_at < $3
+`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id, time.Now().Add(-time.Minute))
+
+	return err
+}
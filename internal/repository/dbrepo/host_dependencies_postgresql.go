@@ -0,0 +1,240 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// hostStatusColumn computes the worst status of all active services of the host aliased h
+const hostStatusColumn = `
+	coalesce((
+		select case
+			when bool_or(hs.status = 'problem') then 'problem'
+			when bool_or(hs.status = 'unreachable') then 'unreachable'
+			when bool_or(hs.status = 'unknown') then 'unknown'
+			when bool_or(hs.status = 'warning') then 'warning'
+			when bool_or(hs.status = 'healthy') then 'healthy'
+			else 'pending' end
+		from host_services hs
+		where hs.host_id = h.id and hs.active = 1
+	), 'pending')`
+
+// maxDependencyDepth guards the recursive queries against runaway trees
+const maxDependencyDepth = 16
+
+// GetHostParentIDs returns the ids of the direct parents of a host
+func (m *postgresDBRepo) GetHostParentIDs(hostID int) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `select parent_host_id from host_dependencies where host_id = $1`, hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// CheckHostParents returns models.ErrDependencyCycle if the parents would make a host depend on
+// itself, without changing anything
+func (m *postgresDBRepo) CheckHostParents(hostID int, parentIDs []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// a host may not depend on itself or on any host that (indirectly) depends on it
+	query := `
+		with recursive descendants(id, depth) as (
+			select $1::integer, 0
+			union
+			select d.host_id, descendants.depth + 1
+			from host_dependencies d
+			join descendants on d.parent_host_id = descendants.id
+			where descendants.depth < $2
+		)
+		select id from descendants
+`
+
+	rows, err := m.DB.QueryContext(ctx, query, hostID, maxDependencyDepth)
+	if err != nil {
+		return err
+	}
+
+	forbidden := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		forbidden[id] = true
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range parentIDs {
+		if forbidden[id] {
+			return models.ErrDependencyCycle
+		}
+	}
+
+	return nil
+}
+
+// UpdateHostParents replaces the parents of a host, refusing changes that would create a cycle
+func (m *postgresDBRepo) UpdateHostParents(hostID int, parentIDs []int) error {
+	if err := m.CheckHostParents(hostID, parentIDs); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from host_dependencies where host_id = $1`, hostID)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range parentIDs {
+		_, err = tx.ExecContext(ctx, `insert into host_dependencies (host_id, parent_host_id, created_at, updated_at)
+			values ($1, $2, $3, $3) on conflict do nothing`, hostID, id, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetHostAncestors returns all hosts a host (indirectly) depends on, with their depth and status
+func (m *postgresDBRepo) GetHostAncestors(hostID int) ([]models.HostDependency, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		with recursive ancestors(id, depth) as (
+			select parent_host_id, 1 from host_dependencies where host_id = $1
+			union
+			select d.parent_host_id, ancestors.depth + 1
+			from host_dependencies d
+			join ancestors on d.host_id = ancestors.id
+			where ancestors.depth < $2
+		)
+		select h.id, h.host_name, min(a.depth), ` + hostStatusColumn + `
+		from ancestors a
+		join hosts h on h.id = a.id
+		group by h.id, h.host_name
+		order by min(a.depth), h.host_name
+`
+
+	return m.queryHostDependencies(ctx, query, hostID, maxDependencyDepth)
+}
+
+// GetHostChildren returns the hosts that directly depend on a host
+func (m *postgresDBRepo) GetHostChildren(hostID int) ([]models.HostDependency, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select h.id, h.host_name, 1, ` + hostStatusColumn + `
+		from host_dependencies d
+		join hosts h on h.id = d.host_id
+		where d.parent_host_id = $1
+		order by h.host_name
+`
+
+	return m.queryHostDependencies(ctx, query, hostID)
+}
+
+// ParentHostDown returns true if any direct parent of a host can't be reached: its HTTP, HTTPS or
+// heartbeat service is in problem or unreachable state, or its agent has gone offline. Other
+// problems, such as an expiring certificate or a full disk, don't make a parent down.
+func (m *postgresDBRepo) ParentHostDown(hostID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// services 1, 2 and 4 are HTTP, HTTPS and Heartbeat
+	query := `
+		select exists (
+			select 1
+			from host_dependencies d
+			join hosts h on h.id = d.parent_host_id
+			join host_services hs on hs.host_id = d.parent_host_id
+			join services s on s.id = hs.service_id
+			where d.host_id = $1
+				and hs.active = 1
+				and hs.status in ('problem', 'unreachable')
+				and (hs.service_id in (1, 2, 4) or (s.check_type = 'agent' and h.agent_last_seen < $2))
+		)
+`
+
+	var down bool
+	err := m.DB.QueryRowContext(ctx, query, hostID, time.Now().Add(-models.AgentOfflineAfter)).Scan(&down)
+
+	return down, err
+}
+
+// StatusBeforeUnreachable returns the status a host service had before it last became
+// unreachable, or an empty string if it isn't known
+func (m *postgresDBRepo) StatusBeforeUnreachable(hostServiceID int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select event_type
+		from events
+		where host_service_id = $1
+			and event_type <> 'unreachable'
+			and id < (select coalesce(max(id), 0) from events where host_service_id = $1 and event_type = 'unreachable')
+		order by id desc
+		limit 1
+`
+
+	var status string
+	err := m.DB.QueryRowContext(ctx, query, hostServiceID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return status, err
+}
+
+// queryHostDependencies runs a query returning id, host name, depth and status rows
+func (m *postgresDBRepo) queryHostDependencies(ctx context.Context, query string, args ...interface{}) ([]models.HostDependency, error) {
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deps []models.HostDependency
+	for rows.Next() {
+		var d models.HostDependency
+		if err := rows.Scan(&d.HostID, &d.HostName, &d.Depth, &d.Status); err != nil {
+			return nil, err
+		}
+		deps = append(deps, d)
+	}
+
+	return deps, rows.Err()
+}
@@ -0,0 +1,314 @@
+package dbrepo
+
+import (
+	"context"
+	"fmt"
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// hostFilterClause returns the sql condition (starting with "and") restricting the host aliased
+// hostAlias according to f, with placeholders numbered from firstArg, and its arguments
+func hostFilterClause(f models.HostFilter, hostAlias string, firstArg int) (string, []interface{}) {
+	var clause string
+	var args []interface{}
+
+	if f.GroupID > 0 {
+		args = append(args, f.GroupID)
+		clause += fmt.Sprintf(`
+			and %s.id in (select host_id from host_group_members where host_group_id = $%d)`, hostAlias, firstArg+len(args)-1)
+	}
+
+	if f.TagKey != "" {
+		args = append(args, f.TagKey)
+		if f.TagValue != "" {
+			args = append(args, f.TagValue)
+			clause += fmt.Sprintf(`
+			and %s.id in (select host_id from host_tags where tag_key = $%d and tag_value = $%d)`,
+				hostAlias, firstArg+len(args)-2, firstArg+len(args)-1)
+		} else {
+			clause += fmt.Sprintf(`
+			and %s.id in (select host_id from host_tags where tag_key = $%d)`, hostAlias, firstArg+len(args)-1)
+		}
+	}
+
+	return clause, args
+}
+
+// AllHostGroups returns all host groups, with host count and service status counts
+func (m *postgresDBRepo) AllHostGroups() ([]models.HostGroup, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			g.id, g.group_name, g.description, g.created_at, g.updated_at,
+			(select count(*) from host_group_members gm where gm.host_group_id = g.id),
+			count(hs.id) filter (where hs.status = 'healthy'),
+			count(hs.id) filter (where hs.status = 'warning'),
+			count(hs.id) filter (where hs.status = 'problem'),
+			count(hs.id) filter (where hs.status = 'pending'),
+			count(hs.id) filter (where hs.status = 'unknown'),
+			count(hs.id) filter (where hs.status = 'unreachable')
+		from host_groups g
+			left join host_group_members gm on gm.host_group_id = g.id
+			left join host_services hs on hs.host_id = gm.host_id and hs.active = 1
+		group by g.id, g.group_name, g.description, g.created_at, g.updated_at
+		order by g.group_name
+`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []models.HostGroup
+
+	for rows.Next() {
+		var g models.HostGroup
+		err := rows.Scan(
+			&g.ID,
+			&g.GroupName,
+			&g.Description,
+			&g.CreatedAt,
+			&g.UpdatedAt,
+			&g.HostCount,
+			&g.Healthy,
+			&g.Warning,
+			&g.Problem,
+			&g.Pending,
+			&g.Unknown,
+			&g.Unreachable,
+		)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// GetHostGroupByID returns a host group by id
+func (m *postgresDBRepo) GetHostGroupByID(id int) (models.HostGroup, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select id, group_name, description, created_at, updated_at from host_groups where id = $1`
+
+	var g models.HostGroup
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&g.ID,
+		&g.GroupName,
+		&g.Description,
+		&g.CreatedAt,
+		&g.UpdatedAt,
+	)
+
+	return g, err
+}
+
+// InsertHostGroup inserts a host group, and returns its id
+func (m *postgresDBRepo) InsertHostGroup(g models.HostGroup) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `insert into host_groups (group_name, description, created_at, updated_at)
+		values ($1, $2, $3, $4) returning id`
+
+	var newID int
+	err := m.DB.QueryRowContext(ctx, stmt, g.GroupName, g.Description, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateHostGroup updates a host group
+func (m *postgresDBRepo) UpdateHostGroup(g models.HostGroup) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update host_groups set group_name = $1, description = $2, updated_at = $3 where id = $4`
+
+	_, err := m.DB.ExecContext(ctx, stmt, g.GroupName, g.Description, time.Now(), g.ID)
+
+	return err
+}
+
+// DeleteHostGroup deletes a host group (but not its hosts)
+func (m *postgresDBRepo) DeleteHostGroup(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from host_groups where id = $1`, id)
+
+	return err
+}
+
+// UpdateHostGroupMembership replaces the groups a host belongs to
+func (m *postgresDBRepo) UpdateHostGroupMembership(hostID int, groupIDs []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from host_group_members where host_id = $1`, hostID)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range groupIDs {
+		_, err = tx.ExecContext(ctx, `insert into host_group_members (host_id, host_group_id, created_at, updated_at)
+			values ($1, $2, $3, $3) on conflict do nothing`, hostID, id, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UpdateHostTags replaces the tags of a host
+func (m *postgresDBRepo) UpdateHostTags(hostID int, tags []models.HostTag) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from host_tags where host_id = $1`, hostID)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tags {
+		_, err = tx.ExecContext(ctx, `insert into host_tags (host_id, tag_key, tag_value, created_at, updated_at)
+			values ($1, $2, $3, $4, $4)
+			on conflict (host_id, tag_key) do update set tag_value = excluded.tag_value, updated_at = excluded.updated_at`,
+			hostID, t.Key, t.Value, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// AllTagKeys returns all distinct tag keys in use
+func (m *postgresDBRepo) AllTagKeys() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, `select distinct tag_key from host_tags order by tag_key`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// AllServices returns all services
+func (m *postgresDBRepo) AllServices() ([]models.Service, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `select id, service_name, active, icon, check_type, created_at, updated_at from services order by service_name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var services []models.Service
+	for rows.Next() {
+		var s models.Service
+		err := rows.Scan(&s.ID, &s.ServiceName, &s.Active, &s.Icon, &s.CheckType, &s.CreatedAt, &s.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+
+	return services, rows.Err()
+}
+
+// attachGroupsAndTags loads the groups and tags of the given hosts
+func (m *postgresDBRepo) attachGroupsAndTags(ctx context.Context, hosts []models.Host) error {
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	index := make(map[int]int)
+	for i, h := range hosts {
+		index[h.ID] = i
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `
+		select gm.host_id, g.id, g.group_name, g.description, g.created_at, g.updated_at
+		from host_group_members gm
+			join host_groups g on g.id = gm.host_group_id
+		order by g.group_name`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hostID int
+		var g models.HostGroup
+		if err := rows.Scan(&hostID, &g.ID, &g.GroupName, &g.Description, &g.CreatedAt, &g.UpdatedAt); err != nil {
+			return err
+		}
+		if i, ok := index[hostID]; ok {
+			hosts[i].Groups = append(hosts[i].Groups, g)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tagRows, err := m.DB.QueryContext(ctx, `select host_id, tag_key, tag_value from host_tags order by tag_key`)
+	if err != nil {
+		return err
+	}
+	defer tagRows.Close()
+
+	for tagRows.Next() {
+		var hostID int
+		var t models.HostTag
+		if err := tagRows.Scan(&hostID, &t.Key, &t.Value); err != nil {
+			return err
+		}
+		if i, ok := index[hostID]; ok {
+			hosts[i].Tags = append(hosts[i].Tags, t)
+		}
+	}
+
+	return tagRows.Err()
+}
@@ -2,6 +2,8 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"github.com/luksbutz/vigilate/internal/models"
 	"time"
 )
@@ -73,7 +75,8 @@ func (m *postgresDBRepo) GetHostByID(id int) (models.Host, error) {
 
 	query := `
 		select
-		    id, host_name, canonical_name, url, ip, ipv6, location, os, active, created_at, updated_at
+		    id, host_name, canonical_name, url, ip, ipv6, location, os, active, created_at, updated_at,
+		    agent_token_prefix, agent_last_seen, agent_version, agent_os
 		from hosts
 		where id = $1
 `
@@ -91,6 +94,10 @@ func (m *postgresDBRepo) GetHostByID(id int) (models.Host, error) {
 		&host.Active,
 		&host.CreatedAt,
 		&host.UpdatedAt,
+		&host.AgentTokenPrefix,
+		&host.AgentLastSeen,
+		&host.AgentVersion,
+		&host.AgentOS,
 	)
 	if err != nil {
 		return host, err
@@ -100,7 +107,10 @@ func (m *postgresDBRepo) GetHostByID(id int) (models.Host, error) {
 	query = `
 		select hs.id, hs.host_id, hs.service_id, hs.active, hs.schedule_number,
 		       hs.schedule_unit, hs.last_check, hs.created_at, hs.updated_at, hs.status, hs.last_message,
-		       s.id, s.service_name, s.active, s.icon, s.created_at, s.updated_at
+		       hs.badge_token, hs.ping_token, hs.grace_number, hs.grace_unit, hs.last_ping,
+		       hs.warning_threshold, hs.critical_threshold,
+		       s.id, s.service_name, s.active, s.icon, s.check_type, s.command, s.arguments, s.timeout_seconds,
+		       s.created_at, s.updated_at
 		from
 		    host_services hs
 			left join services s on s.id = hs.service_id
@@ -130,10 +140,21 @@ func (m *postgresDBRepo) GetHostByID(id int) (models.Host, error) {
 			&hs.UpdatedAt,
 			&hs.Status,
 			&hs.LastMessage,
+			&hs.BadgeToken,
+			&hs.PingToken,
+			&hs.GraceNumber,
+			&hs.GraceUnit,
+			&hs.LastPing,
+			&hs.WarningThreshold,
+			&hs.CriticalThreshold,
 			&hs.Service.ID,
 			&hs.Service.ServiceName,
 			&hs.Service.Active,
 			&hs.Service.Icon,
+			&hs.Service.CheckType,
+			&hs.Service.Command,
+			&hs.Service.Arguments,
+			&hs.Service.TimeoutSeconds,
 			&hs.Service.UpdatedAt,
 			&hs.Service.CreatedAt,
 		)
@@ -143,9 +164,45 @@ func (m *postgresDBRepo) GetHostByID(id int) (models.Host, error) {
 		hostServices = append(hostServices, hs)
 	}
 
+	if err := rows.Err(); err != nil {
+		return host, err
+	}
+
 	host.HostServices = hostServices
 
-	return host, rows.Err()
+	// get parent hosts
+	host.ParentIDs, err = m.GetHostParentIDs(host.ID)
+	if err != nil {
+		return host, err
+	}
+
+	// get groups and tags
+	hosts := []models.Host{host}
+	err = m.attachGroupsAndTags(ctx, hosts)
+
+	return hosts[0], err
+}
+
+// GetHostByName returns the host whose name, canonical name or ip address is name, ignoring case
+func (m *postgresDBRepo) GetHostByName(name string) (models.Host, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select id
+		from hosts
+		where lower(host_name) = lower($1) or lower(canonical_name) = lower($1) or ip = $1 or lower(ipv6) = lower($1)
+		order by (lower(host_name) = lower($1)) desc, id
+		limit 1
+`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(&id)
+	if err != nil {
+		return models.Host{}, err
+	}
+
+	return m.GetHostByID(id)
 }
 
 // UpdateHost updates a host
@@ -175,17 +232,26 @@ update hosts set host_name = $1, canonical_name = $2, url = $3, ip = $4,
 
 // AllHosts returns a slice with all hosts
 func (m *postgresDBRepo) AllHosts() ([]models.Host, error) {
+	return m.FilterHosts(models.HostFilter{})
+}
+
+// FilterHosts returns a slice with all hosts matching the filter
+func (m *postgresDBRepo) FilterHosts(f models.HostFilter) ([]models.Host, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	filter, args := hostFilterClause(f, "h", 1)
+
 	query := `
-	select id, host_name, canonical_name, url, ip, ipv6, location, os, active, created_at, updated_at
-	from hosts
+	select h.id, h.host_name, h.canonical_name, h.url, h.ip, h.ipv6, h.location, h.os, h.active, h.created_at, h.updated_at
+	from hosts h
+	where true ` + filter + `
+	order by h.host_name
 `
 
 	var hosts []models.Host
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -213,7 +279,7 @@ func (m *postgresDBRepo) AllHosts() ([]models.Host, error) {
 		serviceQuery := `
 		select hs.id, hs.host_id, hs.service_id, hs.active, hs.schedule_number,
 		       hs.schedule_unit, hs.last_check, hs.created_at, hs.updated_at, hs.status, hs.last_message,
-		       s.id, s.service_name, s.active, s.icon, s.created_at, s.updated_at
+		       s.id, s.service_name, s.active, s.icon, s.check_type, s.created_at, s.updated_at
 		from host_services hs
 		left join services s on s.id = hs.service_id
 		where host_id = $1
@@ -244,6 +310,7 @@ func (m *postgresDBRepo) AllHosts() ([]models.Host, error) {
 				&hs.Service.ServiceName,
 				&hs.Service.Active,
 				&hs.Service.Icon,
+				&hs.Service.CheckType,
 				&hs.Service.CreatedAt,
 				&hs.Service.UpdatedAt,
 			)
@@ -268,9 +335,23 @@ func (m *postgresDBRepo) AllHosts() ([]models.Host, error) {
 		return nil, err
 	}
 
+	if err = m.attachGroupsAndTags(ctx, hosts); err != nil {
+		return nil, err
+	}
+
 	return hosts, nil
 }
 
+// DeleteHost deletes a host; its services, dependencies, group memberships and tags go with it
+func (m *postgresDBRepo) DeleteHost(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from hosts where id = $1`, id)
+
+	return err
+}
+
 // UpdateHostServiceStatus updates the active status of a host service
 func (m *postgresDBRepo) UpdateHostServiceStatus(hostID, serviceID, active int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -313,32 +394,38 @@ func (m *postgresDBRepo) UpdateHostService(hs models.HostService) error {
 }
 
 // GetAllServiceStatusCounts returns the count for all active services according to there status
-func (m *postgresDBRepo) GetAllServiceStatusCounts() (int, int, int, int, error) {
+func (m *postgresDBRepo) GetAllServiceStatusCounts() (int, int, int, int, int, int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	var healthy, warning, problem, pending int
+	var healthy, warning, problem, pending, unknown, unreachable int
 
 	query := `
 select 
 	(select count(id) from host_services where active = 1 and status = 'healthy') as healthy,
 	(select count(id) from host_services where active = 1 and status = 'warning') as warning,
 	(select count(id) from host_services where active = 1 and status = 'problem') as problem,
-	(select count(id) from host_services where active = 1 and status = 'pending') as pending
+	(select count(id) from host_services where active = 1 and status = 'pending') as pending,
+	(select count(id) from host_services where active = 1 and status = 'unknown') as unknown,
+	(select count(id) from host_services where active = 1 and status = 'unreachable') as unreachable
 `
 
-	err := m.DB.QueryRowContext(ctx, query).Scan(&healthy, &warning, &problem, &pending)
+	err := m.DB.QueryRowContext(ctx, query).Scan(&healthy, &warning, &problem, &pending, &unknown, &unreachable)
 	if err != nil {
-		return 0, 0, 0, 0, err
+		return 0, 0, 0, 0, 0, 0, err
 	}
 
-	return healthy, warning, problem, pending, nil
+	return healthy, warning, problem, pending, unknown, unreachable, nil
 }
 
-func (m *postgresDBRepo) GetServicesByStatus(status string) ([]models.HostService, error) {
+// GetServicesByStatus returns all active host services with the given status, on hosts matching the filter.
+// An empty status matches every status.
+func (m *postgresDBRepo) GetServicesByStatus(status string, f models.HostFilter) ([]models.HostService, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	filter, args := hostFilterClause(f, "h", 2)
+
 	query := `
 		select
 			hs.id, hs.host_id, hs.service_id, hs.active, hs.schedule_number,
@@ -349,15 +436,15 @@ func (m *postgresDBRepo) GetServicesByStatus(status string) ([]models.HostServic
 			left join hosts h on (hs.host_id = h.id)
 			left join services s on (hs.service_id = s.id)
 		where
-		    status = $1
-			and hs.active = 1
+		    (status = $1 or $1 = '')
+			and hs.active = 1 ` + filter + `
 		order by
 		    host_name, service_name
 `
 
 	var services []models.HostService
 
-	rows, err := m.DB.QueryContext(ctx, query, status)
+	rows, err := m.DB.QueryContext(ctx, query, append([]interface{}{status}, args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -400,8 +487,10 @@ func (m *postgresDBRepo) GetHostServiceByID(id int) (models.HostService, error)
 	query := `
 		select
 		    hs.id, hs.host_id, hs.service_id, hs.active, hs.schedule_number,
-			hs.schedule_unit, hs.last_check, hs.created_at, hs.updated_at, hs.status, hs.last_message,
-			s.id, s.service_name, s.active, s.icon, s.created_at, s.updated_at,
+			hs.schedule_unit, hs.last_check, hs.created_at, hs.updated_at, hs.status, hs.last_message, hs.badge_token,
+			hs.ping_token, hs.grace_number, hs.grace_unit, hs.last_ping, hs.warning_threshold, hs.critical_threshold,
+			s.id, s.service_name, s.active, s.icon, s.check_type, s.command, s.arguments, s.timeout_seconds,
+			s.created_at, s.updated_at,
 			h.host_name
 		from host_services hs
 			left join services s on (hs.service_id = s.id)
@@ -426,10 +515,21 @@ func (m *postgresDBRepo) GetHostServiceByID(id int) (models.HostService, error)
 		&hs.UpdatedAt,
 		&hs.Status,
 		&hs.LastMessage,
+		&hs.BadgeToken,
+		&hs.PingToken,
+		&hs.GraceNumber,
+		&hs.GraceUnit,
+		&hs.LastPing,
+		&hs.WarningThreshold,
+		&hs.CriticalThreshold,
 		&hs.Service.ID,
 		&hs.Service.ServiceName,
 		&hs.Service.Active,
 		&hs.Service.Icon,
+		&hs.Service.CheckType,
+		&hs.Service.Command,
+		&hs.Service.Arguments,
+		&hs.Service.TimeoutSeconds,
 		&hs.Service.CreatedAt,
 		&hs.Service.UpdatedAt,
 		&hs.HostName,
@@ -441,6 +541,100 @@ func (m *postgresDBRepo) GetHostServiceByID(id int) (models.HostService, error)
 	return hs, nil
 }
 
+// GetHostServiceByBadgeToken returns the host service whose badges are unlocked by token
+func (m *postgresDBRepo) GetHostServiceByBadgeToken(token string) (models.HostService, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if token == "" {
+		return models.HostService{}, sql.ErrNoRows
+	}
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, `select id from host_services where badge_token = $1`, token).Scan(&id)
+	if err != nil {
+		return models.HostService{}, err
+	}
+
+	return m.GetHostServiceByID(id)
+}
+
+// UpdateHostServiceBadgeToken sets the badge token of a host service; an empty token turns its badges off
+func (m *postgresDBRepo) UpdateHostServiceBadgeToken(id int, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update host_services set badge_token = $1, updated_at = $2 where id = $3`,
+		token, time.Now(), id)
+
+	return err
+}
+
+// GetHostServiceByPingToken returns the heartbeat whose ping url contains token
+func (m *postgresDBRepo) GetHostServiceByPingToken(token string) (models.HostService, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if token == "" {
+		return models.HostService{}, sql.ErrNoRows
+	}
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, `select id from host_services where ping_token = $1`, token).Scan(&id)
+	if err != nil {
+		return models.HostService{}, err
+	}
+
+	return m.GetHostServiceByID(id)
+}
+
+// UpdateHostServicePingToken sets the ping token of a heartbeat
+func (m *postgresDBRepo) UpdateHostServicePingToken(id int, token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update host_services set ping_token = $1, updated_at = $2 where id = $3`,
+		token, time.Now(), id)
+
+	return err
+}
+
+// UpdateHostServiceLastPing records when a heartbeat was last pinged
+func (m *postgresDBRepo) UpdateHostServiceLastPing(id int, at time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update host_services set last_ping = $1 where id = $2`, at, id)
+
+	return err
+}
+
+// UpdateHostServiceThresholds updates the warning and critical thresholds passed to a command check
+func (m *postgresDBRepo) UpdateHostServiceThresholds(id int, warning, critical string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update host_services set warning_threshold = $1, critical_threshold = $2, updated_at = $3 where id = $4`
+
+	_, err := m.DB.ExecContext(ctx, stmt, warning, critical, time.Now(), id)
+
+	return err
+}
+
+// UpdateHostServiceHeartbeat updates how often a heartbeat expects a ping, and how late it may be
+func (m *postgresDBRepo) UpdateHostServiceHeartbeat(hs models.HostService) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update host_services set schedule_number = $1, schedule_unit = $2, grace_number = $3, grace_unit = $4,
+		updated_at = $5 where id = $6`
+
+	_, err := m.DB.ExecContext(ctx, stmt, hs.ScheduleNumber, hs.ScheduleUnit, hs.GraceNumber, hs.GraceUnit,
+		time.Now(), hs.ID)
+
+	return err
+}
+
 func (m *postgresDBRepo) GetServicesToMonitor() ([]models.HostService, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -449,7 +643,7 @@ func (m *postgresDBRepo) GetServicesToMonitor() ([]models.HostService, error) {
 		select 
 		    hs.id, hs.host_id, hs.service_id, hs.active, hs.schedule_number,
 			hs.schedule_unit, hs.last_check, hs.created_at, hs.updated_at, hs.status, hs.last_message,
-			s.id, s.service_name, s.active, s.icon, s.created_at, s.updated_at,
+			s.id, s.service_name, s.active, s.icon, s.check_type, s.created_at, s.updated_at,
 			h.host_name
 		from host_services hs
 			left join services s on(hs.service_id = s.id)
@@ -485,6 +679,7 @@ func (m *postgresDBRepo) GetServicesToMonitor() ([]models.HostService, error) {
 			&hs.Service.ServiceName,
 			&hs.Service.Active,
 			&hs.Service.Icon,
+			&hs.Service.CheckType,
 			&hs.Service.CreatedAt,
 			&hs.Service.UpdatedAt,
 			&hs.HostName,
@@ -511,7 +706,7 @@ func (m *postgresDBRepo) GetHostServiceByHostIDServiceID(hostID, serviceID int)
 		select
 		    hs.id, hs.host_id, hs.service_id, hs.active, hs.schedule_number, hs.schedule_unit,
 		    hs.last_check, hs.status, hs.last_message, hs.created_at, hs.updated_at,
-		    s.id, s.service_name, s.active, s.icon, s.created_at, s.updated_at, h.host_name
+		    s.id, s.service_name, s.active, s.icon, s.check_type, s.created_at, s.updated_at, h.host_name
 		from
 		    host_services hs
 			left join services s on hs.service_id = s.id
@@ -539,6 +734,7 @@ func (m *postgresDBRepo) GetHostServiceByHostIDServiceID(hostID, serviceID int)
 		&hs.Service.ServiceName,
 		&hs.Service.Active,
 		&hs.Service.Icon,
+		&hs.Service.CheckType,
 		&hs.Service.CreatedAt,
 		&hs.Service.UpdatedAt,
 		&hs.HostName,
@@ -625,3 +821,87 @@ func (m *postgresDBRepo) GetAllEvents() ([]models.Event, error) {
 
 	return events, nil
 }
+
+// GetEvents returns one page of events matching the filter, newest first, along with the
+// total number of matching events
+func (m *postgresDBRepo) GetEvents(f models.EventFilter) ([]models.Event, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	where := "where 1 = 1"
+	var args []interface{}
+
+	if f.HostID > 0 {
+		args = append(args, f.HostID)
+		where += fmt.Sprintf(" and host_id = $%d", len(args))
+	}
+
+	if f.HostServiceID > 0 {
+		args = append(args, f.HostServiceID)
+		where += fmt.Sprintf(" and host_service_id = $%d", len(args))
+	}
+
+	if f.EventType != "" {
+		args = append(args, f.EventType)
+		where += fmt.Sprintf(" and event_type = $%d", len(args))
+	}
+
+	if !f.Since.IsZero() {
+		args = append(args, f.Since)
+		where += fmt.Sprintf(" and created_at >= $%d", len(args))
+	}
+
+	if !f.Until.IsZero() {
+		args = append(args, f.Until)
+		where += fmt.Sprintf(" and created_at < $%d", len(args))
+	}
+
+	var total int
+	err := m.DB.QueryRowContext(ctx, `select count(id) from events `+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf(`
+		select
+			id, event_type, host_service_id, host_id, service_name, host_name, message, created_at, updated_at
+		from events
+		%s
+		order by created_at desc, id desc
+		limit $%d offset $%d
+`, where, len(args)+1, len(args)+2)
+
+	rows, err := m.DB.QueryContext(ctx, query, append(args, f.Limit, f.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var events []models.Event
+
+	for rows.Next() {
+		var e models.Event
+		err := rows.Scan(
+			&e.ID,
+			&e.EventType,
+			&e.HostServiceID,
+			&e.HostID,
+			&e.ServiceName,
+			&e.HostName,
+			&e.Message,
+			&e.CreatedAt,
+			&e.UpdatedAt,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return events, total, nil
+}
@@ -0,0 +1,40 @@
+package dbrepo
+
+import (
+	"context"
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// GetUserByLDAPDN returns the user who logs in with the given LDAP directory entry
+func (m *postgresDBRepo) GetUserByLDAPDN(dn string) (models.User, error) {
+	return m.getUserWhere(`lower(ldap_dn) = lower($1) and ldap_dn <> ''`, dn)
+}
+
+// SetLDAPDN links a user to an LDAP directory entry
+func (m *postgresDBRepo) SetLDAPDN(userID int, dn string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update users set ldap_dn = $1 where id = $2`, dn, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// IsLDAPUser reports whether a user logs in with an LDAP directory entry, and so has their
+// password kept there
+func (m *postgresDBRepo) IsLDAPUser(userID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+	err := m.DB.QueryRowContext(ctx, `select count(*) from users where id = $1 and ldap_dn <> ''`, userID).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
@@ -0,0 +1,142 @@
+package dbrepo
+
+import (
+	"context"
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// InsertLoginAttempt records a login with a password
+func (m *postgresDBRepo) InsertLoginAttempt(a models.LoginAttempt) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `insert into login_attempts (email, user_id, ip_address, user_agent, succeeded, reason, created_at, updated_at)
+		values ($1, nullif($2, 0), $3, $4, $5, $6, $7, $7)`
+	_, err := m.DB.ExecContext(ctx, stmt, a.Email, a.UserID, a.IPAddress, a.UserAgent, a.Succeeded, a.Reason, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CountLoginFailures returns how many times a wrong password or second-factor code was given for
+// an email address since a time, and since its last successful login, and when the latest of them was
+func (m *postgresDBRepo) CountLoginFailures(email string, since time.Time) (int, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select count(*), coalesce(max(created_at), $2)
+		from login_attempts
+		where lower(email) = lower($1)
+			and reason in ($3, $4)
+			and created_at > greatest($2, coalesce(
+				(select max(created_at) from login_attempts where lower(email) = lower($1) and succeeded), $2))`
+
+	var n int
+	var last time.Time
+	err := m.DB.QueryRowContext(ctx, query, email, since, models.LoginFailedPassword, models.LoginFailedTwoFactor).Scan(&n, &last)
+	if err != nil {
+		return 0, last, err
+	}
+
+	return n, last, nil
+}
+
+// CountLoginFailuresFromIP returns how many times a wrong password or second-factor code was given
+// from an address since a time, and when the latest of them was
+func (m *postgresDBRepo) CountLoginFailuresFromIP(ip string, since time.Time) (int, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select count(*), coalesce(max(created_at), $2)
+		from login_attempts
+		where ip_address = $1 and reason in ($3, $4) and created_at > $2`
+
+	var n int
+	var last time.Time
+	err := m.DB.QueryRowContext(ctx, query, ip, since, models.LoginFailedPassword, models.LoginFailedTwoFactor).Scan(&n, &last)
+	if err != nil {
+		return 0, last, err
+	}
+
+	return n, last, nil
+}
+
+// RecentFailedLogins returns the latest failed logins, newest first
+func (m *postgresDBRepo) RecentFailedLogins(limit int) ([]models.LoginAttempt, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			id, email, coalesce(user_id, 0), ip_address, user_agent, succeeded, reason, created_at
+		from login_attempts
+		where not succeeded
+		order by created_at desc
+		limit $1
+`
+
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []models.LoginAttempt
+
+	for rows.Next() {
+		var a models.LoginAttempt
+		err := rows.Scan(
+			&a.ID,
+			&a.Email,
+			&a.UserID,
+			&a.IPAddress,
+			&a.UserAgent,
+			&a.Succeeded,
+			&a.Reason,
+			&a.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		attempts = append(attempts, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+// LockUser stops a user logging in with a password until a time
+func (m *postgresDBRepo) LockUser(userID int, until time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update users set locked_until = $1 where id = $2`, until, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UnlockUser lets a locked user log in again. Failed logins from before now no longer count
+// towards locking them.
+func (m *postgresDBRepo) UnlockUser(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update users set locked_until = $1 where id = $2`, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
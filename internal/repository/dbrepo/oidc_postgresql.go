@@ -0,0 +1,74 @@
+package dbrepo
+
+import (
+	"context"
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// GetUserByOIDCSubject returns the user who logs in with the given single sign-on subject
+func (m *postgresDBRepo) GetUserByOIDCSubject(subject string) (models.User, error) {
+	return m.getUserWhere(`oidc_subject = $1 and oidc_subject <> ''`, subject)
+}
+
+// GetUserByEmail returns the user with the given email address, ignoring case
+func (m *postgresDBRepo) GetUserByEmail(email string) (models.User, error) {
+	return m.getUserWhere(`lower(email) = lower($1)`, email)
+}
+
+// getUserWhere returns the user, not deleted, matching a condition on one argument
+func (m *postgresDBRepo) getUserWhere(condition string, arg interface{}) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT id, first_name, last_name, user_active, access_level, email, totp_enabled, locked_until,
+			created_at, updated_at
+			FROM users where deleted_at is null and ` + condition
+
+	var u models.User
+	err := m.DB.QueryRowContext(ctx, stmt, arg).Scan(
+		&u.ID,
+		&u.FirstName,
+		&u.LastName,
+		&u.UserActive,
+		&u.AccessLevel,
+		&u.Email,
+		&u.TOTPEnabled,
+		&u.LockedUntil,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+	)
+	if err != nil {
+		return u, err
+	}
+
+	return u, nil
+}
+
+// SetOIDCSubject links a user to a single sign-on subject
+func (m *postgresDBRepo) SetOIDCSubject(userID int, subject string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update users set oidc_subject = $1 where id = $2`, subject, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// IsOIDCUser reports whether a user is linked to a single sign-on subject, and so logs in with
+// the identity provider
+func (m *postgresDBRepo) IsOIDCUser(userID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+	err := m.DB.QueryRowContext(ctx, `select count(*) from users where id = $1 and oidc_subject <> ''`, userID).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
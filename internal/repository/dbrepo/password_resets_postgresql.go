@@ -0,0 +1,74 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+)
+
+// InsertPasswordReset records a password reset link sent to a user, given as a hash of its token
+func (m *postgresDBRepo) InsertPasswordReset(userID int, hash string, expires time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `insert into password_resets (user_id, token_hash, expires_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $4)`
+	_, err := m.DB.ExecContext(ctx, stmt, userID, hash, expires, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CountPasswordResetsSince returns how many password reset links a user has been sent since a time
+func (m *postgresDBRepo) CountPasswordResetsSince(userID int, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+	err := m.DB.QueryRowContext(ctx, `select count(*) from password_resets where user_id = $1 and created_at > $2`,
+		userID, since).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// PasswordResetValid reports whether a user has a password reset link, given as a hash of its
+// token, that is unused and hasn't expired
+func (m *postgresDBRepo) PasswordResetValid(userID int, hash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+	err := m.DB.QueryRowContext(ctx, `select count(*) from password_resets
+		where user_id = $1 and token_hash = $2 and used_at is null and expires_at > $3`,
+		userID, hash, time.Now()).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// UsePasswordReset marks a user's password reset link, given as a hash of its token, as used. It
+// reports false if the link was used already or has expired: a link works once.
+func (m *postgresDBRepo) UsePasswordReset(userID int, hash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update password_resets set used_at = $1
+		where user_id = $2 and token_hash = $3 and used_at is null and expires_at > $1`
+	res, err := m.DB.ExecContext(ctx, stmt, time.Now(), userID, hash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
@@ -0,0 +1,142 @@
+package dbrepo
+
+import (
+	"context"
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// AllPushTargets returns all push notification targets
+func (m *postgresDBRepo) AllPushTargets() ([]models.PushTarget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select id, name, kind, url, token, recipient, active, created_at, updated_at
+		from push_targets
+		order by name
+`
+
+	var targets []models.PushTarget
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t models.PushTarget
+		err := rows.Scan(
+			&t.ID,
+			&t.Name,
+			&t.Kind,
+			&t.URL,
+			&t.Token,
+			&t.Recipient,
+			&t.Active,
+			&t.CreatedAt,
+			&t.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return targets, nil
+}
+
+// GetPushTargetByID returns a push target by id
+func (m *postgresDBRepo) GetPushTargetByID(id int) (models.PushTarget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select id, name, kind, url, token, recipient, active, created_at, updated_at
+		from push_targets
+		where id = $1
+`
+
+	var t models.PushTarget
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&t.ID,
+		&t.Name,
+		&t.Kind,
+		&t.URL,
+		&t.Token,
+		&t.Recipient,
+		&t.Active,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+
+	return t, err
+}
+
+// InsertPushTarget inserts a push target, and returns its id
+func (m *postgresDBRepo) InsertPushTarget(t models.PushTarget) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into push_targets (name, kind, url, token, recipient, active, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id
+`
+
+	var newID int
+	err := m.DB.QueryRowContext(ctx, stmt,
+		t.Name,
+		t.Kind,
+		t.URL,
+		t.Token,
+		t.Recipient,
+		t.Active,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdatePushTarget updates a push target
+func (m *postgresDBRepo) UpdatePushTarget(t models.PushTarget) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		update push_targets set
+			name = $1, kind = $2, url = $3, token = $4, recipient = $5, active = $6, updated_at = $7
+		where id = $8
+`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		t.Name,
+		t.Kind,
+		t.URL,
+		t.Token,
+		t.Recipient,
+		t.Active,
+		time.Now(),
+		t.ID,
+	)
+
+	return err
+}
+
+// DeletePushTarget deletes a push target
+func (m *postgresDBRepo) DeletePushTarget(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from push_targets where id = $1`, id)
+
+	return err
+}
@@ -0,0 +1,161 @@
+package dbrepo
+
+import (
+	"context"
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// GetServiceByName returns the service with the given name, ignoring case
+func (m *postgresDBRepo) GetServiceByName(name string) (models.Service, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select id, service_name, active, icon, check_type, command, arguments, timeout_seconds,
+			created_at, updated_at
+		from services
+		where lower(service_name) = lower($1)
+		order by id
+		limit 1
+`
+
+	var s models.Service
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(
+		&s.ID, &s.ServiceName, &s.Active, &s.Icon, &s.CheckType, &s.Command, &s.Arguments, &s.TimeoutSeconds,
+		&s.CreatedAt, &s.UpdatedAt)
+
+	return s, err
+}
+
+// GetServiceByID returns a service by id
+func (m *postgresDBRepo) GetServiceByID(id int) (models.Service, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select id, service_name, active, icon, check_type, command, arguments, timeout_seconds,
+			created_at, updated_at
+		from services
+		where id = $1
+`
+
+	var s models.Service
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&s.ID, &s.ServiceName, &s.Active, &s.Icon, &s.CheckType, &s.Command, &s.Arguments, &s.TimeoutSeconds,
+		&s.CreatedAt, &s.UpdatedAt)
+
+	return s, err
+}
+
+// UpdateService updates a service
+func (m *postgresDBRepo) UpdateService(s models.Service) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		update services set service_name = $1, active = $2, icon = $3, command = $4, arguments = $5,
+			timeout_seconds = $6, updated_at = $7
+		where id = $8
+`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		s.ServiceName,
+		s.Active,
+		s.Icon,
+		s.Command,
+		s.Arguments,
+		s.TimeoutSeconds,
+		time.Now(),
+		s.ID,
+	)
+
+	return err
+}
+
+// DeleteService deletes a service, along with its host services
+func (m *postgresDBRepo) DeleteService(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from services where id = $1`, id)
+
+	return err
+}
+
+// AddServiceToAllHosts adds a service, inactive, to every host that doesn't have it yet
+func (m *postgresDBRepo) AddServiceToAllHosts(serviceID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into host_services (host_id, service_id, active, schedule_number, schedule_unit,
+			status, created_at, updated_at)
+		select h.id, $1, 0, 3, 'm', 'pending', $2, $2
+		from hosts h
+		where not exists (select 1 from host_services hs where hs.host_id = h.id and hs.service_id = $1)
+`
+
+	_, err := m.DB.ExecContext(ctx, stmt, serviceID, time.Now())
+
+	return err
+}
+
+// InsertService inserts a service
+func (m *postgresDBRepo) InsertService(s models.Service) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into services (service_name, active, icon, check_type, command, arguments, timeout_seconds,
+			created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id
+`
+
+	var newID int
+	err := m.DB.QueryRowContext(ctx, stmt,
+		s.ServiceName,
+		s.Active,
+		s.Icon,
+		s.CheckType,
+		s.Command,
+		s.Arguments,
+		s.TimeoutSeconds,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// InsertHostService adds a service to a host
+func (m *postgresDBRepo) InsertHostService(hs models.HostService) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into host_services (host_id, service_id, active, schedule_number, schedule_unit,
+			created_at, updated_at, status)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id
+`
+
+	var newID int
+	err := m.DB.QueryRowContext(ctx, stmt,
+		hs.HostID,
+		hs.ServiceID,
+		hs.Active,
+		hs.ScheduleNumber,
+		hs.ScheduleUnit,
+		time.Now(),
+		time.Now(),
+		hs.Status,
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
@@ -0,0 +1,210 @@
+package dbrepo
+
+import (
+	"context"
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// InsertUserSession records a logged in session, and returns its id
+func (m *postgresDBRepo) InsertUserSession(s models.UserSession) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `insert into user_sessions (user_id, ip_address, user_agent, last_seen_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $4, $4) returning id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt, s.UserID, s.IPAddress, s.UserAgent, time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// AllUserSessions returns a user's sessions started since a time, most recently seen first
+func (m *postgresDBRepo) AllUserSessions(userID int, since time.Time) ([]models.UserSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			id, user_id, ip_address, user_agent, last_seen_at, created_at
+		from user_sessions
+		where user_id = $1 and created_at > $2
+		order by last_seen_at desc
+`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []models.UserSession
+
+	for rows.Next() {
+		var s models.UserSession
+		err := rows.Scan(
+			&s.ID,
+			&s.UserID,
+			&s.IPAddress,
+			&s.UserAgent,
+			&s.LastSeenAt,
+			&s.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// UserSessionExists reports whether a user's session is still there, and so hasn't been logged out
+func (m *postgresDBRepo) UserSessionExists(userID, id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+	err := m.DB.QueryRowContext(ctx, `select count(*) from user_sessions where id = $1 and user_id = $2`,
+		id, userID).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// TouchUserSession records that a session was just used, and where from
+func (m *postgresDBRepo) TouchUserSession(id int, ip string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `update user_sessions set last_seen_at = $1, ip_address = $2 where id = $3`,
+		time.Now(), ip, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteUserSession logs out one of a user's sessions
+func (m *postgresDBRepo) DeleteUserSession(userID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from user_sessions where id = $1 and user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteUserSessionsForUser logs out all of a user's sessions
+func (m *postgresDBRepo) DeleteUserSessionsForUser(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from user_sessions where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteUserSessionsBefore forgets sessions started before a time, which have expired
+func (m *postgresDBRepo) DeleteUserSessionsBefore(t time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from user_sessions where created_at < $1`, t)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AllRememberTokensForUser returns the browsers remembered for a user, most recently used first
+func (m *postgresDBRepo) AllRememberTokensForUser(userID int) ([]models.RememberToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select
+			id, user_id, ip_address, user_agent, last_used_at, created_at
+		from remember_tokens
+		where user_id = $1
+		order by greatest(last_used_at, created_at) desc
+`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []models.RememberToken
+
+	for rows.Next() {
+		var t models.RememberToken
+		err := rows.Scan(
+			&t.ID,
+			&t.UserID,
+			&t.IPAddress,
+			&t.UserAgent,
+			&t.LastUsedAt,
+			&t.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// TouchRememberMeToken records that a remember me token was just used, and by which browser
+func (m *postgresDBRepo) TouchRememberMeToken(userID int, token, ip, userAgent string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update remember_tokens set last_used_at = $1, ip_address = $2, user_agent = left($3, 255)
+		where user_id = $4 and remember_token = $5`
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), ip, userAgent, userID, token)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteRememberTokenByID forgets one of the browsers remembered for a user
+func (m *postgresDBRepo) DeleteRememberTokenByID(userID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from remember_tokens where id = $1 and user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,380 @@
+package dbrepo
+
+import (
+	"context"
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// noticeHistory is how long resolved notices stay on a status page
+const noticeHistory = 14 * 24 * time.Hour
+
+// AllStatusPages returns all status pages, without components or notices
+func (m *postgresDBRepo) AllStatusPages() ([]models.StatusPage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select id, name, slug, description, active, created_at, updated_at
+		from status_pages
+		order by name
+`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []models.StatusPage
+
+	for rows.Next() {
+		var p models.StatusPage
+		err := rows.Scan(&p.ID, &p.Name, &p.Slug, &p.Description, &p.Active, &p.CreatedAt, &p.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return pages, nil
+}
+
+// GetStatusPageByID returns a status page with its components, their host services, and all its notices
+func (m *postgresDBRepo) GetStatusPageByID(id int) (models.StatusPage, error) {
+	return m.getStatusPage(`id = $1`, id, false)
+}
+
+// GetStatusPageBySlug returns an active status page with its components, their host services,
+// and the notices that are open or were resolved recently
+func (m *postgresDBRepo) GetStatusPageBySlug(slug string) (models.StatusPage, error) {
+	return m.getStatusPage(`slug = $1 and active = 1`, slug, true)
+}
+
+func (m *postgresDBRepo) getStatusPage(where string, arg interface{}, recentNotices bool) (models.StatusPage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var p models.StatusPage
+
+	query := `
+		select id, name, slug, description, active, created_at, updated_at
+		from status_pages
+		where ` + where
+
+	err := m.DB.QueryRowContext(ctx, query, arg).Scan(
+		&p.ID, &p.Name, &p.Slug, &p.Description, &p.Active, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return p, err
+	}
+
+	// components
+	rows, err := m.DB.QueryContext(ctx, `
+		select id, status_page_id, name, sort_order
+		from status_page_components
+		where status_page_id = $1
+		order by sort_order, name`, p.ID)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+
+	index := make(map[int]int)
+	for rows.Next() {
+		var c models.StatusPageComponent
+		if err := rows.Scan(&c.ID, &c.StatusPageID, &c.Name, &c.SortOrder); err != nil {
+			return p, err
+		}
+		index[c.ID] = len(p.Components)
+		p.Components = append(p.Components, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return p, err
+	}
+
+	// the host services of each component
+	serviceRows, err := m.DB.QueryContext(ctx, `
+		select
+			cs.status_page_component_id,
+			hs.id, hs.host_id, hs.service_id, hs.active, hs.schedule_number, hs.schedule_unit,
+			hs.last_check, hs.created_at, hs.updated_at, hs.status, hs.last_message,
+			h.host_name, s.service_name
+		from status_page_component_services cs
+			join status_page_components c on (cs.status_page_component_id = c.id)
+			join host_services hs on (cs.host_service_id = hs.id)
+			left join hosts h on (hs.host_id = h.id)
+			left join services s on (hs.service_id = s.id)
+		where c.status_page_id = $1
+		order by h.host_name, s.service_name`, p.ID)
+	if err != nil {
+		return p, err
+	}
+	defer serviceRows.Close()
+
+	for serviceRows.Next() {
+		var componentID int
+		var hs models.HostService
+		err := serviceRows.Scan(
+			&componentID,
+			&hs.ID,
+			&hs.HostID,
+			&hs.ServiceID,
+			&hs.Active,
+			&hs.ScheduleNumber,
+			&hs.ScheduleUnit,
+			&hs.LastCheck,
+			&hs.CreatedAt,
+			&hs.UpdatedAt,
+			&hs.Status,
+			&hs.LastMessage,
+			&hs.HostName,
+			&hs.Service.ServiceName,
+		)
+		if err != nil {
+			return p, err
+		}
+
+		if i, ok := index[componentID]; ok {
+			p.Components[i].HostServiceIDs = append(p.Components[i].HostServiceIDs, hs.ID)
+			p.Components[i].HostServices = append(p.Components[i].HostServices, hs)
+		}
+	}
+
+	if err := serviceRows.Err(); err != nil {
+		return p, err
+	}
+
+	// notices
+	noticeQuery := `
+		select id, status_page_id, title, body, severity, resolved_at, created_at, updated_at
+		from status_page_notices
+		where status_page_id = $1`
+	args := []interface{}{p.ID}
+
+	if recentNotices {
+		noticeQuery += ` and (resolved_at < '0002-01-01' or resolved_at > $2)`
+		args = append(args, time.Now().Add(-noticeHistory))
+	}
+
+	noticeRows, err := m.DB.QueryContext(ctx, noticeQuery+` order by created_at desc`, args...)
+	if err != nil {
+		return p, err
+	}
+	defer noticeRows.Close()
+
+	for noticeRows.Next() {
+		var n models.StatusPageNotice
+		err := noticeRows.Scan(&n.ID, &n.StatusPageID, &n.Title, &n.Body, &n.Severity, &n.ResolvedAt,
+			&n.CreatedAt, &n.UpdatedAt)
+		if err != nil {
+			return p, err
+		}
+		p.Notices = append(p.Notices, n)
+	}
+
+	return p, noticeRows.Err()
+}
+
+// InsertStatusPage inserts a status page
+func (m *postgresDBRepo) InsertStatusPage(p models.StatusPage) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into status_pages (name, slug, description, active, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6) returning id
+`
+
+	var newID int
+	err := m.DB.QueryRowContext(ctx, stmt,
+		p.Name,
+		p.Slug,
+		p.Description,
+		p.Active,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateStatusPage updates a status page
+func (m *postgresDBRepo) UpdateStatusPage(p models.StatusPage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update status_pages set name = $1, slug = $2, description = $3, active = $4, updated_at = $5
+		where id = $6`
+
+	_, err := m.DB.ExecContext(ctx, stmt, p.Name, p.Slug, p.Description, p.Active, time.Now(), p.ID)
+
+	return err
+}
+
+// DeleteStatusPage deletes a status page with its components and notices
+func (m *postgresDBRepo) DeleteStatusPage(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from status_pages where id = $1`, id)
+
+	return err
+}
+
+// UpdateStatusPageComponents replaces the components of a status page
+func (m *postgresDBRepo) UpdateStatusPageComponents(pageID int, components []models.StatusPageComponent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from status_page_components where status_page_id = $1`, pageID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, c := range components {
+		var componentID int
+		err = tx.QueryRowContext(ctx, `insert into status_page_components (status_page_id, name, sort_order, created_at, updated_at)
+			values ($1, $2, $3, $4, $4) returning id`, pageID, c.Name, c.SortOrder, now).Scan(&componentID)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range c.HostServiceIDs {
+			_, err = tx.ExecContext(ctx, `insert into status_page_component_services
+				(status_page_component_id, host_service_id, created_at, updated_at) values ($1, $2, $3, $3)
+				on conflict do nothing`, componentID, id, now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// InsertStatusPageNotice posts a notice on a status page
+func (m *postgresDBRepo) InsertStatusPageNotice(n models.StatusPageNotice) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `
+		insert into status_page_notices (status_page_id, title, body, severity, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6) returning id
+`
+
+	var newID int
+	err := m.DB.QueryRowContext(ctx, stmt,
+		n.StatusPageID,
+		n.Title,
+		n.Body,
+		n.Severity,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// ResolveStatusPageNotice marks a notice as resolved
+func (m *postgresDBRepo) ResolveStatusPageNotice(pageID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update status_page_notices set resolved_at = $1 where id = $2 and status_page_id = $3`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id, pageID)
+
+	return err
+}
+
+// DeleteStatusPageNotice deletes a notice
+func (m *postgresDBRepo) DeleteStatusPageNotice(pageID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from status_page_notices where id = $1 and status_page_id = $2`, id, pageID)
+
+	return err
+}
+
+// GetEventsForHostServicesSince returns the events of the given host services created since the
+// given time, plus the last event before it for each host service (so that the status at the start
+// of the window is known), ordered by host service and time
+func (m *postgresDBRepo) GetEventsForHostServicesSince(hostServiceIDs []int, since time.Time) ([]models.Event, error) {
+	if len(hostServiceIDs) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		select id, event_type, host_service_id, host_id, service_name, host_name, message, created_at, updated_at
+		from (
+			select *
+			from events
+			where host_service_id = any($1) and created_at >= $2
+			union all
+			(
+				select distinct on (host_service_id) *
+				from events
+				where host_service_id = any($1) and created_at < $2
+				order by host_service_id, created_at desc
+			)
+		) e
+		order by host_service_id, created_at, id
+`
+
+	rows, err := m.DB.QueryContext(ctx, query, hostServiceIDs, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.Event
+
+	for rows.Next() {
+		var e models.Event
+		err := rows.Scan(
+			&e.ID,
+			&e.EventType,
+			&e.HostServiceID,
+			&e.HostID,
+			&e.ServiceName,
+			&e.HostName,
+			&e.Message,
+			&e.CreatedAt,
+			&e.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
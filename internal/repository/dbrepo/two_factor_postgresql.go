@@ -0,0 +1,160 @@
+package dbrepo
+
+import (
+	"context"
+	"time"
+)
+
+// GetTOTPSecret returns a user's totp secret, which is empty if they have never started setting
+// up two-factor authentication
+func (m *postgresDBRepo) GetTOTPSecret(userID int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var secret string
+	err := m.DB.QueryRowContext(ctx, `select totp_secret from users where id = $1`, userID).Scan(&secret)
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// SetTOTPSecret stores a new totp secret for a user who is setting up two-factor authentication.
+// It is not used to log in until EnableTOTP is called.
+func (m *postgresDBRepo) SetTOTPSecret(userID int, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update users set totp_secret = $1, totp_enabled = 0, totp_last_step = 0 where id = $2`
+	_, err := m.DB.ExecContext(ctx, stmt, secret, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// EnableTOTP turns on two-factor authentication for a user, once they have entered a code for
+// their secret. step is the time step of that code, which can't be used again.
+func (m *postgresDBRepo) EnableTOTP(userID int, step int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update users set totp_enabled = 1, totp_last_step = $1 where id = $2 and totp_secret <> ''`
+	_, err := m.DB.ExecContext(ctx, stmt, step, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DisableTOTP turns off two-factor authentication for a user, and deletes their secret and
+// recovery codes
+func (m *postgresDBRepo) DisableTOTP(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `update users set totp_secret = '', totp_enabled = 0, totp_last_step = 0
+		where id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a user logged in with the code of a time step, and reports false if
+// that step, or a later one, was already used: a code works once
+func (m *postgresDBRepo) UseTOTPStep(userID int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update users set totp_last_step = $1 where id = $2 and totp_last_step < $1`
+	res, err := m.DB.ExecContext(ctx, stmt, step, userID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// ReplaceRecoveryCodes replaces a user's recovery codes with new ones, given as hashes
+func (m *postgresDBRepo) ReplaceRecoveryCodes(userID int, hashes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		_, err = tx.ExecContext(ctx, `insert into recovery_codes (user_id, code_hash, created_at, updated_at)
+			values ($1, $2, $3, $3)`, userID, hash, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks one of a user's recovery codes, given as a hash, as used. It reports
+// false if the user has no such unused code.
+func (m *postgresDBRepo) UseRecoveryCode(userID int, hash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `update recovery_codes set used_at = $1
+		where user_id = $2 and code_hash = $3 and used_at is null`
+	res, err := m.DB.ExecContext(ctx, stmt, time.Now(), userID, hash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func (m *postgresDBRepo) CountRecoveryCodes(userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+	err := m.DB.QueryRowContext(ctx, `select count(*) from recovery_codes where user_id = $1 and used_at is null`,
+		userID).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
@@ -14,8 +14,8 @@ func (m *postgresDBRepo) AllUsers() ([]*models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `SELECT id, last_name, first_name, email, user_active, created_at, updated_at FROM users
-		where deleted_at is null`
+	stmt := `SELECT id, last_name, first_name, email, user_active, access_level, locked_until, created_at, updated_at
+		FROM users where deleted_at is null`
 
 	rows, err := m.DB.QueryContext(ctx, stmt)
 	if err != nil {
@@ -27,7 +27,8 @@ func (m *postgresDBRepo) AllUsers() ([]*models.User, error) {
 
 	for rows.Next() {
 		s := &models.User{}
-		err = rows.Scan(&s.ID, &s.LastName, &s.FirstName, &s.Email, &s.UserActive, &s.CreatedAt, &s.UpdatedAt)
+		err = rows.Scan(&s.ID, &s.LastName, &s.FirstName, &s.Email, &s.UserActive, &s.AccessLevel, &s.LockedUntil,
+			&s.CreatedAt, &s.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -48,7 +49,7 @@ func (m *postgresDBRepo) GetUserById(id int) (models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `SELECT id, first_name, last_name,  user_active, access_level, email, 
+	stmt := `SELECT id, first_name, last_name,  user_active, access_level, email, totp_enabled, locked_until,
 			created_at, updated_at
 			FROM users where id = $1`
 	row := m.DB.QueryRowContext(ctx, stmt, id)
@@ -62,6 +63,8 @@ func (m *postgresDBRepo) GetUserById(id int) (models.User, error) {
 		&u.UserActive,
 		&u.AccessLevel,
 		&u.Email,
+		&u.TOTPEnabled,
+		&u.LockedUntil,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
@@ -155,6 +158,20 @@ func (m *postgresDBRepo) CheckForToken(id int, token string) bool {
 	return err == nil
 }
 
+// DeleteRememberMeTokensForUser deletes all of a user's remember me tokens, logging out remembered browsers
+func (m *postgresDBRepo) DeleteRememberMeTokensForUser(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := "delete from remember_tokens where user_id = $1"
+	_, err := m.DB.ExecContext(ctx, stmt, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // InsertUser method to add a new record to the users table.
 func (m *postgresDBRepo) InsertUser(u models.User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -270,5 +287,12 @@ func (m *postgresDBRepo) UpdatePassword(id int, newPassword string) error {
 		return err
 	}
 
+	// and make sure no password reset link sent before now can change it again
+	stmt = "update password_resets set used_at = $1 where user_id = $2 and used_at is null"
+	_, err = m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -1,6 +1,9 @@
 package repository
 
-import "github.com/luksbutz/vigilate/internal/models"
+import (
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
 
 // DatabaseRepo is the database repository
 type DatabaseRepo interface {
@@ -23,20 +26,156 @@ type DatabaseRepo interface {
 	InsertRememberMeToken(id int, token string) error
 	DeleteToken(token string) error
 	CheckForToken(id int, token string) bool
+	DeleteRememberMeTokensForUser(userID int) error
+
+	// sessions and remembered browsers
+
+	InsertUserSession(s models.UserSession) (int, error)
+	AllUserSessions(userID int, since time.Time) ([]models.UserSession, error)
+	UserSessionExists(userID, id int) (bool, error)
+	TouchUserSession(id int, ip string) error
+	DeleteUserSession(userID, id int) error
+	DeleteUserSessionsForUser(userID int) error
+	DeleteUserSessionsBefore(t time.Time) error
+	AllRememberTokensForUser(userID int) ([]models.RememberToken, error)
+	TouchRememberMeToken(userID int, token, ip, userAgent string) error
+	DeleteRememberTokenByID(userID, id int) error
+
+	// single sign-on and directory logins
+
+	GetUserByOIDCSubject(subject string) (models.User, error)
+	GetUserByEmail(email string) (models.User, error)
+	SetOIDCSubject(userID int, subject string) error
+	IsOIDCUser(userID int) (bool, error)
+	GetUserByLDAPDN(dn string) (models.User, error)
+	SetLDAPDN(userID int, dn string) error
+	IsLDAPUser(userID int) (bool, error)
+
+	// failed logins and lockouts
+
+	InsertLoginAttempt(a models.LoginAttempt) error
+	CountLoginFailures(email string, since time.Time) (int, time.Time, error)
+	CountLoginFailuresFromIP(ip string, since time.Time) (int, time.Time, error)
+	RecentFailedLogins(limit int) ([]models.LoginAttempt, error)
+	LockUser(userID int, until time.Time) error
+	UnlockUser(userID int) error
+
+	// password resets
+
+	InsertPasswordReset(userID int, hash string, expires time.Time) error
+	CountPasswordResetsSince(userID int, since time.Time) (int, error)
+	PasswordResetValid(userID int, hash string) (bool, error)
+	UsePasswordReset(userID int, hash string) (bool, error)
+
+	// two-factor authentication
+
+	GetTOTPSecret(userID int) (string, error)
+	SetTOTPSecret(userID int, secret string) error
+	EnableTOTP(userID int, step int64) error
+	DisableTOTP(userID int) error
+	UseTOTPStep(userID int, step int64) (bool, error)
+	ReplaceRecoveryCodes(userID int, hashes []string) error
+	UseRecoveryCode(userID int, hash string) (bool, error)
+	CountRecoveryCodes(userID int) (int, error)
+
+	// api tokens
+
+	AllAPITokensForUser(userID int) ([]models.APIToken, error)
+	InsertAPIToken(t models.APIToken) (int, error)
+	DeleteAPIToken(userID, id int) error
+	GetAPITokenByHash(hash string) (models.APIToken, error)
+	TouchAPIToken(id int) error
 
 	// hosts
 
 	InsertHost(h models.Host) (int, error)
 	GetHostByID(id int) (models.Host, error)
+	GetHostByName(name string) (models.Host, error)
 	UpdateHost(h models.Host) error
+	DeleteHost(id int) error
 	AllHosts() ([]models.Host, error)
+	FilterHosts(f models.HostFilter) ([]models.Host, error)
 	UpdateHostServiceStatus(hostID, serviceID, active int) error
-	GetAllServiceStatusCounts() (int, int, int, int, error)
-	GetServicesByStatus(status string) ([]models.HostService, error)
+	GetAllServiceStatusCounts() (int, int, int, int, int, int, error)
+	GetServicesByStatus(status string, f models.HostFilter) ([]models.HostService, error)
 	GetHostServiceByID(id int) (models.HostService, error)
+	GetHostServiceByBadgeToken(token string) (models.HostService, error)
+	UpdateHostServiceBadgeToken(id int, token string) error
+	GetHostServiceByPingToken(token string) (models.HostService, error)
+	UpdateHostServicePingToken(id int, token string) error
+	UpdateHostServiceLastPing(id int, at time.Time) error
+	UpdateHostServiceHeartbeat(hs models.HostService) error
+	UpdateHostServiceThresholds(id int, warning, critical string) error
 	UpdateHostService(hs models.HostService) error
 	GetServicesToMonitor() ([]models.HostService, error)
 	GetHostServiceByHostIDServiceID(hostID, serviceID int) (models.HostService, error)
 	GetAllEvents() ([]models.Event, error)
+	GetEvents(f models.EventFilter) ([]models.Event, int, error)
 	InsertEvent(e models.Event) error
+
+	// host dependencies
+
+	GetHostParentIDs(hostID int) ([]int, error)
+	CheckHostParents(hostID int, parentIDs []int) error
+	UpdateHostParents(hostID int, parentIDs []int) error
+	GetHostAncestors(hostID int) ([]models.HostDependency, error)
+	GetHostChildren(hostID int) ([]models.HostDependency, error)
+	ParentHostDown(hostID int) (bool, error)
+	StatusBeforeUnreachable(hostServiceID int) (string, error)
+
+	// host groups and tags
+
+	AllHostGroups() ([]models.HostGroup, error)
+	GetHostGroupByID(id int) (models.HostGroup, error)
+	InsertHostGroup(g models.HostGroup) (int, error)
+	UpdateHostGroup(g models.HostGroup) error
+	DeleteHostGroup(id int) error
+	UpdateHostGroupMembership(hostID int, groupIDs []int) error
+	UpdateHostTags(hostID int, tags []models.HostTag) error
+	AllTagKeys() ([]string, error)
+	AllServices() ([]models.Service, error)
+
+	// services
+
+	GetServiceByName(name string) (models.Service, error)
+	InsertService(s models.Service) (int, error)
+	InsertHostService(hs models.HostService) (int, error)
+	GetServiceByID(id int) (models.Service, error)
+	UpdateService(s models.Service) error
+	DeleteService(id int) error
+	AddServiceToAllHosts(serviceID int) error
+
+	// alertmanager alerts
+
+	UpsertFiringAlert(a models.FiringAlert) error
+	DeleteFiringAlert(hostServiceID int, fingerprint string) error
+	GetFiringAlerts(hostServiceID int) ([]models.FiringAlert, error)
+
+	// agents
+
+	GetHostByAgentToken(hash string) (models.Host, error)
+	UpdateHostAgentToken(hostID int, hash, prefix string) error
+	UpdateHostAgentSeen(hostID int, version, os string) error
+
+	// status pages
+
+	AllStatusPages() ([]models.StatusPage, error)
+	GetStatusPageByID(id int) (models.StatusPage, error)
+	GetStatusPageBySlug(slug string) (models.StatusPage, error)
+	InsertStatusPage(p models.StatusPage) (int, error)
+	UpdateStatusPage(p models.StatusPage) error
+	DeleteStatusPage(id int) error
+	UpdateStatusPageComponents(pageID int, components []models.StatusPageComponent) error
+	InsertStatusPageNotice(n models.StatusPageNotice) (int, error)
+	ResolveStatusPageNotice(pageID, id int) error
+	DeleteStatusPageNotice(pageID, id int) error
+	GetEventsForHostServicesSince(hostServiceIDs []int, since time.Time) ([]models.Event, error)
+
+	// push targets
+
+	AllPushTargets() ([]models.PushTarget, error)
+	GetPushTargetByID(id int) (models.PushTarget, error)
+	InsertPushTarget(t models.PushTarget) (int, error)
+	UpdatePushTarget(t models.PushTarget) error
+	DeletePushTarget(id int) error
 }
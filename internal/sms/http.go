@@ -0,0 +1,69 @@
+package sms
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// httpGateway sends text messages to an arbitrary HTTP endpoint. The url and
+// body may contain the placeholders {to} and {message}, which are replaced
+// (escaped appropriately) before the request is made.
+type httpGateway struct {
+	url         string
+	method      string
+	contentType string
+	body        string
+	authHeader  string
+}
+
+// Send sends a text message via the generic HTTP gateway
+func (g *httpGateway) Send(to, msg string) error {
+	if g.url == "" {
+		return errors.New("sms: no http gateway url configured")
+	}
+
+	method := strings.ToUpper(g.method)
+	if method == "" {
+		method = "POST"
+	}
+
+	urlString := strings.NewReplacer(
+		"{to}", url.QueryEscape(to),
+		"{message}", url.QueryEscape(msg),
+	).Replace(g.url)
+
+	body := g.body
+	switch {
+	case strings.Contains(g.contentType, "json"):
+		body = strings.NewReplacer("{to}", jsonEscape(to), "{message}", jsonEscape(msg)).Replace(body)
+	case strings.Contains(g.contentType, "x-www-form-urlencoded"):
+		body = strings.NewReplacer("{to}", url.QueryEscape(to), "{message}", url.QueryEscape(msg)).Replace(body)
+	default:
+		body = strings.NewReplacer("{to}", to, "{message}", msg).Replace(body)
+	}
+
+	req, err := http.NewRequest(method, urlString, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	if g.contentType != "" {
+		req.Header.Add("Content-Type", g.contentType)
+	}
+
+	if g.authHeader != "" {
+		req.Header.Add("Authorization", g.authHeader)
+	}
+
+	_, err = do(req)
+	return err
+}
+
+// jsonEscape escapes s for use inside a JSON string literal
+func jsonEscape(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
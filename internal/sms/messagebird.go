@@ -0,0 +1,34 @@
+package sms
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// messageBird sends text messages through the MessageBird REST API
+type messageBird struct {
+	accessKey  string
+	originator string
+}
+
+// Send sends a text message via MessageBird
+func (m *messageBird) Send(to, msg string) error {
+	msgData := url.Values{}
+	msgData.Set("originator", m.originator)
+	msgData.Set("recipients", to)
+	msgData.Set("body", msg)
+
+	req, err := http.NewRequest("POST", "https://rest.messagebird.com/messages", strings.NewReader(msgData.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Authorization", fmt.Sprintf("AccessKey %s", m.accessKey))
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	_, err = do(req)
+	return err
+}
@@ -0,0 +1,91 @@
+package sms
+
+import (
+	"errors"
+	"fmt"
+	"github.com/luksbutz/vigilate/internal/config"
+	"io"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrUnknownProvider unsupported sms provider error
+	ErrUnknownProvider = errors.New("sms: unknown provider")
+)
+
+// Provider is the interface every text message gateway implements
+type Provider interface {
+	// Send sends msg to the phone number to
+	Send(to, msg string) error
+}
+
+// client is shared by all providers, so a hanging gateway cannot block a check forever
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// NewProvider returns the provider selected by the sms_provider preference. Installs from before
+// there was a choice have no preference, and keep using Twilio.
+func NewProvider(app *config.AppConfig) (Provider, error) {
+	pm := app.PreferenceMap
+
+	switch pm["sms_provider"] {
+	case "twilio", "":
+		return &twilio{
+			sid:       pm["twilio_sid"],
+			authToken: pm["twilio_auth_token"],
+			from:      pm["twilio_phone_number"],
+		}, nil
+	case "vonage":
+		return &vonage{
+			apiKey:    pm["vonage_api_key"],
+			apiSecret: pm["vonage_api_secret"],
+			from:      pm["vonage_from"],
+		}, nil
+	case "messagebird":
+		return &messageBird{
+			accessKey:  pm["messagebird_access_key"],
+			originator: pm["messagebird_originator"],
+		}, nil
+	case "http":
+		return &httpGateway{
+			url:         pm["sms_http_url"],
+			method:      pm["sms_http_method"],
+			contentType: pm["sms_http_content_type"],
+			body:        pm["sms_http_body"],
+			authHeader:  pm["sms_http_auth_header"],
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, pm["sms_provider"])
+	}
+}
+
+// SendText sends a text message using the provider configured in preferences
+func SendText(to, msg string, app *config.AppConfig) error {
+	p, err := NewProvider(app)
+	if err != nil {
+		return err
+	}
+
+	return p.Send(to, msg)
+}
+
+// do performs the request and returns the response body, or an error if the
+// request failed or the gateway did not answer with a 2xx status
+func do(req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return body, fmt.Errorf("sms: gateway returned %s: %s", resp.Status, body)
+	}
+
+	return body, nil
+}
@@ -0,0 +1,61 @@
+package sms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// vonage sends text messages through the Vonage (formerly Nexmo) SMS API
+type vonage struct {
+	apiKey    string
+	apiSecret string
+	from      string
+}
+
+// vonageResponse is the relevant part of the Vonage SMS API response
+type vonageResponse struct {
+	Messages []struct {
+		Status    string `json:"status"`
+		ErrorText string `json:"error-text"`
+	} `json:"messages"`
+}
+
+// Send sends a text message via Vonage
+func (v *vonage) Send(to, msg string) error {
+	msgData := url.Values{}
+	msgData.Set("api_key", v.apiKey)
+	msgData.Set("api_secret", v.apiSecret)
+	msgData.Set("from", v.from)
+	msgData.Set("to", to)
+	msgData.Set("text", msg)
+
+	req, err := http.NewRequest("POST", "https://rest.nexmo.com/sms/json", strings.NewReader(msgData.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	body, err := do(req)
+	if err != nil {
+		return err
+	}
+
+	// vonage answers 200 even for rejected messages, so check every message status
+	var data vonageResponse
+	if err := json.Unmarshal(body, &data); err != nil {
+		return fmt.Errorf("sms: invalid vonage response: %w", err)
+	}
+
+	for _, m := range data.Messages {
+		if m.Status != "0" {
+			return fmt.Errorf("sms: vonage status %s: %s", m.Status, m.ErrorText)
+		}
+	}
+
+	return nil
+}
@@ -14,4 +14,5 @@ type TemplateData struct {
 	Warning         string
 	Error           string
 	GwVersion       string
+	RealtimeCursor  string
 }
@@ -0,0 +1,164 @@
+// Package uptime turns a host service's history of status changes into uptime figures.
+package uptime
+
+import (
+	"github.com/luksbutz/vigilate/internal/models"
+	"time"
+)
+
+// Transition is the moment a host service was seen in a status
+type Transition struct {
+	At     time.Time
+	Status string
+}
+
+// Day is the uptime of one calendar day
+type Day struct {
+	Date time.Time
+	// Uptime is the fraction of the known time that the service was up, from 0 to 1
+	Uptime float64
+	// Known is false if there is no history for any of the day
+	Known bool
+	// Worst is the worst status seen during the day
+	Worst string
+}
+
+// severity orders statuses from best to worst
+var severity = map[string]int{
+	"pending":     0,
+	"healthy":     1,
+	"warning":     2,
+	"unknown":     3,
+	"unreachable": 4,
+	"problem":     5,
+}
+
+// IsDown returns true for statuses that count as downtime. Warnings and unknown results count as
+// up.
+func IsDown(status string) bool {
+	return status == "problem" || status == "unreachable"
+}
+
+// Worse returns the worse of two statuses
+func Worse(a, b string) string {
+	if severity[b] > severity[a] {
+		return b
+	}
+	return a
+}
+
+// FromEvents groups events by host service into transitions. Events must be ordered by time.
+func FromEvents(events []models.Event) map[int][]Transition {
+	result := make(map[int][]Transition)
+	for _, e := range events {
+		result[e.HostServiceID] = append(result[e.HostServiceID], Transition{At: e.CreatedAt, Status: e.EventType})
+	}
+	return result
+}
+
+// Percent returns the fraction of [from, to) that the service was up, counting only the time
+// for which its status is known. It returns false if the status is unknown for the whole window.
+func Percent(transitions []Transition, from, to time.Time) (float64, bool) {
+	var known, down time.Duration
+
+	walk(transitions, from, to, func(status string, d time.Duration) {
+		if status == "" || status == "pending" {
+			return
+		}
+		known += d
+		if IsDown(status) {
+			down += d
+		}
+	})
+
+	if known == 0 {
+		return 0, false
+	}
+
+	return float64(known-down) / float64(known), true
+}
+
+// WorstStatus returns the worst status seen during [from, to), or an empty string if unknown
+func WorstStatus(transitions []Transition, from, to time.Time) string {
+	worst := ""
+	walk(transitions, from, to, func(status string, d time.Duration) {
+		if status != "" {
+			worst = Worse(worst, status)
+		}
+	})
+	return worst
+}
+
+// Days returns the uptime of each of the last n calendar days, in the location of now, oldest first.
+// The last day ends at now.
+func Days(transitions []Transition, now time.Time, n int) []Day {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	days := make([]Day, 0, n)
+	for i := n - 1; i >= 0; i-- {
+		start := today.AddDate(0, 0, -i)
+		end := start.AddDate(0, 0, 1)
+		if end.After(now) {
+			end = now
+		}
+
+		d := Day{Date: start}
+		d.Uptime, d.Known = Percent(transitions, start, end)
+		d.Worst = WorstStatus(transitions, start, end)
+		days = append(days, d)
+	}
+
+	return days
+}
+
+// Combine merges the days of several services into one, taking the lowest uptime and the
+// worst status of each day. All slices must cover the same days.
+func Combine(series ...[]Day) []Day {
+	if len(series) == 0 {
+		return nil
+	}
+
+	result := make([]Day, len(series[0]))
+	copy(result, series[0])
+
+	for _, s := range series[1:] {
+		for i := range result {
+			if i >= len(s) || !s[i].Known {
+				continue
+			}
+			if !result[i].Known || s[i].Uptime < result[i].Uptime {
+				result[i].Uptime = s[i].Uptime
+			}
+			result[i].Known = true
+			result[i].Worst = Worse(result[i].Worst, s[i].Worst)
+		}
+	}
+
+	return result
+}
+
+// walk calls fn with each status the service was in during [from, to) and for how long.
+// Time before the first transition is reported with an empty status.
+func walk(transitions []Transition, from, to time.Time, fn func(status string, d time.Duration)) {
+	if !to.After(from) {
+		return
+	}
+
+	status := ""
+	at := from
+
+	for _, t := range transitions {
+		if !t.At.After(from) {
+			status = t.Status
+			continue
+		}
+		if !t.At.Before(to) {
+			break
+		}
+
+		fn(status, t.At.Sub(at))
+		status, at = t.Status, t.At
+	}
+
+	fn(status, to.Sub(at))
+}
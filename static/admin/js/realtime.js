@@ -0,0 +1,152 @@
+// Realtime connects to vigilate's built-in hub, and offers the part of the Pusher client that
+// vigilate uses: subscribe(name) returns a channel to bind(event, callback) on. It talks over a
+// websocket, and falls back to server-sent events where a websocket can't be opened (e.g. a
+// proxy that doesn't pass them on).
+//
+// Every event has an id. After losing its connection, the client asks for the events it missed
+// since the last one it saw (or since the page was rendered, given as cursor); if the hub no
+// longer has them, resync is called so that the page can be reloaded.
+function Realtime(options) {
+    const {
+        wsPath = "/admin/realtime/ws",
+        ssePath = "/admin/realtime/events",
+        cursor = "",
+        resync = () => {},
+    } = options || {};
+
+    let epoch = "";
+    let lastID = 0;
+    let resyncCalled = false;
+    let channels = {};
+    let socket = null;
+    let source = null;
+    let useSSE = !("WebSocket" in window);
+    let failures = 0;
+
+    if (cursor.lastIndexOf(":") > 0) {
+        epoch = cursor.substring(0, cursor.lastIndexOf(":"));
+        lastID = parseInt(cursor.substring(cursor.lastIndexOf(":") + 1), 10) || 0;
+    }
+
+    function dispatch(msg) {
+        switch (msg.type) {
+            case "ping":
+                send({type: "pong"});
+                break;
+            case "subscribed":
+                epoch = msg.epoch;
+                lastID = Math.max(lastID, msg.id || 0);
+                break;
+            case "resync":
+                epoch = msg.epoch;
+                lastID = msg.id || 0;
+                // every channel of a connection may ask for it; once is enough
+                if (!resyncCalled) {
+                    resyncCalled = true;
+                    resync();
+                }
+                break;
+            case "event":
+                lastID = Math.max(lastID, msg.id || 0);
+                let channel = channels[msg.channel];
+                if (!!channel) {
+                    (channel.handlers[msg.event] || []).forEach(callback => callback(msg.data));
+                }
+                break;
+            case "error":
+                console.warn("realtime:", msg.error);
+                break;
+        }
+    }
+
+    function receive(e) {
+        try {
+            dispatch(JSON.parse(e.data));
+        } catch (err) {
+            console.warn("realtime: bad message", err);
+        }
+    }
+
+    function send(msg) {
+        if (!!socket && socket.readyState === WebSocket.OPEN) {
+            socket.send(JSON.stringify(msg));
+        }
+    }
+
+    function subscribeMessage(name) {
+        return {type: "subscribe", channel: name, epoch: epoch, last_id: lastID};
+    }
+
+    function connectWS() {
+        let opened = false;
+        resyncCalled = false;
+        let scheme = location.protocol === "https:" ? "wss://" : "ws://";
+
+        socket = new WebSocket(scheme + location.host + wsPath);
+        socket.onopen = () => {
+            opened = true;
+            failures = 0;
+            Object.keys(channels).forEach(name => send(subscribeMessage(name)));
+        };
+        socket.onmessage = receive;
+        socket.onclose = () => {
+            socket = null;
+            if (!opened) {
+                failures++;
+                if (failures >= 3) {
+                    useSSE = true;
+                }
+            }
+            setTimeout(connect, Math.min(30000, 1000 * Math.pow(2, failures)));
+        };
+    }
+
+    function connectSSE() {
+        if (!!source) {
+            source.close();
+        }
+        let names = Object.keys(channels).map(encodeURIComponent).join(",");
+        let from = epoch !== "" ? "&cursor=" + encodeURIComponent(epoch + ":" + lastID) : "";
+
+        // the browser reconnects an event source by itself, sending the id of the last event it got
+        source = new EventSource(ssePath + "?channels=" + names + from);
+        source.onopen = () => {
+            resyncCalled = false;
+        };
+        source.onmessage = receive;
+    }
+
+    function connect() {
+        if (useSSE) {
+            connectSSE();
+        } else {
+            connectWS();
+        }
+    }
+
+    function subscribe(name) {
+        if (!channels[name]) {
+            channels[name] = {
+                handlers: {},
+                bind(event, callback) {
+                    (this.handlers[event] = this.handlers[event] || []).push(callback);
+                    return this;
+                },
+            };
+
+            if (!!socket) {
+                send(subscribeMessage(name));
+            } else if (!!source) {
+                connectSSE();
+            }
+        }
+        return channels[name];
+    }
+
+    // connect once the page has subscribed to its channels
+    setTimeout(connect, 0);
+
+    return {
+        subscribe: subscribe,
+    }
+}